@@ -0,0 +1,46 @@
+package haraqa
+
+import (
+	"context"
+	"io"
+)
+
+// API is the set of operations shared by Client, which talks to a server over http, and the embedded.Client of
+// github.com/haraqa/haraqa/pkg/embedded, which uses a queue in-process. Application code can depend on API to
+// switch between the two
+type API interface {
+	CreateTopic(topic string) error
+	CreateTopicContext(ctx context.Context, topic string) error
+	DeleteTopic(topic string) error
+	DeleteTopicContext(ctx context.Context, topic string) error
+	ListTopics(prefix, suffix, regex string) ([]string, error)
+	ListTopicsContext(ctx context.Context, prefix, suffix, regex string) ([]string, error)
+
+	Produce(topic string, sizes []int64, r io.Reader) error
+	ProduceContext(ctx context.Context, topic string, sizes []int64, r io.Reader) error
+	ProduceMsgs(topic string, msgs ...[]byte) error
+	ProduceMsgsContext(ctx context.Context, topic string, msgs ...[]byte) error
+	ProduceWithOptions(topic string, sizes []int64, opts ProduceOptions, r io.Reader) error
+	ProduceWithOptionsContext(ctx context.Context, topic string, sizes []int64, opts ProduceOptions, r io.Reader) error
+	Consume(topic string, id int64, limit int) (io.ReadCloser, []int64, error)
+	ConsumeContext(ctx context.Context, topic string, id int64, limit int) (io.ReadCloser, []int64, error)
+	ConsumeMsgs(topic string, id int64, limit int) ([][]byte, error)
+	ConsumeMsgsContext(ctx context.Context, topic string, id int64, limit int) ([][]byte, error)
+	ConsumeMessages(topic string, id int64, limit int) ([]*Message, error)
+	ConsumeMessagesContext(ctx context.Context, topic string, id int64, limit int) ([]*Message, error)
+	DestroySubject(subject string) error
+	DestroySubjectContext(ctx context.Context, subject string) error
+	DeleteMsgs(topic string, ranges ...IDRange) (*TopicInfo, error)
+	DeleteMsgsContext(ctx context.Context, topic string, ranges ...IDRange) (*TopicInfo, error)
+
+	GetTopicInfo(topic string) (*TopicInfo, error)
+	GetTopicInfoContext(ctx context.Context, topic string) (*TopicInfo, error)
+	GetConsumerOffset(topic string) (int64, error)
+	GetConsumerOffsetContext(ctx context.Context, topic string) (int64, error)
+	SetConsumerOffset(topic string, id int64) error
+	SetConsumerOffsetContext(ctx context.Context, topic string, id int64) error
+
+	Close() error
+}
+
+var _ API = &Client{}
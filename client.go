@@ -2,12 +2,13 @@ package haraqa
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"net/url"
 	urlpkg "net/url"
 	"strconv"
 	"strings"
@@ -20,10 +21,59 @@ import (
 	"github.com/haraqa/haraqa/internal/headers"
 )
 
+// Errors returned by the server
 var (
-	ErrTopicAlreadyExists = headers.ErrTopicAlreadyExists
-	ErrNoContent          = headers.ErrNoContent
-	ErrInvalidTopic       = headers.ErrInvalidTopic
+	ErrTopicDoesNotExist   = headers.ErrTopicDoesNotExist
+	ErrTopicAlreadyExists  = headers.ErrTopicAlreadyExists
+	ErrInvalidHeaderSizes  = headers.ErrInvalidHeaderSizes
+	ErrInvalidEventTimes   = headers.ErrInvalidEventTimes
+	ErrInvalidMessageID    = headers.ErrInvalidMessageID
+	ErrInvalidMessageLimit = headers.ErrInvalidMessageLimit
+	ErrInvalidTopic        = headers.ErrInvalidTopic
+	ErrReservedTopic       = headers.ErrReservedTopic
+	ErrInvalidBodyMissing  = headers.ErrInvalidBodyMissing
+	ErrInvalidBodyJSON     = headers.ErrInvalidBodyJSON
+	ErrInvalidBodyEncoding = headers.ErrInvalidBodyEncoding
+	ErrInvalidWebsocket    = headers.ErrInvalidWebsocket
+	ErrInvalidProducer     = headers.ErrInvalidProducer
+	ErrStaleProducerSeq    = headers.ErrStaleProducerSeq
+	ErrInvalidGroup        = headers.ErrInvalidGroup
+	ErrInvalidWait         = headers.ErrInvalidWait
+	ErrNoContent           = headers.ErrNoContent
+	ErrClosed              = headers.ErrClosed
+	ErrInvalidSubjects     = headers.ErrInvalidSubjects
+	ErrInvalidSubject      = headers.ErrInvalidSubject
+	ErrUnsupportedSubjects = headers.ErrUnsupportedSubjects
+	ErrInvalidRedacted     = headers.ErrInvalidRedacted
+	ErrInvalidDeleted      = headers.ErrInvalidDeleted
+	ErrInvalidDeleteRange  = headers.ErrInvalidDeleteRange
+	ErrInvalidDeliverAt    = headers.ErrInvalidDeliverAt
+	ErrUnsupportedDelay    = headers.ErrUnsupportedDelay
+)
+
+// TopicInfo describes the range of message ids stored in a topic. An empty topic has a MaxOffset of MinOffset-1
+type TopicInfo = headers.TopicInfo
+
+// IDRange is a range of message ids, from Start to End inclusive
+type IDRange = headers.IDRange
+
+// WatchEvent is sent by the server to describe a change to a watched topic
+type WatchEvent = headers.WatchEvent
+
+// EventType describes the kind of change a WatchEvent represents
+type EventType = headers.EventType
+
+// Event types sent by WatchTopics
+const (
+	EventProduced  = headers.EventProduced
+	EventCreated   = headers.EventCreated
+	EventDeleted   = headers.EventDeleted
+	EventTruncated = headers.EventTruncated
+	EventModified  = headers.EventModified
+
+	// EventReconnected is sent by the client, not the server, after a watch reconnects.
+	// Events may have been missed while disconnected, so offsets should be checked again
+	EventReconnected EventType = "reconnected"
 )
 
 // Option represents a optional function argument to NewClient
@@ -59,13 +109,52 @@ func WithConsumerGroup(group string) Option {
 	}
 }
 
+// WithWatchReconnect makes WatchTopics and WatchTopicsFilter reconnect when the connection to the server is lost.
+// The wait between attempts starts at minBackoff and doubles after each failure, up to maxBackoff.
+// An EventReconnected event is sent for each watched topic after a successful reconnect
+func WithWatchReconnect(minBackoff, maxBackoff time.Duration) Option {
+	return func(c *Client) error {
+		if minBackoff <= 0 {
+			return errors.New("invalid backoff: minimum backoff must be positive")
+		}
+		if maxBackoff < minBackoff {
+			return errors.New("invalid backoff: maximum backoff cannot be less than minimum backoff")
+		}
+		c.watchMinBackoff = minBackoff
+		c.watchMaxBackoff = maxBackoff
+		return nil
+	}
+}
+
+// WithGzip gzip encodes the messages sent by Produce, and asks the server to gzip encode the messages returned
+// by Consume, trading cpu for bandwidth. Message sizes always describe the messages before encoding.
+// Consume responses are only encoded if enabled, even if the http client would otherwise accept them
+func WithGzip(enable bool) Option {
+	return func(c *Client) error {
+		c.gzip = enable
+		return nil
+	}
+}
+
 // Client is a lightweight client around the haraqa http api, use NewClient() to create a new client
 type Client struct {
-	c             *http.Client
-	url           string
-	consumerGroup string
-	dialer        *websocket.Dialer
-	closer        chan struct{}
+	nextEndpoint    uint64 // accessed atomically, kept first for 64 bit alignment
+	c               *http.Client
+	url             string
+	consumerGroup   string
+	dialer          *websocket.Dialer
+	watchMinBackoff time.Duration
+	watchMaxBackoff time.Duration
+	retryPolicy     *RetryPolicy
+	endpoints       []*endpoint
+	balancer        Balancer
+	healthInterval  time.Duration
+	healthTimeout   time.Duration
+	producerID      string
+	produceSeqs     sync.Map
+	gzip            bool
+	closer          chan struct{}
+	closeOnce       sync.Once
 }
 
 // NewClient creates a new client instance. Any options given override the local defaults
@@ -101,88 +190,183 @@ func NewClient(opts ...Option) (*Client, error) {
 			return nil, err
 		}
 	}
+	if len(c.endpoints) > 1 && c.healthInterval > 0 {
+		go c.checkHealth()
+	}
 
 	return c, nil
 }
 
 // CreateTopic Creates a new topic. It returns an error if the topic already exists
 func (c *Client) CreateTopic(topic string) error {
-	req, err := http.NewRequest(http.MethodPut, c.url+"/topics/"+topic, nil)
-	if err != nil {
-		return err
-	}
+	return c.CreateTopicContext(context.Background(), topic)
+}
 
-	resp, err := c.c.Do(req)
+// CreateTopicContext Creates a new topic using the given context. It returns an error if the topic already exists
+func (c *Client) CreateTopicContext(ctx context.Context, topic string) error {
+	resp, err := c.do(ctx, http.MethodPut, topic, "/topics/"+topic, nil, nil, "error creating topic", http.StatusCreated)
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != http.StatusCreated {
-		err = headers.ReadErrors(resp.Header)
-		return errors.Wrap(err, "error creating topic")
-	}
+	closeBody(resp)
 	return nil
 }
 
 // DeleteTopic Delete a topic
 func (c *Client) DeleteTopic(topic string) error {
-	req, err := http.NewRequest(http.MethodDelete, c.url+"/topics/"+topic, nil)
-	if err != nil {
-		return err
-	}
+	return c.DeleteTopicContext(context.Background(), topic)
+}
 
-	resp, err := c.c.Do(req)
+// DeleteTopicContext Delete a topic using the given context
+func (c *Client) DeleteTopicContext(ctx context.Context, topic string) error {
+	resp, err := c.do(ctx, http.MethodDelete, topic, "/topics/"+topic, nil, nil, "error deleting topic", http.StatusNoContent)
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != http.StatusNoContent {
-		err = headers.ReadErrors(resp.Header)
-		return errors.Wrap(err, "error deleting topic")
-	}
+	closeBody(resp)
 	return nil
 }
 
 // ListTopics Lists all topics, filter by prefix, suffix, and/or a regex expression
 func (c *Client) ListTopics(prefix, suffix, regex string) ([]string, error) {
+	return c.ListTopicsContext(context.Background(), prefix, suffix, regex)
+}
+
+// ListTopicsContext Lists all topics using the given context, filter by prefix, suffix, and/or a regex expression
+func (c *Client) ListTopicsContext(ctx context.Context, prefix, suffix, regex string) ([]string, error) {
 	prefix = urlpkg.QueryEscape(prefix)
 	suffix = urlpkg.QueryEscape(suffix)
 	regex = urlpkg.QueryEscape(regex)
-	path := c.url + "/topics?prefix=" + prefix + "&suffix=" + suffix + "&regex=" + regex
-	resp, err := http.Get(path)
+	path := "/topics?prefix=" + prefix + "&suffix=" + suffix + "&regex=" + regex
+	resp, err := c.do(ctx, http.MethodGet, "", path, nil, nil, "error getting topics", http.StatusOK)
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		err = headers.ReadErrors(resp.Header)
-		return nil, errors.Wrap(err, "error getting topics")
-	}
+	defer closeBody(resp)
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
+	if len(body) == 0 {
+		return []string{}, nil
+	}
 	return strings.Split(string(body), ","), nil
 }
 
 // Produce sends messages from a reader to the designated topic
 func (c *Client) Produce(topic string, sizes []int64, r io.Reader) error {
-	req, err := http.NewRequest(http.MethodPost, c.url+"/topics/"+topic, r)
-	if err != nil {
+	return c.ProduceContext(context.Background(), topic, sizes, r)
+}
+
+// ProduceContext sends messages from a reader to the designated topic using the given context.
+// If a retry policy or multiple endpoints are set, the reader is buffered so that it can be sent again
+func (c *Client) ProduceContext(ctx context.Context, topic string, sizes []int64, r io.Reader) error {
+	_, err := c.produce(ctx, topic, sizes, nil, nil, time.Time{}, r)
+	return err
+}
+
+// ProduceOptions are the optional attributes of a batch of messages sent with ProduceWithOptions. The zero value
+// sends the messages without any attribute, as Produce does. Attributes can be combined, except that delayed
+// messages cannot be tagged with subjects
+type ProduceOptions struct {
+	// EventTimes is the time each message's event occurred, stored separately from the time the server received
+	// the messages. A zero time marks a message without an event time. If set, there must be a time per message
+	EventTimes []time.Time
+	// Subjects tags each message with a subject, such as the person the message is about. The server encrypts the
+	// messages of each subject under a key of the subject, DestroySubject destroys the key so that the messages
+	// are consumed as redacted. An empty subject marks a message without a subject. If set, there must be a
+	// subject per message
+	Subjects []string
+	// DeliverAt holds the messages until the given time before they are produced to the topic, so that they are
+	// only visible to consumers once delivered. Messages with a deliver at time in the past are produced
+	// immediately, the zero time produces the messages without delay
+	DeliverAt time.Time
+}
+
+// validate checks that the options have an attribute for each of n messages
+func (opts *ProduceOptions) validate(n int) error {
+	return headers.ValidateProduce(n, opts.EventTimes, opts.Subjects, opts.DeliverAt)
+}
+
+// ProduceWithOptions sends messages from a reader to the designated topic, with the attributes given by opts.
+// Delayed messages are not sequenced, so the server cannot recognize a resent batch as a duplicate. A batch with
+// a DeliverAt time is therefore sent once to the topic's server, without retries or failing over to another
+// server. If an error is returned the delayed messages may still have been stored, in which case sending them
+// again delivers them twice
+func (c *Client) ProduceWithOptions(topic string, sizes []int64, opts ProduceOptions, r io.Reader) error {
+	return c.ProduceWithOptionsContext(context.Background(), topic, sizes, opts, r)
+}
+
+// ProduceWithOptionsContext sends messages from a reader to the designated topic with the attributes given by
+// opts, using the given context. As with ProduceWithOptions, a batch with a DeliverAt time is sent once
+func (c *Client) ProduceWithOptionsContext(ctx context.Context, topic string, sizes []int64, opts ProduceOptions, r io.Reader) error {
+	if err := opts.validate(len(sizes)); err != nil {
 		return err
 	}
-	req.Header = headers.SetSizes(sizes, req.Header)
+	_, err := c.produce(ctx, topic, sizes, opts.EventTimes, opts.Subjects, opts.DeliverAt, r)
+	return err
+}
 
-	resp, err := c.c.Do(req)
-	if err != nil {
-		return err
+// produce sends the messages and returns the ids assigned by the server, if the server reports them. Messages
+// with a deliver at time are not assigned ids until they are delivered
+func (c *Client) produce(ctx context.Context, topic string, sizes []int64, eventTimes []time.Time, subjects []string, deliverAt time.Time, r io.Reader) (*headers.ProduceInfo, error) {
+	header := headers.SetSizes(sizes, http.Header{})
+	headers.SetEventTimes(headers.EventTimeNanos(eventTimes), header)
+	headers.SetSubjects(subjects, header)
+	headers.SetDeliverAt(deliverAt, header)
+	if c.gzip && r != nil {
+		b, err := gzipEncode(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to encode produce body")
+		}
+		r = bytes.NewBuffer(b)
+		header[headers.ContentEncoding] = []string{"gzip"}
+	}
+	body := func() io.Reader { return r }
+	if deliverAt.IsZero() && (c.retryPolicy != nil || c.endpoints != nil) {
+		var b []byte
+		if buf, ok := r.(*bytes.Buffer); ok {
+			b = buf.Next(buf.Len())
+		} else if r != nil {
+			var err error
+			if b, err = ioutil.ReadAll(r); err != nil {
+				return nil, errors.Wrap(err, "unable to buffer produce body")
+			}
+		}
+		if r != nil {
+			body = func() io.Reader { return bytes.NewReader(b) }
+		}
 	}
-	if resp.StatusCode != http.StatusOK {
-		err = headers.ReadErrors(resp.Header)
-		return errors.Wrap(err, "error producing")
+
+	// sequence the batch so the server can drop duplicates sent by retries. Sequenced batches are not failed over,
+	// as other servers cannot tell whether the batch was already produced. Delayed batches cannot be sequenced, so
+	// they are sent once
+	do := c.do
+	switch {
+	case !deliverAt.IsZero():
+		do = c.doOnce
+	case c.producerID != "":
+		seq, done := c.nextProduceSequence(topic)
+		defer done()
+		headers.SetProducerSequence(&headers.ProducerSequence{ID: c.producerID, Seq: seq}, header)
+		do = c.doDesignated
 	}
-	return nil
+
+	resp, err := do(ctx, http.MethodPost, topic, "/topics/"+topic, header, body, "error producing", http.StatusOK, http.StatusNoContent, http.StatusAccepted)
+	if err != nil {
+		return nil, err
+	}
+	closeBody(resp)
+	return headers.ReadProduceInfo(resp.Header)
 }
 
 // ProduceMsgs sends the messages to the designated topic
 func (c *Client) ProduceMsgs(topic string, msgs ...[]byte) error {
+	return c.ProduceMsgsContext(context.Background(), topic, msgs...)
+}
+
+// ProduceMsgsContext sends the messages to the designated topic using the given context
+func (c *Client) ProduceMsgsContext(ctx context.Context, topic string, msgs ...[]byte) error {
 	if len(msgs) == 0 {
 		return nil
 	}
@@ -195,62 +379,202 @@ func (c *Client) ProduceMsgs(topic string, msgs ...[]byte) error {
 	if len(sizes) == 0 {
 		return nil
 	}
-	return c.Produce(topic, sizes, bytes.NewBuffer(bytes.Join(msgs, nil)))
-}
-
-var getRequestPool = &sync.Pool{
-	New: func() interface{} {
-		req, _ := http.NewRequest(http.MethodGet, "*", nil)
-		return req
-	},
+	return c.ProduceContext(ctx, topic, sizes, bytes.NewBuffer(bytes.Join(msgs, nil)))
 }
 
 // Consume reads messages off of a topic starting from id, no more than the given limit is returned.
-// If limit is less than 1, the server sets the limit.
+// If limit is less than 1, the server sets the limit. The caller is responsible for closing the returned reader.
 func (c *Client) Consume(topic string, id int64, limit int) (io.ReadCloser, []int64, error) {
-	var err error
-	req := getRequestPool.Get().(*http.Request)
-	defer getRequestPool.Put(req)
-	req.URL, err = url.Parse(c.url + "/topics/" + topic + "?id=" + strconv.FormatInt(id, 10))
+	return c.ConsumeContext(context.Background(), topic, id, limit)
+}
+
+// ConsumeContext reads messages off of a topic starting from id using the given context, no more than the given
+// limit is returned. If limit is less than 1, the server sets the limit. The caller is responsible for closing
+// the returned reader.
+func (c *Client) ConsumeContext(ctx context.Context, topic string, id int64, limit int) (io.ReadCloser, []int64, error) {
+	b, err := c.consume(ctx, topic, id, limit, 0)
 	if err != nil {
 		return nil, nil, err
 	}
+	return b.body, b.sizes, nil
+}
+
+// consumeBatch is a batch of messages read by consume
+type consumeBatch struct {
+	header http.Header
+	body   io.ReadCloser
+	sizes  []int64
+}
+
+// consume reads messages as in ConsumeContext, holding the request on the server for up to wait if there are
+// no messages
+func (c *Client) consume(ctx context.Context, topic string, id int64, limit int, wait time.Duration) (*consumeBatch, error) {
+	path := "/topics/" + topic + "?id=" + strconv.FormatInt(id, 10)
 	if limit > 0 {
-		req.URL.RawQuery += "&limit=" + strconv.Itoa(limit)
+		path += "&limit=" + strconv.Itoa(limit)
+	}
+	if wait > 0 {
+		path += "&wait=" + wait.String()
+	}
+	// the encoding is set explicitly, so that the http client does not negotiate gzip when disabled
+	header := http.Header{headers.AcceptEncoding: []string{"identity"}}
+	if c.gzip {
+		header[headers.AcceptEncoding] = []string{"gzip"}
 	}
 	if c.consumerGroup != "" {
-		req.Header[headers.HeaderConsumerGroup] = []string{c.consumerGroup}
+		header[headers.HeaderConsumerGroup] = []string{c.consumerGroup}
 	}
 
-	resp, err := c.c.Do(req)
+	resp, err := c.do(ctx, http.MethodGet, "", path, header, nil, "error consuming", http.StatusPartialContent, http.StatusOK)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
-		err = headers.ReadErrors(resp.Header)
-		return nil, nil, errors.Wrap(err, "error consuming")
+	if resp.Header.Get(headers.ContentEncoding) == "gzip" {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			closeBody(resp)
+			return nil, errors.Wrap(err, "unable to decode consume body")
+		}
+		resp.Body = &gzipReadCloser{Reader: zr, body: resp.Body}
 	}
 
 	sizes, err := headers.ReadSizes(resp.Header)
 	if err != nil {
-		return nil, nil, err
+		closeBody(resp)
+		return nil, err
+	}
+	return &consumeBatch{header: resp.Header, body: resp.Body, sizes: sizes}, nil
+}
+
+// messages reads the messages of the batch along with their attributes, then drains and closes the body. The
+// ids of the messages start from id if the server does not report them
+func (b *consumeBatch) messages(topic string, id int64) ([]*Message, error) {
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, b.body)
+		_ = b.body.Close()
+	}()
+	return headers.ReadMessages(topic, id, b.header, b.body)
+}
+
+// gzipEncode reads and gzip encodes the body
+func gzipEncode(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.Copy(zw, r); err != nil {
+		return nil, err
 	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
 
-	return resp.Body, sizes, nil
+// gzipReadCloser decodes a gzip encoded response body, closing the body when closed
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+// Close closes the decoder and the response body
+func (r *gzipReadCloser) Close() error {
+	_ = r.Reader.Close()
+	return r.body.Close()
+}
+
+// ConsumeMessages reads messages off of a topic starting from id as in ConsumeMsgs, along with the id, event time
+// and whether each message is redacted or deleted
+func (c *Client) ConsumeMessages(topic string, id int64, limit int) ([]*Message, error) {
+	return c.ConsumeMessagesContext(context.Background(), topic, id, limit)
+}
+
+// ConsumeMessagesContext reads messages and their attributes off of a topic starting from id using the given
+// context
+func (c *Client) ConsumeMessagesContext(ctx context.Context, topic string, id int64, limit int) ([]*Message, error) {
+	b, err := c.consume(ctx, topic, id, limit, 0)
+	if err != nil {
+		return nil, err
+	}
+	return b.messages(topic, id)
+}
+
+// DeleteMsgs deletes the messages of a topic in the id ranges. Deleted messages keep their ids and are consumed
+// without their content, which the server removes from its files in the background. Ids past the end of the
+// topic are ignored
+func (c *Client) DeleteMsgs(topic string, ranges ...IDRange) (*TopicInfo, error) {
+	return c.DeleteMsgsContext(context.Background(), topic, ranges...)
+}
+
+// DeleteMsgsContext deletes the messages of a topic in the id ranges using the given context
+func (c *Client) DeleteMsgsContext(ctx context.Context, topic string, ranges ...IDRange) (*TopicInfo, error) {
+	if len(ranges) == 0 {
+		return nil, ErrInvalidDeleteRange
+	}
+	if err := headers.ValidateIDRanges(ranges); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(headers.ModifyRequest{Delete: ranges})
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{headers.ContentType: []string{"application/json"}}
+	body := func() io.Reader { return bytes.NewReader(b) }
+	resp, err := c.do(ctx, http.MethodPatch, topic, "/topics/"+topic, header, body, "error deleting messages", http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody(resp)
+	var info TopicInfo
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, errors.Wrap(err, "unable to decode topic info")
+	}
+	return &info, nil
+}
+
+// DestroySubject destroys the key of a subject, the messages produced with the subject are then consumed as
+// redacted. Messages produced with the subject later are encrypted under a new key
+func (c *Client) DestroySubject(subject string) error {
+	return c.DestroySubjectContext(context.Background(), subject)
+}
+
+// DestroySubjectContext destroys the key of a subject using the given context
+func (c *Client) DestroySubjectContext(ctx context.Context, subject string) error {
+	if subject == "" {
+		return ErrInvalidSubject
+	}
+	resp, err := c.do(ctx, http.MethodDelete, "", "/subjects/"+urlpkg.PathEscape(subject), nil, nil, "error destroying subject", http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	closeBody(resp)
+	return nil
 }
 
 // ConsumeMsgs reads messages off of a topic starting from id, no more than the given limit is returned.
 // If limit is less than 1, the server sets the limit.
 func (c *Client) ConsumeMsgs(topic string, id int64, limit int) ([][]byte, error) {
-	r, sizes, err := c.Consume(topic, id, limit)
+	return c.ConsumeMsgsContext(context.Background(), topic, id, limit)
+}
+
+// ConsumeMsgsContext reads messages off of a topic starting from id using the given context, no more than the
+// given limit is returned. If limit is less than 1, the server sets the limit.
+func (c *Client) ConsumeMsgsContext(ctx context.Context, topic string, id int64, limit int) ([][]byte, error) {
+	r, sizes, err := c.ConsumeContext(ctx, topic, id, limit)
 	if err != nil {
 		return nil, err
 	}
-	defer r.Close()
+	return readMsgs(r, sizes)
+}
+
+// readMsgs reads the messages of the given sizes then drains and closes the reader
+func readMsgs(r io.ReadCloser, sizes []int64) ([][]byte, error) {
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, r)
+		_ = r.Close()
+	}()
 	msgs := make([][]byte, len(sizes))
 	for i := range sizes {
 		msgs[i] = make([]byte, sizes[i])
-		_, err = io.ReadAtLeast(r, msgs[i], len(msgs[i]))
+		_, err := io.ReadAtLeast(r, msgs[i], len(msgs[i]))
 		if err != nil {
 			return nil, err
 		}
@@ -258,33 +582,307 @@ func (c *Client) ConsumeMsgs(topic string, id int64, limit int) ([][]byte, error
 	return msgs, nil
 }
 
+// GetTopicInfo returns the range of message ids stored in a topic
+func (c *Client) GetTopicInfo(topic string) (*TopicInfo, error) {
+	return c.GetTopicInfoContext(context.Background(), topic)
+}
+
+// GetTopicInfoContext returns the range of message ids stored in a topic using the given context
+func (c *Client) GetTopicInfoContext(ctx context.Context, topic string) (*TopicInfo, error) {
+	resp, err := c.do(ctx, http.MethodHead, "", "/topics/"+topic, nil, nil, "error getting topic info", http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	closeBody(resp)
+	return headers.ReadTopicInfo(resp.Header)
+}
+
+// GetConsumerOffset returns the offset committed by the client's consumer group for the topic, or -1 if
+// the group has not committed an offset
+func (c *Client) GetConsumerOffset(topic string) (int64, error) {
+	return c.GetConsumerOffsetContext(context.Background(), topic)
+}
+
+// GetConsumerOffsetContext returns the offset committed by the client's consumer group for the topic using
+// the given context, or -1 if the group has not committed an offset
+func (c *Client) GetConsumerOffsetContext(ctx context.Context, topic string) (int64, error) {
+	if c.consumerGroup == "" {
+		return -1, ErrInvalidGroup
+	}
+	header := http.Header{headers.HeaderConsumerGroup: []string{c.consumerGroup}}
+	resp, err := c.do(ctx, http.MethodHead, "", "/topics/"+topic, header, nil, "error getting consumer offset", http.StatusOK)
+	if err != nil {
+		return -1, err
+	}
+	closeBody(resp)
+	offset, err := strconv.ParseInt(resp.Header.Get(headers.HeaderGroupOffset), 10, 64)
+	if err != nil {
+		return -1, errors.Wrap(err, "invalid header: "+headers.HeaderGroupOffset)
+	}
+	return offset, nil
+}
+
+// SetConsumerOffset commits id as the next message to be consumed from the topic by the client's consumer group.
+// Consume requests from the group for an id of 0 or less start from the committed offset
+func (c *Client) SetConsumerOffset(topic string, id int64) error {
+	return c.SetConsumerOffsetContext(context.Background(), topic, id)
+}
+
+// SetConsumerOffsetContext commits id as the next message to be consumed from the topic by the client's
+// consumer group using the given context
+func (c *Client) SetConsumerOffsetContext(ctx context.Context, topic string, id int64) error {
+	if c.consumerGroup == "" {
+		return ErrInvalidGroup
+	}
+	header := http.Header{headers.HeaderConsumerGroup: []string{c.consumerGroup}}
+	path := "/offsets/topics/" + topic + "?id=" + strconv.FormatInt(id, 10)
+	resp, err := c.do(ctx, http.MethodPut, topic, path, header, nil, "error setting consumer offset", http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	closeBody(resp)
+	return nil
+}
+
+// ResponseError is returned when the server responds with an unexpected status code. Err is the
+// error reported by the server, use errors.Is to compare it against the exported errors
+type ResponseError struct {
+	Op         string
+	StatusCode int
+	Err        error
+}
+
+func (e *ResponseError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+// Unwrap returns the error reported by the server
+func (e *ResponseError) Unwrap() error {
+	return e.Err
+}
+
+// Cause returns the error reported by the server, for compatibility with github.com/pkg/errors
+func (e *ResponseError) Cause() error {
+	return e.Err
+}
+
+// checkResponse returns a ResponseError if the response status is not one of the expected codes
+func checkResponse(resp *http.Response, op string, codes ...int) error {
+	for _, code := range codes {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	err := headers.ReadErrors(resp.Header)
+	if err == nil {
+		err = errors.Errorf("unexpected status %q", resp.Status)
+	}
+	return &ResponseError{
+		Op:         op,
+		StatusCode: resp.StatusCode,
+		Err:        err,
+	}
+}
+
+// do sends a request and checks the response status against the expected codes. Requests for a route are sent
+// to the route's designated endpoint first, an empty route is balanced across the endpoints. Within an attempt
+// the request fails over to the next endpoint if an endpoint cannot be reached, and the attempt fails once every
+// endpoint has failed. Failed attempts are retried according to the retry policy, starting again from the
+// healthy endpoints. Requests which must not reach another endpoint use doDesignated instead. The body function
+// is called once per request. On success the caller must close the response body
+func (c *Client) do(ctx context.Context, method, route, path string, header http.Header, body func() io.Reader, op string, codes ...int) (*http.Response, error) {
+	return c.send(ctx, true, func() []*endpoint { return c.candidates(route) }, method, path, header, body, op, codes...)
+}
+
+// doDesignated sends a request as in do, but only to the designated endpoint of the topic without failing over
+// to the other endpoints
+func (c *Client) doDesignated(ctx context.Context, method, route, path string, header http.Header, body func() io.Reader, op string, codes ...int) (*http.Response, error) {
+	return c.send(ctx, true, func() []*endpoint { return []*endpoint{c.designated(route)} }, method, path, header, body, op, codes...)
+}
+
+// doOnce sends a request as in doDesignated, but without retrying it. It is used for requests which cannot be
+// safely sent twice
+func (c *Client) doOnce(ctx context.Context, method, route, path string, header http.Header, body func() io.Reader, op string, codes ...int) (*http.Response, error) {
+	return c.send(ctx, false, func() []*endpoint { return []*endpoint{c.designated(route)} }, method, path, header, body, op, codes...)
+}
+
+// send makes each attempt of a request by trying the endpoints returned by targets in turn, until an endpoint
+// responds or fails with an error which does not fail over. Endpoints which cannot be reached are marked
+// unhealthy, so that they are tried last by later requests. Failed attempts are retried if retry is set
+func (c *Client) send(ctx context.Context, retry bool, targets func() []*endpoint, method, path string, header http.Header, body func() io.Reader, op string, codes ...int) (*http.Response, error) {
+	var resp *http.Response
+	attempt := func() error {
+		var err error
+		for _, e := range targets() {
+			resp, err = c.doEndpoint(ctx, e, method, path, header, body, op, codes...)
+			if err == nil {
+				e.setHealthy(true)
+				return nil
+			}
+			if !isFailover(ctx, err) {
+				return err
+			}
+			e.setHealthy(false)
+		}
+		return err
+	}
+	var err error
+	if retry {
+		err = c.retry(ctx, attempt)
+	} else {
+		err = attempt()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// doEndpoint sends a single request to the endpoint
+func (c *Client) doEndpoint(ctx context.Context, e *endpoint, method, path string, header http.Header, body func() io.Reader, op string, codes ...int) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = body()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, e.url+path, r)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := c.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkResponse(resp, op, codes...); err != nil {
+		closeBody(resp)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// closeBody drains and closes the response body so the underlying connection can be reused
+func closeBody(resp *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+}
+
 // WatchTopics opens a websocket to the server to listen for changes to the given topics.
-// It writes the name of any modified topics to the given channel until a context cancellation or an error occurs
-func (c *Client) WatchTopics(ctx context.Context, topics []string, ch chan<- string) error {
+// Topics may also be glob patterns, such as "orders/*", which include topics created after the watch starts.
+// It writes an event for each change to the given channel until a context cancellation or an error occurs.
+// Servers which only send the names of modified topics are also supported, those messages are
+// delivered as EventProduced events with unknown (-1) offsets
+func (c *Client) WatchTopics(ctx context.Context, topics []string, ch chan<- WatchEvent) error {
 	if ch == nil {
 		return errors.New("receiver channel cannot be nil")
 	}
-	if ctx == nil {
-		ctx = context.Background()
-	}
 	if len(topics) == 0 {
 		return headers.ErrInvalidTopic
 	}
 	for i := range topics {
 		topics[i] = strings.ToLower(topics[i])
 	}
+	return c.watch(ctx, "", topics, ch)
+}
 
-	path := strings.Replace(c.url, "http", "ws", 1) + "/ws/topics"
-	conn, resp, err := c.dialer.Dial(path, map[string][]string{
-		headers.HeaderWatchTopics: topics,
-	})
+// WatchTopicsFilter opens a websocket to the server to listen for changes to all topics matching
+// the prefix, suffix and/or regex expression, including topics created after the watch starts.
+// Events are written to the given channel as in WatchTopics
+func (c *Client) WatchTopicsFilter(ctx context.Context, prefix, suffix, regex string, ch chan<- WatchEvent) error {
+	if ch == nil {
+		return errors.New("receiver channel cannot be nil")
+	}
+	if prefix == "" && suffix == "" && regex == "" {
+		return headers.ErrInvalidTopic
+	}
+	query := "?prefix=" + urlpkg.QueryEscape(strings.ToLower(prefix)) +
+		"&suffix=" + urlpkg.QueryEscape(strings.ToLower(suffix)) +
+		"&regex=" + urlpkg.QueryEscape(regex)
+	return c.watch(ctx, query, nil, ch)
+}
+
+func (c *Client) watch(ctx context.Context, query string, topics []string, ch chan<- WatchEvent) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if c.watchMinBackoff <= 0 {
+		return c.watchConn(ctx, query, topics, ch, nil)
+	}
+
+	var connected bool
+	backoff := c.watchMinBackoff
+	onConnect := func() error {
+		backoff = c.watchMinBackoff
+		if !connected {
+			connected = true
+			return nil
+		}
+		// let the receiver know that events may have been missed while disconnected
+		events := make([]WatchEvent, 0, len(topics))
+		for _, topic := range topics {
+			events = append(events, WatchEvent{Type: EventReconnected, Topic: topic, TopicInfo: headers.TopicInfo{MinOffset: -1, MaxOffset: -1}})
+		}
+		if len(events) == 0 {
+			events = append(events, WatchEvent{Type: EventReconnected, TopicInfo: headers.TopicInfo{MinOffset: -1, MaxOffset: -1}})
+		}
+		for _, event := range events {
+			select {
+			case ch <- event:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	}
+
+	for {
+		err := c.watchConn(ctx, query, topics, ch, onConnect)
+		if err == nil || ctx.Err() != nil || !isWatchRetryable(err) {
+			return err
+		}
+
+		select {
+		case <-c.closer:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > c.watchMaxBackoff {
+			backoff = c.watchMaxBackoff
+		}
+	}
+}
+
+// isWatchRetryable returns false for errors which will not be resolved by reconnecting
+func isWatchRetryable(err error) bool {
+	switch errors.Cause(err) {
+	case headers.ErrTopicDoesNotExist, headers.ErrInvalidTopic, headers.ErrInvalidWebsocket:
+		return false
+	}
+	return true
+}
+
+// watchConn opens a single websocket connection and writes events to the channel until the connection fails
+func (c *Client) watchConn(ctx context.Context, query string, topics []string, ch chan<- WatchEvent, onConnect func() error) error {
+	header := map[string][]string{
+		headers.HeaderWatchFormat: {headers.WatchFormatJSON},
+	}
+	if len(topics) > 0 {
+		header[headers.HeaderWatchTopics] = topics
+	}
+	conn, err := c.dialWatch(ctx, query, header)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
-	err = headers.ReadErrors(resp.Header)
-	if err != nil {
-		return err
+	if onConnect != nil {
+		if err = onConnect(); err != nil {
+			return err
+		}
 	}
 
 	errs := make(chan error, 1)
@@ -292,11 +890,19 @@ func (c *Client) WatchTopics(ctx context.Context, topics []string, ch chan<- str
 		for ctx.Err() == nil {
 			msgType, b, err := conn.ReadMessage()
 			if err != nil {
+				if ce, ok := err.(*websocket.CloseError); ok && ce.Text != "" {
+					err = errors.Wrap(headers.ReadError(ce.Text), err.Error())
+				}
 				errs <- err
 				return
 			}
-			if msgType == websocket.TextMessage {
-				ch <- string(b)
+			if msgType != websocket.TextMessage {
+				continue
+			}
+			select {
+			case ch <- parseWatchEvent(b):
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
@@ -316,9 +922,54 @@ func (c *Client) WatchTopics(ctx context.Context, topics []string, ch chan<- str
 	}
 }
 
-func (c *Client) Close() error {
-	if c.closer != nil {
-		close(c.closer)
+// dialWatch opens a websocket to the first endpoint which accepts the connection
+func (c *Client) dialWatch(ctx context.Context, query string, header http.Header) (*websocket.Conn, error) {
+	var err error
+	for _, e := range c.candidates("") {
+		var conn *websocket.Conn
+		var resp *http.Response
+		conn, resp, err = c.dialer.DialContext(ctx, strings.Replace(e.url, "http", "ws", 1)+"/ws/topics"+query, header)
+		if resp != nil {
+			if resp.Body != nil {
+				_ = resp.Body.Close()
+			}
+			if respErr := headers.ReadErrors(resp.Header); respErr != nil {
+				return nil, respErr
+			}
+		}
+		if err == nil {
+			return conn, nil
+		}
+		if !isFailover(ctx, err) {
+			return nil, err
+		}
+		e.setHealthy(false)
+	}
+	return nil, err
+}
+
+// parseWatchEvent decodes a websocket message, falling back to the bare topic name format
+func parseWatchEvent(b []byte) WatchEvent {
+	var event WatchEvent
+	if len(b) > 0 && b[0] == '{' && json.Unmarshal(b, &event) == nil && event.Type != "" {
+		return event
+	}
+	return WatchEvent{
+		Type:  EventProduced,
+		Topic: string(b),
+		TopicInfo: headers.TopicInfo{
+			MinOffset: -1,
+			MaxOffset: -1,
+		},
 	}
+}
+
+// Close stops any open websockets. It is safe to call Close multiple times
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		if c.closer != nil {
+			close(c.closer)
+		}
+	})
 	return nil
 }
@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -17,6 +18,7 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/haraqa/haraqa/internal/headers"
+	"github.com/haraqa/haraqa/pkg/server"
 )
 
 func TestOptions(t *testing.T) {
@@ -62,6 +64,26 @@ func TestOptions(t *testing.T) {
 		}
 	}
 
+	// WithWatchReconnect
+	{
+		c := &Client{}
+		err := WithWatchReconnect(0, time.Second)(c)
+		if err == nil {
+			t.Error("expected error for zero backoff")
+		}
+		err = WithWatchReconnect(time.Second, time.Millisecond)(c)
+		if err == nil {
+			t.Error("expected error for max backoff below min backoff")
+		}
+		err = WithWatchReconnect(time.Millisecond, time.Second)(c)
+		if err != nil {
+			t.Error(err)
+		}
+		if c.watchMinBackoff != time.Millisecond || c.watchMaxBackoff != time.Second {
+			t.Error(c.watchMinBackoff, c.watchMaxBackoff)
+		}
+	}
+
 	// WithConsumerGroup
 	{
 		group := "test-group"
@@ -385,6 +407,166 @@ func TestClient_Consume(t *testing.T) {
 	}
 }
 
+// headerWriter calls onHeader before the response header is written, so before the client can read the response
+type headerWriter struct {
+	http.ResponseWriter
+	onHeader func()
+	written  bool
+}
+
+func (w *headerWriter) WriteHeader(status int) {
+	if !w.written {
+		w.written = true
+		w.onHeader()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func TestClient_Gzip(t *testing.T) {
+	// the handler records the requests concurrently with the test
+	var mux sync.Mutex
+	var encodings []string
+	var lengths []int64
+	record := func(encoding string, length int64) {
+		mux.Lock()
+		encodings = append(encodings, encoding)
+		lengths = append(lengths, length)
+		mux.Unlock()
+	}
+	recorded := func() ([]string, []int64) {
+		mux.Lock()
+		defer mux.Unlock()
+		e, l := encodings, lengths
+		encodings, lengths = nil, nil
+		return e, l
+	}
+	s, err := server.NewServer(server.WithMemoryQueue(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			record(r.Header.Get("Content-Encoding"), r.ContentLength)
+		case http.MethodGet:
+			// recorded before the response is sent, so that the test sees it once the client has the response
+			w = &headerWriter{ResponseWriter: w, onHeader: func() {
+				record(r.Header.Get("Accept-Encoding")+"/"+w.Header().Get("Content-Encoding"), r.ContentLength)
+			}}
+		}
+		s.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	msgs := [][]byte{bytes.Repeat([]byte("a"), 1000), bytes.Repeat([]byte("b"), 1000)}
+	for i, enable := range []bool{true, false} {
+		c, err := NewClient(WithURL(ts.URL), WithGzip(enable))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			if err = c.CreateTopic("gzip"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = c.ProduceMsgs("gzip", msgs...); err != nil {
+			t.Fatal(err)
+		}
+		r, sizes, err := c.Consume("gzip", 0, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readMsgs(r, sizes)
+		if err != nil || !reflect.DeepEqual(got, msgs) {
+			t.Error(enable, err)
+		}
+
+		// the messages are sent and received encoded only if enabled
+		encodings, lengths := recorded()
+		expected := []string{"", "identity/"}
+		if enable {
+			expected = []string{"gzip", "gzip/gzip"}
+			if lengths[0] >= 2000 {
+				t.Error(lengths)
+			}
+		}
+		if !reflect.DeepEqual(encodings, expected) {
+			t.Error(enable, encodings)
+		}
+	}
+}
+
+func TestClient_Context(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(WithHTTPClient(ts.Client()), WithURL(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	checkErr := func(err error) {
+		t.Helper()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Error(err)
+		}
+	}
+	checkErr(c.CreateTopicContext(ctx, "topic"))
+	checkErr(c.DeleteTopicContext(ctx, "topic"))
+	_, err = c.ListTopicsContext(ctx, "", "", "")
+	checkErr(err)
+	checkErr(c.ProduceMsgsContext(ctx, "topic", []byte("hello")))
+	_, err = c.ConsumeMsgsContext(ctx, "topic", 0, -1)
+	checkErr(err)
+}
+
+func TestClient_ResponseError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			headers.SetError(w, headers.ErrNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(WithHTTPClient(ts.Client()), WithURL(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unexpected status without an error header
+	err = c.ProduceMsgs("topic", []byte("hello"))
+	var respErr *ResponseError
+	if !errors.As(err, &respErr) || respErr.StatusCode != http.StatusBadGateway {
+		t.Fatal(err)
+	}
+	if err.Error() != `error producing: unexpected status "502 Bad Gateway"` {
+		t.Error(err)
+	}
+
+	// server error
+	_, err = c.ConsumeMsgs("topic", 0, -1)
+	if !errors.As(err, &respErr) || respErr.StatusCode != http.StatusNoContent || !errors.Is(err, ErrNoContent) {
+		t.Error(err)
+	}
+	if errors.Cause(err) != ErrNoContent {
+		t.Error(errors.Cause(err))
+	}
+}
+
 func TestClient_WatchTopics(t *testing.T) {
 	c, err := NewClient()
 	if err != nil {
@@ -394,7 +576,7 @@ func TestClient_WatchTopics(t *testing.T) {
 	if err == nil || err.Error() != "receiver channel cannot be nil" {
 		t.Error(err)
 	}
-	ch := make(chan string, 1)
+	ch := make(chan WatchEvent, 1)
 	err = c.WatchTopics(nil, nil, ch)
 	if !errors.Is(err, ErrInvalidTopic) {
 		t.Error(err)
@@ -405,11 +587,19 @@ func TestClient_WatchTopics(t *testing.T) {
 		wg.Add(1)
 		defer wg.Done()
 		upgrader := websocket.Upgrader{}
+		if r.Header.Get(headers.HeaderWatchFormat) != headers.WatchFormatJSON {
+			t.Error(r.Header)
+		}
 		conn, err := upgrader.Upgrade(w, r, map[string][]string{})
 		if err != nil {
 			t.Error(err)
 			return
 		}
+		err = conn.WriteJSON(WatchEvent{Type: EventTruncated, Topic: "ws-topic", TopicInfo: headers.TopicInfo{MinOffset: 5, MaxOffset: 10}})
+		if err != nil {
+			t.Error(err)
+			return
+		}
 		err = conn.WriteMessage(websocket.TextMessage, []byte("ws-topic"))
 		if err != nil {
 			t.Error(err)
@@ -430,14 +620,139 @@ func TestClient_WatchTopics(t *testing.T) {
 			return
 		}
 	}()
-	topic, ok := <-ch
-	if !ok || topic != "ws-topic" {
-		t.Error(topic, ok)
+	event, ok := <-ch
+	if !ok || event.Type != EventTruncated || event.Topic != "ws-topic" || event.MinOffset != 5 || event.MaxOffset != 10 {
+		t.Error(event, ok)
+	}
+
+	// legacy format
+	event, ok = <-ch
+	if !ok || event.Type != EventProduced || event.Topic != "ws-topic" || event.MaxOffset != -1 {
+		t.Error(event, ok)
 	}
 	cancel()
 	wg.Wait()
 }
 
+func TestClient_WatchTopicsFilter(t *testing.T) {
+	c, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.WatchTopicsFilter(nil, "", "", "", nil)
+	if err == nil || err.Error() != "receiver channel cannot be nil" {
+		t.Error(err)
+	}
+	ch := make(chan WatchEvent, 1)
+	err = c.WatchTopicsFilter(nil, "", "", "", ch)
+	if !errors.Is(err, ErrInvalidTopic) {
+		t.Error(err)
+	}
+
+	var wg sync.WaitGroup
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wg.Add(1)
+		defer wg.Done()
+		if r.URL.String() != "/ws/topics?prefix=orders%2F&suffix=_eu&regex=%5B0-9%5D" {
+			t.Errorf("invalid url %q", r.URL.String())
+		}
+		if len(r.Header.Values(headers.HeaderWatchTopics)) != 0 {
+			t.Error(r.Header)
+		}
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, map[string][]string{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		err = conn.WriteJSON(WatchEvent{Type: EventCreated, Topic: "orders/1_eu", TopicInfo: headers.TopicInfo{MaxOffset: -1}})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_, _, _ = conn.ReadMessage()
+	}))
+	defer server.Close()
+	c.url = server.URL
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		err := c.WatchTopicsFilter(ctx, "Orders/", "_EU", "[0-9]", ch)
+		if !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+	}()
+	event := <-ch
+	if event.Type != EventCreated || event.Topic != "orders/1_eu" {
+		t.Error(event)
+	}
+	cancel()
+	wg.Wait()
+}
+
+func TestClient_WatchTopicsReconnect(t *testing.T) {
+	var count int
+	var mux sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		count++
+		n := count
+		mux.Unlock()
+
+		switch n {
+		case 2:
+			// server unavailable
+			headers.SetError(w, headers.ErrClosed)
+			return
+		case 4:
+			// topic removed
+			headers.SetError(w, headers.ErrTopicDoesNotExist)
+			return
+		}
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, map[string][]string{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		err = conn.WriteJSON(WatchEvent{Type: EventProduced, Topic: "ws-topic"})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// server restarting
+		msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, headers.ErrClosed.Error())
+		_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	}))
+	defer server.Close()
+
+	c, err := NewClient(WithURL(server.URL), WithWatchReconnect(time.Millisecond, time.Millisecond*5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ch := make(chan WatchEvent, 10)
+	err = c.WatchTopics(context.Background(), []string{"ws-topic"}, ch)
+	if !errors.Is(err, headers.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+	close(ch)
+
+	var events []EventType
+	for event := range ch {
+		if event.Topic != "ws-topic" {
+			t.Error(event)
+		}
+		events = append(events, event.Type)
+	}
+	expected := []EventType{EventProduced, EventReconnected, EventProduced}
+	if !reflect.DeepEqual(events, expected) {
+		t.Error(events, expected)
+	}
+}
+
 func TestClient_Close(t *testing.T) {
 	c := &Client{
 		closer: make(chan struct{}),
@@ -451,4 +766,10 @@ func TestClient_Close(t *testing.T) {
 	case <-time.After(time.Second * 1):
 		t.Error("channel should be closed")
 	}
+
+	// closing twice should not panic
+	err = c.Close()
+	if err != nil {
+		t.Error(err)
+	}
 }
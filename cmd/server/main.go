@@ -1,10 +1,17 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -19,6 +26,18 @@ func main() {
 		httpPort     uint
 		fileCache    bool
 		fileEntries  int64
+		memory       bool
+		maxOpenFiles int
+		persistIndex bool
+		tailCache    int64
+		preallocate  int64
+		ioHints      bool
+		compress     string
+		compressFreq time.Duration
+		keyFile      string
+		segmentBytes int64
+		segmentAge   time.Duration
+		topicLimits  topicLimitsFlag
 		promEnabled  bool
 		consumeLimit int64
 		cors         bool
@@ -28,6 +47,18 @@ func main() {
 	flag.UintVar(&httpPort, "http", 4353, "Port to listen on")
 	flag.BoolVar(&fileCache, "cache", true, "Enable queue file caching")
 	flag.Int64Var(&fileEntries, "entries", 5000, "The number of msg entries per queue file")
+	flag.BoolVar(&memory, "memory", false, "Store messages in memory instead of in directories, messages are lost on exit")
+	flag.IntVar(&maxOpenFiles, "max-open-files", 0, "The number of queue files kept open by the cache, 0 for no limit, requires -cache")
+	flag.BoolVar(&persistIndex, "persist-index", false, "Store the segment index of each topic in its directory")
+	flag.Int64Var(&segmentBytes, "segment-bytes", 0, "The log size at which a new segment is started, 0 for no limit")
+	flag.DurationVar(&segmentAge, "segment-age", 0, "The age of the first message at which a new segment is started, 0 for no limit")
+	flag.Var(&topicLimits, "topic-segment-limits", "The segment limits of a topic as topic=bytes,age, may be repeated")
+	flag.Int64Var(&tailCache, "tail-cache", 0, "The number of bytes of recent messages kept in memory per topic, 0 to disable")
+	flag.Int64Var(&preallocate, "preallocate", 0, "The number of bytes preallocated for the log of the latest segment of each topic, 0 to disable")
+	flag.BoolVar(&ioHints, "io-hints", false, "Advise the kernel of sequential reads of sealed segments by consumers")
+	flag.StringVar(&compress, "compress", "", "Compress sealed segments in the background with flate or gzip, empty to disable")
+	flag.DurationVar(&compressFreq, "compress-interval", time.Minute, "The interval between checks for sealed segments to compress")
+	flag.StringVar(&keyFile, "keyfile", "", "A json file of the keys topics are encrypted at rest with, reloaded on SIGHUP, empty to disable")
 	flag.Int64Var(&consumeLimit, "limit", -1, "Default batch limit for consumers")
 	flag.BoolVar(&promEnabled, "prometheus", true, "Enable prometheus metrics")
 	flag.BoolVar(&cors, "cors", true, "Enable CORS")
@@ -43,13 +74,40 @@ func main() {
 	}
 
 	// check args
-	if flag.NArg() == 0 {
+	if flag.NArg() == 0 && !memory {
 		logger.Fatal("Missing directory args")
 	}
 
 	// get options
 	var opts []server.Option
-	opts = append(opts, server.WithFileQueue(flag.Args(), fileCache, fileEntries))
+	if memory {
+		opts = append(opts, server.WithMemoryQueue(fileEntries))
+	} else {
+		opts = append(opts, server.WithFileQueue(flag.Args(), fileCache, fileEntries), server.WithMaxOpenFiles(maxOpenFiles), server.WithPersistedIndex(persistIndex), server.WithTailCache(tailCache), server.WithPreallocation(preallocate), server.WithIOHints(ioHints), server.WithCompression(compress, compressFreq), server.WithSegmentLimits(segmentBytes, segmentAge))
+		for _, limits := range topicLimits {
+			opts = append(opts, server.WithTopicSegmentLimits(limits.topic, limits.maxBytes, limits.maxAge))
+		}
+		if keyFile != "" {
+			keys, err := server.NewKeyFile(keyFile)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			opts = append(opts, server.WithKeyProvider(keys))
+
+			// keys are rotated by updating the key file and signaling the server
+			reload := make(chan os.Signal, 1)
+			signal.Notify(reload, syscall.SIGHUP)
+			go func() {
+				for range reload {
+					if err := keys.Reload(); err != nil {
+						logger.Error(err)
+						continue
+					}
+					logger.Println("Reloaded key file", keyFile)
+				}
+			}()
+		}
+	}
 	opts = append(opts, server.WithLogger(logger))
 	if consumeLimit > 0 {
 		opts = append(opts, server.WithDefaultConsumeLimit(consumeLimit))
@@ -92,6 +150,49 @@ func main() {
 	logger.Fatal(http.ListenAndServe(":"+strconv.FormatUint(uint64(httpPort), 10), nil))
 }
 
+// topicLimitsFlag is a repeatable flag of the segment limits of topics, given as topic=bytes,age
+type topicLimitsFlag []struct {
+	topic    string
+	maxBytes int64
+	maxAge   time.Duration
+}
+
+func (f *topicLimitsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	values := make([]string, 0, len(*f))
+	for _, limits := range *f {
+		values = append(values, limits.topic+"="+strconv.FormatInt(limits.maxBytes, 10)+","+limits.maxAge.String())
+	}
+	return strings.Join(values, " ")
+}
+
+func (f *topicLimitsFlag) Set(value string) error {
+	i := strings.LastIndexByte(value, '=')
+	if i <= 0 {
+		return errors.New("expected topic=bytes,age")
+	}
+	limits := strings.SplitN(value[i+1:], ",", 2)
+	if len(limits) != 2 {
+		return errors.New("expected topic=bytes,age")
+	}
+	maxBytes, err := strconv.ParseInt(limits[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid bytes: %w", err)
+	}
+	maxAge, err := time.ParseDuration(limits[1])
+	if err != nil {
+		return fmt.Errorf("invalid age: %w", err)
+	}
+	*f = append(*f, struct {
+		topic    string
+		maxBytes int64
+		maxAge   time.Duration
+	}{topic: value[:i], maxBytes: maxBytes, maxAge: maxAge})
+	return nil
+}
+
 func promMetrics() (func(http.Handler) http.Handler, *Metrics) {
 	inFlightGauge := prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "in_flight_requests",
@@ -142,9 +243,30 @@ func promMetrics() (func(http.Handler) http.Handler, *Metrics) {
 			Buckets: []float64{10, 50, 100, 200, 500, 1000, 2000},
 		},
 	)
+	compressedBytes := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "compressed_segment_bytes_total",
+			Help: "A counter for the uncompressed and compressed sizes of the segment logs compressed in the background.",
+		},
+		[]string{"size"},
+	)
+	compressionRatio := prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "segment_compression_ratio",
+			Help:    "A histogram of the ratio of the uncompressed to compressed size of compressed segment logs.",
+			Buckets: []float64{1, 1.5, 2, 3, 5, 10, 20},
+		},
+	)
+	fileCache := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "file_cache_total",
+			Help: "A counter for the hits, misses and evictions of the cache of open queue files.",
+		},
+		[]string{"result"},
+	)
 
 	// Register all of the metrics in the standard registry.
-	prometheus.MustRegister(inFlightGauge, counter, duration, requestSize, responseSize, produceBatchSize, consumeBatchSize)
+	prometheus.MustRegister(inFlightGauge, counter, duration, requestSize, responseSize, produceBatchSize, consumeBatchSize, fileCache, compressedBytes, compressionRatio)
 
 	return func(next http.Handler) http.Handler {
 			return promhttp.InstrumentHandlerInFlight(inFlightGauge,
@@ -159,15 +281,27 @@ func promMetrics() (func(http.Handler) http.Handler, *Metrics) {
 				),
 			)
 		}, &Metrics{
-			produceHist: produceBatchSize,
-			consumeHist: consumeBatchSize,
+			produceHist:    produceBatchSize,
+			consumeHist:    consumeBatchSize,
+			cacheHits:      fileCache.WithLabelValues("hit"),
+			cacheMisses:    fileCache.WithLabelValues("miss"),
+			cacheEvictions: fileCache.WithLabelValues("eviction"),
+			rawBytes:       compressedBytes.WithLabelValues("raw"),
+			compressed:     compressedBytes.WithLabelValues("compressed"),
+			ratioHist:      compressionRatio,
 		}
 }
 
 // Metrics is a prometheus based implementation of the haraqa Metrics interface
 type Metrics struct {
-	produceHist prometheus.Histogram
-	consumeHist prometheus.Histogram
+	produceHist    prometheus.Histogram
+	consumeHist    prometheus.Histogram
+	cacheHits      prometheus.Counter
+	cacheMisses    prometheus.Counter
+	cacheEvictions prometheus.Counter
+	rawBytes       prometheus.Counter
+	compressed     prometheus.Counter
+	ratioHist      prometheus.Histogram
 }
 
 // ProduceMsgs updates the produce histogram with the batch size
@@ -179,3 +313,27 @@ func (m *Metrics) ProduceMsgs(n int) {
 func (m *Metrics) ConsumeMsgs(n int) {
 	m.consumeHist.Observe(float64(n))
 }
+
+// CacheHit increments the file cache counter for hits
+func (m *Metrics) CacheHit() {
+	m.cacheHits.Inc()
+}
+
+// CacheMiss increments the file cache counter for misses
+func (m *Metrics) CacheMiss() {
+	m.cacheMisses.Inc()
+}
+
+// CacheEviction increments the file cache counter for evictions
+func (m *Metrics) CacheEviction() {
+	m.cacheEvictions.Inc()
+}
+
+// SegmentCompressed updates the compressed segment counters and the compression ratio histogram
+func (m *Metrics) SegmentCompressed(rawSize, compressedSize int64) {
+	m.rawBytes.Add(float64(rawSize))
+	m.compressed.Add(float64(compressedSize))
+	if compressedSize > 0 {
+		m.ratioHist.Observe(float64(rawSize) / float64(compressedSize))
+	}
+}
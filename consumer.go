@@ -0,0 +1,410 @@
+package haraqa
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// ErrConsumerClosed is returned when reading from a closed Consumer
+var ErrConsumerClosed = errors.New("consumer closed")
+
+// ConsumerOption represents a optional function argument to NewConsumer
+type ConsumerOption func(*Consumer) error
+
+// WithConsumeLimit sets the maximum number of messages fetched by each consume request
+func WithConsumeLimit(limit int) ConsumerOption {
+	return func(c *Consumer) error {
+		if limit < 1 {
+			return errors.New("invalid consume limit")
+		}
+		c.limit = limit
+		return nil
+	}
+}
+
+// WithStartID sets the id of the first message to consume. If the client has a consumer group and no start id
+// is given, the consumer starts from the offset committed by the group. The server also treats a start id of 0
+// from a consumer group as the committed offset
+func WithStartID(id int64) ConsumerOption {
+	return func(c *Consumer) error {
+		if id < 0 {
+			return errors.New("invalid start id")
+		}
+		c.position = id
+		c.started = true
+		return nil
+	}
+}
+
+// WithLongPoll sets how long the server holds a consume request open waiting for new messages.
+// A duration of 0 disables long polling
+func WithLongPoll(d time.Duration) ConsumerOption {
+	return func(c *Consumer) error {
+		if d < 0 {
+			return errors.New("invalid long poll duration")
+		}
+		c.longPoll = d
+		return nil
+	}
+}
+
+// WithWatchNotifications makes the consumer wait for new messages by watching the topic over a websocket,
+// instead of long polling
+func WithWatchNotifications() ConsumerOption {
+	return func(c *Consumer) error {
+		c.watch = true
+		c.longPoll = 0
+		return nil
+	}
+}
+
+// WithPollInterval sets the longest the consumer waits before checking for new messages again, when the
+// server has no messages and has not held the request or sent a watch notification
+func WithPollInterval(d time.Duration) ConsumerOption {
+	return func(c *Consumer) error {
+		if d <= 0 {
+			return errors.New("invalid poll interval")
+		}
+		c.pollInterval = d
+		return nil
+	}
+}
+
+// WithCommitInterval sets how often the consumer commits its position when the client has a consumer group.
+// A duration of 0 only commits on Commit and Close
+func WithCommitInterval(d time.Duration) ConsumerOption {
+	return func(c *Consumer) error {
+		if d < 0 {
+			return errors.New("invalid commit interval")
+		}
+		c.commitInterval = d
+		return nil
+	}
+}
+
+// Message is a message read by a Consumer or ConsumeMessages, along with its attributes
+type Message = headers.Message
+
+// Consumer reads the messages of a topic in order, tracking its position and waiting for new messages once
+// it has caught up. If the topic is truncated past its position, the consumer skips to the oldest message
+// remaining. When the client has a consumer group, the position is committed periodically and on Close,
+// a message is only committed once Next has been called again after returning it.
+// A Consumer is not safe for concurrent use. Use NewConsumer to create a new consumer
+type Consumer struct {
+	c              *Client
+	topic          string
+	limit          int
+	longPoll       time.Duration
+	pollInterval   time.Duration
+	commitInterval time.Duration
+	watch          bool
+
+	mux        sync.Mutex
+	started    bool
+	position   int64
+	committed  int64
+	lastCommit time.Time
+	buffer     []*Message
+	closed     bool
+
+	events      chan WatchEvent
+	watchErr    chan error
+	watchCancel context.CancelFunc
+	err         error
+}
+
+// NewConsumer creates a new consumer of the topic
+func NewConsumer(c *Client, topic string, opts ...ConsumerOption) (*Consumer, error) {
+	if c == nil {
+		return nil, errors.New("invalid client")
+	}
+	if topic == "" {
+		return nil, ErrInvalidTopic
+	}
+	cr := &Consumer{
+		c:              c,
+		topic:          topic,
+		limit:          100,
+		longPoll:       30 * time.Second,
+		pollInterval:   time.Second,
+		commitInterval: 5 * time.Second,
+		committed:      -1,
+	}
+	for _, opt := range opts {
+		if err := opt(cr); err != nil {
+			return nil, err
+		}
+	}
+	return cr, nil
+}
+
+// Position returns the id of the next message to be consumed
+func (cr *Consumer) Position() int64 {
+	cr.mux.Lock()
+	defer cr.mux.Unlock()
+	return cr.position
+}
+
+// SetPosition moves the consumer to the given id, discarding any buffered messages
+func (cr *Consumer) SetPosition(id int64) {
+	cr.mux.Lock()
+	defer cr.mux.Unlock()
+	cr.position = id
+	cr.started = true
+	cr.buffer = nil
+}
+
+// Next returns the next message of the topic, waiting until one is available or the context ends
+func (cr *Consumer) Next(ctx context.Context) (*Message, error) {
+	if err := cr.start(ctx); err != nil {
+		return nil, err
+	}
+	if err := cr.maybeCommit(ctx); err != nil {
+		return nil, err
+	}
+	for {
+		cr.mux.Lock()
+		if cr.closed {
+			cr.mux.Unlock()
+			return nil, ErrConsumerClosed
+		}
+		if len(cr.buffer) > 0 {
+			msg := cr.buffer[0]
+			cr.buffer = cr.buffer[1:]
+			cr.position = msg.ID + 1
+			cr.mux.Unlock()
+			return msg, nil
+		}
+		position := cr.position
+		cr.mux.Unlock()
+
+		if err := cr.fetch(ctx, position); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Messages returns a channel of the messages of the topic. The channel is closed when the context ends or an
+// error occurs, the error is then available from Err. Messages should not be used alongside Next
+func (cr *Consumer) Messages(ctx context.Context) <-chan *Message {
+	ch := make(chan *Message)
+	go func() {
+		defer close(ch)
+		for {
+			msg, err := cr.Next(ctx)
+			if err != nil {
+				cr.mux.Lock()
+				cr.err = err
+				cr.mux.Unlock()
+				return
+			}
+			select {
+			case ch <- msg:
+			case <-ctx.Done():
+				// the message was not delivered, read it again next time
+				cr.SetPosition(msg.ID)
+				cr.mux.Lock()
+				cr.err = ctx.Err()
+				cr.mux.Unlock()
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// Err returns the error which closed the channel returned by Messages
+func (cr *Consumer) Err() error {
+	cr.mux.Lock()
+	defer cr.mux.Unlock()
+	return cr.err
+}
+
+// Commit commits the position of the consumer for the client's consumer group
+func (cr *Consumer) Commit(ctx context.Context) error {
+	cr.mux.Lock()
+	position := cr.position
+	cr.mux.Unlock()
+
+	if err := cr.c.SetConsumerOffsetContext(ctx, cr.topic, position); err != nil {
+		return err
+	}
+
+	cr.mux.Lock()
+	cr.committed = position
+	cr.lastCommit = time.Now()
+	cr.mux.Unlock()
+	return nil
+}
+
+// Close stops watching the topic and commits the position of the consumer if the client has a consumer group.
+// It is safe to call Close multiple times
+func (cr *Consumer) Close() error {
+	cr.mux.Lock()
+	if cr.closed {
+		cr.mux.Unlock()
+		return nil
+	}
+	cr.closed = true
+	if cr.watchCancel != nil {
+		cr.watchCancel()
+	}
+	commit := cr.c.consumerGroup != "" && cr.started && cr.position != cr.committed
+	cr.mux.Unlock()
+
+	if commit {
+		return cr.Commit(context.Background())
+	}
+	return nil
+}
+
+// start sets the initial position from the committed group offset, if no start id was given
+func (cr *Consumer) start(ctx context.Context) error {
+	cr.mux.Lock()
+	started := cr.started
+	cr.mux.Unlock()
+	if started {
+		return nil
+	}
+
+	position := int64(0)
+	if cr.c.consumerGroup != "" {
+		offset, err := cr.c.GetConsumerOffsetContext(ctx, cr.topic)
+		if err != nil {
+			return err
+		}
+		if offset >= 0 {
+			position = offset
+		}
+		cr.mux.Lock()
+		cr.committed = offset
+		cr.lastCommit = time.Now()
+		cr.mux.Unlock()
+	}
+
+	cr.mux.Lock()
+	if !cr.started {
+		cr.position = position
+		cr.started = true
+	}
+	cr.mux.Unlock()
+	return nil
+}
+
+// maybeCommit commits the position if the commit interval has passed since the last commit
+func (cr *Consumer) maybeCommit(ctx context.Context) error {
+	if cr.c.consumerGroup == "" || cr.commitInterval == 0 {
+		return nil
+	}
+	cr.mux.Lock()
+	due := cr.position != cr.committed && time.Since(cr.lastCommit) >= cr.commitInterval
+	cr.mux.Unlock()
+	if !due {
+		return nil
+	}
+	return cr.Commit(ctx)
+}
+
+// fetch reads the next batch of messages into the buffer, waiting if there are none
+func (cr *Consumer) fetch(ctx context.Context, position int64) error {
+	start := time.Now()
+	b, err := cr.c.consume(ctx, cr.topic, position, cr.limit, cr.longPoll)
+	if err == nil {
+		buffer, err := b.messages(cr.topic, position)
+		if err != nil {
+			return err
+		}
+		cr.mux.Lock()
+		if cr.position == position {
+			cr.buffer = buffer
+		}
+		cr.mux.Unlock()
+		return nil
+	}
+	if !errors.Is(err, ErrNoContent) {
+		return err
+	}
+
+	// skip ahead if the topic has been truncated past the position
+	info, err := cr.c.GetTopicInfoContext(ctx, cr.topic)
+	if err != nil {
+		return err
+	}
+	if position < info.MinOffset {
+		cr.mux.Lock()
+		if cr.position == position {
+			cr.position = info.MinOffset
+		}
+		cr.mux.Unlock()
+		return nil
+	}
+	return cr.wait(ctx, time.Since(start))
+}
+
+// wait waits for a watch notification or the poll interval before the next consume request
+func (cr *Consumer) wait(ctx context.Context, elapsed time.Duration) error {
+	interval := cr.pollInterval - elapsed
+	if cr.watch {
+		if err := cr.startWatch(); err != nil {
+			return err
+		}
+		interval = cr.pollInterval
+	}
+	if interval <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case event := <-cr.events:
+		if event.Type == EventDeleted {
+			return ErrTopicDoesNotExist
+		}
+		// drain any other notifications, a single consume request covers them
+		for {
+			select {
+			case <-cr.events:
+			default:
+				return nil
+			}
+		}
+	case err := <-cr.watchErr:
+		return err
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// startWatch starts watching the topic, if the consumer is not already watching it
+func (cr *Consumer) startWatch() error {
+	cr.mux.Lock()
+	defer cr.mux.Unlock()
+	if cr.closed {
+		return ErrConsumerClosed
+	}
+	if cr.events != nil {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cr.watchCancel = cancel
+	cr.events = make(chan WatchEvent, 16)
+	cr.watchErr = make(chan error, 1)
+	go func() {
+		err := cr.c.WatchTopics(ctx, []string{cr.topic}, cr.events)
+		if ctx.Err() == nil {
+			if err == nil {
+				err = errors.New("watch closed by server")
+			}
+			cr.watchErr <- err
+		}
+	}()
+	return nil
+}
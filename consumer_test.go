@@ -0,0 +1,292 @@
+//+build linux
+
+package haraqa
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/pkg/server"
+)
+
+func TestConsumerOptions(t *testing.T) {
+	for _, opt := range []ConsumerOption{
+		WithConsumeLimit(0),
+		WithStartID(-1),
+		WithLongPoll(-1),
+		WithPollInterval(0),
+		WithCommitInterval(-1),
+	} {
+		if err := opt(&Consumer{}); err == nil {
+			t.Error("expected invalid option")
+		}
+	}
+	if _, err := NewConsumer(nil, "topic"); err == nil {
+		t.Error("expected invalid client")
+	}
+	if _, err := NewConsumer(&Client{}, ""); err != ErrInvalidTopic {
+		t.Error(err)
+	}
+
+	cr, err := NewConsumer(&Client{}, "topic", WithConsumeLimit(5), WithStartID(3), WithLongPoll(time.Second),
+		WithPollInterval(time.Minute), WithCommitInterval(time.Hour), WithWatchNotifications())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.limit != 5 || cr.Position() != 3 || cr.longPoll != 0 || !cr.watch || cr.pollInterval != time.Minute || cr.commitInterval != time.Hour {
+		t.Error(cr)
+	}
+}
+
+func newConsumerTestServer(t *testing.T, dir string) (*httptest.Server, func()) {
+	_ = os.RemoveAll(dir)
+	s, err := server.NewServer(server.WithFileQueue([]string{dir}, true, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	return ts, func() {
+		ts.Close()
+		_ = s.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestConsumer_Next(t *testing.T) {
+	ts, cleanup := newConsumerTestServer(t, ".haraqa-consumer-next")
+	defer cleanup()
+
+	c, err := NewClient(WithURL(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = c.CreateTopic("next"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.ProduceMsgs("next", []byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e")); err != nil {
+		t.Fatal(err)
+	}
+
+	cr, err := NewConsumer(c, "next", WithConsumeLimit(2), WithLongPoll(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cr.Close()
+	for i, expected := range []string{"a", "b", "c", "d", "e"} {
+		msg, err := cr.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.ID != int64(i) || string(msg.Data) != expected || msg.Topic != "next" {
+			t.Error(msg)
+		}
+	}
+	if cr.Position() != 5 {
+		t.Error(cr.Position())
+	}
+
+	// wait for new messages with long polling
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		if err := c.ProduceMsgs("next", []byte("f")); err != nil {
+			t.Error(err)
+		}
+	}()
+	start := time.Now()
+	msg, err := cr.Next(ctx)
+	if err != nil || msg.ID != 5 || string(msg.Data) != "f" || time.Since(start) > 3*time.Second {
+		t.Error(msg, err, time.Since(start))
+	}
+
+	// the context ends while waiting
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err = cr.Next(timeout); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error(err)
+	}
+
+	// missing topics return an error
+	missing, err := NewConsumer(c, "missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = missing.Next(ctx); !errors.Is(err, ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+
+	if err = cr.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err = cr.Next(ctx); err != ErrConsumerClosed {
+		t.Error(err)
+	}
+}
+
+func TestConsumer_Truncated(t *testing.T) {
+	ts, cleanup := newConsumerTestServer(t, ".haraqa-consumer-truncated")
+	defer cleanup()
+
+	c, err := NewClient(WithURL(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.CreateTopic("truncated"); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"a", "b", "c", "d", "e"} {
+		if err = c.ProduceMsgs("truncated", []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// remove the first file of messages
+	req, err := http.NewRequest(http.MethodPatch, ts.URL+"/topics/truncated", bytes.NewBufferString(`{"truncate":3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	info, err := c.GetTopicInfo("truncated")
+	if err != nil || info.MinOffset != 2 || info.MaxOffset != 4 {
+		t.Fatal(info, err)
+	}
+
+	cr, err := NewConsumer(c, "truncated", WithStartID(0), WithLongPoll(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cr.Close()
+	msg, err := cr.Next(context.Background())
+	if err != nil || msg.ID != 2 || string(msg.Data) != "c" {
+		t.Error(msg, err)
+	}
+}
+
+func TestConsumer_Group(t *testing.T) {
+	ts, cleanup := newConsumerTestServer(t, ".haraqa-consumer-group")
+	defer cleanup()
+
+	c, err := NewClient(WithURL(ts.URL), WithConsumerGroup("group"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = c.CreateTopic("group"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.ProduceMsgs("group", []byte("a"), []byte("b"), []byte("c"), []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	if offset, err := c.GetConsumerOffset("group"); err != nil || offset != -1 {
+		t.Error(offset, err)
+	}
+
+	// commits on close
+	cr, err := NewConsumer(c, "group", WithCommitInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err = cr.Next(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = cr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if offset, err := c.GetConsumerOffset("group"); err != nil || offset != 2 {
+		t.Error(offset, err)
+	}
+
+	// resumes from the committed offset and commits periodically
+	cr, err = NewConsumer(c, "group", WithCommitInterval(time.Nanosecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cr.Close()
+	msg, err := cr.Next(ctx)
+	if err != nil || msg.ID != 2 || string(msg.Data) != "c" {
+		t.Fatal(msg, err)
+	}
+	if _, err = cr.Next(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if offset, err := c.GetConsumerOffset("group"); err != nil || offset != 3 {
+		t.Error(offset, err)
+	}
+
+	// clients without a group cannot commit
+	noGroup, err := NewClient(WithURL(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = noGroup.SetConsumerOffset("group", 1); err != ErrInvalidGroup {
+		t.Error(err)
+	}
+	if _, err = noGroup.GetConsumerOffset("group"); err != ErrInvalidGroup {
+		t.Error(err)
+	}
+}
+
+func TestConsumer_Messages(t *testing.T) {
+	ts, cleanup := newConsumerTestServer(t, ".haraqa-consumer-messages")
+	defer cleanup()
+
+	c, err := NewClient(WithURL(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.CreateTopic("messages"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.ProduceMsgs("messages", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	cr, err := NewConsumer(c, "messages", WithWatchNotifications(), WithPollInterval(10*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cr.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := cr.Messages(ctx)
+	if msg := <-ch; msg == nil || msg.ID != 0 {
+		t.Fatal(msg)
+	}
+
+	// watch notifications wake the consumer
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if err := c.ProduceMsgs("messages", []byte("b")); err != nil {
+			t.Error(err)
+		}
+	}()
+	select {
+	case msg := <-ch:
+		if msg == nil || msg.ID != 1 || string(msg.Data) != "b" {
+			t.Error(msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+
+	cancel()
+	for range ch {
+	}
+	if !errors.Is(cr.Err(), context.Canceled) {
+		t.Error(cr.Err())
+	}
+}
@@ -0,0 +1,201 @@
+package haraqa
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	urlpkg "net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Balancer selects the server used for requests which read from the queue
+type Balancer int
+
+// Balancers available with WithBalancer
+const (
+	// RoundRobin sends each read to the next healthy server in turn
+	RoundRobin Balancer = iota
+	// LeastLatency sends reads to the healthy server with the lowest health check latency
+	LeastLatency
+)
+
+// WithEndpoints sets multiple server urls for the client to use. Reads are spread across the healthy servers
+// using the balancer set by WithBalancer, while produce requests and other writes for a topic are always sent
+// to the same server, chosen by hashing the topic name. If a server cannot be reached the request fails over
+// to the next server, and the server is skipped until a health check succeeds.
+// Produce requests sequenced for a retry policy are the exception, they are only sent to the topic's server
+// as a retried batch is only recognized as a duplicate by the server which received the original batch
+func WithEndpoints(urls ...string) Option {
+	return func(c *Client) error {
+		if len(urls) == 0 {
+			return errors.New("at least one endpoint must be given")
+		}
+		endpoints := make([]*endpoint, len(urls))
+		for i, url := range urls {
+			if _, err := urlpkg.Parse(url); err != nil {
+				return err
+			}
+			endpoints[i] = &endpoint{url: url, healthy: 1}
+		}
+		c.url = urls[0]
+		c.endpoints = endpoints
+		return nil
+	}
+}
+
+// WithBalancer sets how reads are spread across the servers given by WithEndpoints
+func WithBalancer(balancer Balancer) Option {
+	return func(c *Client) error {
+		if balancer != RoundRobin && balancer != LeastLatency {
+			return errors.New("invalid balancer")
+		}
+		c.balancer = balancer
+		return nil
+	}
+}
+
+// WithHealthCheck sets how often the servers given by WithEndpoints are checked, and how long a
+// check may take before the server is considered unhealthy. An interval of 0 disables health checks,
+// in which case a failed server is retried once all other servers have failed
+func WithHealthCheck(interval, timeout time.Duration) Option {
+	return func(c *Client) error {
+		if interval < 0 || timeout <= 0 {
+			return errors.New("invalid health check")
+		}
+		c.healthInterval = interval
+		c.healthTimeout = timeout
+		return nil
+	}
+}
+
+// endpoint is a server used by the client along with its health
+type endpoint struct {
+	latency int64 // accessed atomically, kept first for 64 bit alignment
+	healthy int32
+	url     string
+}
+
+func (e *endpoint) isHealthy() bool {
+	return atomic.LoadInt32(&e.healthy) == 1
+}
+
+func (e *endpoint) setHealthy(healthy bool) {
+	if healthy {
+		atomic.StoreInt32(&e.healthy, 1)
+		return
+	}
+	atomic.StoreInt32(&e.healthy, 0)
+}
+
+// candidates returns the endpoints to try for a request, in order. Writes to a topic start with the
+// topic's designated endpoint, while reads (an empty topic) are ordered by the balancer.
+// Unhealthy endpoints are only tried after all healthy endpoints
+func (c *Client) candidates(topic string) []*endpoint {
+	if len(c.endpoints) == 0 {
+		return []*endpoint{{url: c.url, healthy: 1}}
+	}
+
+	n := len(c.endpoints)
+	ordered := make([]*endpoint, 0, n)
+	switch {
+	case topic != "":
+		start := c.designatedIndex(topic)
+		for i := 0; i < n; i++ {
+			ordered = append(ordered, c.endpoints[(start+i)%n])
+		}
+	case c.balancer == LeastLatency:
+		ordered = append(ordered, c.endpoints...)
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return atomic.LoadInt64(&ordered[i].latency) < atomic.LoadInt64(&ordered[j].latency)
+		})
+	default:
+		start := int(atomic.AddUint64(&c.nextEndpoint, 1) % uint64(n))
+		for i := 0; i < n; i++ {
+			ordered = append(ordered, c.endpoints[(start+i)%n])
+		}
+	}
+
+	// move unhealthy endpoints to the end, keeping the order otherwise
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].isHealthy() && !ordered[j].isHealthy()
+	})
+	return ordered
+}
+
+// designated returns the endpoint which writes to the topic are sent to first, whatever its health
+func (c *Client) designated(topic string) *endpoint {
+	if len(c.endpoints) == 0 {
+		return &endpoint{url: c.url, healthy: 1}
+	}
+	return c.endpoints[c.designatedIndex(topic)]
+}
+
+// designatedIndex returns the index of the designated endpoint of the topic, chosen by hashing the topic name
+func (c *Client) designatedIndex(topic string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(topic))
+	return int(h.Sum32() % uint32(len(c.endpoints)))
+}
+
+// isFailover returns true if a request which failed with err should be sent to another endpoint
+func isFailover(ctx context.Context, err error) bool {
+	return ctx.Err() == nil && IsRetryable(err)
+}
+
+// checkHealth runs the health checks until the client is closed
+func (c *Client) checkHealth() {
+	ticker := time.NewTicker(c.healthInterval)
+	defer ticker.Stop()
+	for {
+		c.checkEndpoints()
+		select {
+		case <-ticker.C:
+		case <-c.closer:
+			return
+		}
+	}
+}
+
+// checkEndpoints checks the health of each endpoint and records its latency
+func (c *Client) checkEndpoints() {
+	var wg sync.WaitGroup
+	for _, e := range c.endpoints {
+		wg.Add(1)
+		go func(e *endpoint) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), c.healthTimeout)
+			defer cancel()
+
+			start := time.Now()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.url+"/health", nil)
+			if err != nil {
+				e.setHealthy(false)
+				return
+			}
+			resp, err := c.c.Do(req)
+			if err != nil {
+				e.setHealthy(false)
+				return
+			}
+			closeBody(resp)
+			if resp.StatusCode != http.StatusOK {
+				e.setHealthy(false)
+				return
+			}
+
+			// keep a moving average of the latency to smooth out spikes
+			latency := int64(time.Since(start))
+			if prev := atomic.LoadInt64(&e.latency); prev > 0 {
+				latency = (prev*3 + latency) / 4
+			}
+			atomic.StoreInt64(&e.latency, latency)
+			e.setHealthy(true)
+		}(e)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,323 @@
+//+build linux
+
+package haraqa
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haraqa/haraqa/pkg/server"
+)
+
+func TestEndpointOptions(t *testing.T) {
+	for _, opt := range []Option{
+		WithEndpoints(),
+		WithEndpoints("http://127.0.0.1:4353", ":invalid"),
+		WithBalancer(Balancer(-1)),
+		WithHealthCheck(-1, time.Second),
+		WithHealthCheck(time.Second, 0),
+	} {
+		if err := opt(&Client{}); err == nil {
+			t.Error("expected invalid option")
+		}
+	}
+
+	c, err := NewClient(WithEndpoints("http://127.0.0.1:1", "http://127.0.0.1:2"), WithBalancer(LeastLatency), WithHealthCheck(0, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.url != "http://127.0.0.1:1" || len(c.endpoints) != 2 || c.balancer != LeastLatency || c.healthTimeout != time.Second {
+		t.Error(c)
+	}
+}
+
+// endpointServer counts the requests it receives and can be made unhealthy
+type endpointServer struct {
+	*httptest.Server
+	mux       sync.Mutex
+	requests  map[string]int
+	unhealthy bool
+	delay     time.Duration
+}
+
+func newEndpointServer() *endpointServer {
+	s := &endpointServer{requests: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mux.Lock()
+		unhealthy, delay := s.unhealthy, s.delay
+		s.requests[r.Method+" "+r.URL.Path]++
+		s.mux.Unlock()
+		time.Sleep(delay)
+		if unhealthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Path == "/topics" {
+				_, _ = w.Write([]byte("a,b"))
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		case http.MethodPost:
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodPut:
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	return s
+}
+
+func (s *endpointServer) count(request string) int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.requests[request]
+}
+
+func (s *endpointServer) setUnhealthy(unhealthy bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.unhealthy = unhealthy
+}
+
+func TestEndpoints_Failover(t *testing.T) {
+	s1, s2 := newEndpointServer(), newEndpointServer()
+	defer s2.Close()
+	c, err := NewClient(WithEndpoints(s1.URL, s2.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reads and writes fail over once a server is down
+	s1.Close()
+	for i := 0; i < 4; i++ {
+		if _, err = c.ListTopics("", "", ""); err != nil {
+			t.Fatal(err)
+		}
+		if err = c.ProduceMsgs("topic", []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s2.count("GET /topics") != 4 || s2.count("POST /topics/topic") != 4 {
+		t.Error(s2.requests)
+	}
+	if c.endpoints[0].isHealthy() || !c.endpoints[1].isHealthy() {
+		t.Error("expected closed server to be unhealthy")
+	}
+
+	// errors are returned once all servers fail
+	s2.setUnhealthy(true)
+	if _, err = c.ListTopics("", "", ""); !IsRetryable(err) {
+		t.Error(err)
+	}
+
+	// errors which are not retryable do not fail over
+	s3, s4 := newEndpointServer(), newEndpointServer()
+	defer s3.Close()
+	defer s4.Close()
+	c, err = NewClient(WithEndpoints(s3.URL, s4.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = c.DeleteTopic("topic"); err == nil {
+			t.Error("expected unexpected status error")
+		}
+	}
+	if s3.count("DELETE /topics/topic")+s4.count("DELETE /topics/topic") != 2 {
+		t.Error(s3.requests, s4.requests)
+	}
+}
+
+func TestEndpoints_Balancing(t *testing.T) {
+	s1, s2 := newEndpointServer(), newEndpointServer()
+	defer s1.Close()
+	defer s2.Close()
+
+	// reads are spread across servers
+	c, err := NewClient(WithEndpoints(s1.URL, s2.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err = c.ListTopics("", "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s1.count("GET /topics") != 5 || s2.count("GET /topics") != 5 {
+		t.Error(s1.requests, s2.requests)
+	}
+
+	// produces to a topic always go to the same server
+	for _, topic := range []string{"a", "b", "c", "d", "e", "f"} {
+		for i := 0; i < 3; i++ {
+			if err = c.ProduceMsgs(topic, []byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		n1, n2 := s1.count("POST /topics/"+topic), s2.count("POST /topics/"+topic)
+		if !(n1 == 3 && n2 == 0) && !(n1 == 0 && n2 == 3) {
+			t.Error(topic, n1, n2)
+		}
+	}
+
+	// reads go to the fastest server
+	s1.mux.Lock()
+	s1.delay = 20 * time.Millisecond
+	s1.mux.Unlock()
+	c, err = NewClient(WithEndpoints(s1.URL, s2.URL), WithBalancer(LeastLatency), WithHealthCheck(time.Hour, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.checkEndpoints()
+	before := s1.count("GET /topics")
+	for i := 0; i < 5; i++ {
+		if _, err = c.ListTopics("", "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s1.count("GET /topics") != before {
+		t.Error(s1.requests, s2.requests)
+	}
+}
+
+func TestEndpoints_HealthCheck(t *testing.T) {
+	s1, s2 := newEndpointServer(), newEndpointServer()
+	defer s1.Close()
+	defer s2.Close()
+	s1.setUnhealthy(true)
+
+	c, err := NewClient(WithEndpoints(s1.URL, s2.URL), WithHealthCheck(10*time.Millisecond, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitFor := func(healthy bool) {
+		t.Helper()
+		for start := time.Now(); c.endpoints[0].isHealthy() != healthy; time.Sleep(5 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("timed out waiting for health check")
+			}
+		}
+	}
+	waitFor(false)
+	if c.endpoints[0].isHealthy() || !c.endpoints[1].isHealthy() {
+		t.Error("unexpected health")
+	}
+
+	// unhealthy servers are skipped
+	before := s1.count("GET /topics")
+	for i := 0; i < 4; i++ {
+		if _, err = c.ListTopics("", "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s1.count("GET /topics") != before || s2.count("GET /topics") != 4 {
+		t.Error(s1.requests, s2.requests)
+	}
+
+	// servers are used again once they recover
+	s1.setUnhealthy(false)
+	waitFor(true)
+	for i := 0; i < 4; i++ {
+		if _, err = c.ListTopics("", "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s1.count("GET /topics") == before || !strings.HasPrefix(c.url, s1.URL) {
+		t.Error(s1.requests)
+	}
+}
+
+func TestEndpoints_SequencedProduce(t *testing.T) {
+	// the response to the first produce is lost after the batch is written, as if the request timed out
+	var lost int32
+	var urls []string
+	for i := 0; i < 2; i++ {
+		s, err := server.NewServer(server.WithMemoryQueue(100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost && atomic.CompareAndSwapInt32(&lost, 0, 1) {
+				s.ServeHTTP(httptest.NewRecorder(), r)
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				_ = conn.Close()
+				return
+			}
+			s.ServeHTTP(w, r)
+		}))
+		defer ts.Close()
+		urls = append(urls, ts.URL)
+	}
+	for _, url := range urls {
+		c, err := NewClient(WithURL(url))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = c.CreateTopic("topic"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := NewClient(WithEndpoints(urls...), WithRetryPolicy(RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.ProduceMsgs("topic", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&lost) != 1 {
+		t.Fatal("expected a lost response")
+	}
+
+	// the batch is retried against the same server, which drops it as a duplicate
+	var produced int64
+	for _, url := range urls {
+		c, err := NewClient(WithURL(url))
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := c.GetTopicInfo("topic")
+		if err != nil {
+			t.Fatal(err)
+		}
+		produced += info.MaxOffset - info.MinOffset + 1
+	}
+	if produced != 1 {
+		t.Error(produced)
+	}
+}
+
+func TestEndpoints_DelayedProduce(t *testing.T) {
+	s1, s2 := newEndpointServer(), newEndpointServer()
+	defer s1.Close()
+	defer s2.Close()
+	s1.setUnhealthy(true)
+	s2.setUnhealthy(true)
+
+	c, err := NewClient(WithEndpoints(s1.URL, s2.URL), WithRetryPolicy(RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// delayed batches are sent once to the designated server, as a resent batch would be delivered twice
+	err = c.ProduceWithOptions("topic", []int64{5}, ProduceOptions{DeliverAt: time.Now().Add(time.Hour)}, strings.NewReader("hello"))
+	if !IsRetryable(err) {
+		t.Error(err)
+	}
+	if n := s1.count("POST /topics/topic") + s2.count("POST /topics/topic"); n != 1 {
+		t.Error(s1.requests, s2.requests)
+	}
+}
@@ -72,7 +72,8 @@ type User struct {
 }
 
 func NewUser(username string, color string) *User {
-	c, err := haraqa.NewClient()
+	// reconnect to the server if it restarts
+	c, err := haraqa.NewClient(haraqa.WithWatchReconnect(time.Millisecond*100, time.Second*5))
 	if err != nil {
 		panic(err)
 	}
@@ -92,8 +93,8 @@ func (u *User) Listen(topic string) {
 		panic(err)
 	}
 
-	ch := make(chan string, 1)
-	ch <- topic
+	ch := make(chan haraqa.WatchEvent, 1)
+	ch <- haraqa.WatchEvent{Type: haraqa.EventProduced, Topic: topic}
 
 	go func() {
 		defer close(ch)
@@ -114,7 +115,12 @@ func (u *User) Listen(topic string) {
 		u.ids[topic] = 0
 	}
 
-	for topic = range ch {
+	for event := range ch {
+		// after a reconnect, check for any messages missed while disconnected
+		if event.Type != haraqa.EventProduced && event.Type != haraqa.EventReconnected {
+			continue
+		}
+		topic = event.Topic
 		msgs, err := u.client.ConsumeMsgs(topic, u.ids[topic], -1)
 		if err != nil && !errors.Is(err, haraqa.ErrNoContent) {
 			panic(err)
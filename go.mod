@@ -3,9 +3,7 @@ module github.com/haraqa/haraqa
 go 1.14
 
 require (
-	github.com/fsnotify/fsnotify v1.4.9
 	github.com/golang/mock v1.4.3
 	github.com/gorilla/websocket v1.4.2
 	github.com/pkg/errors v0.9.1
-	golang.org/x/sys v0.0.0-20200926100807-9d91bd62050c // indirect
 )
@@ -16,66 +16,72 @@ import (
 )
 
 func BenchmarkConsume(b *testing.B) {
-	rnd := make([]byte, 12)
-	rand.Read(rnd)
-	randomName := base64.URLEncoding.EncodeToString(rnd)
-
-	dirNames := []string{
-		".haraqa1-" + randomName,
-	}
-	defer func() {
-		for _, name := range dirNames {
-			os.RemoveAll(name)
-		}
-	}()
-	haraqaServer, err := server.NewServer(
-		server.WithFileQueue(dirNames, true, 5000),
-	)
-	if err != nil {
-		b.Fatal(err)
-	}
-	defer haraqaServer.Close()
+	b.Run("default", benchConsume())
+	b.Run("io hints", benchConsume(server.WithIOHints(true)))
+}
 
-	s := httptest.NewServer(haraqaServer)
-	s.EnableHTTP2 = true
-	defer s.Close()
+func benchConsume(opts ...server.Option) func(b *testing.B) {
+	return func(b *testing.B) {
+		rnd := make([]byte, 12)
+		rand.Read(rnd)
+		randomName := base64.URLEncoding.EncodeToString(rnd)
 
-	c, err := haraqa.NewClient(haraqa.WithURL(s.URL))
-	if err != nil {
-		b.Fatal(err)
-	}
+		dirNames := []string{
+			".haraqa1-" + randomName,
+		}
+		defer func() {
+			for _, name := range dirNames {
+				os.RemoveAll(name)
+			}
+		}()
+		haraqaServer, err := server.NewServer(append([]server.Option{server.WithFileQueue(dirNames, true, 5000)}, opts...)...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer haraqaServer.Close()
 
-	err = c.CreateTopic("benchtopic")
-	if err != nil {
-		b.Fatal(err)
-	}
+		s := httptest.NewServer(haraqaServer)
+		s.EnableHTTP2 = true
+		defer s.Close()
 
-	msgs := make([][100]byte, 1000)
-	sizes := make([]int64, len(msgs))
-	var data []byte
-	for i := range msgs {
-		copy(msgs[i][:], []byte("something"))
-		data = append(data, msgs[i][:]...)
-		sizes[i] = int64(len(msgs[i]))
-	}
+		c, err := haraqa.NewClient(haraqa.WithURL(s.URL))
+		if err != nil {
+			b.Fatal(err)
+		}
 
-	for i := 0; i < b.N; i += len(msgs) {
-		body := bytes.NewBuffer(data)
-		err = c.Produce("benchtopic", sizes, body)
+		err = c.CreateTopic("benchtopic")
 		if err != nil {
 			b.Fatal(err)
 		}
-	}
 
-	b.Run("consume 1", benchConsumer(1, c))
-	b.Run("consume 10", benchConsumer(10, c))
-	b.Run("consume 100", benchConsumer(100, c))
-	b.Run("consume 1000", benchConsumer(1000, c))
-	fmt.Println("")
-	b.Run("go consume 1", benchConsumerN(10, 1, c))
-	b.Run("go consume 10", benchConsumerN(10, 10, c))
-	b.Run("go consume 100", benchConsumerN(10, 100, c))
-	b.Run("go consume 1000", benchConsumerN(10, 1000, c))
+		msgs := make([][100]byte, 100)
+		sizes := make([]int64, len(msgs))
+		var data []byte
+		for i := range msgs {
+			copy(msgs[i][:], []byte("something"))
+			data = append(data, msgs[i][:]...)
+			sizes[i] = int64(len(msgs[i]))
+		}
+
+		// fill more than one segment, so that the segment consumed from is sealed
+		for i := 0; i < 10000; i += len(msgs) {
+			body := bytes.NewBuffer(data)
+			err = c.Produce("benchtopic", sizes, body)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		b.Run("consume 1", benchConsumer(1, c))
+		b.Run("consume 10", benchConsumer(10, c))
+		b.Run("consume 100", benchConsumer(100, c))
+		b.Run("consume 1000", benchConsumer(1000, c))
+		fmt.Println("")
+		b.Run("go consume 1", benchConsumerN(10, 1, c))
+		b.Run("go consume 10", benchConsumerN(10, 10, c))
+		b.Run("go consume 100", benchConsumerN(10, 100, c))
+		b.Run("go consume 1000", benchConsumerN(10, 1000, c))
+	}
 }
 
 func benchConsumer(batchSize int, c *haraqa.Client) func(b *testing.B) {
@@ -106,18 +112,9 @@ func benchConsumerN(N, batchSize int, c *haraqa.Client) func(b *testing.B) {
 		for i := 0; i < N; i++ {
 			go func() {
 				for range ch {
-					var n int
-					for n < batchSize {
-						r, _, err := c.Consume("benchtopic", 0, batchSize-n)
-						if err != nil {
-							b.Fatal(err)
-						}
-						body, err := ioutil.ReadAll(r)
-						if err != nil {
-							b.Fatal(err)
-						}
-						r.Close()
-						n += len(body) / 100
+					// b.Fatal would skip wg.Done from a goroutine other than the benchmark's, leaving Wait blocked
+					if err := consumeN(c, batchSize); err != nil {
+						b.Error(err)
 					}
 					wg.Done()
 				}
@@ -130,5 +127,88 @@ func benchConsumerN(N, batchSize int, c *haraqa.Client) func(b *testing.B) {
 		}
 		wg.Wait()
 		b.StopTimer()
+		if b.Failed() {
+			b.FailNow()
+		}
+	}
+}
+
+// consumeN consumes batches from the start of the topic until n messages have been read
+func consumeN(c *haraqa.Client, n int) error {
+	for read := 0; read < n; {
+		r, _, err := c.Consume("benchtopic", 0, n-read)
+		if err != nil {
+			return err
+		}
+		body, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		read += len(body) / 100
+	}
+	return nil
+}
+
+func BenchmarkConsumeTail(b *testing.B) {
+	b.Run("disk", benchConsumeTail())
+	b.Run("tail cache", benchConsumeTail(server.WithTailCache(1<<20)))
+}
+
+// benchConsumeTail benchmarks consumers reading each batch right after it is produced
+func benchConsumeTail(opts ...server.Option) func(b *testing.B) {
+	return func(b *testing.B) {
+		rnd := make([]byte, 12)
+		rand.Read(rnd)
+		dirName := ".haraqa-tail-" + base64.URLEncoding.EncodeToString(rnd)
+		defer os.RemoveAll(dirName)
+
+		haraqaServer, err := server.NewServer(append([]server.Option{server.WithFileQueue([]string{dirName}, true, 5000)}, opts...)...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer haraqaServer.Close()
+
+		s := httptest.NewServer(haraqaServer)
+		defer s.Close()
+
+		c, err := haraqa.NewClient(haraqa.WithURL(s.URL))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err = c.CreateTopic("benchtopic"); err != nil {
+			b.Fatal(err)
+		}
+
+		const batchSize = 10
+		msg := make([]byte, 100)
+		sizes := make([]int64, batchSize)
+		for i := range sizes {
+			sizes[i] = int64(len(msg))
+		}
+		data := bytes.Repeat(msg, batchSize)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		var id int64
+		for i := 0; i < b.N; i++ {
+			if err = c.Produce("benchtopic", sizes, bytes.NewReader(data)); err != nil {
+				b.Fatal(err)
+			}
+			r, _, err := c.Consume("benchtopic", id, batchSize)
+			if err != nil {
+				b.Fatal(err)
+			}
+			body, err := ioutil.ReadAll(r)
+			if err != nil {
+				b.Fatal(err)
+			}
+			r.Close()
+			if len(body) != len(data) {
+				b.Fatal(len(body))
+			}
+			id += batchSize
+		}
+		b.StopTimer()
 	}
 }
@@ -5,7 +5,6 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
-	"log"
 	"net/http/httptest"
 	"os"
 	"sync"
@@ -17,51 +16,56 @@ import (
 
 func BenchmarkProduce(b *testing.B) {
 	defer os.RemoveAll(".haraqa")
+	b.Run("default", benchProduce())
+	b.Run("preallocated", benchProduce(server.WithPreallocation(64<<20)))
+}
 
-	rnd := make([]byte, 10)
-	rand.Read(rnd)
-	randomName := base64.URLEncoding.EncodeToString(rnd)
-	dirNames := []string{
-		".haraqa1-" + randomName,
-		".haraqa2-" + randomName,
-	}
-	defer func() {
-		for _, name := range dirNames {
-			os.RemoveAll(name)
+func benchProduce(opts ...server.Option) func(b *testing.B) {
+	return func(b *testing.B) {
+
+		rnd := make([]byte, 10)
+		rand.Read(rnd)
+		randomName := base64.URLEncoding.EncodeToString(rnd)
+		dirNames := []string{
+			".haraqa1-" + randomName,
+			".haraqa2-" + randomName,
 		}
-	}()
+		defer func() {
+			for _, name := range dirNames {
+				os.RemoveAll(name)
+			}
+		}()
 
-	haraqaServer, err := server.NewServer(
-		server.WithFileQueue(dirNames, true, 5000),
-	)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer haraqaServer.Close()
+		haraqaServer, err := server.NewServer(append([]server.Option{server.WithFileQueue(dirNames, true, 5000)}, opts...)...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer haraqaServer.Close()
 
-	s := httptest.NewServer(haraqaServer)
-	s.EnableHTTP2 = true
-	defer s.Close()
+		s := httptest.NewServer(haraqaServer)
+		s.EnableHTTP2 = true
+		defer s.Close()
 
-	c, err := haraqa.NewClient(haraqa.WithURL(s.URL))
-	if err != nil {
-		b.Fatal(err)
-	}
-	err = c.CreateTopic("benchtopic")
-	if err != nil {
-		log.Fatal(err)
-	}
+		c, err := haraqa.NewClient(haraqa.WithURL(s.URL))
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = c.CreateTopic("benchtopic")
+		if err != nil {
+			b.Fatal(err)
+		}
 
-	fmt.Println("")
-	b.Run("produce 1", benchProducer(1, c))
-	b.Run("produce 10", benchProducer(10, c))
-	b.Run("produce 100", benchProducer(100, c))
-	b.Run("produce 1000", benchProducer(1000, c))
-	fmt.Println("")
-	b.Run("go produce 1", benchProducerN(10, 1, c))
-	b.Run("go produce 10", benchProducerN(10, 10, c))
-	b.Run("go produce 100", benchProducerN(10, 100, c))
-	b.Run("go produce 1000", benchProducerN(10, 1000, c))
+		fmt.Println("")
+		b.Run("produce 1", benchProducer(1, c))
+		b.Run("produce 10", benchProducer(10, c))
+		b.Run("produce 100", benchProducer(100, c))
+		b.Run("produce 1000", benchProducer(1000, c))
+		fmt.Println("")
+		b.Run("go produce 1", benchProducerN(10, 1, c))
+		b.Run("go produce 10", benchProducerN(10, 10, c))
+		b.Run("go produce 100", benchProducerN(10, 100, c))
+		b.Run("go produce 1000", benchProducerN(10, 1000, c))
+	}
 }
 
 func benchProducer(batchSize int, c *haraqa.Client) func(b *testing.B) {
@@ -88,7 +92,6 @@ func benchProducer(batchSize int, c *haraqa.Client) func(b *testing.B) {
 }
 
 func benchProducerN(N, batchSize int, c *haraqa.Client) func(b *testing.B) {
-	var err error
 	msgs := make([][100]byte, batchSize)
 	sizes := make([]int64, len(msgs))
 	var data []byte
@@ -105,9 +108,9 @@ func benchProducerN(N, batchSize int, c *haraqa.Client) func(b *testing.B) {
 			go func() {
 				for range ch {
 					body := bytes.NewBuffer(data)
-					err = c.Produce("benchtopic", sizes, body)
-					if err != nil {
-						b.Fatal(err)
+					// b.Fatal would skip wg.Done from a goroutine other than the benchmark's, leaving Wait blocked
+					if err := c.Produce("benchtopic", sizes, body); err != nil {
+						b.Error(err)
 					}
 					wg.Done()
 				}
@@ -121,5 +124,8 @@ func benchProducerN(N, batchSize int, c *haraqa.Client) func(b *testing.B) {
 		}
 		wg.Wait()
 		b.StopTimer()
+		if b.Failed() {
+			b.FailNow()
+		}
 	}
 }
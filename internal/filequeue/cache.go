@@ -0,0 +1,158 @@
+package filequeue
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+// CacheMetrics counts the events of the cache of open produce files
+type CacheMetrics interface {
+	CacheHit()
+	CacheMiss()
+	CacheEviction()
+}
+
+type noOpCacheMetrics struct{}
+
+func (noOpCacheMetrics) CacheHit()      {}
+func (noOpCacheMetrics) CacheMiss()     {}
+func (noOpCacheMetrics) CacheEviction() {}
+
+// produceCache holds the open produce files of each topic. Once more than maxFiles files are open,
+// the least recently used topics are evicted from the cache, and should then be closed by the caller
+type produceCache struct {
+	mux      sync.Mutex
+	maxFiles int
+	perTopic int
+	entries  map[string]*list.Element
+	lru      *list.List
+	metrics  CacheMetrics
+}
+
+// produceCacheEntry is the value of the elements in the lru list, the front of the list is the most recently used
+type produceCacheEntry struct {
+	topic string
+	pf    *cacheableProduceFile
+}
+
+// newProduceCache creates an unbounded cache, for topics which each have perTopic files open
+func newProduceCache(perTopic int) *produceCache {
+	return &produceCache{
+		perTopic: perTopic,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		metrics:  noOpCacheMetrics{},
+	}
+}
+
+// Load returns the produce files of the topic, marking them as the most recently used
+func (c *produceCache) Load(topic string) (*cacheableProduceFile, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	e, ok := c.entries[topic]
+	if !ok {
+		c.metrics.CacheMiss()
+		return nil, false
+	}
+	c.metrics.CacheHit()
+	c.lru.MoveToFront(e)
+	return e.Value.(*produceCacheEntry).pf, true
+}
+
+// Store adds the produce files of the topic as the most recently used, and returns any entries evicted to make room
+func (c *produceCache) Store(topic string, pf *cacheableProduceFile) []produceCacheEntry {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if e, ok := c.entries[topic]; ok {
+		e.Value.(*produceCacheEntry).pf = pf
+		c.lru.MoveToFront(e)
+		return nil
+	}
+	c.entries[topic] = c.lru.PushFront(&produceCacheEntry{topic: topic, pf: pf})
+
+	// at least the topic being stored is kept, even if that alone is above the limit
+	var evicted []produceCacheEntry
+	for c.maxFiles > 0 && c.lru.Len() > 1 && c.lru.Len()*c.perTopic > c.maxFiles {
+		entry := c.lru.Remove(c.lru.Back()).(*produceCacheEntry)
+		delete(c.entries, entry.topic)
+		evicted = append(evicted, *entry)
+		c.metrics.CacheEviction()
+	}
+	return evicted
+}
+
+// Contains reports if the given produce files are currently cached for the topic
+func (c *produceCache) Contains(topic string, pf *cacheableProduceFile) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	e, ok := c.entries[topic]
+	return ok && e.Value.(*produceCacheEntry).pf == pf
+}
+
+// Delete removes and returns the produce files of the topic, or nil if there are none
+func (c *produceCache) Delete(topic string) *cacheableProduceFile {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	e, ok := c.entries[topic]
+	if !ok {
+		return nil
+	}
+	delete(c.entries, topic)
+	return c.lru.Remove(e).(*produceCacheEntry).pf
+}
+
+// DeleteNested removes and returns the entries of the topic and any nested topic within
+func (c *produceCache) DeleteNested(topic string) []produceCacheEntry {
+	return c.deleteIf(func(t string) bool {
+		return t == topic || strings.HasPrefix(t, topic+"/")
+	})
+}
+
+// DeleteAll removes and returns all entries
+func (c *produceCache) DeleteAll() []produceCacheEntry {
+	return c.deleteIf(func(string) bool { return true })
+}
+
+func (c *produceCache) deleteIf(match func(topic string) bool) []produceCacheEntry {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	var deleted []produceCacheEntry
+	for topic, e := range c.entries {
+		if match(topic) {
+			deleted = append(deleted, *c.lru.Remove(e).(*produceCacheEntry))
+			delete(c.entries, topic)
+		}
+	}
+	return deleted
+}
+
+// Len returns the number of topics with cached files
+func (c *produceCache) Len() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.lru.Len()
+}
+
+// closeProduceFiles closes the files of entries removed from the produce cache. Each topic's produce lock is
+// held while closing, so that files are never closed during a write. Entries which have been stored again
+// by a concurrent produce are still in use and are left open
+func (q *FileQueue) closeProduceFiles(entries []produceCacheEntry) {
+	for _, entry := range entries {
+		mux := q.produceLock(entry.topic)
+		mux.Lock()
+		if !q.produceCache.Contains(entry.topic, entry.pf) {
+			closeCachedFiles(entry.pf)
+		}
+		mux.Unlock()
+	}
+}
+
+// produceLock returns the lock used to serialize produce actions on the topic
+func (q *FileQueue) produceLock(topic string) *sync.Mutex {
+	mux, ok := q.produceLocks.Load(topic)
+	if !ok {
+		mux, _ = q.produceLocks.LoadOrStore(topic, &sync.Mutex{})
+	}
+	return mux.(*sync.Mutex)
+}
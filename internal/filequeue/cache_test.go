@@ -0,0 +1,195 @@
+package filequeue
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countingFS counts the files currently open
+type countingFS struct {
+	FS
+	open int64
+}
+
+func (fs *countingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&fs.open, 1)
+	return &countingFile{File: f, fs: fs}, nil
+}
+
+func (fs *countingFS) Open(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+type countingFile struct {
+	File
+	fs     *countingFS
+	closed int32
+}
+
+func (f *countingFile) Close() error {
+	if atomic.CompareAndSwapInt32(&f.closed, 0, 1) {
+		atomic.AddInt64(&f.fs.open, -1)
+	}
+	return f.File.Close()
+}
+
+type cacheCounts struct {
+	hits, misses, evictions int64
+}
+
+func (c *cacheCounts) CacheHit()      { atomic.AddInt64(&c.hits, 1) }
+func (c *cacheCounts) CacheMiss()     { atomic.AddInt64(&c.misses, 1) }
+func (c *cacheCounts) CacheEviction() { atomic.AddInt64(&c.evictions, 1) }
+
+func TestFileQueue_MaxOpenFiles(t *testing.T) {
+	if _, err := NewWithOptions(true, 10, []string{"a"}, WithMaxOpenFiles(-1)); err == nil {
+		t.Error("expected invalid max open files")
+	}
+	if _, err := NewWithOptions(false, 10, []string{"a"}, WithFS(NewMemFS()), WithMaxOpenFiles(2)); err == nil || err.Error() != "invalid max open files, the queue does not cache files" {
+		t.Error(err)
+	}
+	if _, err := NewWithOptions(false, 10, []string{"a"}, WithFS(NewMemFS()), WithMaxOpenFiles(0)); err != nil {
+		t.Error(err)
+	}
+	if _, err := NewWithOptions(true, 10, []string{"a"}, WithCacheMetrics(nil)); err == nil {
+		t.Error("expected invalid metrics")
+	}
+
+	fs := &countingFS{FS: NewMemFS()}
+	counts := &cacheCounts{}
+	// each topic has a dat and log open in each of the two directories, so two topics fit
+	q, err := NewWithOptions(true, 10, []string{"a", "b"}, WithFS(fs), WithMaxOpenFiles(9), WithCacheMetrics(counts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{"t1", "t2", "t3", "nested", "nested/topic"} {
+		if err = q.CreateTopic(topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	produce := func(topic string, expectedID int64) {
+		t.Helper()
+		info, err := q.Produce(topic, []int64{1}, 0, nil, nil, bytes.NewBufferString("a"))
+		if err != nil || info.StartID != expectedID {
+			t.Error(info, err)
+		}
+	}
+	check := func(open int64, hits, misses, evictions int64) {
+		t.Helper()
+		if n := atomic.LoadInt64(&fs.open); n != open {
+			t.Error("open", n, open)
+		}
+		if counts.hits != hits || counts.misses != misses || counts.evictions != evictions {
+			t.Error(*counts, hits, misses, evictions)
+		}
+	}
+
+	produce("t1", 0)
+	produce("t2", 0)
+	check(8, 0, 2, 0)
+	produce("t1", 1)
+	check(8, 1, 2, 0)
+
+	// t2 is the least recently used
+	produce("t3", 0)
+	check(8, 1, 3, 1)
+	if _, ok := q.produceCache.entries["t2"]; ok || q.produceCache.Len() != 2 {
+		t.Error(q.produceCache.entries)
+	}
+
+	// evicted topics reopen their files, continuing from the last id
+	produce("t2", 1)
+	check(8, 1, 4, 2)
+	w := httptest.NewRecorder()
+	if n, err := q.Consume("", "t2", 0, -1, w); err != nil || n != 2 || w.Body.String() != "aa" {
+		t.Error(n, err, w.Body.String())
+	}
+
+	// deleting a topic closes the files of nested topics
+	produce("nested/topic", 0)
+	check(8, 1, 5, 3)
+	if err = q.DeleteTopic("nested"); err != nil {
+		t.Fatal(err)
+	}
+	check(4, 1, 5, 3)
+
+	if err = q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(0, 1, 5, 3)
+}
+
+func TestFileQueue_MaxOpenFilesConcurrent(t *testing.T) {
+	fs := &countingFS{FS: NewMemFS()}
+	q, err := NewWithOptions(true, 3, []string{"a"}, WithFS(fs), WithMaxOpenFiles(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const topics, msgs = 8, 20
+	for i := 0; i < topics; i++ {
+		if err = q.CreateTopic("topic" + strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < topics; i++ {
+		wg.Add(1)
+		go func(topic string) {
+			defer wg.Done()
+			for j := 0; j < msgs; j++ {
+				if _, err := q.Produce(topic, []int64{1}, 0, nil, nil, bytes.NewBufferString("a")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}("topic" + strconv.Itoa(i))
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt64(&fs.open); n > 4 {
+		t.Error(n)
+	}
+	for i := 0; i < topics; i++ {
+		info, err := q.GetTopicInfo("topic" + strconv.Itoa(i))
+		if err != nil || info.MaxOffset != msgs-1 {
+			t.Error(info, err)
+		}
+	}
+	if err = q.Close(); err != nil {
+		t.Error(err)
+	}
+	if n := atomic.LoadInt64(&fs.open); n != 0 {
+		t.Error(n)
+	}
+}
+
+func TestFileQueue_NoCacheClosesFiles(t *testing.T) {
+	fs := &countingFS{FS: NewMemFS()}
+	q, err := NewWithOptions(false, 10, []string{"a", "b"}, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.CreateTopic("topic"); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 3; i++ {
+		info, err := q.Produce("topic", []int64{1}, 0, nil, nil, bytes.NewBufferString("a"))
+		if err != nil || info.StartID != i {
+			t.Error(info, err)
+		}
+	}
+	if n := atomic.LoadInt64(&fs.open); n != 0 {
+		t.Error(n)
+	}
+}
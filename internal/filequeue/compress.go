@@ -0,0 +1,394 @@
+package filequeue
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Sealed segment logs can be compressed in the background, replacing the <base>.log file of a segment with a
+// <base>.zlog file. The log is split into blocks of a fixed uncompressed size, each compressed on its own so
+// that consumers only decompress the blocks holding the messages they read. The file is laid out as:
+//
+//	compressed blocks
+//	block offsets, the little endian uint64 offset of each compressed block in the file
+//	trailer, the little endian uint64 block size, uncompressed log size and number of blocks, then the
+//	uint32 magic number and uint32 compression format
+//
+// Dat entries always hold the offsets of messages in the uncompressed log. The raw files served by the server
+// are the files as stored, a compressed segment's log is served as its .zlog file
+const (
+	compressedLogExt        = ".zlog"
+	compressedTrailerLength = 32
+	compressedMagic         = 0x7a717268
+)
+
+// CompressionFormat is the format of the compressed blocks of a segment log
+type CompressionFormat uint32
+
+// Compression formats from the standard library
+const (
+	CompressionFlate CompressionFormat = 1
+	CompressionGzip  CompressionFormat = 2
+)
+
+// Compression configures the background compression of the logs of sealed segments
+type Compression struct {
+	// Format is the compression format of the blocks
+	Format CompressionFormat
+	// Level is the compression level of the format, 0 uses the default level
+	Level int
+	// BlockSize is the uncompressed size of each block, 64KiB if 0
+	BlockSize int64
+	// Interval is the time between checks for segments to compress, a minute if 0
+	Interval time.Duration
+}
+
+// CompressionMetrics records the sizes of the segment logs compressed in the background
+type CompressionMetrics interface {
+	SegmentCompressed(rawSize, compressedSize int64)
+}
+
+type noOpCompressionMetrics struct{}
+
+func (noOpCompressionMetrics) SegmentCompressed(int64, int64) {}
+
+func (c *Compression) validate() error {
+	switch c.Format {
+	case CompressionFlate, CompressionGzip:
+	default:
+		return errors.Errorf("invalid compression format %d", c.Format)
+	}
+	if c.Level == 0 {
+		c.Level = flate.DefaultCompression
+	}
+	if c.Level < flate.HuffmanOnly || c.Level > flate.BestCompression {
+		return errors.Errorf("invalid compression level %d", c.Level)
+	}
+	if c.BlockSize < 0 {
+		return errors.New("invalid compression block size, value must not be negative")
+	}
+	if c.BlockSize == 0 {
+		c.BlockSize = 64 << 10
+	}
+	if c.Interval < 0 {
+		return errors.New("invalid compression interval, value must not be negative")
+	}
+	if c.Interval == 0 {
+		c.Interval = time.Minute
+	}
+	return nil
+}
+
+// startCompression compresses sealed segments on each interval until the queue is closed
+func (q *FileQueue) startCompression() {
+	q.stop = make(chan struct{})
+	q.stopped.Add(1)
+	go func() {
+		defer q.stopped.Done()
+		ticker := time.NewTicker(q.compression.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-q.stop:
+				return
+			case <-ticker.C:
+				// segments which fail to compress are retried on the next interval
+				_ = q.compressSegments()
+			}
+		}
+	}()
+}
+
+// compressSegments compresses the logs of the sealed segments of every topic, in each root directory
+func (q *FileQueue) compressSegments() error {
+	topics, err := q.ListTopics("", "", "")
+	if err != nil {
+		return errors.Wrap(err, "unable to list topics")
+	}
+	var firstErr error
+	for _, topic := range topics {
+		idx, err := q.loadIndex(topic)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "unable to load segment index for %q", topic)
+			}
+			continue
+		}
+		for _, base := range idx.sealed() {
+			select {
+			case <-q.stop:
+				return firstErr
+			default:
+			}
+			// segments are not compressed while deleted messages are reclaimed from them
+			q.compressMux.Lock()
+			for _, dir := range q.rootDirNames {
+				path := filepath.Join(dir, topic, formatName(base))
+				if err = q.compressSegment(path); err != nil && firstErr == nil {
+					firstErr = errors.Wrapf(err, "unable to compress segment %q", path)
+				}
+			}
+			q.compressMux.Unlock()
+		}
+	}
+	return firstErr
+}
+
+// compressSegment replaces the log of a sealed segment with a compressed log. The compressed log is renamed
+// into place before the log is removed, so consumers always find one of them
+func (q *FileQueue) compressSegment(path string) error {
+	log, err := q.fs.Open(path + ".log")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	tmpPath := path + compressedLogExt + ".tmp"
+	f, err := q.fs.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	rawSize, size, err := q.writeCompressedLog(f, log)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = q.fs.Rename(tmpPath, path+compressedLogExt)
+	}
+	if err != nil {
+		_ = q.fs.Remove(tmpPath)
+		return err
+	}
+
+	// the segment may have been removed while it was compressed
+	if _, err = q.fs.Stat(path); os.IsNotExist(err) {
+		_ = q.fs.Remove(path + compressedLogExt)
+		return nil
+	}
+	if err = q.fs.Remove(path + ".log"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	q.compressionMetrics.SegmentCompressed(rawSize, size)
+	return nil
+}
+
+// compressor is implemented by the flate and gzip writers
+type compressor interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// writeCompressedLog writes the blocks and footer of a compressed log, returning the uncompressed and
+// compressed sizes
+func (q *FileQueue) writeCompressedLog(w io.Writer, r io.Reader) (int64, int64, error) {
+	var block bytes.Buffer
+	var zw compressor
+	var err error
+	switch q.compression.Format {
+	case CompressionGzip:
+		zw, err = gzip.NewWriterLevel(&block, q.compression.Level)
+	default:
+		zw, err = flate.NewWriter(&block, q.compression.Level)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var rawSize, size int64
+	var offsets []int64
+	buf := make([]byte, q.compression.BlockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			block.Reset()
+			zw.Reset(&block)
+			if _, err := zw.Write(buf[:n]); err != nil {
+				return 0, 0, err
+			}
+			if err := zw.Close(); err != nil {
+				return 0, 0, err
+			}
+			if _, err := w.Write(block.Bytes()); err != nil {
+				return 0, 0, err
+			}
+			offsets = append(offsets, size)
+			size += int64(block.Len())
+			rawSize += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	footer := make([]byte, 8*len(offsets)+compressedTrailerLength)
+	for i, offset := range offsets {
+		binary.LittleEndian.PutUint64(footer[i*8:], uint64(offset))
+	}
+	trailer := footer[8*len(offsets):]
+	binary.LittleEndian.PutUint64(trailer[0:], uint64(q.compression.BlockSize))
+	binary.LittleEndian.PutUint64(trailer[8:], uint64(rawSize))
+	binary.LittleEndian.PutUint64(trailer[16:], uint64(len(offsets)))
+	binary.LittleEndian.PutUint32(trailer[24:], compressedMagic)
+	binary.LittleEndian.PutUint32(trailer[28:], uint32(q.compression.Format))
+	if _, err = w.Write(footer); err != nil {
+		return 0, 0, err
+	}
+	return rawSize, size + int64(len(footer)), nil
+}
+
+// compressedLog reads the uncompressed log of a compressed segment, decompressing the blocks as they are read
+type compressedLog struct {
+	f         File
+	format    CompressionFormat
+	blockSize int64
+	size      int64
+	// offsets holds the offset of each block, followed by the offset of the footer
+	offsets []int64
+	pos     int64
+	block   int64
+	buf     []byte
+}
+
+// openCompressedLog opens a compressed log and reads its footer
+func openCompressedLog(fs FS, name string) (*compressedLog, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	l, err := readCompressedFooter(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, errors.Wrapf(err, "invalid compressed log %q", name)
+	}
+	return l, nil
+}
+
+func readCompressedFooter(f File) (*compressedLog, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() < compressedTrailerLength {
+		return nil, errors.New("missing trailer")
+	}
+	var trailer [compressedTrailerLength]byte
+	if _, err = f.ReadAt(trailer[:], stat.Size()-compressedTrailerLength); err != nil {
+		return nil, err
+	}
+	l := &compressedLog{
+		f:         f,
+		format:    CompressionFormat(binary.LittleEndian.Uint32(trailer[28:])),
+		blockSize: int64(binary.LittleEndian.Uint64(trailer[0:])),
+		size:      int64(binary.LittleEndian.Uint64(trailer[8:])),
+		block:     -1,
+	}
+	n := int64(binary.LittleEndian.Uint64(trailer[16:]))
+	footerAt := stat.Size() - compressedTrailerLength - 8*n
+	switch {
+	case binary.LittleEndian.Uint32(trailer[24:]) != compressedMagic:
+		return nil, errors.New("invalid magic number")
+	case l.format != CompressionFlate && l.format != CompressionGzip:
+		return nil, errors.Errorf("unknown compression format %d", l.format)
+	case l.blockSize <= 0 || l.size < 0 || n < 0 || footerAt < 0 || n != (l.size+l.blockSize-1)/l.blockSize:
+		return nil, errors.New("invalid trailer")
+	}
+
+	data := make([]byte, 8*n)
+	if _, err = f.ReadAt(data, footerAt); err != nil {
+		return nil, err
+	}
+	l.offsets = make([]int64, n+1)
+	for i := range l.offsets[:n] {
+		l.offsets[i] = int64(binary.LittleEndian.Uint64(data[i*8:]))
+	}
+	l.offsets[n] = footerAt
+	return l, nil
+}
+
+// Read reads the uncompressed log from the current position
+func (l *compressedLog) Read(p []byte) (int, error) {
+	if l.pos >= l.size {
+		return 0, io.EOF
+	}
+	block := l.pos / l.blockSize
+	if block != l.block {
+		if err := l.load(block); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, l.buf[l.pos-block*l.blockSize:])
+	l.pos += int64(n)
+	return n, nil
+}
+
+// Seek sets the position in the uncompressed log
+func (l *compressedLog) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += l.pos
+	case io.SeekEnd:
+		offset += l.size
+	}
+	if offset < 0 {
+		return 0, errors.New("invalid seek to negative position")
+	}
+	l.pos = offset
+	return offset, nil
+}
+
+// Close closes the compressed log file
+func (l *compressedLog) Close() error {
+	return l.f.Close()
+}
+
+// load decompresses a block into the buffer
+func (l *compressedLog) load(block int64) error {
+	start, end := l.offsets[block], l.offsets[block+1]
+	if start < 0 || end < start {
+		return errors.Errorf("invalid offset of block %d", block)
+	}
+	data := make([]byte, end-start)
+	if _, err := l.f.ReadAt(data, start); err != nil {
+		return errors.Wrapf(err, "unable to read block %d", block)
+	}
+
+	var r io.Reader = flate.NewReader(bytes.NewReader(data))
+	if l.format == CompressionGzip {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return errors.Wrapf(err, "unable to decompress block %d", block)
+		}
+		r = zr
+	}
+	size := l.size - block*l.blockSize
+	if size > l.blockSize {
+		size = l.blockSize
+	}
+	if int64(cap(l.buf)) < size {
+		l.buf = make([]byte, l.blockSize)
+	}
+	l.buf = l.buf[:size]
+	l.block = -1
+	if _, err := io.ReadFull(r, l.buf); err != nil {
+		return errors.Wrapf(err, "unable to decompress block %d", block)
+	}
+	l.block = block
+	return nil
+}
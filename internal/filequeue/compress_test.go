@@ -0,0 +1,197 @@
+package filequeue
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/haraqa/haraqa/internal/headers"
+	"github.com/pkg/errors"
+)
+
+type compressionMetrics struct {
+	rawSize, compressedSize int64
+}
+
+func (m *compressionMetrics) SegmentCompressed(rawSize, compressedSize int64) {
+	m.rawSize += rawSize
+	m.compressedSize += compressedSize
+}
+
+func TestCompression_Validate(t *testing.T) {
+	for _, c := range []Compression{
+		{},
+		{Format: CompressionFlate, Level: 10},
+		{Format: CompressionGzip, BlockSize: -1},
+		{Format: CompressionGzip, Interval: -1},
+	} {
+		if _, err := NewWithOptions(true, 10, []string{"a"}, WithFS(NewMemFS()), WithCompression(c)); err == nil {
+			t.Error("expected invalid compression", c)
+		}
+	}
+	if _, err := NewWithOptions(true, 10, []string{"a"}, WithFS(NewMemFS()), WithCompressionMetrics(nil)); err == nil {
+		t.Error("expected invalid compression metrics")
+	}
+
+	// compression starts when the option is applied to an open queue, and only once
+	q, err := NewWithOptions(true, 10, []string{"a"}, WithFS(NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = WithCompression(Compression{Format: CompressionFlate})(q); err != nil || q.stop == nil {
+		t.Error(err)
+	}
+	if err = WithCompression(Compression{Format: CompressionFlate})(q); err == nil {
+		t.Error("expected compression to have started")
+	}
+}
+
+func TestFileQueue_Compression(t *testing.T) {
+	const topic = "compressed"
+	for _, format := range []CompressionFormat{CompressionFlate, CompressionGzip} {
+		fs := NewFaultFS(NewMemFS())
+		metrics := &compressionMetrics{}
+		q, err := NewWithOptions(true, 3, []string{"a", "b"}, WithFS(fs),
+			WithCompression(Compression{Format: format, BlockSize: 4, Interval: time.Hour}),
+			WithCompressionMetrics(metrics))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = q.CreateTopic(topic); err != nil {
+			t.Fatal(err)
+		}
+		msgs := []string{"first", "second", "third message", "fourth", "fifth message", "sixth", "seventh"}
+		for _, msg := range msgs {
+			if _, err = q.Produce(topic, []int64{int64(len(msg))}, 0, nil, nil, bytes.NewBufferString(msg)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		consume := func(id, limit int64, expected ...string) {
+			t.Helper()
+			w := httptest.NewRecorder()
+			n, err := q.Consume("", topic, id, limit, w)
+			if err != nil || n != len(expected) {
+				t.Fatal(format, n, err)
+			}
+			if body, _ := ioutil.ReadAll(w.Body); string(body) != strings.Join(expected, "") {
+				t.Error(format, string(body))
+			}
+		}
+
+		// only the sealed segments are compressed, in each directory
+		if err = q.compressSegments(); err != nil {
+			t.Fatal(err)
+		}
+		for _, dir := range []string{"a", "b"} {
+			for _, base := range []int64{0, 3} {
+				path := dir + "/" + topic + "/" + formatName(base)
+				if _, err = fs.Stat(path + ".log"); !os.IsNotExist(err) {
+					t.Error(path, err)
+				}
+				if _, err = fs.Stat(path + compressedLogExt); err != nil {
+					t.Error(path, err)
+				}
+			}
+			if _, err = fs.Stat(dir + "/" + topic + "/" + formatName(6) + ".log"); err != nil {
+				t.Error(err)
+			}
+		}
+		if raw := int64(len(strings.Join(msgs[:6], ""))); metrics.rawSize != 2*raw || metrics.compressedSize == 0 {
+			t.Error(metrics)
+		}
+
+		// consumers decompress the blocks they read, the dat offsets are offsets in the uncompressed log
+		consume(0, -1, msgs[:3]...)
+		consume(1, 1, msgs[1])
+		consume(4, 2, msgs[4:6]...)
+		consume(6, -1, msgs[6])
+		w := httptest.NewRecorder()
+		if _, err = q.Consume("", topic, 2, 1, w); err != nil {
+			t.Fatal(err)
+		}
+		if v := w.Header().Get(headers.HeaderFileName); v != "b/"+topic+"/"+formatName(0)+compressedLogExt {
+			t.Error(v)
+		}
+
+		// compressing again leaves the compressed segments as they are
+		if err = q.compressSegments(); err != nil {
+			t.Fatal(err)
+		}
+		consume(3, -1, msgs[3:6]...)
+
+		// failed compressions leave the log in place
+		for _, msg := range []string{"extra", "more", "last"} {
+			if _, err = q.Produce(topic, []int64{int64(len(msg))}, 0, nil, nil, bytes.NewBufferString(msg)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		fs.Inject(Fault{Op: FaultRename, Path: compressedLogExt, Err: syscall.EIO, Times: 1})
+		if err = q.compressSegments(); !errors.Is(err, syscall.EIO) {
+			t.Error(err)
+		}
+		if _, err = fs.Stat("a/" + topic + "/" + formatName(6) + compressedLogExt + ".tmp"); !os.IsNotExist(err) {
+			t.Error(err)
+		}
+		if _, err = fs.Stat("a/" + topic + "/" + formatName(6) + ".log"); err != nil {
+			t.Error(err)
+		}
+		consume(6, -1, msgs[6], "extra", "more")
+		consume(9, -1, "last")
+
+		// corrupt compressed logs are reported
+		if err = writeFile(fs, "b/"+topic+"/"+formatName(0)+compressedLogExt, []byte("invalid"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = q.Consume("", topic, 0, -1, httptest.NewRecorder()); err == nil {
+			t.Error("expected invalid compressed log")
+		}
+
+		// compressed logs are removed with their segment
+		if _, err = q.ModifyTopic(topic, headers.ModifyRequest{Truncate: 4}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = fs.Stat("a/" + topic + "/" + formatName(0) + compressedLogExt); !os.IsNotExist(err) {
+			t.Error(err)
+		}
+		if err = q.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFileQueue_CompressionInterval(t *testing.T) {
+	const topic = "background"
+	fs := NewMemFS()
+	q, err := NewWithOptions(true, 1, []string{"a"}, WithFS(fs), WithCompression(Compression{Format: CompressionGzip, Interval: time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"hello", "world"} {
+		if _, err = q.Produce(topic, []int64{5}, 0, nil, nil, bytes.NewBufferString(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if _, err = fs.Stat("a/" + topic + "/" + formatName(0) + compressedLogExt); err == nil {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("segment was not compressed")
+		}
+	}
+	if err = q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,11 +1,13 @@
 package filequeue
 
 import (
+	"bytes"
+	"crypto/cipher"
 	"encoding/binary"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
-	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -16,17 +18,34 @@ import (
 
 // Consume copies messages from a log to the writer
 func (q *FileQueue) Consume(group, topic string, id int64, limit int64, w http.ResponseWriter) (int, error) {
-	id = getGroupOffsetID(group, topic, id)
+	id = q.getGroupOffsetID(group, topic, id)
 
-	datName, err := getConsumeDat(q.consumeNameCache, filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic), topic, id)
+	// recently produced messages are served from memory
+	if q.tails != nil {
+		if n, ok, err := q.consumeTail(topic, id, limit, w); ok {
+			return n, err
+		}
+	}
+
+	idx, err := q.loadIndex(topic)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return 0, headers.ErrTopicDoesNotExist
 		}
-		return 0, errors.Wrap(err, "unable to get consume dat filename")
+		return 0, errors.Wrap(err, "unable to load segment index")
 	}
-	path := filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic, datName)
-	dat, err := os.Open(path)
+	base, ok := idx.find(id)
+	if !ok {
+		return 0, nil
+	}
+	path := filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic, formatName(base))
+
+	// the files of the segment must not be replaced by a rewrite while they are read
+	rw := q.rewriteLock(topic)
+	rw.RLock()
+	defer rw.RUnlock()
+
+	dat, err := q.fs.Open(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return 0, nil
@@ -46,15 +65,10 @@ func (q *FileQueue) Consume(group, topic string, id int64, limit int64, w http.R
 		if id < 0 {
 			return 0, nil
 		}
-	}
-
-	if id > stat.Size()/datEntryLength-1 {
-		base, err := strconv.ParseInt(stat.Name(), 10, 64)
-		if err != nil {
-			return 0, err
-		}
+	} else {
+		// get the position of the id within the file
 		id = id - base
-		if id > stat.Size()/datEntryLength-1 {
+		if id < 0 || id > stat.Size()/datEntryLength-1 {
 			return 0, nil
 		}
 	}
@@ -70,70 +84,87 @@ func (q *FileQueue) Consume(group, topic string, id int64, limit int64, w http.R
 	}
 	limit = int64(length) / datEntryLength
 
-	return q.consumeResponse(w, data, limit, path+".log")
-}
-
-func getGroupOffsetID(group, topic string, id int64) int64 {
-	if group == "" || id > 0 {
-		return id
+	eventTimes, err := q.readEventTimes(path, id, limit)
+	if err != nil {
+		return 0, err
 	}
-	// TODO: LOOKUP consumer group offset
-	return id
-}
-
-func getConsumeDat(consumeNameCache *sync.Map, path string, topic string, id int64) (string, error) {
-	exact := formatName(id)
-	if consumeNameCache != nil {
-		value, ok := consumeNameCache.Load(topic)
-		if ok {
-			names := value.([]string)
-			for i := range names {
-				if len(names[i]) == len(exact) && names[i] <= exact {
-					return names[i], nil
-				}
-			}
-		}
+	subjectIDs, err := q.readSubjectKeyIDs(path, id, limit)
+	if err != nil {
+		return 0, err
 	}
-
-	dir, err := os.Open(path)
+	deleted, err := q.readDeleted(path, id, limit)
 	if err != nil {
-		return "", err
+		return 0, err
 	}
-	defer dir.Close()
+	latest, _ := idx.find(-1)
+	return q.consumeResponse(w, topic, data, eventTimes, subjectIDs, deleted, limit, path, base != latest)
+}
+
+var reqPool = sync.Pool{
+	New: func() interface{} {
+		return &http.Request{}
+	},
+}
 
-	names, err := dir.Readdirnames(-1)
+// consumeResponse serves the messages from the log of the segment at path, or its compressed log, decrypting
+// them if the segment is encrypted or the messages have a subject and dropping the content of deleted messages
+// which has not been reclaimed
+func (q *FileQueue) consumeResponse(w http.ResponseWriter, topic string, data []byte, eventTimes []uint64, subjectIDs [][subjectKeyIDLength]byte, deleted []bool, limit int64, path string, sealed bool) (int, error) {
+	keyID, err := readSegmentKeyID(q.fs, path)
 	if err != nil {
-		return "", err
+		return 0, errors.Wrap(err, "unable to read segment key id")
 	}
-	sort.Sort(sortableDirNames(names))
-	if consumeNameCache != nil {
-		consumeNameCache.Store(topic, names)
+	var aead cipher.AEAD
+	if keyID != "" {
+		if aead, err = q.segmentCipher(topic, keyID); err != nil {
+			return 0, err
+		}
 	}
-	if id < 0 {
-		for i := range names {
-			if len(names[i]) == len(exact) {
-				return names[i], nil
-			}
+	serve := q.serveConsume
+	if aead != nil || subjectIDs != nil || unreclaimed(data, deleted) {
+		serve = func(w http.ResponseWriter, data []byte, eventTimes []uint64, limit int64, filename string, content io.ReadSeeker) (int, error) {
+			return q.serveRewritten(w, aead, subjectIDs, deleted, data, eventTimes, limit, filename, content)
 		}
+	} else {
+		headers.SetDeleted(deleted, w.Header())
 	}
 
-	for i := range names {
-		if len(names[i]) == len(exact) && names[i] <= exact {
-			return names[i], nil
+	filename := path + ".log"
+	f, err := q.fs.Open(filename)
+	if os.IsNotExist(err) && sealed {
+		l, zErr := openCompressedLog(q.fs, path+compressedLogExt)
+		if zErr != nil {
+			if os.IsNotExist(zErr) {
+				return 0, err
+			}
+			return 0, zErr
 		}
+		defer l.Close()
+		return serve(w, data, eventTimes, limit, path+compressedLogExt, l)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if !sealed || !q.ioHints {
+		return serve(w, data, eventTimes, limit, filename, f)
 	}
-	return formatName(0), nil
-}
 
-var reqPool = sync.Pool{
-	New: func() interface{} {
-		return &http.Request{}
-	},
+	// sealed segments are no longer written to and are read from start to end by consumers catching up,
+	// the pages sent are unlikely to be needed again soon
+	start := int64(binary.LittleEndian.Uint64(data[16:]))
+	last := data[(limit-1)*datEntryLength:]
+	end := int64(binary.LittleEndian.Uint64(last[16:]) + binary.LittleEndian.Uint64(last[24:]))
+	adviseSequential(f)
+	n, err := serve(w, data, eventTimes, limit, filename, f)
+	adviseDontNeed(f, start, end-start)
+	return n, err
 }
 
-func (q *FileQueue) consumeResponse(w http.ResponseWriter, data []byte, limit int64, filename string) (int, error) {
+// serveConsume writes the messages of the dat entries from the log content
+func (q *FileQueue) serveConsume(w http.ResponseWriter, data []byte, eventTimes []uint64, limit int64, filename string, content io.ReadSeeker) (int, error) {
 	sizes := make([]int64, limit)
-	startTime := time.Unix(int64(binary.LittleEndian.Uint64(data[8:])), 0)
+	startTime := binary.LittleEndian.Uint64(data[8:])
 	endTime := startTime
 	startAt := binary.LittleEndian.Uint64(data[16:])
 	endAt := startAt
@@ -142,29 +173,96 @@ func (q *FileQueue) consumeResponse(w http.ResponseWriter, data []byte, limit in
 		sizes[i] = int64(size)
 		endAt += size
 		if i == len(sizes)-1 {
-			endTime = time.Unix(int64(binary.LittleEndian.Uint64(data[i*datEntryLength+8:])), 0)
+			endTime = binary.LittleEndian.Uint64(data[i*datEntryLength+8:])
 		}
 	}
+	empty := endAt == startAt
 	endAt--
 
-	f, err := os.Open(filename)
-	if err != nil {
-		return 0, err
-	}
-	defer f.Close()
-
 	wHeader := w.Header()
-	wHeader[headers.HeaderStartTime] = []string{startTime.Format(time.ANSIC)}
-	wHeader[headers.HeaderEndTime] = []string{endTime.Format(time.ANSIC)}
+	wHeader[headers.HeaderStartTime] = []string{headers.FormatTime(timestampNanos(startTime))}
+	wHeader[headers.HeaderEndTime] = []string{headers.FormatTime(timestampNanos(endTime))}
 	wHeader[headers.HeaderFileName] = []string{filename}
+	wHeader[headers.HeaderStartID] = []string{strconv.FormatUint(binary.LittleEndian.Uint64(data[0:]), 10)}
+	wHeader[headers.HeaderEndID] = []string{strconv.FormatUint(binary.LittleEndian.Uint64(data[(limit-1)*datEntryLength:]), 10)}
 	wHeader[headers.ContentType] = []string{"application/octet-stream"}
 	headers.SetSizes(sizes, wHeader)
+	headers.SetEventTimes(eventTimes, wHeader)
+
+	// there is no range to serve for batches without content, such as batches of redacted messages
+	if empty {
+		wHeader["Content-Length"] = []string{"0"}
+		w.WriteHeader(http.StatusOK)
+		return len(sizes), nil
+	}
 	rangeHeader := "bytes=" + strconv.FormatUint(startAt, 10) + "-" + strconv.FormatUint(endAt, 10)
 	wHeader["Range"] = []string{rangeHeader}
 
 	req := reqPool.Get().(*http.Request)
 	req.Header = wHeader
-	http.ServeContent(w, req, filename, endTime, f)
+	http.ServeContent(w, req, filename, time.Unix(0, int64(timestampNanos(endTime))), content)
 	reqPool.Put(req)
 	return len(sizes), nil
 }
+
+// serveRewritten serves the messages of the dat entries after rewriting them from the log content. The messages
+// are decrypted with the key of the segment if it is encrypted, then with the key of their subject if they have
+// one. Deleted messages and messages whose subject key was destroyed are sent without their content
+func (q *FileQueue) serveRewritten(w http.ResponseWriter, aead cipher.AEAD, subjectIDs [][subjectKeyIDLength]byte, deleted []bool, data []byte, eventTimes []uint64, limit int64, filename string, content io.ReadSeeker) (int, error) {
+	start := int64(binary.LittleEndian.Uint64(data[16:]))
+	last := data[(limit-1)*datEntryLength:]
+	end := int64(binary.LittleEndian.Uint64(last[16:]) + binary.LittleEndian.Uint64(last[24:]))
+	if _, err := content.Seek(start, io.SeekStart); err != nil {
+		return 0, err
+	}
+	stored := make([]byte, end-start)
+	if _, err := io.ReadFull(content, stored); err != nil {
+		return 0, errors.Wrap(err, "unable to read messages")
+	}
+
+	// the dat entries are rewritten with the offsets and sizes of the messages sent
+	var none [subjectKeyIDLength]byte
+	var redacted []bool
+	plain := make([]byte, 0, len(stored))
+	rewritten := make([]byte, len(data[:limit*datEntryLength]))
+	copy(rewritten, data)
+	for i := int64(0); i < limit; i++ {
+		entry := rewritten[i*datEntryLength:]
+		offset := int64(binary.LittleEndian.Uint64(entry[16:])) - start
+		size := int64(binary.LittleEndian.Uint64(entry[24:]))
+		if offset < 0 || offset+size > int64(len(stored)) {
+			return 0, errors.Errorf("invalid message %d", binary.LittleEndian.Uint64(entry))
+		}
+		msg := stored[offset : offset+size]
+		isDeleted := deleted != nil && deleted[i]
+		var err error
+		if isDeleted {
+			msg = nil
+		} else if aead != nil {
+			if msg, err = decryptMessage(aead, msg, entry[:8]); err != nil {
+				return 0, err
+			}
+		}
+		if !isDeleted && subjectIDs != nil && subjectIDs[i] != none {
+			subjectCipher, err := q.subjectCipher(subjectIDs[i])
+			if err != nil {
+				return 0, err
+			}
+			if subjectCipher == nil {
+				if redacted == nil {
+					redacted = make([]bool, limit)
+				}
+				redacted[i] = true
+				msg = nil
+			} else if msg, err = decryptMessage(subjectCipher, msg, entry[:8]); err != nil {
+				return 0, err
+			}
+		}
+		binary.LittleEndian.PutUint64(entry[16:], uint64(len(plain)))
+		binary.LittleEndian.PutUint64(entry[24:], uint64(len(msg)))
+		plain = append(plain, msg...)
+	}
+	headers.SetRedacted(redacted, w.Header())
+	headers.SetDeleted(deleted, w.Header())
+	return q.serveConsume(w, rewritten, eventTimes, limit, filename, bytes.NewReader(plain))
+}
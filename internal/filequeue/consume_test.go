@@ -53,7 +53,7 @@ func TestFileQueue_Consume(t *testing.T) {
 	if err = q.CreateTopic(topic); err != nil {
 		t.Error(err)
 	}
-	if err = q.Produce(topic, msgSizes, uint64(time.Now().Unix()), r); err != nil {
+	if _, err = q.Produce(topic, msgSizes, uint64(time.Now().UnixNano()), nil, nil, r); err != nil {
 		t.Error(err)
 	}
 	// consume
@@ -183,7 +183,7 @@ func TestFileQueue_Consume(t *testing.T) {
 		if _, err = r.Write(newInput); err != nil {
 			t.Error(err)
 		}
-		err = q.Produce(topic, []int64{int64(len(newInput))}, 0, r)
+		_, err = q.Produce(topic, []int64{int64(len(newInput))}, 0, nil, nil, r)
 		if err != nil {
 			t.Error(err)
 		}
@@ -215,3 +215,35 @@ func TestFileQueue_Consume(t *testing.T) {
 		}
 	}
 }
+
+func TestFileQueue_ConsumeBatchFile(t *testing.T) {
+	topic := "consume-batch"
+	_ = os.RemoveAll(".haraqa-consume-batch")
+	defer os.RemoveAll(".haraqa-consume-batch")
+	q, err := New(true, 2, ".haraqa-consume-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second batch is larger than the base id of its file, so ids within the file are relative to the base
+	if _, err = q.Produce(topic, []int64{1, 1, 1}, uint64(time.Now().UnixNano()), nil, nil, bytes.NewBufferString("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = q.Produce(topic, []int64{1, 1, 1, 1, 1, 1}, uint64(time.Now().UnixNano()), nil, nil, bytes.NewBufferString("defghi")); err != nil {
+		t.Fatal(err)
+	}
+	for id, expected := range map[int64]string{1: "bc", 3: "defghi", 4: "efghi", 8: "i"} {
+		w := httptest.NewRecorder()
+		n, err := q.Consume("", topic, id, -1, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := ioutil.ReadAll(w.Body); n != len(expected) || string(b) != expected {
+			t.Error(id, n, string(b))
+		}
+	}
+}
@@ -1,6 +1,138 @@
 package filequeue
 
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+const (
+	// consumersFileName is the file in each topic directory recording the committed offset of each consumer group
+	consumersFileName = ".consumers"
+
+	// consumerRecordLength is the length of a consumer offset record, excluding the group name
+	consumerRecordLength = 9
+
+	// maxGroupLength is the longest consumer group name which can be stored
+	maxGroupLength = 255
+)
+
+// consumerOffsets holds the committed offsets of the consumer groups of a topic
+type consumerOffsets struct {
+	mux     sync.Mutex
+	offsets map[string]int64
+	records int
+}
+
 // SetConsumerOffset sets the offset for a given consumer group + topic
 func (q *FileQueue) SetConsumerOffset(group, topic string, id int64) error {
+	if group == "" || len(group) > maxGroupLength {
+		return headers.ErrInvalidGroup
+	}
+	if id < 0 {
+		return headers.ErrInvalidMessageID
+	}
+	if _, err := q.fs.Stat(filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic)); err != nil {
+		if os.IsNotExist(err) {
+			return headers.ErrTopicDoesNotExist
+		}
+		return errors.Wrapf(err, "unable to stat topic %q", topic)
+	}
+
+	co, err := q.loadConsumerOffsets(topic)
+	if err != nil {
+		return err
+	}
+	co.mux.Lock()
+	defer co.mux.Unlock()
+	co.offsets[group] = id
+
+	// rewrite the file with only the latest offsets once enough records have been appended
+	if co.records >= compactRecords && co.records > 2*len(co.offsets) {
+		buf := bytes.NewBuffer(make([]byte, 0, len(co.offsets)*(consumerRecordLength+32)))
+		for g, offset := range co.offsets {
+			buf.Write(encodeConsumerRecord(g, offset))
+		}
+		if err = q.replaceTopicRecords(topic, consumersFileName, buf.Bytes()); err != nil {
+			return err
+		}
+		co.records = len(co.offsets)
+		return nil
+	}
+
+	if err = q.appendTopicRecord(topic, consumersFileName, encodeConsumerRecord(group, id)); err != nil {
+		return err
+	}
+	co.records++
 	return nil
 }
+
+// GetConsumerOffset returns the offset committed by the consumer group for the topic, or -1 if no offset has been committed
+func (q *FileQueue) GetConsumerOffset(group, topic string) (int64, error) {
+	if group == "" {
+		return -1, nil
+	}
+	co, err := q.loadConsumerOffsets(topic)
+	if err != nil {
+		return -1, err
+	}
+	co.mux.Lock()
+	defer co.mux.Unlock()
+	offset, ok := co.offsets[group]
+	if !ok {
+		return -1, nil
+	}
+	return offset, nil
+}
+
+// loadConsumerOffsets reads the consumer offsets of the topic, from the cache or the consumers file
+func (q *FileQueue) loadConsumerOffsets(topic string) (*consumerOffsets, error) {
+	if v, ok := q.consumerOffsets.Load(topic); ok {
+		return v.(*consumerOffsets), nil
+	}
+
+	co := &consumerOffsets{offsets: make(map[string]int64)}
+	data, err := q.readTopicRecords(topic, consumersFileName)
+	if err != nil {
+		return nil, err
+	}
+	for len(data) >= consumerRecordLength {
+		groupLength := int(data[consumerRecordLength-1])
+		if len(data) < consumerRecordLength+groupLength {
+			// partially written record
+			break
+		}
+		co.offsets[string(data[consumerRecordLength:consumerRecordLength+groupLength])] = int64(binary.LittleEndian.Uint64(data[0:8]))
+		co.records++
+		data = data[consumerRecordLength+groupLength:]
+	}
+
+	v, _ := q.consumerOffsets.LoadOrStore(topic, co)
+	return v.(*consumerOffsets), nil
+}
+
+// getGroupOffsetID returns the committed offset of the consumer group if the consumer did not request a specific id
+func (q *FileQueue) getGroupOffsetID(group, topic string, id int64) int64 {
+	if group == "" || id > 0 {
+		return id
+	}
+	offset, err := q.GetConsumerOffset(group, topic)
+	if err != nil || offset < 0 {
+		return id
+	}
+	return offset
+}
+
+func encodeConsumerRecord(group string, offset int64) []byte {
+	record := make([]byte, consumerRecordLength+len(group))
+	binary.LittleEndian.PutUint64(record[0:8], uint64(offset))
+	record[consumerRecordLength-1] = byte(len(group))
+	copy(record[consumerRecordLength:], group)
+	return record
+}
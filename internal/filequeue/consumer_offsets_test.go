@@ -0,0 +1,115 @@
+package filequeue
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haraqa/haraqa/internal/headers"
+	"github.com/pkg/errors"
+)
+
+func TestFileQueue_ConsumerOffsets(t *testing.T) {
+	topic := "offsets-topic"
+	group := "offsets-group"
+	_ = os.RemoveAll(".haraqa-offsets")
+	defer os.RemoveAll(".haraqa-offsets")
+	q, err := New(true, 5000, ".haraqa-offsets")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// invalid requests
+	if err = q.SetConsumerOffset(group, topic, 1); !errors.Is(err, headers.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+	if err = q.SetConsumerOffset("", topic, 1); !errors.Is(err, headers.ErrInvalidGroup) {
+		t.Error(err)
+	}
+	if err = q.SetConsumerOffset(strings.Repeat("a", maxGroupLength+1), topic, 1); !errors.Is(err, headers.ErrInvalidGroup) {
+		t.Error(err)
+	}
+	if err = q.SetConsumerOffset(group, topic, -1); !errors.Is(err, headers.ErrInvalidMessageID) {
+		t.Error(err)
+	}
+
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = q.Produce(topic, []int64{1, 1, 1, 1}, uint64(time.Now().UnixNano()), nil, nil, bytes.NewBufferString("abcd")); err != nil {
+		t.Fatal(err)
+	}
+	if offset, err := q.GetConsumerOffset(group, topic); err != nil || offset != -1 {
+		t.Error(offset, err)
+	}
+	if err = q.SetConsumerOffset(group, topic, 1); err != nil {
+		t.Error(err)
+	}
+	if err = q.SetConsumerOffset(group, topic, 2); err != nil {
+		t.Error(err)
+	}
+	if err = q.SetConsumerOffset("other", topic, 3); err != nil {
+		t.Error(err)
+	}
+
+	// consume from the committed offset
+	consume := func(q *FileQueue, group string, id int64, expected string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		n, err := q.Consume(group, topic, id, 1, w)
+		if err != nil || n != 1 {
+			t.Fatal(n, err)
+		}
+		if w.Body.String() != expected || w.Header().Get(headers.HeaderStartID) != w.Header().Get(headers.HeaderEndID) {
+			t.Error(w.Body.String(), w.Header())
+		}
+	}
+	consume(q, group, 0, "c")
+	consume(q, "other", 0, "d")
+	consume(q, group, 1, "b")
+	consume(q, "", 0, "a")
+	if err = q.Close(); err != nil {
+		t.Error(err)
+	}
+
+	// offsets are kept after a restart
+	q, err = New(true, 5000, ".haraqa-offsets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if offset, err := q.GetConsumerOffset(group, topic); err != nil || offset != 2 {
+		t.Error(offset, err)
+	}
+
+	// the consumers file is compacted
+	co, err := q.loadConsumerOffsets(topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	co.records = compactRecords
+	if err = q.SetConsumerOffset(group, topic, 3); err != nil {
+		t.Error(err)
+	}
+	if co.records != 2 {
+		t.Error(co.records)
+	}
+	q.consumerOffsets.Delete(topic)
+	if offset, err := q.GetConsumerOffset("other", topic); err != nil || offset != 3 {
+		t.Error(offset, err)
+	}
+	if offset, err := q.GetConsumerOffset(group, topic); err != nil || offset != 3 {
+		t.Error(offset, err)
+	}
+
+	// deleted topics forget their offsets
+	if err = q.DeleteTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.consumerOffsets.Load(topic); ok {
+		t.Error("expected offsets to be removed")
+	}
+}
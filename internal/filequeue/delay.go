@@ -0,0 +1,373 @@
+package filequeue
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// Messages can be produced with a deliver at time, to be held until that time before they are produced to their
+// topic. Each delayed batch is stored in the .delayed directory of each root directory, in a file named
+// <deliver at unix nanoseconds, zero padded to 19 digits>-<random hex id> so that the batches are listed in the
+// order they are due. A batch file holds:
+//
+//	[4 bytes topic length][topic][4 bytes key id length][key id][4 bytes message count]
+//	[8 bytes size of each message][8 bytes event time of each message][messages]
+//
+// Batches of a topic encrypted at rest are encrypted with the current key of the topic, whose id is stored in the
+// batch. Their messages are then stored as a random nonce followed by the ciphertext of the messages,
+// authenticated with the rest of the batch file
+//
+// A background goroutine produces the batches once they are due, with the time they are delivered at as their
+// timestamp, then removes their files. It is started when a batch is stored, or by OnDelivered if batches were
+// stored before the queue was opened. It is not started by the constructor, so that batches delivered after a
+// restart are produced with the options applied to the queue once it is built, such as its key provider. A batch
+// is delivered again if the queue stops between producing the batch and removing its files. Batches of a topic
+// deleted before they are due are dropped. A batch which fails to be delivered, such as one rejected by its topic,
+// is retried without holding back the batches due after it. After delayedAttempts failures it is moved to the
+// .delayed/failed directory of each root directory, where it is kept for inspection but no longer delivered
+const (
+	delayedDir        = ".delayed"
+	delayedFailedDir  = "failed"
+	delayedTimeDigits = 19
+	delayedRetry      = time.Second
+	delayedAttempts   = 5
+)
+
+// delayedFileName returns the name of the file of a delayed batch
+func delayedFileName(deliverAt time.Time) (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", errors.Wrap(err, "unable to generate delayed batch id")
+	}
+	v := strconv.FormatInt(deliverAt.UnixNano(), 10)
+	if len(v) < delayedTimeDigits {
+		v = strings.Repeat("0", delayedTimeDigits-len(v)) + v
+	}
+	return v + "-" + hex.EncodeToString(id), nil
+}
+
+// ProduceDelayed stores the messages, to be produced to the topic once deliverAt has passed
+func (q *FileQueue) ProduceDelayed(topic string, msgSizes []int64, deliverAt time.Time, eventTimes []uint64, r io.Reader) error {
+	if _, err := q.fs.Stat(filepath.Join(q.RootDir(), topic)); err != nil {
+		if os.IsNotExist(err) {
+			return headers.ErrTopicDoesNotExist
+		}
+		return err
+	}
+
+	keyID, key, err := q.currentKey(topic)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, size := range msgSizes {
+		total += size
+	}
+	n := len(msgSizes)
+	header := make([]byte, 12+len(topic)+len(keyID)+16*n)
+	binary.LittleEndian.PutUint32(header, uint32(len(topic)))
+	pos := 4 + copy(header[4:], topic)
+	binary.LittleEndian.PutUint32(header[pos:], uint32(len(keyID)))
+	pos += 4 + copy(header[pos+4:], keyID)
+	binary.LittleEndian.PutUint32(header[pos:], uint32(n))
+	pos += 4
+	for i, size := range msgSizes {
+		binary.LittleEndian.PutUint64(header[pos+i*8:], uint64(size))
+		if eventTimes != nil {
+			binary.LittleEndian.PutUint64(header[pos+(n+i)*8:], eventTimes[i])
+		}
+	}
+	msgs := make([]byte, total)
+	if _, err = io.ReadFull(r, msgs); err != nil {
+		return errors.Wrap(err, "unable to read delayed messages")
+	}
+
+	data := append(header, msgs...)
+	if keyID != "" {
+		// the messages are encrypted at rest while the batch waits to be delivered
+		aead, err := newCipher(key)
+		if err != nil {
+			return errors.Wrapf(err, "invalid current key of %q", topic)
+		}
+		data = make([]byte, len(header)+encryptionNonceSize, len(header)+int(total)+encryptionOverhead)
+		copy(data, header)
+		nonce := data[len(header):]
+		if _, err = rand.Read(nonce); err != nil {
+			return errors.Wrap(err, "unable to generate nonce")
+		}
+		data = aead.Seal(data, nonce, msgs, header)
+	}
+
+	name, err := delayedFileName(deliverAt)
+	if err != nil {
+		return err
+	}
+	for i, dir := range q.rootDirNames {
+		dir = filepath.Join(dir, delayedDir)
+		if err = q.fs.MkdirAll(dir, os.ModePerm); err != nil {
+			q.removeDelayed(name, i)
+			return errors.Wrapf(err, "unable to create delayed directory %q", dir)
+		}
+		// the batch is written to a temporary file first, so that a partly written batch is never delivered
+		path := filepath.Join(dir, name)
+		if err = writeFile(q.fs, path+".tmp", data, 0666); err == nil {
+			err = q.fs.Rename(path+".tmp", path)
+		}
+		if err != nil {
+			_ = q.fs.Remove(path + ".tmp")
+			q.removeDelayed(name, i)
+			return errors.Wrapf(err, "unable to write delayed batch %q", path)
+		}
+	}
+
+	q.startDelivery()
+	select {
+	case q.deliveryWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// OnDelivered sets the function called after delayed messages are produced to a topic, with the number produced.
+// It also starts the delivery of the batches stored before the queue was opened, so it should be called once the
+// queue is configured
+func (q *FileQueue) OnDelivered(fn func(topic string, n int)) {
+	q.delayMux.Lock()
+	q.delivered = fn
+	q.delayMux.Unlock()
+
+	if infos, err := readDir(q.fs, filepath.Join(q.RootDir(), delayedDir)); err == nil && len(infos) > 0 {
+		q.startDelivery()
+	}
+}
+
+// OnDeliveryFailed sets the function called when a delayed batch fails to be delivered
+func (q *FileQueue) OnDeliveryFailed(fn func(err error)) {
+	q.delayMux.Lock()
+	defer q.delayMux.Unlock()
+	q.deliveryFailed = fn
+}
+
+// startDelivery starts the background delivery of delayed batches, if it has not started
+func (q *FileQueue) startDelivery() {
+	q.deliveryOnce.Do(func() {
+		q.stopped.Add(1)
+		go func() {
+			defer q.stopped.Done()
+			timer := time.NewTimer(0)
+			defer timer.Stop()
+			for {
+				select {
+				case <-q.deliveryStop:
+					return
+				case <-q.deliveryWake:
+				case <-timer.C:
+				}
+				next, err := q.deliverDelayed(time.Now())
+				if err != nil {
+					// batches which fail to be delivered are retried
+					if retry := time.Now().Add(delayedRetry); next.IsZero() || retry.Before(next) {
+						next = retry
+					}
+				}
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				if !next.IsZero() {
+					timer.Reset(time.Until(next))
+				}
+			}
+		}()
+	})
+}
+
+// deliverDelayed produces the delayed batches due by now to their topics. It returns the time the next batch
+// is due, or the zero time if no batch is left, along with the first error of the batches which failed
+func (q *FileQueue) deliverDelayed(now time.Time) (time.Time, error) {
+	q.delayMux.Lock()
+	defer q.delayMux.Unlock()
+
+	infos, err := readDir(q.fs, filepath.Join(q.RootDir(), delayedDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, errors.Wrap(err, "unable to read delayed directory")
+	}
+	var failed error
+	for _, info := range infos {
+		name := info.Name()
+		if len(name) < delayedTimeDigits || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		nanos, err := strconv.ParseInt(name[:delayedTimeDigits], 10, 64)
+		if err != nil {
+			continue
+		}
+		if deliverAt := time.Unix(0, nanos); deliverAt.After(now) {
+			return deliverAt, failed
+		}
+		if err = q.deliverBatch(name, now); err != nil {
+			err = errors.Wrapf(err, "unable to deliver delayed batch %q", name)
+			q.failBatch(name, err)
+			if failed == nil {
+				failed = err
+			}
+			continue
+		}
+		delete(q.deliveryAttempts, name)
+	}
+	return time.Time{}, failed
+}
+
+// failBatch reports a failed delivery of a batch, and moves the batch aside once it has failed delayedAttempts
+// times. The delay lock must be held
+func (q *FileQueue) failBatch(name string, err error) {
+	if q.deliveryAttempts == nil {
+		q.deliveryAttempts = make(map[string]int)
+	}
+	q.deliveryAttempts[name]++
+	if q.deliveryAttempts[name] >= delayedAttempts {
+		delete(q.deliveryAttempts, name)
+		for _, dir := range q.rootDirNames {
+			failedDir := filepath.Join(dir, delayedDir, delayedFailedDir)
+			moveErr := q.fs.MkdirAll(failedDir, os.ModePerm)
+			if moveErr == nil {
+				moveErr = q.fs.Rename(filepath.Join(dir, delayedDir, name), filepath.Join(failedDir, name))
+			}
+			if moveErr != nil && !os.IsNotExist(moveErr) {
+				err = errors.Wrapf(err, "unable to move batch aside: %v", moveErr)
+			}
+		}
+		err = errors.Wrapf(err, "batch moved to %s after %d attempts", delayedFailedDir, delayedAttempts)
+	}
+	if q.deliveryFailed != nil {
+		q.deliveryFailed(err)
+	}
+}
+
+// deliverBatch produces a delayed batch to its topic and removes its files, the delay lock must be held
+func (q *FileQueue) deliverBatch(name string, now time.Time) error {
+	data, err := readFile(q.fs, filepath.Join(q.RootDir(), delayedDir, name))
+	if err != nil {
+		return err
+	}
+	b, err := parseDelayedBatch(data)
+	if err != nil {
+		// a corrupt batch can never be delivered
+		q.removeDelayed(name, len(q.rootDirNames))
+		return err
+	}
+	body := b.msgs
+	if b.keyID != "" {
+		aead, err := q.segmentCipher(b.topic, b.keyID)
+		if err != nil {
+			return err
+		}
+		if body, err = aead.Open(nil, b.msgs[:encryptionNonceSize], b.msgs[encryptionNonceSize:], b.header); err != nil {
+			return errors.Wrap(err, "unable to decrypt delayed batch")
+		}
+	}
+	_, err = q.Produce(b.topic, b.sizes, uint64(now.UnixNano()), b.eventTimes, nil, bytes.NewReader(body))
+	if errors.Cause(err) == headers.ErrTopicDoesNotExist {
+		q.removeDelayed(name, len(q.rootDirNames))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	q.removeDelayed(name, len(q.rootDirNames))
+	if q.delivered != nil {
+		q.delivered(b.topic, len(b.sizes))
+	}
+	return nil
+}
+
+// delayedBatch is a batch read from its file
+type delayedBatch struct {
+	topic      string
+	keyID      string
+	sizes      []int64
+	eventTimes []uint64
+	// header is the part of the file before the messages, which authenticates the messages of an encrypted batch
+	header []byte
+	// msgs are the messages, or the nonce and ciphertext of the messages if the batch is encrypted
+	msgs []byte
+}
+
+// parseDelayedBatch reads the topic and messages of a delayed batch file
+func parseDelayedBatch(data []byte) (*delayedBatch, error) {
+	errInvalid := errors.New("invalid delayed batch")
+	b := &delayedBatch{}
+	pos := int64(0)
+	readString := func() (string, bool) {
+		if int64(len(data)) < pos+4 {
+			return "", false
+		}
+		n := int64(binary.LittleEndian.Uint32(data[pos:]))
+		if int64(len(data)) < pos+4+n {
+			return "", false
+		}
+		v := string(data[pos+4 : pos+4+n])
+		pos += 4 + n
+		return v, true
+	}
+	var ok bool
+	if b.topic, ok = readString(); !ok {
+		return nil, errInvalid
+	}
+	if b.keyID, ok = readString(); !ok {
+		return nil, errInvalid
+	}
+	if int64(len(data)) < pos+4 {
+		return nil, errInvalid
+	}
+	n := int64(binary.LittleEndian.Uint32(data[pos:]))
+	pos += 4
+	if n == 0 || (int64(len(data))-pos)/16 < n {
+		return nil, errInvalid
+	}
+	b.sizes = make([]int64, n)
+	var total int64
+	for i := range b.sizes {
+		b.sizes[i] = int64(binary.LittleEndian.Uint64(data[pos+int64(i)*8:]))
+		total += b.sizes[i]
+		if t := binary.LittleEndian.Uint64(data[pos+(n+int64(i))*8:]); t != 0 {
+			if b.eventTimes == nil {
+				b.eventTimes = make([]uint64, n)
+			}
+			b.eventTimes[i] = t
+		}
+	}
+	pos += 16 * n
+	b.header, b.msgs = data[:pos], data[pos:]
+	if b.keyID != "" {
+		total += encryptionOverhead
+	}
+	if int64(len(b.msgs)) != total {
+		return nil, errInvalid
+	}
+	return b, nil
+}
+
+// removeDelayed removes the file of a delayed batch from the first n root directories
+func (q *FileQueue) removeDelayed(name string, n int) {
+	for _, dir := range q.rootDirNames[:n] {
+		_ = q.fs.Remove(filepath.Join(dir, delayedDir, name))
+	}
+}
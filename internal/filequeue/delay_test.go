@@ -0,0 +1,291 @@
+package filequeue
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestFileQueue_ProduceDelayed(t *testing.T) {
+	const topic = "delayed"
+	fs := NewMemFS()
+	q, err := NewWithOptions(true, 10, []string{"a", "b"}, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mux sync.Mutex
+	delivered := map[string]int{}
+	q.OnDelivered(func(topic string, n int) {
+		mux.Lock()
+		defer mux.Unlock()
+		delivered[topic] += n
+	})
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	consume := func(id int64, expected string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		if _, err := q.Consume("", topic, id, -1, w); err != nil {
+			t.Fatal(err)
+		}
+		if body, _ := ioutil.ReadAll(w.Body); string(body) != expected {
+			t.Error(id, string(body))
+		}
+	}
+
+	// delayed batches are stored in each root directory, which is not listed as a topic
+	now := time.Now()
+	if err = q.ProduceDelayed("missing", []int64{1}, now.Add(time.Hour), nil, bytes.NewBufferString("a")); err != headers.ErrTopicDoesNotExist {
+		t.Error(err)
+	}
+	eventTime := uint64(time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC).UnixNano())
+	if err = q.ProduceDelayed(topic, []int64{5, 6}, now.Add(2*time.Hour), []uint64{0, eventTime}, bytes.NewBufferString("laterbatch!")); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.ProduceDelayed(topic, []int64{5}, now.Add(time.Hour), nil, bytes.NewBufferString("first")); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"a", "b"} {
+		if infos, err := readDir(fs, filepath.Join(dir, delayedDir)); err != nil || len(infos) != 2 {
+			t.Error(dir, len(infos), err)
+		}
+	}
+	if topics, err := q.ListTopics("", "", ""); err != nil || len(topics) != 1 || topics[0] != topic {
+		t.Error(topics, err)
+	}
+
+	// batches are produced once due, in the order they are due
+	if next, err := q.deliverDelayed(now); err != nil || !next.Equal(now.Add(time.Hour)) {
+		t.Error(next, err)
+	}
+	if info, err := q.GetTopicInfo(topic); err != nil || info.MaxOffset != -1 {
+		t.Error(info, err)
+	}
+	if next, err := q.deliverDelayed(now.Add(time.Hour)); err != nil || !next.Equal(now.Add(2*time.Hour)) {
+		t.Error(next, err)
+	}
+	consume(0, "first")
+	if _, err = q.Produce(topic, []int64{3}, 0, nil, nil, bytes.NewBufferString("now")); err != nil {
+		t.Fatal(err)
+	}
+	if next, err := q.deliverDelayed(now.Add(3 * time.Hour)); err != nil || !next.IsZero() {
+		t.Error(next, err)
+	}
+	consume(1, "nowlaterbatch!")
+	w := httptest.NewRecorder()
+	if _, err = q.Consume("", topic, 2, -1, w); err != nil {
+		t.Fatal(err)
+	}
+	if eventTimes, err := headers.ReadEventTimes(w.Header()); err != nil || len(eventTimes) != 2 || eventTimes[0] != 0 || eventTimes[1] != eventTime {
+		t.Error(eventTimes, err)
+	}
+	for _, dir := range []string{"a", "b"} {
+		if infos, err := readDir(fs, filepath.Join(dir, delayedDir)); err != nil || len(infos) != 0 {
+			t.Error(dir, len(infos), err)
+		}
+	}
+	mux.Lock()
+	if delivered[topic] != 3 {
+		t.Error(delivered)
+	}
+	mux.Unlock()
+
+	// batches of deleted topics and corrupt batches are dropped
+	if err = q.CreateTopic("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.ProduceDelayed("deleted", []int64{1}, now.Add(time.Hour), nil, bytes.NewBufferString("d")); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.DeleteTopic("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	if err = writeFile(fs, filepath.Join("b", delayedDir, "0000000000000000001-corrupt"), []byte("corrupt"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	// the corrupt batch may be dropped by the background delivery first
+	_, _ = q.deliverDelayed(now.Add(time.Hour))
+	if next, err := q.deliverDelayed(now.Add(time.Hour)); err != nil || !next.IsZero() {
+		t.Error(next, err)
+	}
+	if infos, err := readDir(fs, filepath.Join("a", delayedDir)); err != nil || len(infos) != 0 {
+		t.Error(len(infos), err)
+	}
+	if err = q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// batches stored before a restart are delivered once due
+	if err = q.ProduceDelayed(topic, []int64{7}, time.Now(), nil, bytes.NewBufferString("closed!")); err != nil {
+		t.Fatal(err)
+	}
+	if infos, err := readDir(fs, filepath.Join("a", delayedDir)); err != nil || len(infos) != 1 {
+		t.Fatal(len(infos), err)
+	}
+	q, err = NewWithOptions(true, 10, []string{"a", "b"}, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	// delivery waits for the queue to be configured, which ends with OnDelivered
+	time.Sleep(50 * time.Millisecond)
+	if info, err := q.GetTopicInfo(topic); err != nil || info.MaxOffset != 3 {
+		t.Fatal(info, err)
+	}
+	restarted := make(chan int, 1)
+	q.OnDelivered(func(topic string, n int) { restarted <- n })
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if info, err := q.GetTopicInfo(topic); err == nil && info.MaxOffset == 4 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("delayed batch was not delivered")
+		}
+	}
+	consume(4, "closed!")
+	if n := <-restarted; n != 1 {
+		t.Error(n)
+	}
+}
+
+func TestFileQueue_ProduceDelayedEncrypted(t *testing.T) {
+	const topic = "encrypted"
+	fs := NewMemFS()
+	keys := &testKeys{
+		current: map[string]string{topic: "k1"},
+		keys:    map[string][]byte{"k1": bytes.Repeat([]byte{1}, 16), "k2": bytes.Repeat([]byte{2}, 32)},
+	}
+	q, err := NewWithOptions(true, 10, []string{"a", "b"}, WithFS(fs), WithKeyProvider(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+
+	// delayed batches of encrypted topics are encrypted with the current key of the topic while they wait
+	now := time.Now()
+	if err = q.ProduceDelayed(topic, []int64{6, 8}, now.Add(time.Hour), nil, bytes.NewBufferString("secretmessages")); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.ProduceDelayed(topic, []int64{8}, now.Add(2*time.Hour), nil, bytes.NewBufferString("tampered")); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, dir := range []string{"a", "b"} {
+		infos, err := readDir(fs, filepath.Join(dir, delayedDir))
+		if err != nil || len(infos) != 2 {
+			t.Fatal(dir, len(infos), err)
+		}
+		for _, info := range infos {
+			data, err := readFile(fs, filepath.Join(dir, delayedDir, info.Name()))
+			if err != nil || bytes.Contains(data, []byte("secret")) || bytes.Contains(data, []byte("tampered")) {
+				t.Error(string(data), err)
+			}
+			names = append(names, info.Name())
+		}
+	}
+
+	// batches are decrypted with the key they were stored with, and produced with the current key
+	keys.current[topic] = "k2"
+	if next, err := q.deliverDelayed(now.Add(time.Hour)); err != nil || !next.Equal(now.Add(2*time.Hour)) {
+		t.Fatal(next, err)
+	}
+	w := httptest.NewRecorder()
+	if _, err = q.Consume("", topic, 0, -1, w); err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(w.Body); string(body) != "secretmessages" {
+		t.Error(string(body))
+	}
+	if id, err := readFile(fs, filepath.Join("a", topic, formatName(0)+segmentKeyExt)); err != nil || string(id) != "k2" {
+		t.Error(string(id), err)
+	}
+
+	// a batch which fails authentication is not delivered
+	path := filepath.Join(q.RootDir(), delayedDir, names[1])
+	data, err := readFile(fs, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[4]++
+	if err = writeFile(fs, path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = q.deliverDelayed(now.Add(2 * time.Hour)); err == nil {
+		t.Error("expected the tampered batch to fail decryption")
+	}
+	if info, err := q.GetTopicInfo(topic); err != nil || info.MaxOffset != 1 {
+		t.Error(info, err)
+	}
+}
+
+func TestFileQueue_DeliveryFailed(t *testing.T) {
+	fs := NewMemFS()
+	keys := &testKeys{
+		current: map[string]string{"encrypted": "k1"},
+		keys:    map[string][]byte{"k1": bytes.Repeat([]byte{1}, 16)},
+	}
+	q, err := NewWithOptions(true, 10, []string{"a", "b"}, WithFS(fs), WithKeyProvider(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	var failures []error
+	q.OnDeliveryFailed(func(err error) { failures = append(failures, err) })
+	for _, topic := range []string{"encrypted", "plain"} {
+		if err = q.CreateTopic(topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	if err = q.ProduceDelayed("encrypted", []int64{4}, now.Add(time.Hour), nil, bytes.NewBufferString("lost")); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.ProduceDelayed("plain", []int64{4}, now.Add(2*time.Hour), nil, bytes.NewBufferString("kept")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a batch which cannot be delivered does not hold back the batches due after it
+	delete(keys.keys, "k1")
+	if next, err := q.deliverDelayed(now.Add(3 * time.Hour)); err == nil || !next.IsZero() {
+		t.Fatal(next, err)
+	}
+	if info, err := q.GetTopicInfo("plain"); err != nil || info.MaxOffset != 0 {
+		t.Error(info, err)
+	}
+	if len(failures) != 1 {
+		t.Error(failures)
+	}
+
+	// the batch is moved aside once it has failed too many times
+	for i := 1; i < delayedAttempts; i++ {
+		if _, err = q.deliverDelayed(now.Add(3 * time.Hour)); err == nil {
+			t.Error("expected failed delivery")
+		}
+	}
+	if len(failures) != delayedAttempts || !strings.Contains(failures[delayedAttempts-1].Error(), "moved to failed") {
+		t.Error(failures)
+	}
+	if next, err := q.deliverDelayed(now.Add(3 * time.Hour)); err != nil || !next.IsZero() {
+		t.Error(next, err)
+	}
+	for _, dir := range []string{"a", "b"} {
+		if infos, err := readDir(fs, filepath.Join(dir, delayedDir, delayedFailedDir)); err != nil || len(infos) != 1 {
+			t.Error(dir, len(infos), err)
+		}
+	}
+	if info, err := q.GetTopicInfo("encrypted"); err != nil || info.MaxOffset != -1 {
+		t.Error(info, err)
+	}
+}
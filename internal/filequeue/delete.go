@@ -0,0 +1,283 @@
+package filequeue
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// Messages can be deleted by id, such as to take down their content. The <base>.del file of a segment holds a
+// byte per message, 1 if the message is deleted, and is only written once a message of the segment is deleted.
+// Deleted messages keep their ids and are consumed as messages without content.
+//
+// The content of deleted messages is reclaimed in the background, by rewriting the dat and log files of the
+// segment without it in each root directory. The dat entries of reclaimed messages have a size of 0, a deleted
+// message with a size is still to be reclaimed. Segments are rewritten while holding the rewrite lock of the
+// topic, which consumers hold while reading a segment so that they never read a dat file and a log file from
+// different rewrites. Deletions left unreclaimed by a restart are reclaimed once messages of the topic are
+// deleted again
+const deletedExt = ".del"
+
+// rewriteLock returns the lock held to replace the files of the segments of a topic
+func (q *FileQueue) rewriteLock(topic string) *sync.RWMutex {
+	mux, ok := q.rewriteLocks.Load(topic)
+	if !ok {
+		mux, _ = q.rewriteLocks.LoadOrStore(topic, &sync.RWMutex{})
+	}
+	return mux.(*sync.RWMutex)
+}
+
+// deleteMessages marks the messages of the id ranges as deleted in each root directory, the produce lock of the
+// topic must be held. It returns true if a message was marked
+func (q *FileQueue) deleteMessages(topic string, idx *segmentIndex, ranges []headers.IDRange) (bool, error) {
+	var marked bool
+	for _, base := range idx.all() {
+		stat, err := q.fs.Stat(filepath.Join(q.RootDir(), topic, formatName(base)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return marked, err
+		}
+		last := base + stat.Size()/datEntryLength - 1
+		for _, r := range ranges {
+			start, end := r.Start, r.End
+			if start < base {
+				start = base
+			}
+			if end > last {
+				end = last
+			}
+			if start > end {
+				continue
+			}
+			flags := make([]byte, end-start+1)
+			for i := range flags {
+				flags[i] = 1
+			}
+			if err = q.writeDeleted(topic, base, start-base, flags); err != nil {
+				return marked, err
+			}
+			marked = true
+		}
+	}
+	return marked, nil
+}
+
+// writeDeleted writes the deleted flags of the messages of a segment, starting from the message at the given
+// position, in each root directory
+func (q *FileQueue) writeDeleted(topic string, base, pos int64, flags []byte) error {
+	for _, dir := range q.rootDirNames {
+		path := filepath.Join(dir, topic, formatName(base)+deletedExt)
+		f, err := q.fs.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			return errors.Wrapf(err, "unable to open/create file %q", path)
+		}
+		_, err = f.WriteAt(flags, pos)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return errors.Wrapf(err, "unable to write to file %q", path)
+		}
+	}
+	return nil
+}
+
+// readDeleted reads whether n messages of the segment are deleted, starting from the message at the given
+// position. Nil is returned if no message is deleted
+func (q *FileQueue) readDeleted(datPath string, pos, n int64) ([]bool, error) {
+	f, err := q.fs.Open(datPath + deletedExt)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, n)
+	length, err := f.ReadAt(data, pos)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	var deleted []bool
+	for i, flag := range data[:length] {
+		if flag == 0 {
+			continue
+		}
+		if deleted == nil {
+			deleted = make([]bool, n)
+		}
+		deleted[i] = true
+	}
+	return deleted, nil
+}
+
+// unreclaimed returns true if a deleted message of the dat entries still has content in the log
+func unreclaimed(data []byte, deleted []bool) bool {
+	for i := range deleted {
+		if deleted[i] && binary.LittleEndian.Uint64(data[i*datEntryLength+24:]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// startReclaim reclaims the deleted messages of the topic in the background, Close waits for it to finish
+func (q *FileQueue) startReclaim(topic string) {
+	q.reclaims.Add(1)
+	go func() {
+		defer q.reclaims.Done()
+		// segments which fail to be rewritten are retried when messages of the topic are deleted again
+		_ = q.reclaimDeleted(topic)
+	}()
+}
+
+// reclaimDeleted rewrites the segments of the topic holding deleted messages which still have content
+func (q *FileQueue) reclaimDeleted(topic string) error {
+	idx, err := q.loadIndex(topic)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load segment index for %q", topic)
+	}
+	var firstErr error
+	for _, base := range idx.all() {
+		if err = q.reclaimSegment(topic, base); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "unable to reclaim segment %d of %q", base, topic)
+		}
+	}
+	return firstErr
+}
+
+// reclaimSegment rewrites the dat and log files of a segment without the content of its deleted messages. The
+// new files are written next to the files they replace in each root directory, then renamed into place
+func (q *FileQueue) reclaimSegment(topic string, base int64) error {
+	// hold the produce lock, so that the segment is not written to or removed while it is rewritten, and the
+	// compression lock so that the log is not replaced by a compressed log of the previous content
+	mux := q.produceLock(topic)
+	mux.Lock()
+	defer mux.Unlock()
+	q.compressMux.Lock()
+	defer q.compressMux.Unlock()
+
+	path := filepath.Join(q.RootDir(), topic, formatName(base))
+	data, err := readFile(q.fs, path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	n := int64(len(data)) / datEntryLength
+	data = data[:n*datEntryLength]
+	deleted, err := q.readDeleted(path, 0, n)
+	if err != nil || !unreclaimed(data, deleted) {
+		return err
+	}
+	log, err := q.readLog(path, data)
+	if err != nil {
+		return err
+	}
+
+	// the messages which are kept are moved down over the content of the deleted messages
+	var offset uint64
+	kept := log[:0]
+	for i := int64(0); i < n; i++ {
+		entry := data[i*datEntryLength:]
+		start := binary.LittleEndian.Uint64(entry[16:])
+		size := binary.LittleEndian.Uint64(entry[24:])
+		if deleted[i] {
+			size = 0
+		}
+		kept = append(kept, log[start:start+size]...)
+		binary.LittleEndian.PutUint64(entry[16:], offset)
+		binary.LittleEndian.PutUint64(entry[24:], size)
+		offset += size
+	}
+
+	for _, dir := range q.rootDirNames {
+		p := filepath.Join(dir, topic, formatName(base))
+		if err = writeFile(q.fs, p+".tmp", data, 0666); err == nil {
+			err = writeFile(q.fs, p+".log.tmp", kept, 0666)
+		}
+		if err != nil {
+			q.removeReclaimFiles(topic, base)
+			return err
+		}
+	}
+
+	rw := q.rewriteLock(topic)
+	rw.Lock()
+	defer rw.Unlock()
+	for _, dir := range q.rootDirNames {
+		p := filepath.Join(dir, topic, formatName(base))
+		if err = q.fs.Rename(p+".log.tmp", p+".log"); err == nil {
+			err = q.fs.Rename(p+".tmp", p)
+		}
+		if err == nil {
+			err = q.fs.Remove(p + compressedLogExt)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		}
+		if err != nil {
+			q.removeReclaimFiles(topic, base)
+			return errors.Wrapf(err, "unable to replace segment %q", p)
+		}
+	}
+
+	// the cached produce files and the tail of the topic hold the previous offsets
+	if q.produceCache != nil {
+		if pf := q.produceCache.Delete(topic); pf != nil {
+			closeCachedFiles(pf)
+		}
+	}
+	if q.tails != nil {
+		q.clearTail(topic)
+	}
+	return nil
+}
+
+// readLog reads the content of the log of a segment up to the end of the last of its dat entries, from the log
+// file or the compressed log of a sealed segment
+func (q *FileQueue) readLog(path string, data []byte) ([]byte, error) {
+	var content io.ReadSeeker
+	f, err := q.fs.Open(path + ".log")
+	if os.IsNotExist(err) {
+		l, zErr := openCompressedLog(q.fs, path+compressedLogExt)
+		if zErr != nil {
+			if os.IsNotExist(zErr) {
+				return nil, err
+			}
+			return nil, zErr
+		}
+		defer l.Close()
+		content = l
+	} else if err != nil {
+		return nil, err
+	} else {
+		defer f.Close()
+		content = f
+	}
+
+	last := data[len(data)-datEntryLength:]
+	log := make([]byte, binary.LittleEndian.Uint64(last[16:])+binary.LittleEndian.Uint64(last[24:]))
+	if _, err = io.ReadFull(content, log); err != nil {
+		return nil, errors.Wrapf(err, "unable to read log of %q", path)
+	}
+	return log, nil
+}
+
+// removeReclaimFiles removes the files written to rewrite a segment, after the rewrite failed
+func (q *FileQueue) removeReclaimFiles(topic string, base int64) {
+	for _, dir := range q.rootDirNames {
+		p := filepath.Join(dir, topic, formatName(base))
+		_ = q.fs.Remove(p + ".tmp")
+		_ = q.fs.Remove(p + ".log.tmp")
+	}
+}
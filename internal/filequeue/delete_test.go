@@ -0,0 +1,144 @@
+package filequeue
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestFileQueue_DeleteMessages(t *testing.T) {
+	const topic, encrypted = "deleted", "encrypted"
+	fs := NewFaultFS(NewMemFS())
+	keys := &testKeys{
+		current: map[string]string{encrypted: "k1"},
+		keys:    map[string][]byte{"k1": bytes.Repeat([]byte{1}, 16)},
+	}
+	q, err := NewWithOptions(true, 3, []string{"a", "b"}, WithFS(fs), WithKeyProvider(keys), WithTailCache(1024),
+		WithCompression(Compression{Format: CompressionFlate, Interval: time.Hour}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	msgs := []string{"first", "second", "third message", "fourth", "fifth message", "sixth", "seventh"}
+	for _, name := range []string{topic, encrypted} {
+		if err = q.CreateTopic(name); err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range msgs {
+			if _, err = q.Produce(name, []int64{int64(len(msg))}, 0, nil, nil, bytes.NewBufferString(msg)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err = q.compressSegments(); err != nil {
+		t.Fatal(err)
+	}
+	consume := func(topic string, id, limit int64, expected ...string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		n, err := q.Consume("", topic, id, limit, w)
+		if err != nil || n != len(expected) {
+			t.Fatal(topic, id, n, err)
+		}
+		if body, _ := ioutil.ReadAll(w.Body); string(body) != strings.Join(expected, "") {
+			t.Error(topic, id, string(body))
+		}
+		deleted, err := headers.ReadDeleted(w.Header())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range expected {
+			if (deleted != nil && deleted[i]) != (expected[i] == "") {
+				t.Error(topic, id, deleted, expected)
+			}
+		}
+	}
+
+	// invalid ranges are rejected before any message is deleted
+	if _, err = q.ModifyTopic(topic, headers.ModifyRequest{Delete: []headers.IDRange{{Start: 0, End: 0}, {Start: -1, End: 2}}}); err != headers.ErrInvalidDeleteRange {
+		t.Error(err)
+	}
+	if _, err = q.ModifyTopic("missing", headers.ModifyRequest{Delete: []headers.IDRange{{Start: 0, End: 0}}}); err == nil {
+		t.Error("expected missing topic")
+	}
+	consume(topic, 0, -1, msgs[:3]...)
+
+	// deleted messages are consumed without content once marked, and their content is reclaimed in the background
+	ranges := []headers.IDRange{{Start: 1, End: 1}, {Start: 4, End: 6}}
+	for _, name := range []string{topic, encrypted} {
+		info, err := q.ModifyTopic(name, headers.ModifyRequest{Delete: ranges})
+		if err != nil || info.MinOffset != 0 || info.MaxOffset != 6 {
+			t.Fatal(info, err)
+		}
+	}
+	q.reclaims.Wait()
+	for _, name := range []string{topic, encrypted} {
+		consume(name, 0, -1, "first", "", "third message")
+		consume(name, 1, 1, "")
+		consume(name, 3, -1, "fourth", "", "")
+		consume(name, 6, -1, "")
+	}
+	for _, dir := range []string{"a", "b"} {
+		for base, kept := range map[int64][]string{0: {"first", "third message"}, 3: {"fourth"}, 6: nil} {
+			path := dir + "/" + topic + "/" + formatName(base)
+			if log, err := readFile(fs, path+".log"); err != nil || string(log) != strings.Join(kept, "") {
+				t.Error(path, string(log), err)
+			}
+			if _, err = fs.Stat(path + compressedLogExt); !os.IsNotExist(err) {
+				t.Error(path, err)
+			}
+			if _, err = fs.Stat(path + ".tmp"); !os.IsNotExist(err) {
+				t.Error(path, err)
+			}
+			path = dir + "/" + encrypted + "/" + formatName(base)
+			if log, err := readFile(fs, path+".log"); err != nil || len(log) != len(strings.Join(kept, ""))+len(kept)*encryptionOverhead {
+				t.Error(path, len(log), err)
+			}
+		}
+	}
+
+	// ids are kept, producing continues after the reclaimed segments
+	if info, err := q.GetTopicInfo(topic); err != nil || info.MinOffset != 0 || info.MaxOffset != 6 {
+		t.Error(info, err)
+	}
+	for _, name := range []string{topic, encrypted} {
+		if info, err := q.Produce(name, []int64{5}, 0, nil, nil, bytes.NewBufferString("eight")); err != nil || info.StartID != 7 {
+			t.Fatal(info, err)
+		}
+		consume(name, 6, -1, "", "eight")
+		consume(name, 7, -1, "eight")
+	}
+
+	// a failed rewrite leaves the segment as it was, and is retried when messages are deleted again
+	fs.Inject(Fault{Op: FaultRename, Path: ".log.tmp", Err: syscall.EIO, Times: 1})
+	if _, err = q.ModifyTopic(topic, headers.ModifyRequest{Delete: []headers.IDRange{{Start: 0, End: 0}}}); err != nil {
+		t.Fatal(err)
+	}
+	q.reclaims.Wait()
+	consume(topic, 0, -1, "", "", "third message")
+	for _, dir := range []string{"a", "b"} {
+		path := dir + "/" + topic + "/" + formatName(0)
+		if log, err := readFile(fs, path+".log"); err != nil || string(log) != "firstthird message" {
+			t.Error(path, string(log), err)
+		}
+		if _, err = fs.Stat(path + ".log.tmp"); !os.IsNotExist(err) {
+			t.Error(path, err)
+		}
+	}
+	if _, err = q.ModifyTopic(topic, headers.ModifyRequest{Delete: []headers.IDRange{{Start: 2, End: 2}}}); err != nil {
+		t.Fatal(err)
+	}
+	q.reclaims.Wait()
+	consume(topic, 0, -1, "", "", "")
+	if log, err := readFile(fs, "b/"+topic+"/"+formatName(0)+".log"); err != nil || len(log) != 0 {
+		t.Error(string(log), err)
+	}
+}
@@ -0,0 +1,230 @@
+package filequeue
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// The messages of encrypted topics are encrypted at rest with AES-GCM. The key a segment is encrypted with is
+// chosen when the segment is started, and its id is stored in the <base>.key file of the segment. A segment
+// without a key file is not encrypted. Each message is stored in the log as:
+//
+//	random nonce
+//	ciphertext, authenticated with the id of the message
+//
+// Dat entries hold the offsets and sizes of the encrypted messages. Consumers are sent the decrypted messages,
+// the raw files served by the server are the files as stored and only hold ciphertext
+const (
+	segmentKeyExt       = ".key"
+	encryptionNonceSize = 12
+	encryptionOverhead  = encryptionNonceSize + 16
+)
+
+// KeyProvider provides the keys of the topics encrypted at rest. Keys are rotated by changing the current key
+// of a topic, new segments are encrypted with the current key while the keys of older segments must still be
+// provided to consume them
+type KeyProvider interface {
+	// CurrentKey returns the id and the key new segments of the topic are encrypted with. An empty id is
+	// returned if the topic is not encrypted
+	CurrentKey(topic string) (string, []byte, error)
+	// Key returns the key with the given id, used to decrypt the segments of the topic encrypted with it
+	Key(topic, id string) ([]byte, error)
+}
+
+// KeyFile is a KeyProvider reading its keys from a json file, of the form:
+//
+//	{
+//	  "keys": {"<id>": "<base64 encoded 16, 24 or 32 byte key>"},
+//	  "topics": {"<topic>": "<id of the current key>"}
+//	}
+//
+// Keys are rotated by adding a key to the file, setting it as the current key of the topic and reloading it
+type KeyFile struct {
+	mux    sync.RWMutex
+	path   string
+	keys   map[string][]byte
+	topics map[string]string
+}
+
+// NewKeyFile loads the keys of the json file at path
+func NewKeyFile(path string) (*KeyFile, error) {
+	k := &KeyFile{path: path}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload reads the keys of the file again, the previous keys are kept if the file is invalid
+func (k *KeyFile) Reload() error {
+	data, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		return errors.Wrap(err, "unable to read key file")
+	}
+	var file struct {
+		Keys   map[string]string `json:"keys"`
+		Topics map[string]string `json:"topics"`
+	}
+	if err = json.Unmarshal(data, &file); err != nil {
+		return errors.Wrap(err, "invalid key file")
+	}
+	keys := make(map[string][]byte, len(file.Keys))
+	for id, encoded := range file.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return errors.Wrapf(err, "invalid key %q", id)
+		}
+		if _, err = aes.NewCipher(key); err != nil {
+			return errors.Wrapf(err, "invalid key %q", id)
+		}
+		keys[id] = key
+	}
+	for topic, id := range file.Topics {
+		if _, ok := keys[id]; !ok || id == "" {
+			return errors.Errorf("unknown key %q of topic %q", id, topic)
+		}
+	}
+
+	k.mux.Lock()
+	k.keys, k.topics = keys, file.Topics
+	k.mux.Unlock()
+	return nil
+}
+
+// CurrentKey returns the current key of the topic, or an empty id if the topic is not encrypted
+func (k *KeyFile) CurrentKey(topic string) (string, []byte, error) {
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+	id, ok := k.topics[topic]
+	if !ok {
+		return "", nil, nil
+	}
+	return id, k.keys[id], nil
+}
+
+// Key returns the key with the given id
+func (k *KeyFile) Key(topic, id string) ([]byte, error) {
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, errors.Errorf("unknown key %q", id)
+	}
+	return key, nil
+}
+
+// currentKey returns the id and key of the topic's current key, an empty id if the topic is not encrypted
+func (q *FileQueue) currentKey(topic string) (string, []byte, error) {
+	if q.keys == nil {
+		return "", nil, nil
+	}
+	id, key, err := q.keys.CurrentKey(topic)
+	return id, key, errors.Wrapf(err, "unable to get current key of %q", topic)
+}
+
+// segmentCipher returns the cipher of a segment encrypted with the key of the given id
+func (q *FileQueue) segmentCipher(topic, id string) (cipher.AEAD, error) {
+	if q.keys == nil {
+		return nil, errors.Errorf("no key provider for segment encrypted with key %q", id)
+	}
+	key, err := q.keys.Key(topic, id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to get key %q", id)
+	}
+	return newCipher(key)
+}
+
+func newCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid key")
+	}
+	return cipher.NewGCM(block)
+}
+
+// readSegmentKeyID returns the id of the key a segment is encrypted with, or an empty id if it is not encrypted
+func readSegmentKeyID(fs FS, path string) (string, error) {
+	id, err := readFile(fs, path+segmentKeyExt)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(id), err
+}
+
+// writeSegmentKeyID records the id of the key a segment is encrypted with in each root directory, an empty id
+// removes the key files of a segment which is not encrypted
+func (q *FileQueue) writeSegmentKeyID(paths []string, id string) error {
+	for _, p := range paths {
+		var err error
+		if id == "" {
+			err = q.fs.Remove(p + segmentKeyExt)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		} else {
+			err = writeFile(q.fs, p+segmentKeyExt, []byte(id), 0666)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "unable to write key id of segment %q", p)
+		}
+	}
+	return nil
+}
+
+// encryptMessages reads the messages of a batch and encrypts each with its cipher, returning the sizes of the
+// stored messages and a reader of the stored batch. Messages without a cipher are stored as they are
+func encryptMessages(ciphers []cipher.AEAD, startID int64, msgSizes []int64, r io.Reader) ([]int64, io.Reader, error) {
+	var total int64
+	for i, size := range msgSizes {
+		total += size
+		if ciphers[i] != nil {
+			total += encryptionOverhead
+		}
+	}
+	out := make([]byte, 0, total)
+	sizes := make([]int64, len(msgSizes))
+	var msg []byte
+	var ad [8]byte
+	for i, size := range msgSizes {
+		if int64(cap(msg)) < size {
+			msg = make([]byte, size)
+		}
+		msg = msg[:size]
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return nil, nil, errors.Wrap(err, "unable to read message")
+		}
+		if ciphers[i] == nil {
+			out = append(out, msg...)
+			sizes[i] = size
+			continue
+		}
+		nonce := out[len(out) : len(out)+encryptionNonceSize]
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, nil, errors.Wrap(err, "unable to generate nonce")
+		}
+		binary.LittleEndian.PutUint64(ad[:], uint64(startID+int64(i)))
+		out = ciphers[i].Seal(out[:len(out)+encryptionNonceSize], nonce, msg, ad[:])
+		sizes[i] = size + encryptionOverhead
+	}
+	return sizes, bytes.NewReader(out), nil
+}
+
+// decryptMessage decrypts a stored message, authenticating it with the id of the message
+func decryptMessage(aead cipher.AEAD, msg, id []byte) ([]byte, error) {
+	if len(msg) < encryptionOverhead {
+		return nil, errors.Errorf("invalid encrypted message %d", binary.LittleEndian.Uint64(id))
+	}
+	plain, err := aead.Open(nil, msg[:encryptionNonceSize], msg[encryptionNonceSize:], id)
+	return plain, errors.Wrapf(err, "unable to decrypt message %d", binary.LittleEndian.Uint64(id))
+}
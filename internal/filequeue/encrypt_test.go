@@ -0,0 +1,232 @@
+package filequeue
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haraqa/haraqa/internal/headers"
+	"github.com/pkg/errors"
+)
+
+func TestKeyFile(t *testing.T) {
+	_ = os.RemoveAll(".haraqa-keyfile")
+	defer os.RemoveAll(".haraqa-keyfile")
+	if err := os.Mkdir(".haraqa-keyfile", os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	path := ".haraqa-keyfile/keys.json"
+	key1 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 16))
+	key2 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+
+	if _, err := NewKeyFile(path); err == nil {
+		t.Error("expected missing key file")
+	}
+	for _, invalid := range []string{
+		`{`,
+		`{"keys": {"k1": "not base64"}}`,
+		`{"keys": {"k1": "` + base64.StdEncoding.EncodeToString([]byte("short")) + `"}}`,
+		`{"keys": {"k1": "` + key1 + `"}, "topics": {"encrypted": "k2"}}`,
+	} {
+		if err := ioutil.WriteFile(path, []byte(invalid), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewKeyFile(path); err == nil {
+			t.Error("expected invalid key file", invalid)
+		}
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"keys": {"k1": "`+key1+`"}, "topics": {"encrypted": "k1"}}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	k, err := NewKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, key, err := k.CurrentKey("encrypted"); err != nil || id != "k1" || len(key) != 16 {
+		t.Error(id, key, err)
+	}
+	if id, key, err := k.CurrentKey("plain"); err != nil || id != "" || key != nil {
+		t.Error(id, key, err)
+	}
+	if _, err = k.Key("encrypted", "k2"); err == nil {
+		t.Error("expected unknown key")
+	}
+
+	// rotating keys keeps the previous keys, an invalid file leaves the keys unchanged
+	if err = ioutil.WriteFile(path, []byte(`{"keys": {"k1": "`+key1+`", "k2": "`+key2+`"}, "topics": {"encrypted": "k2"}}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err = k.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if id, key, err := k.CurrentKey("encrypted"); err != nil || id != "k2" || len(key) != 32 {
+		t.Error(id, key, err)
+	}
+	if key, err := k.Key("encrypted", "k1"); err != nil || len(key) != 16 {
+		t.Error(key, err)
+	}
+	if err = ioutil.WriteFile(path, []byte(`{"keys": {}, "topics": {"encrypted": "k3"}}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err = k.Reload(); err == nil {
+		t.Error("expected invalid key file")
+	}
+	if id, _, err := k.CurrentKey("encrypted"); err != nil || id != "k2" {
+		t.Error(id, err)
+	}
+}
+
+type testKeys struct {
+	current map[string]string
+	keys    map[string][]byte
+}
+
+func (k *testKeys) CurrentKey(topic string) (string, []byte, error) {
+	id := k.current[topic]
+	if id == "unavailable" {
+		return "", nil, errors.New("key provider unavailable")
+	}
+	return id, k.keys[id], nil
+}
+
+func (k *testKeys) Key(topic, id string) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, errors.Errorf("unknown key %q", id)
+	}
+	return key, nil
+}
+
+func TestFileQueue_Encryption(t *testing.T) {
+	const topic, plainTopic = "encrypted", "plain"
+	fs := NewMemFS()
+	keys := &testKeys{
+		current: map[string]string{topic: "k1"},
+		keys:    map[string][]byte{"k1": bytes.Repeat([]byte{1}, 16), "k2": bytes.Repeat([]byte{2}, 32)},
+	}
+	if _, err := NewWithOptions(true, 3, []string{"a"}, WithFS(fs), WithKeyProvider(nil)); err == nil {
+		t.Error("expected invalid key provider")
+	}
+	q, err := NewWithOptions(true, 3, []string{"a", "b"}, WithFS(fs), WithKeyProvider(keys), WithTailCache(1024),
+		WithCompression(Compression{Format: CompressionFlate, Interval: time.Hour}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for _, name := range []string{topic, plainTopic} {
+		if err = q.CreateTopic(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	produce := func(topic string, msgs ...string) {
+		t.Helper()
+		sizes := make([]int64, len(msgs))
+		for i, msg := range msgs {
+			sizes[i] = int64(len(msg))
+		}
+		if _, err := q.Produce(topic, sizes, 0, nil, nil, bytes.NewBufferString(strings.Join(msgs, ""))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	consume := func(topic string, id, limit int64, expected ...string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		n, err := q.Consume("", topic, id, limit, w)
+		if err != nil || n != len(expected) {
+			t.Fatal(n, err)
+		}
+		if body, _ := ioutil.ReadAll(w.Body); string(body) != strings.Join(expected, "") {
+			t.Error(string(body))
+		}
+		sizes, err := headers.ReadSizes(w.Header())
+		if err != nil || len(sizes) != len(expected) {
+			t.Fatal(sizes, err)
+		}
+		for i := range sizes {
+			if sizes[i] != int64(len(expected[i])) {
+				t.Error(sizes, expected)
+			}
+		}
+	}
+
+	// messages are stored encrypted with the key recorded by the segment, and consumed decrypted
+	produce(topic, "secret", "messages")
+	produce(plainTopic, "plain", "text")
+	for _, dir := range []string{"a", "b"} {
+		path := dir + "/" + topic + "/" + formatName(0)
+		if log, err := readFile(fs, path+".log"); err != nil || bytes.Contains(log, []byte("secret")) || len(log) != 14+2*encryptionOverhead {
+			t.Error(string(log), err)
+		}
+		if id, err := readFile(fs, path+segmentKeyExt); err != nil || string(id) != "k1" {
+			t.Error(string(id), err)
+		}
+		if _, err = fs.Stat(dir + "/" + plainTopic + "/" + formatName(0) + segmentKeyExt); !os.IsNotExist(err) {
+			t.Error(err)
+		}
+	}
+	consume(topic, 0, -1, "secret", "messages")
+	consume(topic, 1, 1, "messages")
+	consume(plainTopic, 0, -1, "plain", "text")
+
+	// rotating the key starts a new segment, the previous segments are still decrypted with their key
+	keys.current[topic] = "k2"
+	produce(topic, "rotated")
+	if id, err := readFile(fs, "b/"+topic+"/"+formatName(2)+segmentKeyExt); err != nil || string(id) != "k2" {
+		t.Error(string(id), err)
+	}
+	produce(topic, "again", "full")
+	consume(topic, 0, -1, "secret", "messages")
+	consume(topic, 2, -1, "rotated", "again", "full")
+
+	// compressed segments are decrypted after they are decompressed
+	if err = q.compressSegments(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Stat("b/" + topic + "/" + formatName(0) + compressedLogExt); err != nil {
+		t.Fatal(err)
+	}
+	consume(topic, 1, -1, "messages")
+
+	// topics no longer encrypted start a new segment without a key
+	delete(keys.current, topic)
+	produce(topic, "unencrypted")
+	if _, err = fs.Stat("a/" + topic + "/" + formatName(5) + segmentKeyExt); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+	consume(topic, 5, -1, "unencrypted")
+
+	// the key provider must provide the current and previous keys
+	keys.current[plainTopic] = "unavailable"
+	if _, err = q.Produce(plainTopic, []int64{1}, 0, nil, nil, bytes.NewBufferString("a")); err == nil {
+		t.Error("expected key provider error")
+	}
+	delete(keys.keys, "k2")
+	if _, err = q.Consume("", topic, 2, -1, httptest.NewRecorder()); err == nil {
+		t.Error("expected unknown key")
+	}
+
+	// tampered messages fail to decrypt
+	if err = writeFile(fs, "b/"+topic+"/"+formatName(0)+".log", bytes.Repeat([]byte{0}, 14+2*encryptionOverhead), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Remove("b/" + topic + "/" + formatName(0) + compressedLogExt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = q.Consume("", topic, 0, 1, httptest.NewRecorder()); err == nil {
+		t.Error("expected decryption error")
+	}
+
+	// key files are removed with their segment
+	if _, err = q.ModifyTopic(topic, headers.ModifyRequest{Truncate: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Stat("a/" + topic + "/" + formatName(0) + segmentKeyExt); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,240 @@
+package filequeue
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operations which faults can be injected into
+const (
+	FaultOpen      = "open"
+	FaultMkdir     = "mkdir"
+	FaultMkdirAll  = "mkdirall"
+	FaultRemove    = "remove"
+	FaultRemoveAll = "removeall"
+	FaultRename    = "rename"
+	FaultStat      = "stat"
+	FaultRead      = "read"
+	FaultWrite     = "write"
+	FaultTruncate  = "truncate"
+	FaultSync      = "sync"
+)
+
+// Fault describes an error or delay to inject into the operations of a FaultFS
+type Fault struct {
+	// Op is the operation to inject the fault into, an empty Op matches every operation
+	Op string
+	// Path is matched against the paths of the operations as a substring, an empty Path matches every path
+	Path string
+	// Err is returned from matching operations without performing them, e.g. syscall.ENOSPC or syscall.EIO
+	Err error
+	// Short makes matching writes write only half of their data and return no error, as a misbehaving disk would
+	Short bool
+	// Delay is added to matching operations before they are performed, to simulate a slow disk
+	Delay time.Duration
+	// Times is the number of operations the fault is injected into, 0 injects into every matching operation
+	Times int
+}
+
+// FaultFS wraps an FS, injecting faults into its operations. Faults can be added and removed while
+// the filesystem is in use, including into files which are already open
+type FaultFS struct {
+	FS
+	mux    sync.Mutex
+	faults []*Fault
+}
+
+var _ FS = &FaultFS{}
+
+// NewFaultFS creates a FaultFS wrapping fs, with no faults injected
+func NewFaultFS(fs FS) *FaultFS {
+	return &FaultFS{FS: fs}
+}
+
+// Inject adds a fault, faults are checked in the order they are added and only the first match applies
+func (fs *FaultFS) Inject(f Fault) {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	fs.faults = append(fs.faults, &f)
+}
+
+// Reset removes all injected faults
+func (fs *FaultFS) Reset() {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	fs.faults = nil
+}
+
+// fault returns the first fault matching the operation and path after waiting for its delay, or nil
+func (fs *FaultFS) fault(op, path string) *Fault {
+	fs.mux.Lock()
+	var match *Fault
+	for i, f := range fs.faults {
+		if (f.Op == "" || f.Op == op) && strings.Contains(path, f.Path) {
+			match = f
+			if f.Times > 0 {
+				f.Times--
+				if f.Times == 0 {
+					fs.faults = append(fs.faults[:i:i], fs.faults[i+1:]...)
+				}
+			}
+			break
+		}
+	}
+	fs.mux.Unlock()
+
+	if match != nil && match.Delay > 0 {
+		time.Sleep(match.Delay)
+	}
+	return match
+}
+
+// err returns the error of a matching fault wrapped as a *os.PathError, or nil
+func (fs *FaultFS) err(op, path string) error {
+	if f := fs.fault(op, path); f != nil && f.Err != nil {
+		return &os.PathError{Op: op, Path: path, Err: f.Err}
+	}
+	return nil
+}
+
+// Open opens the named file for reading
+func (fs *FaultFS) Open(name string) (File, error) {
+	if err := fs.err(FaultOpen, name); err != nil {
+		return nil, err
+	}
+	f, err := fs.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: f, fs: fs}, nil
+}
+
+// OpenFile opens the named file with the given flags and permissions
+func (fs *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if err := fs.err(FaultOpen, name); err != nil {
+		return nil, err
+	}
+	f, err := fs.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: f, fs: fs}, nil
+}
+
+// Mkdir creates a directory
+func (fs *FaultFS) Mkdir(name string, perm os.FileMode) error {
+	if err := fs.err(FaultMkdir, name); err != nil {
+		return err
+	}
+	return fs.FS.Mkdir(name, perm)
+}
+
+// MkdirAll creates a directory and any missing parents
+func (fs *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	if err := fs.err(FaultMkdirAll, path); err != nil {
+		return err
+	}
+	return fs.FS.MkdirAll(path, perm)
+}
+
+// Remove removes a file or empty directory
+func (fs *FaultFS) Remove(name string) error {
+	if err := fs.err(FaultRemove, name); err != nil {
+		return err
+	}
+	return fs.FS.Remove(name)
+}
+
+// RemoveAll removes a path and any children it contains
+func (fs *FaultFS) RemoveAll(path string) error {
+	if err := fs.err(FaultRemoveAll, path); err != nil {
+		return err
+	}
+	return fs.FS.RemoveAll(path)
+}
+
+// Rename renames a file, faults are matched against the old path
+func (fs *FaultFS) Rename(oldpath, newpath string) error {
+	if err := fs.err(FaultRename, oldpath); err != nil {
+		return err
+	}
+	return fs.FS.Rename(oldpath, newpath)
+}
+
+// Stat returns the file info of the named file
+func (fs *FaultFS) Stat(name string) (os.FileInfo, error) {
+	if err := fs.err(FaultStat, name); err != nil {
+		return nil, err
+	}
+	return fs.FS.Stat(name)
+}
+
+// faultFile is an open file of a FaultFS
+type faultFile struct {
+	File
+	fs *FaultFS
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.fs.err(FaultRead, f.Name()); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.fs.err(FaultRead, f.Name()); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	short, err := f.writeFault()
+	if err != nil {
+		return 0, err
+	}
+	if short {
+		return f.File.Write(p[:len(p)/2])
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	short, err := f.writeFault()
+	if err != nil {
+		return 0, err
+	}
+	if short {
+		return f.File.WriteAt(p[:len(p)/2], off)
+	}
+	return f.File.WriteAt(p, off)
+}
+
+// writeFault returns whether a write should be short, or the error it should fail with
+func (f *faultFile) writeFault() (bool, error) {
+	fault := f.fs.fault(FaultWrite, f.Name())
+	if fault == nil {
+		return false, nil
+	}
+	if fault.Err != nil {
+		return false, &os.PathError{Op: FaultWrite, Path: f.Name(), Err: fault.Err}
+	}
+	return fault.Short, nil
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if err := f.fs.err(FaultTruncate, f.Name()); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.err(FaultSync, f.Name()); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
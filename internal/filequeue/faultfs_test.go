@@ -0,0 +1,198 @@
+package filequeue
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestFaultFS(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	if err := fs.Mkdir("dir", os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	// faults match on operation and path, and expire after the given number of operations
+	fs.Inject(Fault{Op: FaultOpen, Path: "other", Err: syscall.EIO})
+	fs.Inject(Fault{Op: FaultOpen, Path: "dir/", Err: syscall.ENOSPC, Times: 1})
+	if _, err := fs.OpenFile("dir/file", os.O_RDWR|os.O_CREATE, 0666); !errors.Is(err, syscall.ENOSPC) {
+		t.Error(err)
+	}
+	f, err := fs.OpenFile("dir/file", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = fs.Open("other"); !errors.Is(err, syscall.EIO) {
+		t.Error(err)
+	}
+	fs.Reset()
+	if _, err = fs.Open("other"); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+
+	// faults apply to files which are already open
+	fs.Inject(Fault{Op: FaultWrite, Short: true, Times: 2})
+	if n, err := f.Write([]byte("abcd")); err != nil || n != 2 {
+		t.Error(n, err)
+	}
+	if n, err := f.WriteAt([]byte("abcd"), 2); err != nil || n != 2 {
+		t.Error(n, err)
+	}
+	if n, err := f.WriteAt([]byte("efgh"), 4); err != nil || n != 4 {
+		t.Error(n, err)
+	}
+	fs.Inject(Fault{Op: FaultRead, Err: syscall.EIO, Times: 1})
+	if _, err = f.ReadAt(make([]byte, 8), 0); !errors.Is(err, syscall.EIO) {
+		t.Error(err)
+	}
+	b := make([]byte, 8)
+	if n, err := f.ReadAt(b, 0); err != nil || string(b[:n]) != "ababefgh" {
+		t.Error(string(b[:n]), err)
+	}
+
+	// an empty fault matches everything
+	fs.Inject(Fault{Err: syscall.EIO})
+	for _, err := range []error{
+		fs.Mkdir("a", os.ModePerm),
+		fs.MkdirAll("a/b", os.ModePerm),
+		fs.Remove("dir/file"),
+		fs.RemoveAll("dir"),
+		fs.Rename("dir/file", "dir/moved"),
+		f.Truncate(0),
+		f.Sync(),
+	} {
+		if !errors.Is(err, syscall.EIO) {
+			t.Error(err)
+		}
+	}
+	if _, err = fs.Stat("dir"); !errors.Is(err, syscall.EIO) {
+		t.Error(err)
+	}
+	if _, err = f.Read(b); !errors.Is(err, syscall.EIO) {
+		t.Error(err)
+	}
+	fs.Reset()
+
+	// delays are added before the operation
+	fs.Inject(Fault{Op: FaultStat, Delay: 20 * time.Millisecond})
+	start := time.Now()
+	if info, err := fs.Stat("dir/file"); err != nil || info.Size() != 8 {
+		t.Error(info, err)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Error(d)
+	}
+}
+
+func TestFileQueue_Faults(t *testing.T) {
+	for _, cache := range []bool{true, false} {
+		t.Run("cache="+strconv.FormatBool(cache), func(t *testing.T) {
+			testFileQueueFaults(t, cache)
+		})
+	}
+}
+
+func testFileQueueFaults(t *testing.T, cache bool) {
+	const topic = "faults"
+	fs := NewFaultFS(NewMemFS())
+	q, err := NewWithOptions(cache, 5000, []string{"a", "b"}, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []byte
+	nextID := int64(0)
+	produce := func(msg string) error {
+		t.Helper()
+		info, err := q.Produce(topic, []int64{int64(len(msg))}, 0, nil, nil, bytes.NewBufferString(msg))
+		if err != nil {
+			return err
+		}
+		if info.StartID != nextID || info.EndID != nextID {
+			t.Error(info, nextID)
+		}
+		expected = append(expected, msg...)
+		nextID++
+		return nil
+	}
+	check := func() {
+		t.Helper()
+		w := httptest.NewRecorder()
+		n, err := q.Consume("", topic, 0, -1, w)
+		if err != nil || n != int(nextID) || !bytes.Equal(w.Body.Bytes(), expected) {
+			t.Error(n, err, w.Body.String(), string(expected))
+		}
+	}
+
+	if err = produce("first"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a full disk fails the produce, which succeeds once space is available again
+	fs.Inject(Fault{Op: FaultWrite, Path: ".log", Err: syscall.ENOSPC})
+	if err = produce("full"); !errors.Is(err, syscall.ENOSPC) {
+		t.Error(err)
+	}
+	fs.Reset()
+	if err = produce("second"); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	// a failing second volume fails the produce after the first volume was written, without corrupting either
+	fs.Inject(Fault{Op: FaultWrite, Path: "b/" + topic, Err: syscall.EIO})
+	if err = produce("degraded"); !errors.Is(err, syscall.EIO) {
+		t.Error(err)
+	}
+	fs.Reset()
+	if err = produce("third"); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	for _, dir := range []string{"a", "b"} {
+		info, err := fs.Stat(dir + "/" + topic + "/" + formatName(0))
+		if err != nil || info.Size() != nextID*datEntryLength {
+			t.Error(dir, info, err)
+		}
+	}
+
+	// a short write is reported as incomplete
+	fs.Inject(Fault{Op: FaultWrite, Short: true, Times: 1})
+	if err = produce("short"); err == nil || errors.Cause(err).Error() != "incomplete write" {
+		t.Error(err)
+	}
+	if err = produce("fourth"); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	// read errors are returned by consume
+	fs.Inject(Fault{Op: FaultRead, Path: "b/" + topic + "/" + formatName(0), Err: syscall.EIO, Times: 1})
+	if _, err = q.Consume("", topic, 0, -1, httptest.NewRecorder()); !errors.Is(err, syscall.EIO) {
+		t.Error(err)
+	}
+	check()
+
+	// a slow disk slows down each write, the log and dat of both volumes
+	fs.Inject(Fault{Op: FaultWrite, Delay: 10 * time.Millisecond})
+	start := time.Now()
+	if err = produce("slow"); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Error(d)
+	}
+	fs.Reset()
+	check()
+}
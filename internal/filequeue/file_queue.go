@@ -15,29 +15,86 @@ import (
 
 // FileQueue implements the haraqa queue by storing messages in log files, under topic based directories
 type FileQueue struct {
-	rootDirNames     []string
-	max              int64
-	produceLocks     *sync.Map
-	produceCache     *sync.Map
-	consumeNameCache *sync.Map
+	fs                 FS
+	rootDirNames       []string
+	max                int64
+	produceLocks       *sync.Map
+	produceCache       *produceCache
+	indexes            *sync.Map
+	persistIndex       bool
+	tails              *sync.Map
+	tailSize           int64
+	limits             SegmentLimits
+	topicLimits        map[string]SegmentLimits
+	preallocate        int64
+	ioHints            bool
+	compression        *Compression
+	compressionMetrics CompressionMetrics
+	compressMux        sync.Mutex
+	rewriteLocks       *sync.Map
+	reclaims           sync.WaitGroup
+	keys               KeyProvider
+	subjectKeys        *sync.Map
+	subjectCiphers     *sync.Map
+	subjectMux         sync.Mutex
+	delayMux           sync.Mutex
+	delivered          func(topic string, n int)
+	deliveryFailed     func(err error)
+	deliveryAttempts   map[string]int
+	deliveryOnce       sync.Once
+	deliveryWake       chan struct{}
+	deliveryStop       chan struct{}
+	stop               chan struct{}
+	stopped            sync.WaitGroup
+	closeOnce          sync.Once
+	producers          *sync.Map
+	consumerOffsets    *sync.Map
 }
 
-// New creates a new FileQueue
+// New creates a new FileQueue stored in the given directories of the operating system's filesystem
 func New(cacheFiles bool, maxEntries int64, dirs ...string) (*FileQueue, error) {
+	return NewWithOptions(cacheFiles, maxEntries, dirs)
+}
+
+// NewWithOptions creates a new FileQueue stored in the given directories, configured by the options
+func NewWithOptions(cacheFiles bool, maxEntries int64, dirs []string, opts ...Option) (*FileQueue, error) {
 	if len(dirs) == 0 {
 		return nil, errors.New("at least one directory must be given")
 	}
 
-	dirNames := make([]string, 0, len(dirs))
+	q := &FileQueue{
+		fs:                 OSFS{},
+		max:                maxEntries,
+		produceLocks:       &sync.Map{},
+		indexes:            &sync.Map{},
+		producers:          &sync.Map{},
+		consumerOffsets:    &sync.Map{},
+		subjectKeys:        &sync.Map{},
+		subjectCiphers:     &sync.Map{},
+		rewriteLocks:       &sync.Map{},
+		compressionMetrics: noOpCompressionMetrics{},
+		deliveryWake:       make(chan struct{}, 1),
+		deliveryStop:       make(chan struct{}),
+	}
+	if cacheFiles {
+		q.produceCache = newProduceCache(2 * len(dirs))
+	}
+	for _, opt := range opts {
+		if err := opt(q); err != nil {
+			return nil, err
+		}
+	}
+
+	q.rootDirNames = make([]string, 0, len(dirs))
 	for _, dir := range dirs {
 		dir = filepath.Clean(dir)
-		info, err := os.Stat(dir)
+		info, err := q.fs.Stat(dir)
 		if os.IsNotExist(err) {
-			err = osMkdir(dir, os.ModePerm)
+			err = q.fs.Mkdir(dir, os.ModePerm)
 			if err != nil {
 				return nil, errors.Wrapf(err, "unable to create queue directory %q", dir)
 			}
-			info, err = os.Stat(dir)
+			info, err = q.fs.Stat(dir)
 		}
 		if err != nil {
 			return nil, errors.Wrapf(err, "unable to stat queue directory %q", dir)
@@ -46,45 +103,42 @@ func New(cacheFiles bool, maxEntries int64, dirs ...string) (*FileQueue, error)
 			return nil, errors.Errorf("path %q is not a directory", dir)
 		}
 
-		dirNames = append(dirNames, dir)
+		q.rootDirNames = append(q.rootDirNames, dir)
 	}
 
-	q := &FileQueue{
-		rootDirNames: dirNames,
-		max:          maxEntries,
-		produceLocks: &sync.Map{},
-	}
-	if cacheFiles {
-		q.produceCache = &sync.Map{}
-		q.consumeNameCache = &sync.Map{}
+	if q.compression != nil {
+		q.startCompression()
 	}
 	return q, nil
 }
 
-// Close closes the queue cached files
+// Close stops the background compression and delivery of delayed messages, and closes the queue cached files
+// once the deleted messages being reclaimed have been reclaimed
 func (q *FileQueue) Close() error {
+	q.closeOnce.Do(func() {
+		if q.stop != nil {
+			close(q.stop)
+		}
+		if q.deliveryStop != nil {
+			close(q.deliveryStop)
+		}
+	})
+	q.stopped.Wait()
+	q.reclaims.Wait()
 	if q.produceCache != nil {
-		q.produceCache.Range(func(key, value interface{}) bool {
-			lock, _ := q.produceLocks.Load(key)
-			if l, ok := lock.(*sync.Mutex); ok {
-				l.Lock()
-				defer l.Unlock()
-			}
-			v, ok := value.(*cacheableProduceFile)
-			if ok {
-				for _, f := range v.Logs {
-					_ = f.Close()
-				}
-				for _, f := range v.Dats {
-					_ = f.Close()
-				}
-			}
-			return true
-		})
+		q.closeProduceFiles(q.produceCache.DeleteAll())
 	}
 	return nil
 }
 
+// segmentLimits returns the segment limits of the topic
+func (q *FileQueue) segmentLimits(topic string) SegmentLimits {
+	if limits, ok := q.topicLimits[topic]; ok {
+		return limits
+	}
+	return q.limits
+}
+
 // RootDir returns the path to the haraqa queue root directory. This is used to serve the raw files
 func (q *FileQueue) RootDir() string {
 	return q.rootDirNames[len(q.rootDirNames)-1]
@@ -94,13 +148,17 @@ func (q *FileQueue) RootDir() string {
 func (q *FileQueue) ListTopics(prefix, suffix, regex string) ([]string, error) {
 	var names []string
 	rootDir := q.rootDirNames[len(q.rootDirNames)-1]
-	err := filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
+	err := walk(q.fs, rootDir, func(path string, info os.FileInfo, err error) error {
 		if !info.IsDir() {
 			return nil
 		}
 		if path == rootDir {
 			return nil
 		}
+		// directories starting with a dot, such as the subject keys, are not topics
+		if strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
 		path = filepath.ToSlash(strings.TrimPrefix(path, rootDir+string(filepath.Separator)))
 
 		if prefix != "" && !strings.HasPrefix(path, prefix) {
@@ -128,17 +186,21 @@ func (q *FileQueue) ListTopics(prefix, suffix, regex string) ([]string, error) {
 func (q *FileQueue) CreateTopic(topic string) error {
 	topic = strings.TrimSpace(topic)
 	topic = strings.TrimSuffix(topic, "/")
+	// directories starting with a dot are kept by the queue and skipped by ListTopics
+	if err := headers.ValidateTopic(topic); err != nil {
+		return err
+	}
 	splitTopic := strings.Split(topic, "/")
 	for _, name := range q.rootDirNames {
 		var err error
 		if len(splitTopic) == 1 {
-			err = osMkdir(filepath.Join(name, topic), os.ModePerm)
+			err = q.fs.Mkdir(filepath.Join(name, topic), os.ModePerm)
 		} else {
-			err = osMkdirAll(filepath.Join(name, filepath.Join(splitTopic[:len(splitTopic)-1]...)), os.ModePerm)
+			err = q.fs.MkdirAll(filepath.Join(name, filepath.Join(splitTopic[:len(splitTopic)-1]...)), os.ModePerm)
 			if err != nil {
 				return err
 			}
-			err = osMkdir(filepath.Join(name, filepath.Join(splitTopic...)), os.ModePerm)
+			err = q.fs.Mkdir(filepath.Join(name, filepath.Join(splitTopic...)), os.ModePerm)
 		}
 		if os.IsExist(err) {
 			return headers.ErrTopicAlreadyExists
@@ -153,21 +215,62 @@ func (q *FileQueue) CreateTopic(topic string) error {
 // DeleteTopic deletes the topic and any nested topic within
 func (q *FileQueue) DeleteTopic(topic string) error {
 	for _, name := range q.rootDirNames {
-		os.RemoveAll(filepath.Join(name, topic))
-	}
-	if q.consumeNameCache != nil {
-		q.consumeNameCache.Delete(topic)
+		_ = q.fs.RemoveAll(filepath.Join(name, topic))
 	}
+	deleteNestedTopics(q.indexes, topic)
+	deleteNestedTopics(q.tails, topic)
+	deleteNestedTopics(q.rewriteLocks, topic)
 	if q.produceCache != nil {
-		q.produceCache.Delete(topic)
+		q.closeProduceFiles(q.produceCache.DeleteNested(topic))
 	}
 	if q.produceLocks != nil {
 		q.produceLocks.Delete(topic)
 	}
+	deleteNestedTopics(q.producers, topic)
+	deleteNestedTopics(q.consumerOffsets, topic)
 
 	return nil
 }
 
+// deleteNestedTopics removes the topic and any nested topic from a topic keyed cache
+func deleteNestedTopics(m *sync.Map, topic string) {
+	if m == nil {
+		return
+	}
+	m.Range(func(key, _ interface{}) bool {
+		if t := key.(string); t == topic || strings.HasPrefix(t, topic+"/") {
+			m.Delete(key)
+		}
+		return true
+	})
+}
+
+// GetTopicInfo returns the min and max offsets of the messages currently stored in the topic.
+// An empty topic returns a max offset of -1
+func (q *FileQueue) GetTopicInfo(topic string) (*headers.TopicInfo, error) {
+	idx, err := q.loadIndex(topic)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, headers.ErrTopicDoesNotExist
+		}
+		return nil, errors.Wrapf(err, "unable to load segment index for %q", topic)
+	}
+
+	info := &headers.TopicInfo{MinOffset: 0, MaxOffset: -1}
+	minBase, maxBase, ok := idx.bounds()
+	if !ok {
+		return info, nil
+	}
+
+	stat, err := q.fs.Stat(filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic, formatName(maxBase)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to stat latest dat file for %q", topic)
+	}
+	info.MinOffset = minBase
+	info.MaxOffset = maxBase + stat.Size()/datEntryLength - 1
+	return info, nil
+}
+
 func formatName(baseID int64) string {
 	const defaultName = "0000000000000000"
 
@@ -1,10 +1,12 @@
 package filequeue
 
 import (
+	"bytes"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/haraqa/haraqa/internal/headers"
 	"github.com/pkg/errors"
@@ -19,21 +21,26 @@ func TestNewFileQueue(t *testing.T) {
 	_ = os.RemoveAll(".haraqa-newfq")
 	defer os.RemoveAll(".haraqa-newfq")
 
+	// missing filesystem
+	_, err = NewWithOptions(true, 5000, []string{".haraqa-newfq"}, WithFS(nil))
+	if err == nil || err.Error() != "filesystem cannot be nil" {
+		t.Error(err)
+	}
+
 	// mkdir fails
 	errTest := errors.New("test error")
-	osMkdir = func(name string, perm os.FileMode) error { return errTest }
-	_, err = New(true, 5000, ".haraqa-newfq")
+	fs := NewFaultFS(OSFS{})
+	fs.Inject(Fault{Op: FaultMkdir, Err: errTest})
+	_, err = NewWithOptions(true, 5000, []string{".haraqa-newfq"}, WithFS(fs))
 	if !errors.Is(err, errTest) {
 		t.Error(err)
 	}
 
 	// mkdir succeeds but open fails
-	osMkdir = func(name string, perm os.FileMode) error { return nil }
-	_, err = New(true, 5000, ".haraqa-newfq")
+	_, err = NewWithOptions(true, 5000, []string{".haraqa-newfq"}, WithFS(noMkdirFS{OSFS{}}))
 	if !os.IsNotExist(errors.Cause(err)) {
 		t.Error(err)
 	}
-	osMkdir = os.Mkdir
 
 	// file is not a directory
 	_, err = New(true, 5000, "file_queue.go")
@@ -55,12 +62,20 @@ func TestNewFileQueue(t *testing.T) {
 	}
 }
 
+// noMkdirFS reports directories as created without creating them
+type noMkdirFS struct {
+	FS
+}
+
+func (noMkdirFS) Mkdir(string, os.FileMode) error { return nil }
+
 func TestFileQueue_Topics(t *testing.T) {
 	dir := ".haraqa-fqtopics"
 	_ = os.RemoveAll(dir)
 	defer os.RemoveAll(dir)
 
-	q, err := New(true, 5000, dir)
+	fs := NewFaultFS(OSFS{})
+	q, err := NewWithOptions(true, 5000, []string{dir}, WithFS(fs))
 	if err != nil {
 		t.Error(err)
 	}
@@ -89,20 +104,20 @@ func TestFileQueue_Topics(t *testing.T) {
 
 		// mkdir error
 		errTest := errors.New("mkdir error")
-		osMkdir = func(name string, perm os.FileMode) error { return errTest }
+		fs.Inject(Fault{Op: FaultMkdir, Err: errTest})
 		err = q.CreateTopic("newtopic")
 		if !errors.Is(err, errTest) {
 			t.Error(err)
 		}
-		osMkdir = os.Mkdir
+		fs.Reset()
 
 		// mkdirall error
-		osMkdirAll = func(name string, perm os.FileMode) error { return errTest }
+		fs.Inject(Fault{Op: FaultMkdirAll, Err: errTest})
 		err = q.CreateTopic("newtopic/nested-topic/topic")
 		if !errors.Is(err, errTest) {
 			t.Error(err)
 		}
-		osMkdirAll = os.MkdirAll
+		fs.Reset()
 
 	}
 
@@ -162,3 +177,62 @@ func TestFileQueue_Topics(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestFileQueue_GetTopicInfo(t *testing.T) {
+	dir := ".haraqa-fqinfo"
+	topic := "info-topic"
+	_ = os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	q, err := New(true, 2, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	// missing topic
+	_, err = q.GetTopicInfo(topic)
+	if !errors.Is(err, headers.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+
+	// empty topic
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	info, err := q.GetTopicInfo(topic)
+	if err != nil {
+		t.Error(err)
+	}
+	if info.MinOffset != 0 || info.MaxOffset != -1 {
+		t.Error(info)
+	}
+
+	// topic spanning multiple files
+	for i := 0; i < 5; i++ {
+		_, err = q.Produce(topic, []int64{5}, uint64(time.Now().UnixNano()), nil, nil, bytes.NewBufferString("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err = q.GetTopicInfo(topic)
+	if err != nil {
+		t.Error(err)
+	}
+	if info.MinOffset != 0 || info.MaxOffset != 4 {
+		t.Error(info)
+	}
+
+	// after truncation
+	_, err = q.ModifyTopic(topic, headers.ModifyRequest{Truncate: 3})
+	if err != nil {
+		t.Error(err)
+	}
+	info, err = q.GetTopicInfo(topic)
+	if err != nil {
+		t.Error(err)
+	}
+	if info.MinOffset != 2 || info.MaxOffset != 4 {
+		t.Error(info)
+	}
+}
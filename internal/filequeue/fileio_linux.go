@@ -0,0 +1,66 @@
+//go:build amd64 || arm64
+// +build amd64 arm64
+
+package filequeue
+
+import (
+	"syscall"
+)
+
+const (
+	fallocKeepSize = 0x1
+	fadvSequential = 2
+	fadvDontNeed   = 4
+)
+
+// fder is implemented by files backed by an operating system file descriptor, such as *os.File
+type fder interface {
+	Fd() uintptr
+}
+
+// preallocate allocates the first size bytes of the file without changing its size. Files without a file
+// descriptor and filesystems without fallocate support are left as they are
+func preallocate(f interface{}, size int64) error {
+	fd, ok := f.(fder)
+	if !ok || size <= 0 {
+		return nil
+	}
+	err := syscall.Fallocate(int(fd.Fd()), fallocKeepSize, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return nil
+	}
+	return err
+}
+
+// trim releases the blocks allocated past the end of the file by preallocate, truncating a file to its own
+// size frees the blocks beyond it
+func trim(f interface{}) error {
+	fd, ok := f.(fder)
+	if !ok {
+		return nil
+	}
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(int(fd.Fd()), &stat); err != nil {
+		return err
+	}
+	allocated := stat.Blocks * 512
+	if allocated <= stat.Size {
+		return nil
+	}
+	return syscall.Ftruncate(int(fd.Fd()), stat.Size)
+}
+
+// adviseSequential hints that the file is about to be read sequentially, hints are best effort
+func adviseSequential(f interface{}) {
+	if fd, ok := f.(fder); ok {
+		_, _, _ = syscall.Syscall6(syscall.SYS_FADVISE64, fd.Fd(), 0, 0, fadvSequential, 0, 0)
+	}
+}
+
+// adviseDontNeed hints that n bytes of the file from off will not be read again soon, so their pages can
+// be dropped from the page cache, hints are best effort
+func adviseDontNeed(f interface{}, off, n int64) {
+	if fd, ok := f.(fder); ok && n > 0 {
+		_, _, _ = syscall.Syscall6(syscall.SYS_FADVISE64, fd.Fd(), uintptr(off), uintptr(n), fadvDontNeed, 0, 0)
+	}
+}
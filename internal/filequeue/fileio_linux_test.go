@@ -0,0 +1,88 @@
+//go:build amd64 || arm64
+// +build amd64 arm64
+
+package filequeue
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestFileQueue_Preallocation(t *testing.T) {
+	if _, err := NewWithOptions(true, 10, []string{"a"}, WithFS(NewMemFS()), WithPreallocation(-1)); err == nil {
+		t.Error("expected invalid preallocation size")
+	}
+
+	const topic = "preallocated"
+	dir := ".haraqa-preallocation"
+	_ = os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	q, err := NewWithOptions(true, 2, []string{dir}, WithPreallocation(1<<20), WithIOHints(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	allocated := func(name string) (int64, int64) {
+		t.Helper()
+		var stat syscall.Stat_t
+		if err := syscall.Stat(filepath.Join(dir, topic, name), &stat); err != nil {
+			t.Fatal(err)
+		}
+		return stat.Size, stat.Blocks * 512
+	}
+	produce := func(msg string) {
+		t.Helper()
+		if _, err := q.Produce(topic, []int64{int64(len(msg))}, 0, nil, nil, bytes.NewBufferString(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the files of the latest segment are preallocated without changing their size
+	produce("abc")
+	size, blocks := allocated(formatName(0) + ".log")
+	if size != 3 {
+		t.Error(size)
+	}
+	if blocks < 1<<20 {
+		t.Skip("preallocation is not supported by the filesystem")
+	}
+	if size, blocks = allocated(formatName(0)); size != datEntryLength || blocks < 2*datEntryLength {
+		t.Error(size, blocks)
+	}
+
+	// sealed segments are trimmed
+	produce("de")
+	produce("f")
+	for _, name := range []string{formatName(0), formatName(0) + ".log"} {
+		if size, blocks = allocated(name); blocks >= 1<<20 {
+			t.Error(name, size, blocks)
+		}
+	}
+	if _, blocks = allocated(formatName(2) + ".log"); blocks < 1<<20 {
+		t.Error(blocks)
+	}
+
+	// sealed segments are consumed with hints
+	w := httptest.NewRecorder()
+	if n, err := q.Consume("", topic, 0, -1, w); err != nil || n != 2 {
+		t.Fatal(n, err)
+	}
+	if body, _ := ioutil.ReadAll(w.Body); string(body) != "abcde" {
+		t.Error(string(body))
+	}
+
+	// the latest segment is trimmed on close
+	if err = q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if size, blocks = allocated(formatName(2) + ".log"); size != 1 || blocks >= 1<<20 {
+		t.Error(size, blocks)
+	}
+}
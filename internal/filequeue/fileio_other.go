@@ -0,0 +1,16 @@
+//go:build !linux || (!amd64 && !arm64)
+// +build !linux !amd64,!arm64
+
+package filequeue
+
+// preallocate is only supported on linux
+func preallocate(f interface{}, size int64) error { return nil }
+
+// trim is only supported on linux
+func trim(f interface{}) error { return nil }
+
+// adviseSequential is only supported on linux
+func adviseSequential(f interface{}) {}
+
+// adviseDontNeed is only supported on linux
+func adviseDontNeed(f interface{}, off, n int64) {}
@@ -0,0 +1,177 @@
+package filequeue
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// FS is the filesystem a FileQueue stores its topics in. OSFS uses the operating system, MemFS stores
+// files in memory and FaultFS wraps another FS to inject errors. Errors should be *os.PathError values,
+// so that os.IsNotExist and os.IsExist can be used on them
+type FS interface {
+	Open(name string) (File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(path string, perm os.FileMode) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	Rename(oldpath, newpath string) error
+	Stat(name string) (os.FileInfo, error)
+}
+
+// File is an open file or directory of an FS, *os.File implements File
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Readdir(n int) ([]os.FileInfo, error)
+	Readdirnames(n int) ([]string, error)
+	Truncate(size int64) error
+	Sync() error
+}
+
+var (
+	_ FS   = OSFS{}
+	_ File = &os.File{}
+)
+
+// OSFS implements FS using the os package
+type OSFS struct{}
+
+// Open opens the named file for reading
+func (OSFS) Open(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// OpenFile opens the named file with the given flags and permissions
+func (OSFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Mkdir creates a directory
+func (OSFS) Mkdir(name string, perm os.FileMode) error { return os.Mkdir(name, perm) }
+
+// MkdirAll creates a directory and any missing parents
+func (OSFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+
+// Remove removes a file or empty directory
+func (OSFS) Remove(name string) error { return os.Remove(name) }
+
+// RemoveAll removes a path and any children it contains
+func (OSFS) RemoveAll(path string) error { return os.RemoveAll(path) }
+
+// Rename renames a file, replacing newpath if it exists
+func (OSFS) Rename(oldpath, newpath string) error { return os.Rename(oldpath, newpath) }
+
+// Stat returns the file info of the named file
+func (OSFS) Stat(name string) (os.FileInfo, error) { return os.Stat(name) }
+
+// readFile reads the whole of the named file
+func readFile(fs FS, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var size int64
+	if info, err := f.Stat(); err == nil {
+		size = info.Size()
+	}
+	data := make([]byte, 0, size+512)
+	for {
+		n, err := f.Read(data[len(data):cap(data)])
+		data = data[:len(data)+n]
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == cap(data) {
+			data = append(data, 0)[:len(data)]
+		}
+	}
+}
+
+// writeFile writes data to the named file, replacing any existing contents
+func writeFile(fs FS, name string, data []byte, perm os.FileMode) error {
+	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	n, err := f.Write(data)
+	if err == nil && n < len(data) {
+		err = io.ErrShortWrite
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// walk walks the file tree rooted at root in lexical order, calling fn for each file or directory,
+// with the same semantics as filepath.Walk
+func walk(fs FS, root string, fn filepath.WalkFunc) error {
+	info, err := fs.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkDir(fs, root, info, fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walkDir(fs FS, path string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+
+	infos, err := readDir(fs, path)
+	err1 := fn(path, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+
+	for _, child := range infos {
+		err = walkDir(fs, filepath.Join(path, child.Name()), child, fn)
+		if err != nil {
+			if !child.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readDir returns the file infos of a directory, sorted by name
+func readDir(fs FS, name string) ([]os.FileInfo, error) {
+	dir, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := dir.Readdir(-1)
+	_ = dir.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
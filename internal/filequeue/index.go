@@ -0,0 +1,321 @@
+package filequeue
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// indexFileName is the file in each topic directory recording the base id of each segment, if the index is persisted
+const indexFileName = ".segments"
+
+// segmentIndex is the sorted list of the segments of a topic. Each segment is a dat and a log file, named
+// by the id of the first message in the segment
+type segmentIndex struct {
+	mux   sync.RWMutex
+	bases []int64
+	// times holds the timestamp of the first message of each segment, or 0 if it has not been read yet
+	times []uint64
+}
+
+// find returns the base id of the segment which would hold the id, or false if the id is before the first
+// segment. A negative id returns the latest segment
+func (idx *segmentIndex) find(id int64) (int64, bool) {
+	idx.mux.RLock()
+	defer idx.mux.RUnlock()
+	if len(idx.bases) == 0 {
+		return 0, false
+	}
+	if id < 0 {
+		return idx.bases[len(idx.bases)-1], true
+	}
+	i := sort.Search(len(idx.bases), func(i int) bool { return idx.bases[i] > id }) - 1
+	if i < 0 {
+		return 0, false
+	}
+	return idx.bases[i], true
+}
+
+// bounds returns the base ids of the first and latest segments, or false if there are no segments
+func (idx *segmentIndex) bounds() (int64, int64, bool) {
+	idx.mux.RLock()
+	defer idx.mux.RUnlock()
+	if len(idx.bases) == 0 {
+		return 0, 0, false
+	}
+	return idx.bases[0], idx.bases[len(idx.bases)-1], true
+}
+
+// sealed returns the base ids of every segment except the latest, which is still written to
+func (idx *segmentIndex) sealed() []int64 {
+	idx.mux.RLock()
+	defer idx.mux.RUnlock()
+	if len(idx.bases) == 0 {
+		return nil
+	}
+	return append([]int64(nil), idx.bases[:len(idx.bases)-1]...)
+}
+
+// all returns the base ids of every segment
+func (idx *segmentIndex) all() []int64 {
+	idx.mux.RLock()
+	defer idx.mux.RUnlock()
+	return append([]int64(nil), idx.bases...)
+}
+
+// add inserts a segment, returning false if it was already in the index
+func (idx *segmentIndex) add(base int64) bool {
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+	i := sort.Search(len(idx.bases), func(i int) bool { return idx.bases[i] >= base })
+	if i < len(idx.bases) && idx.bases[i] == base {
+		return false
+	}
+	idx.bases = append(idx.bases, 0)
+	copy(idx.bases[i+1:], idx.bases[i:])
+	idx.bases[i] = base
+	idx.times = append(idx.times, 0)
+	copy(idx.times[i+1:], idx.times[i:])
+	idx.times[i] = 0
+	return true
+}
+
+// reset replaces the segments in the index
+func (idx *segmentIndex) reset(bases []int64) {
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+	idx.bases = bases
+	idx.times = make([]uint64, len(bases))
+}
+
+// FindTime returns the id of the first message in the topic produced at or after t, or the id of the next
+// message to be produced if there is none. The segments, then the messages of a segment, are binary searched
+func (q *FileQueue) FindTime(topic string, t time.Time) (int64, error) {
+	idx, err := q.loadIndex(topic)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, headers.ErrTopicDoesNotExist
+		}
+		return 0, errors.Wrapf(err, "unable to load segment index for %q", topic)
+	}
+	idx.mux.RLock()
+	bases := idx.bases[:len(idx.bases):len(idx.bases)]
+	times := append([]uint64(nil), idx.times...)
+	idx.mux.RUnlock()
+	if len(bases) == 0 {
+		return 0, nil
+	}
+	var ts uint64
+	if n := t.UnixNano(); n > 0 {
+		ts = uint64(n)
+	}
+	topicPath := filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic)
+
+	// find the last segment starting at or before the timestamp
+	var searchErr error
+	i := sort.Search(len(bases), func(i int) bool {
+		if times[i] == 0 {
+			entries, err := q.readDatTimes(filepath.Join(topicPath, formatName(bases[i])), 0, 1)
+			if err != nil {
+				searchErr = err
+				return true
+			}
+			if len(entries) == 0 {
+				// an empty segment has no messages before the timestamp
+				return true
+			}
+			times[i] = entries[0]
+		}
+		return timestampNanos(times[i]) > ts
+	})
+	if searchErr != nil {
+		return 0, errors.Wrapf(searchErr, "unable to search segments of %q", topic)
+	}
+	idx.mux.Lock()
+	for j := 0; j < len(times) && j < len(idx.times); j++ {
+		if idx.bases[j] == bases[j] && idx.times[j] == 0 {
+			idx.times[j] = times[j]
+		}
+	}
+	idx.mux.Unlock()
+	if i == 0 {
+		return bases[0], nil
+	}
+
+	// search the messages of the segment, the message may instead be the first of the following segment
+	datPath := filepath.Join(topicPath, formatName(bases[i-1]))
+	info, err := q.fs.Stat(datPath)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to stat dat file for %q", topic)
+	}
+	entries := info.Size() / datEntryLength
+	j := sort.Search(int(entries), func(j int) bool {
+		times, err := q.readDatTimes(datPath, int64(j), 1)
+		if err != nil || len(times) == 0 {
+			searchErr = err
+			return true
+		}
+		return timestampNanos(times[0]) >= ts
+	})
+	if searchErr != nil {
+		return 0, errors.Wrapf(searchErr, "unable to search messages of %q", topic)
+	}
+	return bases[i-1] + int64(j), nil
+}
+
+// readDatTimes reads the timestamps of up to n dat entries, starting from the entry at the given position
+func (q *FileQueue) readDatTimes(path string, pos, n int64) ([]uint64, error) {
+	dat, err := q.fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dat.Close()
+	data := make([]byte, n*datEntryLength)
+	length, err := dat.ReadAt(data, pos*datEntryLength)
+	if err != nil && length < datEntryLength {
+		if err == io.EOF {
+			err = nil
+		}
+		return nil, err
+	}
+	times := make([]uint64, length/datEntryLength)
+	for i := range times {
+		times[i] = binary.LittleEndian.Uint64(data[i*datEntryLength+8:])
+	}
+	return times, nil
+}
+
+// loadIndex returns the segment index of the topic, reading it from the persisted index file or
+// the topic directory if it has not been loaded yet
+func (q *FileQueue) loadIndex(topic string) (*segmentIndex, error) {
+	if v, ok := q.indexes.Load(topic); ok {
+		return v.(*segmentIndex), nil
+	}
+
+	var bases []int64
+	var err error
+	if q.persistIndex {
+		bases, err = q.readIndexFile(topic)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if bases == nil {
+		bases, err = q.scanSegments(topic)
+		if err != nil {
+			return nil, err
+		}
+		if q.persistIndex {
+			if err = q.writeIndexFile(topic, bases); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	idx := &segmentIndex{}
+	idx.reset(bases)
+	v, _ := q.indexes.LoadOrStore(topic, idx)
+	return v.(*segmentIndex), nil
+}
+
+// addSegment adds a new segment to the index of a topic, and to the index file if persisted
+func (q *FileQueue) addSegment(topic string, idx *segmentIndex, base int64) error {
+	if !idx.add(base) || !q.persistIndex {
+		return nil
+	}
+	var record [8]byte
+	binary.LittleEndian.PutUint64(record[:], uint64(base))
+	return q.appendTopicRecord(topic, indexFileName, record[:])
+}
+
+// rebuildIndex rereads the segments of the topic directory into the index, after segments are removed
+func (q *FileQueue) rebuildIndex(topic string, idx *segmentIndex) error {
+	bases, err := q.scanSegments(topic)
+	if err != nil {
+		return err
+	}
+	idx.reset(bases)
+	if q.persistIndex {
+		return q.writeIndexFile(topic, bases)
+	}
+	return nil
+}
+
+// scanSegments returns the sorted base ids of the segments in the topic directory
+func (q *FileQueue) scanSegments(topic string) ([]int64, error) {
+	dir, err := q.fs.Open(filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic))
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	bases := make([]int64, 0, len(names)/2)
+	for _, name := range names {
+		if len(name) != len(formatName(0)) || strings.ContainsRune(name, '.') {
+			continue
+		}
+		if base, err := strconv.ParseInt(name, 10, 64); err == nil {
+			bases = append(bases, base)
+		}
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+	return bases, nil
+}
+
+// readIndexFile reads the persisted index of a topic. A nil slice is returned if the file is missing or
+// does not match the segments on disk, in which case the topic directory must be scanned instead
+func (q *FileQueue) readIndexFile(topic string) ([]int64, error) {
+	data, err := q.readTopicRecords(topic, indexFileName)
+	if err != nil || len(data) < 8 {
+		return nil, err
+	}
+	bases := make([]int64, 0, len(data)/8)
+	for ; len(data) >= 8; data = data[8:] {
+		bases = append(bases, int64(binary.LittleEndian.Uint64(data)))
+	}
+	for i := 1; i < len(bases); i++ {
+		if bases[i] <= bases[i-1] {
+			return nil, nil
+		}
+	}
+
+	// the first and latest segments must exist, and the latest must not have been followed by a segment
+	// which was created without being recorded
+	topicPath := filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic)
+	if _, err = q.fs.Stat(filepath.Join(topicPath, formatName(bases[0]))); err != nil {
+		return nil, nil
+	}
+	latest := bases[len(bases)-1]
+	info, err := q.fs.Stat(filepath.Join(topicPath, formatName(latest)))
+	if err != nil {
+		return nil, nil
+	}
+	next := latest + info.Size()/datEntryLength
+	if _, err = q.fs.Stat(filepath.Join(topicPath, formatName(next))); next != latest && !os.IsNotExist(err) {
+		return nil, nil
+	}
+	return bases, nil
+}
+
+// writeIndexFile replaces the persisted index of a topic
+func (q *FileQueue) writeIndexFile(topic string, bases []int64) error {
+	data := make([]byte, 8*len(bases))
+	for i, base := range bases {
+		binary.LittleEndian.PutUint64(data[i*8:], uint64(base))
+	}
+	return errors.Wrap(q.replaceTopicRecords(topic, indexFileName, data), "unable to write segment index")
+}
@@ -0,0 +1,236 @@
+package filequeue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestSegmentIndex(t *testing.T) {
+	idx := &segmentIndex{}
+	if _, ok := idx.find(0); ok {
+		t.Error("expected empty index")
+	}
+	if _, _, ok := idx.bounds(); ok {
+		t.Error("expected empty index")
+	}
+	for _, base := range []int64{10, 0, 5, 20} {
+		if !idx.add(base) {
+			t.Error(base)
+		}
+	}
+	if idx.add(5) {
+		t.Error("expected duplicate")
+	}
+	if !reflect.DeepEqual(idx.bases, []int64{0, 5, 10, 20}) || len(idx.times) != 4 {
+		t.Error(idx.bases, idx.times)
+	}
+	for id, expected := range map[int64]int64{-1: 20, 0: 0, 4: 0, 5: 5, 19: 10, 100: 20} {
+		if base, ok := idx.find(id); !ok || base != expected {
+			t.Error(id, base, ok)
+		}
+	}
+	if minBase, maxBase, ok := idx.bounds(); !ok || minBase != 0 || maxBase != 20 {
+		t.Error(minBase, maxBase, ok)
+	}
+	idx.reset([]int64{5})
+	if _, ok := idx.find(4); ok {
+		t.Error("expected id before the first segment")
+	}
+}
+
+func TestFileQueue_SegmentIndex(t *testing.T) {
+	const topic = "index"
+	fs := NewMemFS()
+	q, err := NewWithOptions(true, 2, []string{"a", "b"}, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if _, err = q.Consume("", topic, 0, -1, httptest.NewRecorder()); !errors.Is(err, headers.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		if _, err = q.Produce(topic, []int64{1}, 0, nil, nil, bytes.NewBufferString(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx, err := q.loadIndex(topic)
+	if err != nil || !reflect.DeepEqual(idx.bases, []int64{0, 2, 4, 6}) {
+		t.Fatal(idx, err)
+	}
+	consume := func(id int64, expected string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		n, err := q.Consume("", topic, id, -1, w)
+		if err != nil || n != len(expected) || w.Body.String() != expected {
+			t.Error(id, n, err, w.Body.String())
+		}
+	}
+	consume(0, "01")
+	consume(3, "3")
+	consume(-1, "6")
+
+	// truncated segments are removed from the index and both directories, including their logs
+	info, err := q.ModifyTopic(topic, headers.ModifyRequest{Truncate: 3})
+	if err != nil || info.MinOffset != 2 || info.MaxOffset != 6 {
+		t.Error(info, err)
+	}
+	if !reflect.DeepEqual(idx.bases, []int64{2, 4, 6}) {
+		t.Error(idx.bases)
+	}
+	for _, dir := range []string{"a", "b"} {
+		if _, err = fs.Stat(dir + "/" + topic + "/" + formatName(0) + ".log"); !os.IsNotExist(err) {
+			t.Error(dir, err)
+		}
+	}
+	consume(1, "")
+	consume(2, "23")
+
+	// retention can remove every segment, the cached produce files are closed with them
+	if _, err = q.ModifyTopic(topic, headers.ModifyRequest{Before: time.Now().Add(time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.bases) != 0 || q.produceCache.Len() != 0 {
+		t.Error(idx.bases, q.produceCache.Len())
+	}
+	consume(6, "")
+	if info, err := q.GetTopicInfo(topic); err != nil || info.MinOffset != 0 || info.MaxOffset != -1 {
+		t.Error(info, err)
+	}
+
+	// deleting a topic drops its index
+	if err = q.DeleteTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.indexes.Load(topic); ok {
+		t.Error("expected index to be deleted")
+	}
+	if _, err = q.GetTopicInfo(topic); !errors.Is(err, headers.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+}
+
+func TestFileQueue_PersistedIndex(t *testing.T) {
+	const topic = "persisted"
+	fs := NewMemFS()
+	q, err := NewWithOptions(true, 2, []string{"a", "b"}, WithFS(fs), WithPersistedIndex(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err = q.Produce(topic, []int64{1}, 0, nil, nil, bytes.NewBufferString("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"a", "b"} {
+		data, err := readFile(fs, dir+"/"+topic+"/"+indexFileName)
+		if err != nil || !bytes.Equal(data, encodeBases(0, 2, 4)) {
+			t.Error(dir, data, err)
+		}
+	}
+
+	// segments which are not in the persisted index are not found once it is loaded
+	if err = writeFile(fs, "b/"+topic+"/"+formatName(100), make([]byte, datEntryLength), 0666); err != nil {
+		t.Fatal(err)
+	}
+	reopen := func() *FileQueue {
+		q, err := NewWithOptions(true, 2, []string{"a", "b"}, WithFS(fs), WithPersistedIndex(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+	q = reopen()
+	if info, err := q.GetTopicInfo(topic); err != nil || info.MinOffset != 0 || info.MaxOffset != 4 {
+		t.Error(info, err)
+	}
+	if err = fs.Remove("b/" + topic + "/" + formatName(100)); err != nil {
+		t.Fatal(err)
+	}
+
+	// an index missing the latest segment is rebuilt from the directory
+	if err = writeFile(fs, "b/"+topic+"/"+indexFileName, encodeBases(0, 2), 0666); err != nil {
+		t.Fatal(err)
+	}
+	q = reopen()
+	if info, err := q.GetTopicInfo(topic); err != nil || info.MinOffset != 0 || info.MaxOffset != 4 {
+		t.Error(info, err)
+	}
+	if data, err := readFile(fs, "b/"+topic+"/"+indexFileName); err != nil || !bytes.Equal(data, encodeBases(0, 2, 4)) {
+		t.Error(data, err)
+	}
+
+	// truncation rewrites the persisted index
+	if _, err = q.ModifyTopic(topic, headers.ModifyRequest{Truncate: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readFile(fs, "b/"+topic+"/"+indexFileName); err != nil || !bytes.Equal(data, encodeBases(4)) {
+		t.Error(data, err)
+	}
+	if info, err := q.Produce(topic, []int64{1}, 0, nil, nil, bytes.NewBufferString("a")); err != nil || info.StartID != 5 {
+		t.Error(info, err)
+	}
+	if info, err := q.Produce(topic, []int64{1}, 0, nil, nil, bytes.NewBufferString("a")); err != nil || info.StartID != 6 {
+		t.Error(info, err)
+	}
+	if data, err := readFile(fs, "b/"+topic+"/"+indexFileName); err != nil || !bytes.Equal(data, encodeBases(4, 6)) {
+		t.Error(data, err)
+	}
+}
+
+func encodeBases(bases ...int64) []byte {
+	data := make([]byte, 8*len(bases))
+	for i, base := range bases {
+		binary.LittleEndian.PutUint64(data[i*8:], uint64(base))
+	}
+	return data
+}
+
+func TestFileQueue_FindTime(t *testing.T) {
+	const topic = "time"
+	q, err := NewWithOptions(true, 3, []string{"a"}, WithFS(NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if _, err = q.FindTime(topic, time.Unix(0, 0)); !errors.Is(err, headers.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := q.FindTime(topic, time.Unix(0, 0)); err != nil || id != 0 {
+		t.Error(id, err)
+	}
+
+	// message i is produced at 10*(i+1), the segments start at 0, 3, 6 and 9
+	for i := 0; i < 10; i++ {
+		if _, err = q.Produce(topic, []int64{1}, uint64(10*(i+1)), nil, nil, bytes.NewBufferString("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for ts, expected := range map[int64]int64{0: 0, 10: 0, 11: 1, 30: 2, 31: 3, 40: 3, 65: 6, 95: 9, 100: 9, 101: 10} {
+		if id, err := q.FindTime(topic, time.Unix(ts, 0)); err != nil || id != expected {
+			t.Error(ts, id, expected, err)
+		}
+	}
+}
@@ -0,0 +1,472 @@
+package filequeue
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MemFS implements FS by storing files in memory. Like a unix filesystem, a removed file can still be
+// used through the files already open on it. All files are lost when the MemFS is garbage collected
+type MemFS struct {
+	mux   sync.RWMutex
+	nodes map[string]*memNode
+}
+
+// memNode is a file or directory of a MemFS
+type memNode struct {
+	mux     sync.RWMutex
+	dir     bool
+	mode    os.FileMode
+	modTime time.Time
+	data    []byte
+}
+
+var _ FS = &MemFS{}
+
+// NewMemFS creates an empty MemFS, containing only the current and root directories
+func NewMemFS() *MemFS {
+	now := time.Now()
+	return &MemFS{
+		nodes: map[string]*memNode{
+			".":                        {dir: true, mode: os.ModeDir | os.ModePerm, modTime: now},
+			string(filepath.Separator): {dir: true, mode: os.ModeDir | os.ModePerm, modTime: now},
+		},
+	}
+}
+
+// Open opens the named file for reading
+func (fs *MemFS) Open(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens the named file with the given flags, creating it with the given permissions if required
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	path := filepath.Clean(name)
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	node, ok := fs.nodes[path]
+	switch {
+	case ok && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case ok && node.dir && writable:
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		if err := fs.checkParent("open", name, path); err != nil {
+			return nil, err
+		}
+		node = &memNode{mode: perm &^ os.ModeType, modTime: time.Now()}
+		fs.nodes[path] = node
+	}
+
+	if flag&os.O_TRUNC != 0 && writable {
+		node.mux.Lock()
+		node.data = node.data[:0]
+		node.modTime = time.Now()
+		node.mux.Unlock()
+	}
+	return &memFile{fs: fs, node: node, name: name, path: path, flag: flag}, nil
+}
+
+// Mkdir creates a directory, the parent directory must already exist
+func (fs *MemFS) Mkdir(name string, perm os.FileMode) error {
+	path := filepath.Clean(name)
+
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	if _, ok := fs.nodes[path]; ok {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if err := fs.checkParent("mkdir", name, path); err != nil {
+		return err
+	}
+	fs.nodes[path] = &memNode{dir: true, mode: os.ModeDir | perm&os.ModePerm, modTime: time.Now()}
+	return nil
+}
+
+// MkdirAll creates a directory and any missing parents
+func (fs *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	path = filepath.Clean(path)
+
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	return fs.mkdirAll(path, perm)
+}
+
+func (fs *MemFS) mkdirAll(path string, perm os.FileMode) error {
+	if node, ok := fs.nodes[path]; ok {
+		if !node.dir {
+			return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if parent := filepath.Dir(path); parent != path {
+		if err := fs.mkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+	fs.nodes[path] = &memNode{dir: true, mode: os.ModeDir | perm&os.ModePerm, modTime: time.Now()}
+	return nil
+}
+
+// Remove removes a file or empty directory
+func (fs *MemFS) Remove(name string) error {
+	path := filepath.Clean(name)
+
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	node, ok := fs.nodes[path]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if node.dir && len(fs.children(path)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(fs.nodes, path)
+	return nil
+}
+
+// RemoveAll removes a path and any children it contains, a missing path is not an error
+func (fs *MemFS) RemoveAll(path string) error {
+	path = filepath.Clean(path)
+
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	prefix := path + string(filepath.Separator)
+	for p := range fs.nodes {
+		if p == path || strings.HasPrefix(p, prefix) {
+			delete(fs.nodes, p)
+		}
+	}
+	return nil
+}
+
+// Rename renames a file or directory, replacing newpath if it is a file
+func (fs *MemFS) Rename(oldpath, newpath string) error {
+	from, to := filepath.Clean(oldpath), filepath.Clean(newpath)
+
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	node, ok := fs.nodes[from]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if existing, ok := fs.nodes[to]; ok && existing.dir {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrExist}
+	}
+	if err := fs.checkParent("rename", newpath, to); err != nil {
+		return err
+	}
+	if from == to {
+		return nil
+	}
+
+	moved := map[string]*memNode{to: node}
+	prefix := from + string(filepath.Separator)
+	for p, child := range fs.nodes {
+		if strings.HasPrefix(p, prefix) {
+			moved[to+p[len(from):]] = child
+			delete(fs.nodes, p)
+		}
+	}
+	delete(fs.nodes, from)
+	for p, child := range moved {
+		fs.nodes[p] = child
+	}
+	return nil
+}
+
+// Stat returns the file info of the named file
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	path := filepath.Clean(name)
+
+	fs.mux.RLock()
+	defer fs.mux.RUnlock()
+	node, ok := fs.nodes[path]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return node.info(filepath.Base(path)), nil
+}
+
+// checkParent returns an error if the parent of path is not an existing directory, fs.mux must be held
+func (fs *MemFS) checkParent(op, name, path string) error {
+	parent, ok := fs.nodes[filepath.Dir(path)]
+	if !ok {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	if !parent.dir {
+		return &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+// children returns the infos of the direct children of a directory sorted by name, fs.mux must be held
+func (fs *MemFS) children(path string) []os.FileInfo {
+	var infos []os.FileInfo
+	for p, node := range fs.nodes {
+		if p != path && filepath.Dir(p) == path {
+			infos = append(infos, node.info(filepath.Base(p)))
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos
+}
+
+func (n *memNode) info(name string) os.FileInfo {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	return &memFileInfo{name: name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+// memFileInfo implements os.FileInfo for the files of a MemFS
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
+
+// memFile is an open file of a MemFS
+type memFile struct {
+	fs     *MemFS
+	node   *memNode
+	name   string
+	path   string
+	flag   int
+	mux    sync.Mutex
+	offset int64
+	dirPos int
+	closed bool
+}
+
+// check returns an error if the file is closed, or if the operation is not allowed by the open flags
+func (f *memFile) check(op string, write bool) error {
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	if write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0 || !write && f.flag&os.O_WRONLY != 0 {
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+	if f.node.dir && op != "readdir" && op != "close" && op != "stat" {
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EISDIR}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: f.name, Err: syscall.EINVAL}
+	}
+	return f.readAt(p, off)
+}
+
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	f.node.mux.RLock()
+	defer f.node.mux.RUnlock()
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.node.mux.RLock()
+		f.offset = int64(len(f.node.data))
+		f.node.mux.RUnlock()
+	}
+	n := f.writeAt(p, f.offset)
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: syscall.EINVAL}
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: syscall.EINVAL}
+	}
+	return f.writeAt(p, off), nil
+}
+
+func (f *memFile) writeAt(p []byte, off int64) int {
+	f.node.mux.Lock()
+	defer f.node.mux.Unlock()
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		if end > int64(cap(f.node.data)) {
+			data := make([]byte, end, 2*end)
+			copy(data, f.node.data)
+			f.node.data = data
+		} else {
+			size := len(f.node.data)
+			f.node.data = f.node.data[:end]
+			for i := size; i < int(off); i++ {
+				f.node.data[i] = 0
+			}
+		}
+	}
+	f.node.modTime = time.Now()
+	return copy(f.node.data[off:], p)
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.closed {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrClosed}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.node.mux.RLock()
+		offset += int64(len(f.node.data))
+		f.node.mux.RUnlock()
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.closed {
+		return nil, &os.PathError{Op: "stat", Path: f.name, Err: os.ErrClosed}
+	}
+	return f.node.info(filepath.Base(f.path)), nil
+}
+
+func (f *memFile) Readdir(n int) ([]os.FileInfo, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.closed {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: os.ErrClosed}
+	}
+	if !f.node.dir {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+
+	f.fs.mux.RLock()
+	infos := f.fs.children(f.path)
+	f.fs.mux.RUnlock()
+	if f.dirPos > len(infos) {
+		f.dirPos = len(infos)
+	}
+	infos = infos[f.dirPos:]
+	if n > 0 {
+		if len(infos) == 0 {
+			return nil, io.EOF
+		}
+		if n < len(infos) {
+			infos = infos[:n]
+		}
+	}
+	f.dirPos += len(infos)
+	return infos, nil
+}
+
+func (f *memFile) Readdirnames(n int) ([]string, error) {
+	infos, err := f.Readdir(n)
+	names := make([]string, len(infos))
+	for i := range infos {
+		names[i] = infos[i].Name()
+	}
+	return names, err
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.node.mux.Lock()
+	defer f.node.mux.Unlock()
+	if size <= int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.closed {
+		return &os.PathError{Op: "sync", Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
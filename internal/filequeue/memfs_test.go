@@ -0,0 +1,167 @@
+package filequeue
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS()
+
+	// directories
+	if err := fs.Mkdir("a/b", os.ModePerm); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+	if err := fs.MkdirAll("a/b", os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("a", os.ModePerm); !os.IsExist(err) {
+		t.Error(err)
+	}
+	if info, err := fs.Stat("a/b"); err != nil || !info.IsDir() || info.Name() != "b" {
+		t.Error(info, err)
+	}
+	if _, err := fs.Stat("a/c"); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+
+	// files
+	if _, err := fs.Open("a/file"); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+	if _, err := fs.OpenFile("missing/file", os.O_RDWR|os.O_CREATE, 0666); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+	if _, err := fs.OpenFile("a", os.O_RDWR, 0666); err == nil {
+		t.Error("expected error opening directory for writing")
+	}
+	f, err := fs.OpenFile("a/file", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.OpenFile("a/file", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666); !os.IsExist(err) {
+		t.Error(err)
+	}
+	if _, err = f.Write([]byte("hello")); err != nil {
+		t.Error(err)
+	}
+	if _, err = f.WriteAt([]byte("world"), 8); err != nil {
+		t.Error(err)
+	}
+	b := make([]byte, 16)
+	if n, err := f.ReadAt(b, 0); err != io.EOF || string(b[:n]) != "hello\x00\x00\x00world" {
+		t.Errorf("%q %v", b[:n], err)
+	}
+	if _, err = f.Seek(1, io.SeekStart); err != nil {
+		t.Error(err)
+	}
+	if n, err := f.Read(b[:4]); err != nil || string(b[:n]) != "ello" {
+		t.Error(string(b[:n]), err)
+	}
+	if err = f.Truncate(2); err != nil {
+		t.Error(err)
+	}
+	if info, err := f.Stat(); err != nil || info.Size() != 2 || info.IsDir() || f.Name() != "a/file" {
+		t.Error(info, err)
+	}
+
+	// read only files cannot be written
+	r, err := fs.Open("a/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Write([]byte("a")); err == nil {
+		t.Error("expected error writing read only file")
+	}
+	if data, err := readFile(fs, "a/file"); err != nil || string(data) != "he" {
+		t.Error(string(data), err)
+	}
+
+	// appending files always write at the end
+	if err = writeFile(fs, "a/append", []byte("ab"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	appender, err := fs.OpenFile("a/append", os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = appender.Write([]byte("cd")); err != nil {
+		t.Error(err)
+	}
+	if _, err = appender.WriteAt([]byte("cd"), 0); err == nil {
+		t.Error("expected error writing at an offset of an appending file")
+	}
+	if data, err := readFile(fs, "a/append"); err != nil || string(data) != "abcd" {
+		t.Error(string(data), err)
+	}
+
+	// removed files can still be used through open files
+	if err = fs.Remove("a"); err == nil {
+		t.Error("expected error removing non-empty directory")
+	}
+	if err = fs.Remove("a/file"); err != nil {
+		t.Error(err)
+	}
+	if err = fs.Remove("a/file"); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+	if n, err := r.ReadAt(b[:2], 0); err != nil || string(b[:n]) != "he" {
+		t.Error(string(b[:n]), err)
+	}
+	if err = r.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err = r.Read(b); err == nil {
+		t.Error("expected error reading closed file")
+	}
+
+	// rename moves files and the children of directories
+	if err = fs.Rename("a/missing", "a/other"); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+	if err = fs.Rename("a", "c"); err != nil {
+		t.Error(err)
+	}
+	if data, err := readFile(fs, "c/append"); err != nil || string(data) != "abcd" {
+		t.Error(string(data), err)
+	}
+
+	// walk visits files and directories in lexical order
+	var paths []string
+	err = walk(fs, "c", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, filepath.ToSlash(path))
+		return nil
+	})
+	if err != nil || !reflect.DeepEqual(paths, []string{"c", "c/append", "c/b"}) {
+		t.Error(paths, err)
+	}
+	dir, err := fs.Open("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names, err := dir.Readdirnames(1); err != nil || !reflect.DeepEqual(names, []string{"append"}) {
+		t.Error(names, err)
+	}
+	if names, err := dir.Readdirnames(1); err != nil || !reflect.DeepEqual(names, []string{"b"}) {
+		t.Error(names, err)
+	}
+	if _, err := dir.Readdirnames(1); err != io.EOF {
+		t.Error(err)
+	}
+
+	if err = fs.RemoveAll("c"); err != nil {
+		t.Error(err)
+	}
+	if err = fs.RemoveAll("c"); err != nil {
+		t.Error(err)
+	}
+	if _, err = fs.Stat("c/b"); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+}
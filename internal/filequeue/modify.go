@@ -10,19 +10,34 @@ import (
 	"github.com/pkg/errors"
 )
 
-// ModifyTopic updates the topic to truncate/remove messages and return the topic offset info
+// ModifyTopic updates the topic to truncate/remove messages and return the topic offset info. Messages of the
+// delete ranges are marked as deleted once the topic is truncated, and their content is reclaimed in the background
 func (q *FileQueue) ModifyTopic(topic string, request headers.ModifyRequest) (*headers.TopicInfo, error) {
 	if topic == "" {
 		return nil, nil
 	}
+	if err := headers.ValidateIDRanges(request.Delete); err != nil {
+		return nil, err
+	}
 	topicPath := filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic)
-	latest, err := getLatestDat(topicPath)
+
+	// hold the produce lock, so that no segment is created or written to while segments are removed
+	mux := q.produceLock(topic)
+	mux.Lock()
+	defer mux.Unlock()
+
+	idx, err := q.loadIndex(topic)
 	if err != nil {
-		return nil, errors.Wrapf(err, "unable to open latest dat file for %q", topic)
+		if os.IsNotExist(err) {
+			return nil, headers.ErrTopicDoesNotExist
+		}
+		return nil, errors.Wrapf(err, "unable to load segment index for %q", topic)
 	}
+	latestBase, _ := idx.find(-1)
+	latest := formatName(latestBase)
 
 	topicInfo := &headers.TopicInfo{}
-	err = filepath.Walk(topicPath, func(path string, info os.FileInfo, err error) error {
+	err = walk(q.fs, topicPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			if os.IsNotExist(err) {
 				err = nil
@@ -30,42 +45,71 @@ func (q *FileQueue) ModifyTopic(topic string, request headers.ModifyRequest) (*h
 			return err
 		}
 
-		// ignore directories & non dat files
-		if info.IsDir() || strings.ContainsRune(info.Name(), '.') {
+		// ignore nested topics & non dat files
+		if info.IsDir() {
+			if path != topicPath {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.ContainsRune(info.Name(), '.') {
 			return nil
 		}
 
-		return truncateTopic(request, topicInfo, latest, path, info)
+		return q.truncateTopic(topic, request, topicInfo, latest, info)
 	})
 	if err != nil {
 		return nil, errors.Wrapf(err, "unable to modify topic %q", topic)
 	}
 
+	// the cached produce files may belong to a removed segment, and the index must not list removed segments
+	if q.produceCache != nil {
+		if pf := q.produceCache.Delete(topic); pf != nil {
+			closeCachedFiles(pf)
+		}
+	}
+	if q.tails != nil {
+		q.clearTail(topic)
+	}
+	if err = q.rebuildIndex(topic, idx); err != nil {
+		return nil, errors.Wrapf(err, "unable to rebuild segment index for %q", topic)
+	}
+
+	if len(request.Delete) > 0 {
+		marked, err := q.deleteMessages(topic, idx, request.Delete)
+		if marked {
+			q.startReclaim(topic)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to delete messages of %q", topic)
+		}
+		// deleting without truncating leaves the offsets of the topic as they are
+		if request.Truncate == 0 && request.Before.IsZero() {
+			return q.GetTopicInfo(topic)
+		}
+	}
 	return topicInfo, nil
 }
 
-func truncateTopic(request headers.ModifyRequest, topicInfo *headers.TopicInfo, latest string, path string, info os.FileInfo) error {
+func (q *FileQueue) truncateTopic(topic string, request headers.ModifyRequest, topicInfo *headers.TopicInfo, latest string, info os.FileInfo) error {
 	// remove all but latest if truncate is negative
 	if request.Truncate < 0 && !strings.HasPrefix(info.Name(), latest) {
-		return errors.Wrapf(os.Remove(path), "unable to remove truncated file %s", path)
+		return errors.Wrap(q.removeSegment(topic, info.Name()), "unable to remove truncated segment")
 	}
 
 	// remove all before modtime
 	if !request.Before.IsZero() && info.ModTime().Before(request.Before) {
-		return errors.Wrapf(os.Remove(path), "unable to remove timed out file %s", path)
+		return errors.Wrap(q.removeSegment(topic, info.Name()), "unable to remove timed out segment")
 	}
 
 	// remove if file is completely before the truncate point
 	base, err := strconv.ParseInt(info.Name(), 10, 64)
 	if err != nil {
-		return errors.Wrapf(os.Remove(path), "unable to remove unparsable file %s", path)
+		return errors.Wrap(q.removeSegment(topic, info.Name()), "unable to remove unparsable file")
 	}
 	datSize := info.Size() / datEntryLength
 	if request.Truncate > 0 && base+datSize < request.Truncate {
-		if err = os.Remove(path); err != nil {
-			return errors.Wrapf(os.Remove(path), "unable to remove file %s", path)
-		}
-		return errors.Wrapf(os.Remove(path+".log"), "unable to remove file %s", path)
+		return errors.Wrap(q.removeSegment(topic, info.Name()), "unable to remove segment")
 	}
 
 	// check if this is the lowest point
@@ -80,3 +124,17 @@ func truncateTopic(request headers.ModifyRequest, topicInfo *headers.TopicInfo,
 	}
 	return nil
 }
+
+// removeSegment removes the dat, log, compressed log, event times, key, subject keys and deleted files of a
+// segment from each root directory
+func (q *FileQueue) removeSegment(topic, name string) error {
+	for _, dir := range q.rootDirNames {
+		path := filepath.Join(dir, topic, name)
+		for _, p := range []string{path, path + ".log", path + compressedLogExt, path + eventTimesExt, path + segmentKeyExt, path + subjectKeysExt, path + deletedExt} {
+			if err := q.fs.Remove(p); err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "unable to remove file %s", p)
+			}
+		}
+	}
+	return nil
+}
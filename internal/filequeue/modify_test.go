@@ -25,13 +25,13 @@ func TestFileQueue_ModifyTopic(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err = q.Produce(topic, []int64{5, 5}, uint64(time.Now().Unix()), bytes.NewBuffer([]byte("helloworld"))); err != nil {
+	if _, err = q.Produce(topic, []int64{5, 5}, uint64(time.Now().UnixNano()), nil, nil, bytes.NewBuffer([]byte("helloworld"))); err != nil {
 		t.Error(err)
 	}
-	if err = q.Produce(topic, []int64{5, 5}, uint64(time.Now().Unix()), bytes.NewBuffer([]byte("hellothere"))); err != nil {
+	if _, err = q.Produce(topic, []int64{5, 5}, uint64(time.Now().UnixNano()), nil, nil, bytes.NewBuffer([]byte("hellothere"))); err != nil {
 		t.Error(err)
 	}
-	if err = q.Produce(topic, []int64{5, 5}, uint64(time.Now().Unix()), bytes.NewBuffer([]byte("helloagain"))); err != nil {
+	if _, err = q.Produce(topic, []int64{5, 5}, uint64(time.Now().UnixNano()), nil, nil, bytes.NewBuffer([]byte("helloagain"))); err != nil {
 		t.Error(err)
 	}
 	if tmp, err := os.Create(filepath.Join(dir, topic, "invalid-file")); err != nil {
@@ -76,3 +76,35 @@ func TestFileQueue_ModifyTopic(t *testing.T) {
 		t.Error(info)
 	}
 }
+
+func TestFileQueue_ModifyNestedTopic(t *testing.T) {
+	dir := ".haraqa-modify-nested"
+	topic, nested := "modify-parent", "modify-parent/child"
+
+	_ = os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	q, err := New(false, 2, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{topic, nested} {
+		if err = q.CreateTopic(name); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = q.Produce(name, []int64{5}, uint64(time.Now().UnixNano()), nil, nil, bytes.NewBuffer([]byte("hello"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// truncating a topic leaves the files of its nested topics
+	if _, err = q.ModifyTopic(topic, headers.ModifyRequest{Before: time.Now().Add(time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, topic, formatName(0))); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, nested, formatName(0))); err != nil {
+		t.Error(err)
+	}
+}
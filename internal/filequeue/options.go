@@ -0,0 +1,196 @@
+package filequeue
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Option represents a optional function argument to NewWithOptions
+type Option func(*FileQueue) error
+
+// WithFS sets the filesystem the queue is stored in, instead of the operating system's filesystem
+func WithFS(fs FS) Option {
+	return func(q *FileQueue) error {
+		if fs == nil {
+			return errors.New("filesystem cannot be nil")
+		}
+		q.fs = fs
+		return nil
+	}
+}
+
+// WithMaxOpenFiles limits the number of produce files kept open by the cache. Each topic keeps a dat and a
+// log file open per directory, once the limit is reached the files of the least recently produced to topics
+// are closed. A limit of 0 keeps the files of every topic open until the queue is closed. A limit requires the
+// queue to cache its files, it returns an error otherwise
+func WithMaxOpenFiles(n int) Option {
+	return func(q *FileQueue) error {
+		if n < 0 {
+			return errors.New("invalid max open files, value must not be negative")
+		}
+		if q.produceCache == nil {
+			if n > 0 {
+				return errors.New("invalid max open files, the queue does not cache files")
+			}
+			return nil
+		}
+		q.produceCache.mux.Lock()
+		q.produceCache.maxFiles = n
+		q.produceCache.mux.Unlock()
+		return nil
+	}
+}
+
+// WithCacheMetrics sets the handler for the hits, misses and evictions of the produce file cache
+func WithCacheMetrics(metrics CacheMetrics) Option {
+	return func(q *FileQueue) error {
+		if metrics == nil {
+			return errors.New("metrics cannot be nil")
+		}
+		if q.produceCache != nil {
+			q.produceCache.mux.Lock()
+			q.produceCache.metrics = metrics
+			q.produceCache.mux.Unlock()
+		}
+		return nil
+	}
+}
+
+// WithPersistedIndex stores the segment index of each topic in a file of the topic directory, so that the
+// directory does not need to be read the first time a topic is used after the queue is opened
+func WithPersistedIndex(persist bool) Option {
+	return func(q *FileQueue) error {
+		q.persistIndex = persist
+		return nil
+	}
+}
+
+// WithTailCache keeps the most recently produced messages of each topic in memory, up to the given number of
+// bytes per topic. Consumers reading the latest messages are served from memory instead of the files.
+// A size of 0 disables the cache
+func WithTailCache(size int64) Option {
+	return func(q *FileQueue) error {
+		if size < 0 {
+			return errors.New("invalid tail cache size, value must not be negative")
+		}
+		q.tailSize = size
+		q.tails = nil
+		if size > 0 {
+			q.tails = &sync.Map{}
+		}
+		return nil
+	}
+}
+
+// SegmentLimits are the limits at which the latest segment of a topic is closed and a new segment is started,
+// in addition to the max entries of the queue. A segment may exceed the byte limit by the last batch written to
+// it. A zero value disables a limit
+type SegmentLimits struct {
+	// MaxBytes is the size of the log of a segment
+	MaxBytes int64
+	// MaxAge is the time since the first message of a segment was produced
+	MaxAge time.Duration
+}
+
+func (l SegmentLimits) validate() error {
+	if l.MaxBytes < 0 {
+		return errors.New("invalid segment max bytes, value must not be negative")
+	}
+	if l.MaxAge < 0 {
+		return errors.New("invalid segment max age, value must not be negative")
+	}
+	return nil
+}
+
+// WithSegmentLimits sets the segment limits of every topic without its own limits
+func WithSegmentLimits(limits SegmentLimits) Option {
+	return func(q *FileQueue) error {
+		if err := limits.validate(); err != nil {
+			return err
+		}
+		q.limits = limits
+		return nil
+	}
+}
+
+// WithTopicSegmentLimits sets the segment limits of a topic, replacing the limits set by WithSegmentLimits
+func WithTopicSegmentLimits(topic string, limits SegmentLimits) Option {
+	return func(q *FileQueue) error {
+		if err := limits.validate(); err != nil {
+			return err
+		}
+		if q.topicLimits == nil {
+			q.topicLimits = make(map[string]SegmentLimits)
+		}
+		q.topicLimits[topic] = limits
+		return nil
+	}
+}
+
+// WithPreallocation preallocates the files of the latest segment of each topic while they are kept open by the
+// produce file cache, the dat files for the max entries of the queue and the log files for logSize bytes.
+// Preallocated space beyond the written data is released once the segment is sealed or the queue is closed.
+// Preallocation is only supported on linux, a size of 0 disables it
+func WithPreallocation(logSize int64) Option {
+	return func(q *FileQueue) error {
+		if logSize < 0 {
+			return errors.New("invalid preallocation size, value must not be negative")
+		}
+		q.preallocate = logSize
+		return nil
+	}
+}
+
+// WithIOHints advises the kernel that sealed segments are read sequentially by consumers, and that the pages
+// sent to a consumer can be dropped from the page cache. Hints are only supported on linux
+func WithIOHints(enable bool) Option {
+	return func(q *FileQueue) error {
+		q.ioHints = enable
+		return nil
+	}
+}
+
+// WithCompression compresses the logs of sealed segments in the background, so that they take less space on
+// disk. Consumers of a compressed segment decompress the blocks holding the messages they read. Compression
+// starts once the queue is opened, or straight away if the option is applied to an open queue
+func WithCompression(compression Compression) Option {
+	return func(q *FileQueue) error {
+		if err := compression.validate(); err != nil {
+			return err
+		}
+		if q.stop != nil {
+			return errors.New("compression has already started")
+		}
+		q.compression = &compression
+		if len(q.rootDirNames) > 0 {
+			q.startCompression()
+		}
+		return nil
+	}
+}
+
+// WithCompressionMetrics sets the handler for the sizes of the segment logs compressed in the background
+func WithCompressionMetrics(metrics CompressionMetrics) Option {
+	return func(q *FileQueue) error {
+		if metrics == nil {
+			return errors.New("metrics cannot be nil")
+		}
+		q.compressionMetrics = metrics
+		return nil
+	}
+}
+
+// WithKeyProvider encrypts the messages of the topics the provider has a current key for at rest. New segments
+// are encrypted with the current key of their topic, a segment is started as soon as the current key changes.
+// Consumers are sent the decrypted messages
+func WithKeyProvider(keys KeyProvider) Option {
+	return func(q *FileQueue) error {
+		if keys == nil {
+			return errors.New("key provider cannot be nil")
+		}
+		q.keys = keys
+		return nil
+	}
+}
@@ -1,10 +0,0 @@
-package filequeue
-
-import "os"
-
-var (
-	osMkdir    = os.Mkdir
-	osMkdirAll = os.MkdirAll
-	osOpen     = os.Open
-	osOpenFile = os.OpenFile
-)
@@ -1,13 +1,14 @@
 package filequeue
 
 import (
+	"bytes"
+	"crypto/cipher"
 	"encoding/binary"
 	"io"
 	"os"
 	"path/filepath"
-	"sort"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/haraqa/haraqa/internal/headers"
 	"github.com/pkg/errors"
@@ -15,61 +16,187 @@ import (
 
 const datEntryLength = 32
 
-// Produce copies messages from the reader into the queue log
-func (q *FileQueue) Produce(topic string, msgSizes []int64, timestamp uint64, r io.Reader) error {
+// eventTimeLength is the length of each entry of the event times file of a segment, the unix nanoseconds of
+// the event time of each message in the segment. The file is only written once a message has an event time
+const eventTimeLength = 8
+
+// eventTimesExt is the extension of the event times file of a segment
+const eventTimesExt = ".time"
+
+// Produce copies messages from the reader into the queue log and returns the ids assigned to them.
+// If a producer sequence is given and the batch has already been produced, the messages are not written
+// again and the ids assigned to the original batch are returned
+func (q *FileQueue) Produce(topic string, msgSizes []int64, timestamp uint64, eventTimes []uint64, producer *headers.ProducerSequence, r io.Reader) (*headers.ProduceInfo, error) {
+	return q.ProduceWithSubjects(topic, msgSizes, timestamp, eventTimes, nil, producer, r)
+}
+
+// ProduceWithSubjects produces messages as Produce does, encrypting each message tagged with a subject under the
+// key of its subject. The subjects are nil, or hold the subject of each message, empty for messages without one
+func (q *FileQueue) ProduceWithSubjects(topic string, msgSizes []int64, timestamp uint64, eventTimes []uint64, subjects []string, producer *headers.ProducerSequence, r io.Reader) (*headers.ProduceInfo, error) {
 	if len(msgSizes) == 0 {
-		return nil
+		return nil, nil
+	}
+	if eventTimes != nil && len(eventTimes) != len(msgSizes) {
+		return nil, headers.ErrInvalidEventTimes
+	}
+	if subjects != nil && len(subjects) != len(msgSizes) {
+		return nil, headers.ErrInvalidSubjects
 	}
 
 	if r == nil {
-		return headers.ErrInvalidBodyMissing
+		return nil, headers.ErrInvalidBodyMissing
 	}
 
 	// lock actions on the topic
-	mux, ok := q.produceLocks.Load(topic)
-	if !ok {
-		mux, _ = q.produceLocks.LoadOrStore(topic, &sync.Mutex{})
+	mux := q.produceLock(topic)
+	mux.Lock()
+	info, evicted, err := q.produce(topic, msgSizes, timestamp, eventTimes, subjects, producer, r)
+	mux.Unlock()
+
+	// close the files evicted from the cache, once the lock on this topic is released
+	if len(evicted) > 0 {
+		q.closeProduceFiles(evicted)
+	}
+	return info, err
+}
+
+// produce writes the messages to the topic, the produce lock of the topic must be held
+func (q *FileQueue) produce(topic string, msgSizes []int64, timestamp uint64, eventTimes []uint64, subjects []string, producer *headers.ProducerSequence, r io.Reader) (*headers.ProduceInfo, []produceCacheEntry, error) {
+	// Check for duplicate batches
+	var pt *producerTable
+	if producer != nil {
+		var err error
+		pt, err = q.loadProducers(topic)
+		if err != nil {
+			return nil, nil, err
+		}
+		info, err := pt.checkProducer(producer)
+		if info != nil || err != nil {
+			return info, nil, err
+		}
+	}
+
+	// Get the keys of the subjects, before any file is written
+	subjectCiphers, subjectIDs, err := q.batchSubjectKeys(subjects)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to get subject keys")
 	}
-	mux.(*sync.Mutex).Lock()
-	defer mux.(*sync.Mutex).Unlock()
 
 	// Open files
-	pf, err := q.openProduceFile(topic)
+	pf, err := q.openProduceFile(topic, timestamp)
 	if err != nil {
 		if os.IsNotExist(errors.Cause(err)) {
 			err = headers.ErrTopicDoesNotExist
 		}
-		return errors.Wrap(err, "open producer file error")
+		return nil, nil, errors.Wrap(err, "open producer file error")
 	}
-	isNewFile := pf.CurrentDatOffset == 0
+	info := &headers.ProduceInfo{StartID: pf.NextID}
+	base, logOffset := pf.Base, pf.CurrentLogOffset
 
-	// Write logs & dats
-	err = pf.Write(msgSizes, timestamp, r)
-	if err != nil {
-		return errors.Wrap(err, "write producer file error")
+	// Keep a copy of the messages for the tail cache
+	var tail *tailBuffer
+	var buf *bytes.Buffer
+	if q.tails != nil {
+		tail = q.tailBuffer(topic)
+		var total int64
+		for _, size := range msgSizes {
+			total += size
+		}
+		// encrypted messages are not kept, as consumers of the tail would be sent them as stored and messages
+		// tagged with a subject must not outlive the key of the subject
+		if total <= q.tailSize && pf.AEAD == nil && subjectCiphers == nil {
+			buf = bytes.NewBuffer(make([]byte, 0, total))
+			r = io.TeeReader(r, buf)
+		}
+	}
+
+	// Encrypt the messages tagged with a subject, then the messages of encrypted segments. The dat entries hold
+	// the sizes of the messages as stored
+	if subjectCiphers != nil {
+		msgSizes, r, err = encryptMessages(subjectCiphers, pf.NextID, msgSizes, r)
+	}
+	if err == nil && pf.AEAD != nil {
+		ciphers := make([]cipher.AEAD, len(msgSizes))
+		for i := range ciphers {
+			ciphers[i] = pf.AEAD
+		}
+		msgSizes, r, err = encryptMessages(ciphers, pf.NextID, msgSizes, r)
 	}
 
-	// Add back to pool
+	// Write logs & dats, a failed write leaves the offsets unchanged so the files can still be cached
+	if err == nil {
+		err = q.writeEventTimes(topic, pf, eventTimes)
+	}
+	if err == nil {
+		err = q.writeSubjectKeyIDs(topic, pf, len(msgSizes), subjectIDs)
+	}
+	if err == nil {
+		err = pf.Write(msgSizes, timestamp, r)
+		if err != nil && len(pf.EventTimes) > 0 {
+			// best effort, the entries are overwritten by the next batch only if it has event times
+			_ = q.writeEventTimes(topic, pf, make([]uint64, len(msgSizes)))
+		}
+		if err != nil && len(pf.SubjectKeys) > 0 {
+			_ = q.writeSubjectKeyIDs(topic, pf, len(msgSizes), nil)
+		}
+	}
+	var evicted []produceCacheEntry
 	if q.produceCache != nil {
-		q.produceCache.Store(topic, pf)
+		evicted = q.produceCache.Store(topic, pf)
+	} else {
+		closeCachedFiles(pf)
 	}
-	if q.consumeNameCache != nil && isNewFile {
-		q.consumeNameCache.Delete(topic)
+	if err != nil {
+		return nil, evicted, errors.Wrap(err, "write producer file error")
 	}
-	return nil
+	info.EndID = pf.NextID - 1
+	if tail != nil {
+		if buf != nil {
+			tail.push(info.StartID, base, timestamp, eventTimes, logOffset, msgSizes, buf.Bytes())
+		} else {
+			tail.mux.Lock()
+			tail.clear()
+			tail.mux.Unlock()
+		}
+	}
+
+	// Record the batch, if this fails the batch is still deduplicated until the queue is restarted
+	if pt != nil {
+		if err = q.storeProducer(topic, pt, producer, info); err != nil {
+			return nil, evicted, err
+		}
+	}
+	return info, evicted, nil
 }
 
 type cacheableProduceFile struct {
 	Dats, Logs       MultiWriteAtCloser
+	EventTimes       MultiWriteAtCloser
+	SubjectKeys      MultiWriteAtCloser
+	Base             int64
+	FirstTimestamp   uint64
 	NextID           int64
 	CurrentDatOffset int64
 	CurrentLogOffset int64
+	Preallocated     bool
+	KeyID            string
+	AEAD             cipher.AEAD
 }
 
 func closeCachedFiles(pf *cacheableProduceFile) {
 	if pf == nil {
 		return
 	}
+	if pf.Preallocated {
+		// best effort release of the space preallocated past the written data
+		for i := range pf.Dats {
+			_ = trim(pf.Dats[i])
+		}
+		for i := range pf.Logs {
+			_ = trim(pf.Logs[i])
+		}
+		pf.Preallocated = false
+	}
 	if len(pf.Dats) > 0 {
 		_ = pf.Dats.Close()
 		pf.Dats = nil
@@ -78,73 +205,140 @@ func closeCachedFiles(pf *cacheableProduceFile) {
 		_ = pf.Logs.Close()
 		pf.Logs = nil
 	}
+	if len(pf.EventTimes) > 0 {
+		_ = pf.EventTimes.Close()
+		pf.EventTimes = nil
+	}
+	if len(pf.SubjectKeys) > 0 {
+		_ = pf.SubjectKeys.Close()
+		pf.SubjectKeys = nil
+	}
 	pf.CurrentDatOffset = 0
 	pf.CurrentLogOffset = 0
+	pf.FirstTimestamp = 0
+	pf.KeyID = ""
+	pf.AEAD = nil
 }
 
-func (q *FileQueue) openProduceFile(topic string) (*cacheableProduceFile, error) {
+// maxSecondsTimestamp is the largest timestamp written in unix seconds, segments written before timestamps
+// were stored in nanoseconds hold timestamps in seconds
+const maxSecondsTimestamp = 1 << 35
+
+// timestampNanos returns the timestamp of a dat entry in unix nanoseconds
+func timestampNanos(ts uint64) uint64 {
+	if ts < maxSecondsTimestamp {
+		return ts * uint64(time.Second)
+	}
+	return ts
+}
+
+// segmentFull returns true if a new segment should be started before writing messages produced at the
+// timestamp, because the segment has reached the max entries or one of the segment limits of the topic, or
+// because the segment is not encrypted with the current key of the topic
+func (q *FileQueue) segmentFull(topic string, pf *cacheableProduceFile, timestamp uint64, keyID string) bool {
+	if pf.KeyID != keyID || pf.CurrentDatOffset/datEntryLength >= q.max {
+		return true
+	}
+	if pf.CurrentDatOffset == 0 {
+		return false
+	}
+	limits := q.segmentLimits(topic)
+	if limits.MaxBytes > 0 && pf.CurrentLogOffset >= limits.MaxBytes {
+		return true
+	}
+	return limits.MaxAge > 0 && timestampNanos(timestamp) >= timestampNanos(pf.FirstTimestamp)+uint64(limits.MaxAge)
+}
+
+func (q *FileQueue) openProduceFile(topic string, timestamp uint64) (*cacheableProduceFile, error) {
 	var pf *cacheableProduceFile
-	var datName string
+	var base int64
 	var loaded bool
 
+	keyID, key, err := q.currentKey(topic)
+	if err != nil {
+		return nil, err
+	}
+
 	// attempt to load from cache
 	if q.produceCache != nil {
-		if tmp, ok := q.produceCache.Load(topic); ok {
-			if pf, ok = tmp.(*cacheableProduceFile); ok {
-				// if we haven't reached the max cap, return
-				if pf.CurrentDatOffset/datEntryLength < q.max {
-					return pf, nil
-				}
-
-				// best effort close, prep to open a new set of files
-				closeCachedFiles(pf)
-				datName = formatName(pf.NextID)
-				loaded = true
+		if pf, loaded = q.produceCache.Load(topic); loaded && len(pf.Dats) == 0 {
+			// a previous attempt to open the next files failed, find the files again
+			loaded = false
+		} else if loaded {
+			// if we haven't reached the max cap, return
+			if !q.segmentFull(topic, pf, timestamp, keyID) {
+				return pf, nil
 			}
+
+			// best effort close, prep to open a new set of files
+			closeCachedFiles(pf)
+			base = pf.NextID
 		}
 	}
 
-	// find nextID based on filesystem
+	idx, err := q.loadIndex(topic)
+	if err != nil {
+		closeCachedFiles(pf)
+		return nil, errors.Wrapf(err, "unable to load segment index for %q", topic)
+	}
+
+	// find nextID based on the latest segment
 	if !loaded {
 		pf = &cacheableProduceFile{}
-		var err error
-		datName, err = getLatestDat(filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic))
-		if err != nil {
-			return nil, errors.Wrapf(err, "unable to open latest dat file for %q", topic)
-		}
+		base, _ = idx.find(-1)
 	}
 
 	// open file set
 OpenFileSet:
+	datName := formatName(base)
+	pf.Base = base
 	for _, dir := range q.rootDirNames {
 		datPath := filepath.Join(dir, topic, datName)
-		dat, err := osOpenFile(datPath, os.O_RDWR|os.O_CREATE, 0666)
+		dat, err := q.fs.OpenFile(datPath, os.O_RDWR|os.O_CREATE, 0666)
 		if err != nil {
 			closeCachedFiles(pf)
 			return nil, errors.Wrapf(err, "unable to open/create file %q", datPath)
 		}
 		logPath := filepath.Join(dir, topic, datName+".log")
-		log, err := osOpenFile(logPath, os.O_RDWR|os.O_CREATE, 0666)
+		log, err := q.fs.OpenFile(logPath, os.O_RDWR|os.O_CREATE, 0666)
 		if err != nil {
 			closeCachedFiles(pf)
 			return nil, errors.Wrapf(err, "unable to open/create file %q", logPath)
 		}
 		pf.Dats = append(pf.Dats, dat)
 		pf.Logs = append(pf.Logs, log)
+
+		// files are only preallocated while cached, as they are trimmed when closed
+		if q.preallocate > 0 && q.produceCache != nil {
+			pf.Preallocated = true
+			if err = preallocate(dat, q.max*datEntryLength); err != nil {
+				closeCachedFiles(pf)
+				return nil, errors.Wrapf(err, "unable to preallocate file %q", datPath)
+			}
+			if err = preallocate(log, q.preallocate); err != nil {
+				closeCachedFiles(pf)
+				return nil, errors.Wrapf(err, "unable to preallocate file %q", logPath)
+			}
+		}
+	}
+	if err := q.addSegment(topic, idx, base); err != nil {
+		closeCachedFiles(pf)
+		return nil, errors.Wrapf(err, "unable to index segment %q", datName)
 	}
 
 	// if we didn't load from cache, we need to stat the last file
 	if !loaded {
 		// stat file
-		dat := pf.Dats[len(pf.Dats)-1].(*os.File)
+		dat := pf.Dats[len(pf.Dats)-1].(File)
 		stat, err := dat.Stat()
 		if err != nil {
 			closeCachedFiles(pf)
 			return nil, errors.Wrapf(err, "unable to stat dat file %q", dat.Name())
 		}
 
-		// read last data entry
+		// read last data entry, an empty file starts from its base
 		size := stat.Size()
+		pf.NextID = base
 		if size >= datEntryLength {
 			var data [datEntryLength]byte
 			_, err = dat.ReadAt(data[:], size-datEntryLength-(size%datEntryLength))
@@ -155,19 +349,105 @@ OpenFileSet:
 			pf.NextID = int64(binary.LittleEndian.Uint64(data[0:8])) + 1
 			pf.CurrentDatOffset = datEntryLength * (size / datEntryLength)
 			pf.CurrentLogOffset = int64(binary.LittleEndian.Uint64(data[16:24]) + binary.LittleEndian.Uint64(data[24:32]))
+			if _, err = dat.ReadAt(data[:], 0); err != nil {
+				closeCachedFiles(pf)
+				return nil, errors.Wrap(err, "unable to read dat")
+			}
+			pf.FirstTimestamp = binary.LittleEndian.Uint64(data[8:16])
+			if pf.KeyID, err = readSegmentKeyID(q.fs, filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic, datName)); err != nil {
+				closeCachedFiles(pf)
+				return nil, errors.Wrap(err, "unable to read segment key id")
+			}
 
 			// check if this file has been filled
-			if size/datEntryLength >= q.max {
+			if q.segmentFull(topic, pf, timestamp, keyID) {
 				closeCachedFiles(pf)
-				datName = formatName(pf.NextID)
+				base = pf.NextID
 				goto OpenFileSet
 			}
 		}
 	}
 
+	// new segments are encrypted with the current key of the topic
+	if pf.CurrentDatOffset == 0 {
+		paths := make([]string, 0, len(q.rootDirNames))
+		for _, dir := range q.rootDirNames {
+			paths = append(paths, filepath.Join(dir, topic, datName))
+		}
+		if err = q.writeSegmentKeyID(paths, keyID); err != nil {
+			closeCachedFiles(pf)
+			return nil, err
+		}
+		pf.KeyID = keyID
+	}
+	if pf.KeyID != "" {
+		if pf.AEAD, err = newCipher(key); err != nil {
+			closeCachedFiles(pf)
+			return nil, errors.Wrapf(err, "unable to encrypt segment %q", datName)
+		}
+	}
+
 	return pf, nil
 }
 
+// writeEventTimes writes the event times of the messages about to be written, opening the event times files
+// of the segment if needed
+func (q *FileQueue) writeEventTimes(topic string, pf *cacheableProduceFile, eventTimes []uint64) error {
+	var set bool
+	for _, t := range eventTimes {
+		set = set || t != 0
+	}
+	if !set && len(pf.EventTimes) == 0 {
+		return nil
+	}
+	if len(pf.EventTimes) == 0 {
+		for _, dir := range q.rootDirNames {
+			path := filepath.Join(dir, topic, formatName(pf.Base)+eventTimesExt)
+			f, err := q.fs.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+			if err != nil {
+				_ = pf.EventTimes.Close()
+				pf.EventTimes = nil
+				return errors.Wrapf(err, "unable to open/create file %q", path)
+			}
+			pf.EventTimes = append(pf.EventTimes, f)
+		}
+	}
+	data := make([]byte, eventTimeLength*len(eventTimes))
+	for i, t := range eventTimes {
+		binary.LittleEndian.PutUint64(data[i*eventTimeLength:], t)
+	}
+	err := pf.EventTimes.WriteAt(data, pf.CurrentDatOffset/datEntryLength*eventTimeLength)
+	return errors.Wrap(err, "unable to write to event times file")
+}
+
+// readEventTimes reads the event times of n messages of the segment, starting from the message at the given
+// position. Nil is returned if no message has an event time
+func (q *FileQueue) readEventTimes(datPath string, pos, n int64) ([]uint64, error) {
+	f, err := q.fs.Open(datPath + eventTimesExt)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, n*eventTimeLength)
+	length, err := f.ReadAt(data, pos*eventTimeLength)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	var eventTimes []uint64
+	for i := 0; i+eventTimeLength <= length; i += eventTimeLength {
+		if t := binary.LittleEndian.Uint64(data[i:]); t != 0 {
+			if eventTimes == nil {
+				eventTimes = make([]uint64, n)
+			}
+			eventTimes[i/eventTimeLength] = t
+		}
+	}
+	return eventTimes, nil
+}
+
 var bufPool = sync.Pool{New: func() interface{} {
 	return make([]byte, 32*1024)
 }}
@@ -212,34 +492,11 @@ func (pf *cacheableProduceFile) Write(msgSizes []int64, timestamp uint64, r io.R
 		return errors.Wrap(err, "unable to write to dat file")
 	}
 
+	if pf.CurrentDatOffset == 0 {
+		pf.FirstTimestamp = timestamp
+	}
 	pf.NextID = nextID
 	pf.CurrentDatOffset += int64(len(data))
 	pf.CurrentLogOffset = offset
 	return nil
 }
-
-func getLatestDat(path string) (string, error) {
-	dir, err := osOpen(path)
-	if err != nil {
-		return "", err
-	}
-	defer dir.Close()
-	names, err := dir.Readdirnames(-1)
-	if err != nil {
-		return "", err
-	}
-	sort.Sort(sortableDirNames(names))
-	for i := range names {
-		if !strings.HasSuffix(names[i], ".log") {
-			return names[i], nil
-		}
-	}
-	return formatName(0), nil
-}
-
-// sortableDirNames attaches the methods of sort.Interface to []string, sorting in decreasing order.
-type sortableDirNames []string
-
-func (p sortableDirNames) Len() int           { return len(p) }
-func (p sortableDirNames) Less(i, j int) bool { return len(p[i]) < len(p[j]) || p[i] > p[j] }
-func (p sortableDirNames) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
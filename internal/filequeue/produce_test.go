@@ -2,9 +2,11 @@ package filequeue
 
 import (
 	"bytes"
+	"net/http/httptest"
 	"os"
-	"sort"
-	"strings"
+	"reflect"
+	"strconv"
+	"syscall"
 	"testing"
 	"time"
 
@@ -12,27 +14,6 @@ import (
 	"github.com/pkg/errors"
 )
 
-func TestSortableDirNames(t *testing.T) {
-	names := []string{
-		formatName(1),
-		formatName(0) + ".log",
-		formatName(1) + ".log",
-		formatName(0),
-		formatName(2),
-	}
-	sort.Sort(sortableDirNames(names))
-	n := int64(2)
-	for _, name := range names {
-		if strings.HasSuffix(name, ".log") {
-			continue
-		}
-		if name != formatName(n) {
-			t.Error(names, name, n)
-		}
-		n--
-	}
-}
-
 func TestFileQueue_Produce(t *testing.T) {
 	topic := "produce-topic"
 	_ = os.RemoveAll(".haraqa-producer")
@@ -49,19 +30,19 @@ func TestFileQueue_Produce(t *testing.T) {
 	}()
 
 	// no messages
-	err = q.Produce(topic, nil, 0, nil)
+	_, err = q.Produce(topic, nil, 0, nil, nil, nil)
 	if err != nil {
 		t.Error(err)
 	}
 
 	// no body
-	err = q.Produce(topic, []int64{123}, 0, nil)
+	_, err = q.Produce(topic, []int64{123}, 0, nil, nil, nil)
 	if !errors.Is(err, headers.ErrInvalidBodyMissing) {
 		t.Error(err)
 	}
 
 	// no topic
-	err = q.Produce(topic, []int64{123}, 0, bytes.NewBuffer(nil))
+	_, err = q.Produce(topic, []int64{123}, 0, nil, nil, bytes.NewBuffer(nil))
 	if !errors.Is(err, headers.ErrTopicDoesNotExist) {
 		t.Error(err)
 	}
@@ -78,7 +59,7 @@ func TestFileQueue_Produce(t *testing.T) {
 		if _, err = r.Write(input); err != nil {
 			t.Error(err)
 		}
-		err = q.Produce(topic, []int64{5, int64(len(input) - 5)}, uint64(time.Now().Unix()), r)
+		_, err = q.Produce(topic, []int64{5, int64(len(input) - 5)}, uint64(time.Now().UnixNano()), nil, nil, r)
 		if err != nil {
 			t.Error(err)
 		}
@@ -89,7 +70,7 @@ func TestFileQueue_Produce(t *testing.T) {
 		if _, err = r.Write(input); err != nil {
 			t.Error(err)
 		}
-		err = q.Produce(topic, []int64{5, int64(len(input) - 5)}, uint64(time.Now().Unix()), r)
+		_, err = q.Produce(topic, []int64{5, int64(len(input) - 5)}, uint64(time.Now().UnixNano()), nil, nil, r)
 		if err != nil {
 			t.Error(err)
 		}
@@ -101,7 +82,7 @@ func TestFileQueue_Produce(t *testing.T) {
 		if _, err = r.Write(input); err != nil {
 			t.Error(err)
 		}
-		err = q.Produce(topic, []int64{5, int64(len(input) - 5)}, uint64(time.Now().Unix()), r)
+		_, err = q.Produce(topic, []int64{5, int64(len(input) - 5)}, uint64(time.Now().UnixNano()), nil, nil, r)
 		if err != nil {
 			t.Error(err)
 		}
@@ -113,10 +94,267 @@ func TestFileQueue_Produce(t *testing.T) {
 		if _, err = r.Write(input); err != nil {
 			t.Error(err)
 		}
-		err = q.Produce(topic, []int64{5, int64(len(input) - 5)}, uint64(time.Now().Unix()), r)
+		_, err = q.Produce(topic, []int64{5, int64(len(input) - 5)}, uint64(time.Now().UnixNano()), nil, nil, r)
 		if err != nil {
 			t.Error(err)
 		}
 	}
 
 }
+
+func TestFileQueue_ProduceIdempotent(t *testing.T) {
+	topic := "idempotent-topic"
+	_ = os.RemoveAll(".haraqa-idempotent")
+	defer os.RemoveAll(".haraqa-idempotent")
+
+	q, err := New(true, 5000, ".haraqa-idempotent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	// nested topics and the producers file must not be mistaken for dat files
+	if err = q.CreateTopic(topic + "/nested"); err != nil {
+		t.Fatal(err)
+	}
+
+	produce := func(q *FileQueue, producer *headers.ProducerSequence, expected headers.ProduceInfo) {
+		t.Helper()
+		info, err := q.Produce(topic, []int64{5, 6}, uint64(time.Now().UnixNano()), nil, producer, bytes.NewBufferString("hello world"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *info != expected {
+			t.Error(*info, expected)
+		}
+	}
+
+	p1 := &headers.ProducerSequence{ID: "producer-1", Seq: 1}
+	p2 := &headers.ProducerSequence{ID: "producer-2", Seq: 7}
+	produce(q, p1, headers.ProduceInfo{StartID: 0, EndID: 1})
+	produce(q, p2, headers.ProduceInfo{StartID: 2, EndID: 3})
+	produce(q, nil, headers.ProduceInfo{StartID: 4, EndID: 5})
+
+	// retried batches are acknowledged with the original ids
+	produce(q, p1, headers.ProduceInfo{StartID: 0, EndID: 1, Duplicate: true})
+	produce(q, p2, headers.ProduceInfo{StartID: 2, EndID: 3, Duplicate: true})
+
+	// old batches are rejected
+	p1.Seq = 2
+	produce(q, p1, headers.ProduceInfo{StartID: 6, EndID: 7})
+	_, err = q.Produce(topic, []int64{5}, 0, nil, &headers.ProducerSequence{ID: "producer-1", Seq: 1}, bytes.NewBufferString("hello"))
+	if !errors.Is(err, headers.ErrStaleProducerSeq) {
+		t.Error(err)
+	}
+	if err = q.Close(); err != nil {
+		t.Error(err)
+	}
+
+	// producer state is kept after a restart
+	q, err = New(true, 5000, ".haraqa-idempotent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	produce(q, p1, headers.ProduceInfo{StartID: 6, EndID: 7, Duplicate: true})
+	produce(q, p2, headers.ProduceInfo{StartID: 2, EndID: 3, Duplicate: true})
+	p2.Seq++
+	produce(q, p2, headers.ProduceInfo{StartID: 8, EndID: 9})
+
+	// the producers file is compacted
+	pt, err := q.loadProducers(topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt.records = compactRecords
+	p2.Seq++
+	produce(q, p2, headers.ProduceInfo{StartID: 10, EndID: 11})
+	if pt.records != 2 {
+		t.Error(pt.records)
+	}
+	q.producers.Delete(topic)
+	produce(q, p2, headers.ProduceInfo{StartID: 10, EndID: 11, Duplicate: true})
+	produce(q, p1, headers.ProduceInfo{StartID: 6, EndID: 7, Duplicate: true})
+
+	// the producers with the oldest batches are forgotten, also when the producers file is read again
+	for i := 0; i < headers.MaxTrackedProducers; i++ {
+		producer := &headers.ProducerSequence{ID: "tracked-" + strconv.Itoa(i), Seq: 1}
+		produce(q, producer, headers.ProduceInfo{StartID: 12 + 2*int64(i), EndID: 13 + 2*int64(i)})
+	}
+	for _, reload := range []bool{false, true} {
+		if reload {
+			q.producers.Delete(topic)
+		}
+		pt, err = q.loadProducers(topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, p1Tracked := pt.states[p1.ID]
+		_, p2Tracked := pt.states[p2.ID]
+		if len(pt.states) != headers.MaxTrackedProducers || p1Tracked || p2Tracked {
+			t.Error(reload, len(pt.states), p1Tracked, p2Tracked)
+		}
+	}
+
+	// deleted topics forget their producers
+	if err = q.DeleteTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.producers.Load(topic); ok {
+		t.Error("expected producers to be removed")
+	}
+}
+
+func TestFileQueue_SegmentLimits(t *testing.T) {
+	if _, err := NewWithOptions(true, 10, []string{"a"}, WithSegmentLimits(SegmentLimits{MaxBytes: -1})); err == nil {
+		t.Error("expected invalid max bytes")
+	}
+	if _, err := NewWithOptions(true, 10, []string{"a"}, WithTopicSegmentLimits("topic", SegmentLimits{MaxAge: -1})); err == nil {
+		t.Error("expected invalid max age")
+	}
+
+	for _, cache := range []bool{true, false} {
+		fs := NewMemFS()
+		open := func() *FileQueue {
+			q, err := NewWithOptions(cache, 100, []string{"a"}, WithFS(fs),
+				WithSegmentLimits(SegmentLimits{MaxBytes: 4}),
+				WithTopicSegmentLimits("aged", SegmentLimits{MaxAge: time.Minute}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return q
+		}
+		q := open()
+		for _, topic := range []string{"sized", "aged"} {
+			if err := q.CreateTopic(topic); err != nil {
+				t.Fatal(err)
+			}
+		}
+		produce := func(topic string, timestamp uint64, msg string) {
+			t.Helper()
+			if _, err := q.Produce(topic, []int64{int64(len(msg))}, timestamp, nil, nil, bytes.NewBufferString(msg)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		segments := func(topic string, expected ...int64) {
+			t.Helper()
+			bases, err := q.scanSegments(topic)
+			if err != nil || !reflect.DeepEqual(bases, expected) {
+				t.Error(cache, topic, bases, err)
+			}
+		}
+
+		// a segment is rolled once its log reaches the max bytes, a batch may exceed it
+		produce("sized", 0, "abc")
+		produce("sized", 0, "defgh")
+		produce("sized", 0, "i")
+		segments("sized", 0, 2)
+
+		// the topic limits replace the global limits, the segment rolls once its first message is a minute old
+		produce("aged", 100, "abcdef")
+		produce("aged", 159, "g")
+		produce("aged", 160, "h")
+		produce("aged", 170, "i")
+		segments("aged", 0, 2)
+
+		// the limits are checked against segments reopened from disk
+		if err := q.Close(); err != nil {
+			t.Fatal(err)
+		}
+		q = open()
+		produce("aged", 219, "j")
+		segments("aged", 0, 2)
+		produce("aged", 220, "k")
+		segments("aged", 0, 2, 5)
+		produce("sized", 0, "jkl")
+		segments("sized", 0, 2)
+		produce("sized", 0, "m")
+		segments("sized", 0, 2, 4)
+		if err := q.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFileQueue_EventTimes(t *testing.T) {
+	const topic = "events"
+	fs := NewFaultFS(NewMemFS())
+	q, err := NewWithOptions(true, 3, []string{"a", "b"}, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	produce := func(eventTimes []uint64, msgs string) error {
+		sizes := make([]int64, len(msgs))
+		for i := range sizes {
+			sizes[i] = 1
+		}
+		_, err := q.Produce(topic, sizes, 5, eventTimes, nil, bytes.NewBufferString(msgs))
+		return err
+	}
+	if err = produce([]uint64{1}, "ab"); !errors.Is(err, headers.ErrInvalidEventTimes) {
+		t.Error(err)
+	}
+
+	// the event times file is only created once a message has an event time
+	if err = produce(nil, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Stat("b/" + topic + "/" + formatName(0) + eventTimesExt); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+	if err = produce([]uint64{0, 20}, "bc"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed write does not leave its event times for the next batch
+	fs.Inject(Fault{Op: FaultWrite, Path: ".log", Err: syscall.EIO, Times: 1})
+	if err = produce([]uint64{30}, "d"); !errors.Is(err, syscall.EIO) {
+		t.Error(err)
+	}
+	if err = produce(nil, "d"); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"a", "b"} {
+		data, err := readFile(fs, dir+"/"+topic+"/"+formatName(0)+eventTimesExt)
+		if err != nil || !bytes.Equal(data, encodeBases(0, 0, 20)) {
+			t.Error(dir, data, err)
+		}
+		data, err = readFile(fs, dir+"/"+topic+"/"+formatName(3)+eventTimesExt)
+		if err != nil || !bytes.Equal(data, encodeBases(0)) {
+			t.Error(dir, data, err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	if _, err = q.Consume("", topic, 1, -1, w); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(w.Header()[headers.HeaderEventTimes], []string{"", "1970-01-01T00:00:00.00000002Z"}) {
+		t.Error(w.Header())
+	}
+	w = httptest.NewRecorder()
+	if _, err = q.Consume("", topic, 3, -1, w); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := w.Header()[headers.HeaderEventTimes]; ok {
+		t.Error(v)
+	}
+
+	// timestamps written in seconds are reported in nanoseconds
+	if v := w.Header().Get(headers.HeaderStartTime); v != "1970-01-01T00:00:05Z" {
+		t.Error(v)
+	}
+
+	// the event times are removed with their segment
+	if _, err = q.ModifyTopic(topic, headers.ModifyRequest{Truncate: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Stat("a/" + topic + "/" + formatName(0) + eventTimesExt); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+}
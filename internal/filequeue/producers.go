@@ -0,0 +1,135 @@
+package filequeue
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+const (
+	// producersFileName is the file in each topic directory recording the last batch of each idempotent producer
+	producersFileName = ".producers"
+
+	// producerRecordLength is the length of a producer record, excluding the producer id
+	producerRecordLength = 25
+)
+
+// producerState is the last batch produced by an idempotent producer
+type producerState struct {
+	seq     uint64
+	startID int64
+	endID   int64
+}
+
+// producerTable holds the state of the idempotent producers of a topic. It is guarded by the topic produce lock
+type producerTable struct {
+	states  map[string]producerState
+	records int
+}
+
+// checkProducer returns the ids of the original batch if the producer sequence has already been produced.
+// Only the last batch of each producer is tracked, so any greater sequence is accepted as a new batch, even
+// if sequences were skipped, and producers that are not tracked are accepted at any sequence. Up to
+// headers.MaxTrackedProducers producers are tracked per topic, see evictProducer
+func (pt *producerTable) checkProducer(producer *headers.ProducerSequence) (*headers.ProduceInfo, error) {
+	state, ok := pt.states[producer.ID]
+	if !ok || producer.Seq > state.seq {
+		return nil, nil
+	}
+	if producer.Seq < state.seq {
+		return nil, headers.ErrStaleProducerSeq
+	}
+	return &headers.ProduceInfo{
+		StartID:   state.startID,
+		EndID:     state.endID,
+		Duplicate: true,
+	}, nil
+}
+
+// loadProducers reads the producer states of the topic, from the cache or the producers file
+func (q *FileQueue) loadProducers(topic string) (*producerTable, error) {
+	if v, ok := q.producers.Load(topic); ok {
+		return v.(*producerTable), nil
+	}
+
+	pt := &producerTable{states: make(map[string]producerState)}
+	data, err := q.readTopicRecords(topic, producersFileName)
+	if err != nil {
+		return nil, err
+	}
+	for len(data) >= producerRecordLength {
+		idLength := int(data[producerRecordLength-1])
+		if len(data) < producerRecordLength+idLength {
+			// partially written record
+			break
+		}
+		pt.states[string(data[producerRecordLength:producerRecordLength+idLength])] = producerState{
+			seq:     binary.LittleEndian.Uint64(data[0:8]),
+			startID: int64(binary.LittleEndian.Uint64(data[8:16])),
+			endID:   int64(binary.LittleEndian.Uint64(data[16:24])),
+		}
+		pt.records++
+		data = data[producerRecordLength+idLength:]
+	}
+	for len(pt.states) > headers.MaxTrackedProducers {
+		pt.evictProducer()
+	}
+
+	q.producers.Store(topic, pt)
+	return pt, nil
+}
+
+// storeProducer records the last batch of the producer in the producers file of each root directory
+func (q *FileQueue) storeProducer(topic string, pt *producerTable, producer *headers.ProducerSequence, info *headers.ProduceInfo) error {
+	pt.states[producer.ID] = producerState{
+		seq:     producer.Seq,
+		startID: info.StartID,
+		endID:   info.EndID,
+	}
+	if len(pt.states) > headers.MaxTrackedProducers {
+		pt.evictProducer()
+	}
+
+	// rewrite the file with only the latest states once enough records have been appended
+	if pt.records >= compactRecords && pt.records > 2*len(pt.states) {
+		buf := bytes.NewBuffer(make([]byte, 0, len(pt.states)*(producerRecordLength+32)))
+		for id, state := range pt.states {
+			buf.Write(encodeProducerRecord(id, state))
+		}
+		if err := q.replaceTopicRecords(topic, producersFileName, buf.Bytes()); err != nil {
+			return err
+		}
+		pt.records = len(pt.states)
+		return nil
+	}
+
+	if err := q.appendTopicRecord(topic, producersFileName, encodeProducerRecord(producer.ID, pt.states[producer.ID])); err != nil {
+		return err
+	}
+	pt.records++
+	return nil
+}
+
+// evictProducer forgets the producer whose last batch is the oldest. Ids increase with each batch, so it is
+// the producer with the lowest end id. Its records are dropped from the producers file when it is compacted
+func (pt *producerTable) evictProducer() {
+	var oldest string
+	minID := int64(-1)
+	for id, state := range pt.states {
+		if minID < 0 || state.endID < minID {
+			oldest, minID = id, state.endID
+		}
+	}
+	delete(pt.states, oldest)
+}
+
+func encodeProducerRecord(id string, state producerState) []byte {
+	record := make([]byte, producerRecordLength+len(id))
+	binary.LittleEndian.PutUint64(record[0:8], state.seq)
+	binary.LittleEndian.PutUint64(record[8:16], uint64(state.startID))
+	binary.LittleEndian.PutUint64(record[16:24], uint64(state.endID))
+	record[producerRecordLength-1] = byte(len(id))
+	copy(record[producerRecordLength:], id)
+	return record
+}
@@ -0,0 +1,54 @@
+package filequeue
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// compactRecords is the number of records appended to a topic state file before it is compacted
+const compactRecords = 4096
+
+// readTopicRecords reads a topic state file from the last root directory. A missing file is treated as empty
+func (q *FileQueue) readTopicRecords(topic, name string) ([]byte, error) {
+	path := filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic, name)
+	data, err := readFile(q.fs, path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "unable to read %q", path)
+	}
+	return data, nil
+}
+
+// appendTopicRecord appends a record to a topic state file in each root directory
+func (q *FileQueue) appendTopicRecord(topic, name string, record []byte) error {
+	for _, dir := range q.rootDirNames {
+		path := filepath.Join(dir, topic, name)
+		f, err := q.fs.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		if err != nil {
+			return errors.Wrapf(err, "unable to open %q", path)
+		}
+		_, err = f.Write(record)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return errors.Wrapf(err, "unable to write %q", path)
+		}
+	}
+	return nil
+}
+
+// replaceTopicRecords replaces the contents of a topic state file in each root directory
+func (q *FileQueue) replaceTopicRecords(topic, name string, data []byte) error {
+	for _, dir := range q.rootDirNames {
+		path := filepath.Join(dir, topic, name)
+		if err := writeFile(q.fs, path+".tmp", data, 0666); err != nil {
+			return errors.Wrapf(err, "unable to write %q", path)
+		}
+		if err := q.fs.Rename(path+".tmp", path); err != nil {
+			return errors.Wrapf(err, "unable to replace %q", path)
+		}
+	}
+	return nil
+}
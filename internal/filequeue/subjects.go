@@ -0,0 +1,247 @@
+package filequeue
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// Messages can be tagged with a subject, such as the person the message is about, to encrypt them with AES-GCM
+// under a data key of the subject. Destroying the key of a subject makes its messages unrecoverable without
+// rewriting the segments holding them, consumers are sent them as redacted. The keys are stored in the
+// .subjects directory of each root directory, as:
+//
+//	subject-<hex sha256 of the subject>, the id of the subject's key
+//	key-<hex id>, the key
+//
+// The <base>.subj file of a segment holds the id of the subject key of each message, all zero for messages
+// without a subject. Like the event times file, it is only written once a message of the segment has a subject.
+// Tagged messages are stored in the log as a random nonce followed by the ciphertext, authenticated with the id
+// of the message, and are then encrypted with the key of the topic if the topic is encrypted
+const (
+	subjectKeysDir     = ".subjects"
+	subjectKeysExt     = ".subj"
+	subjectKeyIDLength = 16
+)
+
+// subjectKey is the cached key of a subject
+type subjectKey struct {
+	id   [subjectKeyIDLength]byte
+	aead cipher.AEAD
+}
+
+func subjectFileName(subject string) string {
+	hash := sha256.Sum256([]byte(subject))
+	return "subject-" + hex.EncodeToString(hash[:])
+}
+
+func subjectKeyFileName(id [subjectKeyIDLength]byte) string {
+	return "key-" + hex.EncodeToString(id[:])
+}
+
+// subjectKey returns the key of the subject, creating it in each root directory if it does not exist
+func (q *FileQueue) subjectKey(subject string) (*subjectKey, error) {
+	if v, ok := q.subjectKeys.Load(subject); ok {
+		return v.(*subjectKey), nil
+	}
+	q.subjectMux.Lock()
+	defer q.subjectMux.Unlock()
+	if v, ok := q.subjectKeys.Load(subject); ok {
+		return v.(*subjectKey), nil
+	}
+
+	// a subject file without a key is left over from a destroyed key, and is replaced
+	k := &subjectKey{}
+	data, err := readFile(q.fs, filepath.Join(q.RootDir(), subjectKeysDir, subjectFileName(subject)))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "unable to read subject key id")
+	}
+	if err == nil && len(data) == subjectKeyIDLength {
+		copy(k.id[:], data)
+		if k.aead, err = q.subjectCipher(k.id); err != nil {
+			return nil, err
+		}
+	}
+	if k.aead == nil {
+		if k, err = q.createSubjectKey(subject); err != nil {
+			return nil, err
+		}
+	}
+	q.subjectKeys.Store(subject, k)
+	return k, nil
+}
+
+// createSubjectKey generates a key for the subject, the key is written to each root directory before the
+// subject is mapped to it
+func (q *FileQueue) createSubjectKey(subject string) (*subjectKey, error) {
+	k := &subjectKey{}
+	key := make([]byte, 32)
+	if _, err := rand.Read(k.id[:]); err != nil {
+		return nil, errors.Wrap(err, "unable to generate subject key id")
+	}
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Wrap(err, "unable to generate subject key")
+	}
+	var err error
+	if k.aead, err = newCipher(key); err != nil {
+		return nil, err
+	}
+	for _, dir := range q.rootDirNames {
+		dir = filepath.Join(dir, subjectKeysDir)
+		if err = q.fs.MkdirAll(dir, os.ModePerm); err != nil {
+			return nil, errors.Wrapf(err, "unable to create subject key directory %q", dir)
+		}
+		if err = writeFile(q.fs, filepath.Join(dir, subjectKeyFileName(k.id)), key, 0600); err != nil {
+			return nil, errors.Wrap(err, "unable to write subject key")
+		}
+	}
+	for _, dir := range q.rootDirNames {
+		if err = writeFile(q.fs, filepath.Join(dir, subjectKeysDir, subjectFileName(subject)), k.id[:], 0600); err != nil {
+			return nil, errors.Wrap(err, "unable to write subject key id")
+		}
+	}
+	q.subjectCiphers.Store(k.id, k.aead)
+	return k, nil
+}
+
+// subjectCipher returns the cipher of the subject key with the given id, or nil if the key was destroyed
+func (q *FileQueue) subjectCipher(id [subjectKeyIDLength]byte) (cipher.AEAD, error) {
+	if v, ok := q.subjectCiphers.Load(id); ok {
+		return v.(cipher.AEAD), nil
+	}
+	key, err := readFile(q.fs, filepath.Join(q.RootDir(), subjectKeysDir, subjectKeyFileName(id)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read subject key")
+	}
+	aead, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	q.subjectCiphers.Store(id, aead)
+	return aead, nil
+}
+
+// DestroySubject destroys the key of the subject in each root directory, the messages tagged with the subject
+// can no longer be decrypted and are consumed as redacted. Messages produced later with the subject are
+// encrypted under a new key
+func (q *FileQueue) DestroySubject(subject string) error {
+	if subject == "" {
+		return headers.ErrInvalidSubject
+	}
+	q.subjectMux.Lock()
+	defer q.subjectMux.Unlock()
+
+	name := subjectFileName(subject)
+	data, err := readFile(q.fs, filepath.Join(q.RootDir(), subjectKeysDir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to read subject key id")
+	}
+	var id [subjectKeyIDLength]byte
+	copy(id[:], data)
+	q.subjectKeys.Delete(subject)
+	q.subjectCiphers.Delete(id)
+
+	for _, dir := range q.rootDirNames {
+		for _, p := range []string{subjectKeyFileName(id), name} {
+			p = filepath.Join(dir, subjectKeysDir, p)
+			if err = q.fs.Remove(p); err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "unable to remove %q", p)
+			}
+		}
+	}
+	return nil
+}
+
+// batchSubjectKeys returns the keys of the subjects of a batch, with nil for messages without a subject, and the
+// ids of the keys to record in the subject keys file. Nil is returned if no message has a subject
+func (q *FileQueue) batchSubjectKeys(subjects []string) ([]cipher.AEAD, []byte, error) {
+	var ciphers []cipher.AEAD
+	var ids []byte
+	for i, subject := range subjects {
+		if subject == "" {
+			continue
+		}
+		k, err := q.subjectKey(subject)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ciphers == nil {
+			ciphers = make([]cipher.AEAD, len(subjects))
+			ids = make([]byte, len(subjects)*subjectKeyIDLength)
+		}
+		ciphers[i] = k.aead
+		copy(ids[i*subjectKeyIDLength:], k.id[:])
+	}
+	return ciphers, ids, nil
+}
+
+// writeSubjectKeyIDs writes the subject key ids of the n messages about to be written, opening the subject keys
+// files of the segment if needed. Nil ids are written as messages without a subject
+func (q *FileQueue) writeSubjectKeyIDs(topic string, pf *cacheableProduceFile, n int, ids []byte) error {
+	if ids == nil && len(pf.SubjectKeys) == 0 {
+		return nil
+	}
+	if ids == nil {
+		ids = make([]byte, n*subjectKeyIDLength)
+	}
+	if len(pf.SubjectKeys) == 0 {
+		for _, dir := range q.rootDirNames {
+			path := filepath.Join(dir, topic, formatName(pf.Base)+subjectKeysExt)
+			f, err := q.fs.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+			if err != nil {
+				_ = pf.SubjectKeys.Close()
+				pf.SubjectKeys = nil
+				return errors.Wrapf(err, "unable to open/create file %q", path)
+			}
+			pf.SubjectKeys = append(pf.SubjectKeys, f)
+		}
+	}
+	err := pf.SubjectKeys.WriteAt(ids, pf.CurrentDatOffset/datEntryLength*subjectKeyIDLength)
+	return errors.Wrap(err, "unable to write to subject keys file")
+}
+
+// readSubjectKeyIDs reads the subject key ids of n messages of the segment, starting from the message at the
+// given position. Nil is returned if no message has a subject
+func (q *FileQueue) readSubjectKeyIDs(datPath string, pos, n int64) ([][subjectKeyIDLength]byte, error) {
+	f, err := q.fs.Open(datPath + subjectKeysExt)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, n*subjectKeyIDLength)
+	length, err := f.ReadAt(data, pos*subjectKeyIDLength)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	var ids [][subjectKeyIDLength]byte
+	var none [subjectKeyIDLength]byte
+	for i := 0; i+subjectKeyIDLength <= length; i += subjectKeyIDLength {
+		var id [subjectKeyIDLength]byte
+		copy(id[:], data[i:])
+		if id == none {
+			continue
+		}
+		if ids == nil {
+			ids = make([][subjectKeyIDLength]byte, n)
+		}
+		ids[i/subjectKeyIDLength] = id
+	}
+	return ids, nil
+}
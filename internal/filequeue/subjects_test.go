@@ -0,0 +1,137 @@
+package filequeue
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/haraqa/haraqa/internal/headers"
+	"github.com/pkg/errors"
+)
+
+func TestFileQueue_Subjects(t *testing.T) {
+	const topic = "subjects"
+	fs := NewMemFS()
+	keys := &testKeys{current: map[string]string{}, keys: map[string][]byte{"k1": bytes.Repeat([]byte{1}, 16)}}
+	q, err := NewWithOptions(true, 10, []string{"a", "b"}, WithFS(fs), WithTailCache(1024), WithKeyProvider(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err = q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	produce := func(subjects []string, msgs ...string) {
+		t.Helper()
+		sizes := make([]int64, len(msgs))
+		for i, msg := range msgs {
+			sizes[i] = int64(len(msg))
+		}
+		if _, err := q.ProduceWithSubjects(topic, sizes, 0, nil, subjects, nil, bytes.NewBufferString(strings.Join(msgs, ""))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	consume := func(q *FileQueue, id, limit int64, redacted []bool, expected ...string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		n, err := q.Consume("", topic, id, limit, w)
+		if err != nil || n != len(expected) || (w.Code != http.StatusOK && w.Code != http.StatusPartialContent) {
+			t.Fatal(n, err, w.Code)
+		}
+		if body, _ := ioutil.ReadAll(w.Body); string(body) != strings.Join(expected, "") {
+			t.Error(string(body))
+		}
+		sizes, err := headers.ReadSizes(w.Header())
+		if err != nil || len(sizes) != len(expected) {
+			t.Fatal(sizes, err)
+		}
+		for i := range sizes {
+			if sizes[i] != int64(len(expected[i])) {
+				t.Error(sizes, expected)
+			}
+		}
+		if r, err := headers.ReadRedacted(w.Header()); err != nil || !reflect.DeepEqual(r, redacted) {
+			t.Error(r, err)
+		}
+	}
+
+	if _, err = q.ProduceWithSubjects(topic, []int64{1}, 0, nil, []string{"a", "b"}, nil, bytes.NewBufferString("a")); !errors.Is(err, headers.ErrInvalidSubjects) {
+		t.Error(err)
+	}
+
+	// messages tagged with a subject are stored encrypted, the key store is not a topic
+	produce([]string{"alice", "", "bob"}, "alice's data", "public", "bob's data")
+	produce(nil, "untagged")
+	for _, dir := range []string{"a", "b"} {
+		log, err := readFile(fs, dir+"/"+topic+"/"+formatName(0)+".log")
+		if err != nil || bytes.Contains(log, []byte("data")) || !bytes.Contains(log, []byte("public")) {
+			t.Error(string(log), err)
+		}
+	}
+	if topics, err := q.ListTopics("", "", ""); err != nil || !reflect.DeepEqual(topics, []string{topic}) {
+		t.Error(topics, err)
+	}
+	consume(q, 0, -1, nil, "alice's data", "public", "bob's data", "untagged")
+
+	// topic encryption is applied on top of the subject keys
+	keys.current[topic] = "k1"
+	produce([]string{"alice"}, "encrypted")
+	consume(q, 4, -1, nil, "encrypted")
+
+	// destroying a subject's key redacts its messages, in each root directory
+	if err = q.DestroySubject(""); !errors.Is(err, headers.ErrInvalidSubject) {
+		t.Error(err)
+	}
+	if err = q.DestroySubject("unknown"); err != nil {
+		t.Error(err)
+	}
+	if err = q.DestroySubject("alice"); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"a", "b"} {
+		infos, err := readDir(fs, dir+"/"+subjectKeysDir)
+		if err != nil || len(infos) != 2 {
+			t.Error(infos, err)
+		}
+	}
+	consume(q, 0, -1, []bool{true, false, false, false}, "", "public", "bob's data", "untagged")
+	consume(q, 4, -1, []bool{true}, "")
+
+	// keys are read from the key store once the queue is reopened, a destroyed subject gets a new key
+	reopened, err := NewWithOptions(true, 10, []string{"a", "b"}, WithFS(fs), WithKeyProvider(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	consume(reopened, 0, 3, []bool{true, false, false}, "", "public", "bob's data")
+	produce([]string{"alice"}, "new data")
+	consume(reopened, 4, -1, []bool{true, false}, "", "new data")
+
+	// failing to create a subject key leaves the topic unchanged
+	faults := NewFaultFS(fs)
+	faulty, err := NewWithOptions(true, 10, []string{"a", "b"}, WithFS(faults))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer faulty.Close()
+	faults.Inject(Fault{Op: FaultMkdirAll, Path: subjectKeysDir, Err: os.ErrPermission})
+	if _, err = faulty.ProduceWithSubjects(topic, []int64{1}, 0, nil, []string{"carol"}, nil, bytes.NewBufferString("c")); !errors.Is(err, os.ErrPermission) {
+		t.Error(err)
+	}
+	if info, err := faulty.GetTopicInfo(topic); err != nil || info.MaxOffset != 5 {
+		t.Error(info, err)
+	}
+
+	// subject keys files are removed with their segment
+	if _, err = q.ModifyTopic(topic, headers.ModifyRequest{Truncate: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Stat("a/" + topic + "/" + formatName(0) + subjectKeysExt); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+}
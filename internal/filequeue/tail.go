@@ -0,0 +1,227 @@
+package filequeue
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// tailEntry is a recently produced message kept in memory
+type tailEntry struct {
+	id        int64
+	base      int64
+	timestamp uint64
+	eventTime uint64
+	offset    int64
+	data      []byte
+}
+
+// tailBuffer is a ring buffer of the latest messages of a topic. The buffer always holds a contiguous run of
+// ids ending at the latest produced message, the oldest messages are dropped once the memory budget is used
+type tailBuffer struct {
+	mux    sync.RWMutex
+	budget int64
+	used   int64
+	ring   []tailEntry
+	head   int
+	n      int
+}
+
+func newTailBuffer(budget int64) *tailBuffer {
+	return &tailBuffer{budget: budget}
+}
+
+// at returns the i-th oldest message in the buffer
+func (b *tailBuffer) at(i int) *tailEntry {
+	return &b.ring[(b.head+i)%len(b.ring)]
+}
+
+// push adds the messages of a produced batch, the data of the batch is shared by the messages
+func (b *tailBuffer) push(startID, base int64, timestamp uint64, eventTimes []uint64, offset int64, msgSizes []int64, data []byte) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	// the buffer must stay contiguous, and batches larger than the budget are not kept
+	if int64(len(data)) > b.budget || (b.n > 0 && b.at(b.n-1).id+1 != startID) {
+		b.clear()
+		if int64(len(data)) > b.budget {
+			return
+		}
+	}
+
+	for i, size := range msgSizes {
+		if b.n == len(b.ring) {
+			b.grow()
+		}
+		*b.at(b.n) = tailEntry{
+			id:        startID + int64(i),
+			base:      base,
+			timestamp: timestamp,
+			offset:    offset,
+			data:      data[:size:size],
+		}
+		if eventTimes != nil {
+			b.at(b.n).eventTime = eventTimes[i]
+		}
+		b.n++
+		b.used += size
+		offset += size
+		data = data[size:]
+	}
+
+	// drop the oldest messages until the buffer is within budget
+	for b.used > b.budget {
+		e := b.at(0)
+		b.used -= int64(len(e.data))
+		*e = tailEntry{}
+		b.head = (b.head + 1) % len(b.ring)
+		b.n--
+	}
+}
+
+func (b *tailBuffer) grow() {
+	ring := make([]tailEntry, 2*len(b.ring)+16)
+	for i := 0; i < b.n; i++ {
+		ring[i] = *b.at(i)
+	}
+	b.ring = ring
+	b.head = 0
+}
+
+// clear drops every message in the buffer, the lock must be held
+func (b *tailBuffer) clear() {
+	for i := 0; i < b.n; i++ {
+		*b.at(i) = tailEntry{}
+	}
+	b.head, b.n, b.used = 0, 0, 0
+}
+
+// read returns up to limit messages starting from the id, which all belong to the same segment, and the size
+// of the segment log. A negative id reads the latest message, a negative limit reads to the end of the segment.
+// False is returned if the buffer does not hold the id, in which case the messages must be read from disk
+func (b *tailBuffer) read(id, limit int64) ([]tailEntry, int64, bool) {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	if b.n == 0 {
+		return nil, 0, false
+	}
+	first, next := b.at(0).id, b.at(b.n-1).id+1
+	if id < 0 {
+		id = next - 1
+	}
+	if id < first {
+		return nil, 0, false
+	}
+	if id >= next || limit == 0 {
+		return nil, 0, true
+	}
+
+	// the messages of a segment are contiguous in the buffer
+	i := int(id - first)
+	base := b.at(i).base
+	end := i + sort.Search(b.n-i, func(j int) bool { return b.at(i+j).base != base })
+	last := b.at(end - 1)
+	if limit > 0 && int64(end-i) > limit {
+		end = i + int(limit)
+	}
+	entries := make([]tailEntry, 0, end-i)
+	for ; i < end; i++ {
+		entries = append(entries, *b.at(i))
+	}
+	return entries, last.offset + int64(len(last.data)), true
+}
+
+// tailBuffer returns the tail buffer of the topic, creating it if it does not exist
+func (q *FileQueue) tailBuffer(topic string) *tailBuffer {
+	if v, ok := q.tails.Load(topic); ok {
+		return v.(*tailBuffer)
+	}
+	v, _ := q.tails.LoadOrStore(topic, newTailBuffer(q.tailSize))
+	return v.(*tailBuffer)
+}
+
+// clearTail drops the buffered messages of a topic, after messages are removed from disk
+func (q *FileQueue) clearTail(topic string) {
+	if v, ok := q.tails.Load(topic); ok {
+		b := v.(*tailBuffer)
+		b.mux.Lock()
+		b.clear()
+		b.mux.Unlock()
+	}
+}
+
+// consumeTail writes the messages from the tail buffer of the topic. False is returned if the buffer does
+// not hold the id
+func (q *FileQueue) consumeTail(topic string, id, limit int64, w http.ResponseWriter) (int, bool, error) {
+	v, ok := q.tails.Load(topic)
+	if !ok {
+		return 0, false, nil
+	}
+	entries, size, ok := v.(*tailBuffer).read(id, limit)
+	if !ok || len(entries) == 0 {
+		return 0, ok, nil
+	}
+
+	// build the dat entries and the log content of the messages, as they were written to disk
+	data := make([]byte, len(entries)*datEntryLength)
+	content := &tailReader{start: entries[0].offset, size: size}
+	var eventTimes []uint64
+	for i, e := range entries {
+		if e.eventTime != 0 {
+			if eventTimes == nil {
+				eventTimes = make([]uint64, len(entries))
+			}
+			eventTimes[i] = e.eventTime
+		}
+		binary.LittleEndian.PutUint64(data[i*datEntryLength:], uint64(e.id))
+		binary.LittleEndian.PutUint64(data[i*datEntryLength+8:], e.timestamp)
+		binary.LittleEndian.PutUint64(data[i*datEntryLength+16:], uint64(e.offset))
+		binary.LittleEndian.PutUint64(data[i*datEntryLength+24:], uint64(len(e.data)))
+		content.data = append(content.data, e.data...)
+	}
+	filename := filepath.Join(q.rootDirNames[len(q.rootDirNames)-1], topic, formatName(entries[0].base)) + ".log"
+	n, err := q.serveConsume(w, data, eventTimes, int64(len(entries)), filename, content)
+	return n, true, err
+}
+
+// tailReader is a log file of the given size, holding only the messages read from a tail buffer
+type tailReader struct {
+	data  []byte
+	start int64
+	size  int64
+	pos   int64
+}
+
+func (r *tailReader) Read(p []byte) (int, error) {
+	if r.pos < r.start {
+		return 0, errors.New("read before the buffered messages")
+	}
+	if r.pos >= r.start+int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[r.pos-r.start:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *tailReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
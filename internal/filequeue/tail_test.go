@@ -0,0 +1,151 @@
+package filequeue
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestTailBuffer(t *testing.T) {
+	b := newTailBuffer(10)
+	if _, _, ok := b.read(0, -1); ok {
+		t.Error("expected empty buffer")
+	}
+
+	ids := func(entries []tailEntry) []int64 {
+		var ids []int64
+		for _, e := range entries {
+			ids = append(ids, e.id)
+		}
+		return ids
+	}
+	check := func(id, limit int64, expected []int64, expectedOK bool) {
+		t.Helper()
+		entries, _, ok := b.read(id, limit)
+		if ok != expectedOK || !reflect.DeepEqual(ids(entries), expected) {
+			t.Error(id, limit, ids(entries), ok)
+		}
+	}
+
+	// messages 0-1 are in segment 0, 2-5 in segment 2
+	b.push(0, 0, 1, nil, 0, []int64{2, 2}, []byte("aabb"))
+	b.push(2, 2, 1, nil, 0, []int64{1, 1, 1}, []byte("cde"))
+	check(0, -1, []int64{0, 1}, true)
+	check(1, 10, []int64{1}, true)
+	check(2, 2, []int64{2, 3}, true)
+	check(-1, -1, []int64{4}, true)
+	check(5, -1, nil, true)
+
+	// the oldest messages are dropped to stay within the budget
+	b.push(5, 2, 1, nil, 3, []int64{3}, []byte("fff"))
+	if b.used != 10 || b.n != 6 {
+		t.Error(b.used, b.n)
+	}
+	b.push(6, 2, 1, nil, 6, []int64{2}, []byte("gg"))
+	if b.used != 10 || b.n != 6 {
+		t.Error(b.used, b.n)
+	}
+	check(0, -1, nil, false)
+	check(1, -1, []int64{1}, true)
+	check(2, -1, []int64{2, 3, 4, 5, 6}, true)
+	if e, size, _ := b.read(5, 1); len(e) != 1 || string(e[0].data) != "fff" || e[0].offset != 3 || size != 8 {
+		t.Error(e, size)
+	}
+
+	// batches larger than the budget and gaps in the ids clear the buffer
+	b.push(7, 2, 1, nil, 8, []int64{11}, make([]byte, 11))
+	check(6, -1, nil, false)
+	b.push(8, 2, 1, nil, 19, []int64{1}, []byte("h"))
+	b.push(10, 2, 1, nil, 21, []int64{1}, []byte("j"))
+	check(8, -1, nil, false)
+	check(10, -1, []int64{10}, true)
+
+	// the ring grows, keeping the order of the messages
+	b = newTailBuffer(100)
+	for i := int64(0); i < 40; i++ {
+		b.push(i, 0, 1, nil, i, []int64{1}, []byte{byte(i)})
+	}
+	entries, _, _ := b.read(0, -1)
+	for i, e := range entries {
+		if e.id != int64(i) || e.data[0] != byte(i) {
+			t.Error(i, e)
+		}
+	}
+}
+
+func TestFileQueue_TailCache(t *testing.T) {
+	if _, err := NewWithOptions(true, 3, []string{"a"}, WithTailCache(-1)); err == nil {
+		t.Error("expected invalid tail cache size")
+	}
+
+	const topic = "tail"
+	fs := NewFaultFS(NewMemFS())
+	q, err := NewWithOptions(true, 3, []string{"a", "b"}, WithFS(fs), WithTailCache(6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	disk, err := NewWithOptions(true, 3, []string{"a"}, WithFS(NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+
+	for _, queue := range []*FileQueue{q, disk} {
+		if err = queue.CreateTopic(topic); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 8; i++ {
+			if _, err = queue.Produce(topic, []int64{1, 1}, uint64(i), nil, nil, bytes.NewBufferString(strconv.Itoa(i)+"x")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// the tail is served from memory with the same response as from disk
+	fs.Inject(Fault{Op: FaultOpen, Path: topic + "/", Err: syscall.EIO})
+	for _, c := range []struct{ id, limit int64 }{{10, -1}, {12, -1}, {13, 1}, {14, 5}, {-1, -1}, {16, -1}} {
+		w, expected := httptest.NewRecorder(), httptest.NewRecorder()
+		n, err := q.Consume("", topic, c.id, c.limit, w)
+		expectedN, _ := disk.Consume("", topic, c.id, c.limit, expected)
+		if err != nil || n != expectedN || w.Code != expected.Code || w.Body.String() != expected.Body.String() {
+			t.Error(c, n, expectedN, err, w.Body.String(), expected.Body.String())
+		}
+		for _, key := range []string{headers.HeaderStartID, headers.HeaderEndID, headers.HeaderSizes, headers.HeaderStartTime, "Content-Range"} {
+			if w.Header().Get(key) != expected.Header().Get(key) {
+				t.Error(c, key, w.Header().Get(key), expected.Header().Get(key))
+			}
+		}
+	}
+
+	// older messages are read from disk
+	if _, err = q.Consume("", topic, 9, -1, httptest.NewRecorder()); !errors.Is(err, syscall.EIO) {
+		t.Error(err)
+	}
+	fs.Reset()
+
+	// removing messages clears the tail
+	if _, err = q.ModifyTopic(topic, headers.ModifyRequest{Truncate: 12}); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _, ok := q.tailBuffer(topic).read(15, -1); ok || entries != nil {
+		t.Error(entries)
+	}
+	w := httptest.NewRecorder()
+	if n, err := q.Consume("", topic, 15, -1, w); err != nil || n != 1 || w.Body.String() != "x" {
+		t.Error(n, err, w.Body.String())
+	}
+	if err = q.DeleteTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.tails.Load(topic); ok {
+		t.Error("expected tail to be deleted")
+	}
+}
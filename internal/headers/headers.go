@@ -1,8 +1,10 @@
 package headers
 
 import (
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -17,19 +19,50 @@ const (
 	HeaderFileName      = "X-File-Name"
 	HeaderWatchTopics   = "X-Topics"
 	HeaderConsumerGroup = "X-Consumer-Group"
+	HeaderWatchFormat   = "X-Watch-Format"
+	HeaderProducerID    = "X-Producer-Id"
+	HeaderProducerSeq   = "X-Producer-Seq"
+	HeaderStartID       = "X-Start-Id"
+	HeaderEndID         = "X-End-Id"
+	HeaderDuplicate     = "X-Duplicate"
+	HeaderMinOffset     = "X-Min-Offset"
+	HeaderMaxOffset     = "X-Max-Offset"
+	HeaderGroupOffset   = "X-Consumer-Offset"
+	HeaderEventTimes    = "X-Event-Times"
+	HeaderSubjects      = "X-Subjects"
+	HeaderRedacted      = "X-Redacted"
+	HeaderDeleted       = "X-Deleted"
+	HeaderDeliverAt     = "X-Deliver-At"
 	ContentType         = "Content-Type"
+	ContentEncoding     = "Content-Encoding"
+	AcceptEncoding      = "Accept-Encoding"
 )
 
 const (
 	errTopicDoesNotExist   = "topic does not exist"
 	errTopicAlreadyExists  = "topic already exists"
 	errInvalidHeaderSizes  = "invalid header: " + HeaderSizes
+	errInvalidEventTimes   = "invalid header: " + HeaderEventTimes
+	errInvalidSubjects     = "invalid header: " + HeaderSubjects
+	errInvalidRedacted     = "invalid header: " + HeaderRedacted
+	errInvalidDeleted      = "invalid header: " + HeaderDeleted
+	errInvalidDeleteRange  = "invalid delete range"
+	errInvalidSubject      = "invalid subject"
+	errUnsupportedSubjects = "queue does not support subjects"
+	errInvalidDeliverAt    = "invalid header: " + HeaderDeliverAt
+	errUnsupportedDelay    = "queue does not support delayed messages"
 	errInvalidMessageID    = "invalid message id"
 	errInvalidMessageLimit = "invalid message limit"
 	errInvalidTopic        = "invalid topic"
+	errReservedTopic       = "invalid topic: names starting with a dot are reserved"
 	errInvalidBodyMissing  = "invalid body: body cannot be empty"
 	errInvalidBodyJSON     = "invalid body: invalid json entry"
+	errInvalidBodyEncoding = "invalid body: unsupported content encoding"
 	errInvalidWebsocket    = "invalid websocket"
+	errInvalidProducer     = "invalid header: " + HeaderProducerID + "/" + HeaderProducerSeq
+	errStaleProducerSeq    = "stale producer sequence"
+	errInvalidGroup        = "invalid header: " + HeaderConsumerGroup
+	errInvalidWait         = "invalid wait duration"
 	errNoContent           = "no content"
 	errClosed              = "server closing"
 )
@@ -39,12 +72,27 @@ var (
 	ErrTopicDoesNotExist   = errors.New(errTopicDoesNotExist)
 	ErrTopicAlreadyExists  = errors.New(errTopicAlreadyExists)
 	ErrInvalidHeaderSizes  = errors.New(errInvalidHeaderSizes)
+	ErrInvalidEventTimes   = errors.New(errInvalidEventTimes)
+	ErrInvalidSubjects     = errors.New(errInvalidSubjects)
+	ErrInvalidRedacted     = errors.New(errInvalidRedacted)
+	ErrInvalidDeleted      = errors.New(errInvalidDeleted)
+	ErrInvalidDeleteRange  = errors.New(errInvalidDeleteRange)
+	ErrInvalidSubject      = errors.New(errInvalidSubject)
+	ErrUnsupportedSubjects = errors.New(errUnsupportedSubjects)
+	ErrInvalidDeliverAt    = errors.New(errInvalidDeliverAt)
+	ErrUnsupportedDelay    = errors.New(errUnsupportedDelay)
 	ErrInvalidMessageID    = errors.New(errInvalidMessageID)
 	ErrInvalidMessageLimit = errors.New(errInvalidMessageLimit)
 	ErrInvalidTopic        = errors.New(errInvalidTopic)
+	ErrReservedTopic       = errors.New(errReservedTopic)
 	ErrInvalidBodyMissing  = errors.New(errInvalidBodyMissing)
 	ErrInvalidBodyJSON     = errors.New(errInvalidBodyJSON)
+	ErrInvalidBodyEncoding = errors.New(errInvalidBodyEncoding)
 	ErrInvalidWebsocket    = errors.New(errInvalidWebsocket)
+	ErrInvalidProducer     = errors.New(errInvalidProducer)
+	ErrStaleProducerSeq    = errors.New(errStaleProducerSeq)
+	ErrInvalidGroup        = errors.New(errInvalidGroup)
+	ErrInvalidWait         = errors.New(errInvalidWait)
 	ErrNoContent           = errors.New(errNoContent)
 	ErrClosed              = errors.New(errClosed)
 )
@@ -53,12 +101,27 @@ var errMap = map[string]error{
 	errTopicDoesNotExist:   ErrTopicDoesNotExist,
 	errTopicAlreadyExists:  ErrTopicAlreadyExists,
 	errInvalidHeaderSizes:  ErrInvalidHeaderSizes,
+	errInvalidEventTimes:   ErrInvalidEventTimes,
+	errInvalidSubjects:     ErrInvalidSubjects,
+	errInvalidRedacted:     ErrInvalidRedacted,
+	errInvalidDeleted:      ErrInvalidDeleted,
+	errInvalidDeleteRange:  ErrInvalidDeleteRange,
+	errInvalidSubject:      ErrInvalidSubject,
+	errUnsupportedSubjects: ErrUnsupportedSubjects,
+	errInvalidDeliverAt:    ErrInvalidDeliverAt,
+	errUnsupportedDelay:    ErrUnsupportedDelay,
 	errInvalidMessageID:    ErrInvalidMessageID,
 	errInvalidMessageLimit: ErrInvalidMessageLimit,
 	errInvalidTopic:        ErrInvalidTopic,
+	errReservedTopic:       ErrReservedTopic,
 	errInvalidBodyMissing:  ErrInvalidBodyMissing,
 	errInvalidBodyJSON:     ErrInvalidBodyJSON,
+	errInvalidBodyEncoding: ErrInvalidBodyEncoding,
 	errInvalidWebsocket:    ErrInvalidWebsocket,
+	errInvalidProducer:     ErrInvalidProducer,
+	errStaleProducerSeq:    ErrStaleProducerSeq,
+	errInvalidGroup:        ErrInvalidGroup,
+	errInvalidWait:         ErrInvalidWait,
 	errNoContent:           ErrNoContent,
 	errClosed:              ErrClosed,
 }
@@ -77,13 +140,30 @@ func SetError(w http.ResponseWriter, errOriginal error) {
 		w.WriteHeader(http.StatusPreconditionFailed)
 	case
 		ErrInvalidHeaderSizes,
+		ErrInvalidEventTimes,
+		ErrInvalidSubjects,
+		ErrInvalidRedacted,
+		ErrInvalidDeleted,
+		ErrInvalidDeleteRange,
+		ErrInvalidSubject,
+		ErrInvalidDeliverAt,
 		ErrInvalidMessageID,
 		ErrInvalidMessageLimit,
 		ErrInvalidTopic,
+		ErrReservedTopic,
 		ErrInvalidBodyMissing,
 		ErrInvalidBodyJSON,
-		ErrInvalidWebsocket:
+		ErrInvalidWebsocket,
+		ErrInvalidProducer,
+		ErrInvalidGroup,
+		ErrInvalidWait:
 		w.WriteHeader(http.StatusBadRequest)
+	case ErrInvalidBodyEncoding:
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+	case ErrUnsupportedSubjects, ErrUnsupportedDelay:
+		w.WriteHeader(http.StatusNotImplemented)
+	case ErrStaleProducerSeq:
+		w.WriteHeader(http.StatusConflict)
 	case ErrNoContent:
 		w.WriteHeader(http.StatusNoContent)
 	case ErrClosed:
@@ -94,6 +174,15 @@ func SetError(w http.ResponseWriter, errOriginal error) {
 	_, _ = w.Write([]byte(errOriginal.Error()))
 }
 
+// Retryable returns true if the error is temporary and the request can safely be sent again
+func Retryable(err error) bool {
+	switch errors.Cause(err) {
+	case ErrClosed:
+		return true
+	}
+	return false
+}
+
 // ReadErrors reads any errors from the response header and returns as an error type
 func ReadErrors(header http.Header) error {
 	errs := header[HeaderErrors]
@@ -104,15 +193,23 @@ func ReadErrors(header http.Header) error {
 		if err == "" {
 			continue
 		}
-		e, ok := errMap[err]
-		if !ok {
-			return errors.New(err)
-		}
-		return e
+		return ReadError(err)
 	}
 	return nil
 }
 
+// ReadError converts an error message sent by the server back into its error type
+func ReadError(msg string) error {
+	if msg == "" {
+		return nil
+	}
+	e, ok := errMap[msg]
+	if !ok {
+		return errors.New(msg)
+	}
+	return e
+}
+
 // ReadSizes reads the message sizes from the header
 func ReadSizes(header http.Header) ([]int64, error) {
 	sizes := header[HeaderSizes]
@@ -140,10 +237,359 @@ func SetSizes(msgSizes []int64, h http.Header) http.Header {
 	return h
 }
 
-// ModifyRequest is the request structure required by the modify endpoints
+// ReadEventTimes reads the event times of the messages from the header, as unix nanoseconds. Messages without
+// an event time are 0, nil is returned if no message has an event time
+func ReadEventTimes(header http.Header) ([]uint64, error) {
+	values := header[HeaderEventTimes]
+	if len(values) == 0 {
+		return nil, nil
+	}
+	eventTimes := make([]uint64, len(values))
+	for i, v := range values {
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil || t.UnixNano() <= 0 {
+			return nil, ErrInvalidEventTimes
+		}
+		eventTimes[i] = uint64(t.UnixNano())
+	}
+	return eventTimes, nil
+}
+
+// SetEventTimes sets the event times of the messages in the header, given as unix nanoseconds. The header is
+// not set if no message has an event time
+func SetEventTimes(eventTimes []uint64, h http.Header) http.Header {
+	var set bool
+	values := make([]string, len(eventTimes))
+	for i, t := range eventTimes {
+		if t != 0 {
+			values[i] = FormatTime(t)
+			set = true
+		}
+	}
+	if set {
+		h[HeaderEventTimes] = values
+	}
+	return h
+}
+
+// ReadDeliverAt reads the time the messages are to be delivered at from the header, the zero time is returned
+// if the header is not set
+func ReadDeliverAt(header http.Header) (time.Time, error) {
+	v := header.Get(HeaderDeliverAt)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil || t.UnixNano() <= 0 {
+		return time.Time{}, ErrInvalidDeliverAt
+	}
+	return t, nil
+}
+
+// SetDeliverAt sets the time the messages are to be delivered at in the header. The header is not set for the
+// zero time
+func SetDeliverAt(deliverAt time.Time, h http.Header) http.Header {
+	if !deliverAt.IsZero() {
+		h[HeaderDeliverAt] = []string{deliverAt.UTC().Format(time.RFC3339Nano)}
+	}
+	return h
+}
+
+// ReadSubjects reads the subjects the messages are tagged with from the header. Messages without a subject are
+// empty, nil is returned if no message has a subject
+func ReadSubjects(header http.Header) []string {
+	values := header[HeaderSubjects]
+	if len(values) == 0 {
+		return nil
+	}
+	return values
+}
+
+// SetSubjects sets the subjects the messages are tagged with in the header. The header is not set if no message
+// has a subject
+func SetSubjects(subjects []string, h http.Header) http.Header {
+	for _, subject := range subjects {
+		if subject != "" {
+			h[HeaderSubjects] = subjects
+			break
+		}
+	}
+	return h
+}
+
+// ReadRedacted reads which of the messages were redacted from the header, nil is returned if no message was
+// redacted
+func ReadRedacted(header http.Header) ([]bool, error) {
+	return readFlags(header, HeaderRedacted, ErrInvalidRedacted)
+}
+
+// SetRedacted sets which of the messages were redacted in the header. The header is not set if no message was
+// redacted
+func SetRedacted(redacted []bool, h http.Header) http.Header {
+	return setFlags(redacted, HeaderRedacted, h)
+}
+
+// ReadDeleted reads which of the messages were deleted from the header, nil is returned if no message was
+// deleted
+func ReadDeleted(header http.Header) ([]bool, error) {
+	return readFlags(header, HeaderDeleted, ErrInvalidDeleted)
+}
+
+// SetDeleted sets which of the messages were deleted in the header. The header is not set if no message was
+// deleted
+func SetDeleted(deleted []bool, h http.Header) http.Header {
+	return setFlags(deleted, HeaderDeleted, h)
+}
+
+// readFlags reads a flag per message from the header, an empty value is false
+func readFlags(header http.Header, key string, errInvalid error) ([]bool, error) {
+	values := header[key]
+	if len(values) == 0 {
+		return nil, nil
+	}
+	flags := make([]bool, len(values))
+	for i, v := range values {
+		if v == "" {
+			continue
+		}
+		var err error
+		if flags[i], err = strconv.ParseBool(v); err != nil {
+			return nil, errInvalid
+		}
+	}
+	return flags, nil
+}
+
+// setFlags sets a flag per message in the header, true flags are "true" and false flags are empty. The header
+// is not set if no flag is true
+func setFlags(flags []bool, key string, h http.Header) http.Header {
+	var set bool
+	values := make([]string, len(flags))
+	for i, f := range flags {
+		if f {
+			values[i] = "true"
+			set = true
+		}
+	}
+	if set {
+		h[key] = values
+	}
+	return h
+}
+
+// FormatTime formats a timestamp given as unix nanoseconds for the time headers
+func FormatTime(t uint64) string {
+	return time.Unix(0, int64(t)).UTC().Format(time.RFC3339Nano)
+}
+
+// EventTimeNanos converts event times to unix nanoseconds as taken by SetEventTimes, zero times are 0
+func EventTimeNanos(eventTimes []time.Time) []uint64 {
+	if eventTimes == nil {
+		return nil
+	}
+	nanos := make([]uint64, len(eventTimes))
+	for i, t := range eventTimes {
+		if !t.IsZero() && t.UnixNano() > 0 {
+			nanos[i] = uint64(t.UnixNano())
+		}
+	}
+	return nanos
+}
+
+// ValidateProduce returns an error if the event times or subjects of n produced messages, when given, do not
+// have a value per message, or if messages to be delivered in the future are tagged with subjects
+func ValidateProduce(n int, eventTimes []time.Time, subjects []string, deliverAt time.Time) error {
+	if eventTimes != nil && len(eventTimes) != n {
+		return ErrInvalidEventTimes
+	}
+	if subjects != nil && len(subjects) != n {
+		return ErrInvalidSubjects
+	}
+	if subjects != nil && deliverAt.After(time.Now()) {
+		return ErrInvalidDeliverAt
+	}
+	return nil
+}
+
+// Message is a consumed message along with its attributes
+type Message struct {
+	Topic string
+	ID    int64
+	Data  []byte
+	// EventTime is the time given by the producer of the message, or the zero time if none was given
+	EventTime time.Time
+	// Redacted is set if the message was tagged with a subject whose key has been destroyed, Data is then empty
+	Redacted bool
+	// Deleted is set if the message has been deleted, Data is then empty
+	Deleted bool
+}
+
+// ReadMessages reads the messages of a consume response from the body, along with their attributes from the
+// header. The ids of the messages start from id if the header does not contain the id of the first message
+func ReadMessages(topic string, id int64, header http.Header, body io.Reader) ([]*Message, error) {
+	sizes, err := ReadSizes(header)
+	if err != nil {
+		return nil, err
+	}
+	n := len(sizes)
+	eventTimes, err := ReadEventTimes(header)
+	if err == nil && eventTimes != nil && len(eventTimes) != n {
+		err = ErrInvalidEventTimes
+	}
+	if err != nil {
+		return nil, err
+	}
+	redacted, err := ReadRedacted(header)
+	if err == nil && redacted != nil && len(redacted) != n {
+		err = ErrInvalidRedacted
+	}
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := ReadDeleted(header)
+	if err == nil && deleted != nil && len(deleted) != n {
+		err = ErrInvalidDeleted
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v := header.Get(HeaderStartID); v != "" {
+		if id, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, errors.Wrap(err, "invalid header: "+HeaderStartID)
+		}
+	}
+
+	msgs := make([]*Message, n)
+	for i := range msgs {
+		msg := &Message{Topic: topic, ID: id + int64(i), Data: make([]byte, sizes[i])}
+		if _, err = io.ReadFull(body, msg.Data); err != nil {
+			return nil, err
+		}
+		if eventTimes != nil && eventTimes[i] != 0 {
+			msg.EventTime = time.Unix(0, int64(eventTimes[i])).UTC()
+		}
+		msg.Redacted = redacted != nil && redacted[i]
+		msg.Deleted = deleted != nil && deleted[i]
+		msgs[i] = msg
+	}
+	return msgs, nil
+}
+
+// MaxProducerIDLength is the longest producer id accepted in the HeaderProducerID header
+const MaxProducerIDLength = 255
+
+// MaxTrackedProducers is the number of idempotent producers a queue tracks per topic. Once reached, the
+// producer whose last batch is the oldest is forgotten, and its next batch is accepted as new
+const MaxTrackedProducers = 1024
+
+// ProducerSequence identifies a batch of messages sent by an idempotent producer. Batches are
+// numbered in increasing order by each producer, a repeated sequence number marks a retried batch
+type ProducerSequence struct {
+	ID  string
+	Seq uint64
+}
+
+// ReadProducerSequence reads the producer id and sequence from the header. It returns nil if
+// the request was not sent by an idempotent producer
+func ReadProducerSequence(header http.Header) (*ProducerSequence, error) {
+	id := header.Get(HeaderProducerID)
+	if id == "" {
+		return nil, nil
+	}
+	if len(id) > MaxProducerIDLength {
+		return nil, ErrInvalidProducer
+	}
+	seq, err := strconv.ParseUint(header.Get(HeaderProducerSeq), 10, 64)
+	if err != nil || seq == 0 {
+		return nil, ErrInvalidProducer
+	}
+	return &ProducerSequence{ID: id, Seq: seq}, nil
+}
+
+// SetProducerSequence sets the producer id and sequence in the header
+func SetProducerSequence(producer *ProducerSequence, h http.Header) http.Header {
+	h[HeaderProducerID] = []string{producer.ID}
+	h[HeaderProducerSeq] = []string{strconv.FormatUint(producer.Seq, 10)}
+	return h
+}
+
+// ProduceInfo describes the ids assigned to a batch of produced messages. Duplicate is set if the
+// batch had already been produced, in which case the ids are those assigned to the original batch
+type ProduceInfo struct {
+	StartID   int64
+	EndID     int64
+	Duplicate bool
+}
+
+// SetProduceInfo sets the produced ids in the header
+func SetProduceInfo(info *ProduceInfo, h http.Header) http.Header {
+	h[HeaderStartID] = []string{strconv.FormatInt(info.StartID, 10)}
+	h[HeaderEndID] = []string{strconv.FormatInt(info.EndID, 10)}
+	if info.Duplicate {
+		h[HeaderDuplicate] = []string{"true"}
+	}
+	return h
+}
+
+// ReadProduceInfo reads the produced ids from the header. It returns nil if the header does not contain them
+func ReadProduceInfo(h http.Header) (*ProduceInfo, error) {
+	if h.Get(HeaderStartID) == "" {
+		return nil, nil
+	}
+	var err error
+	info := &ProduceInfo{}
+	info.StartID, err = strconv.ParseInt(h.Get(HeaderStartID), 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid header: "+HeaderStartID)
+	}
+	info.EndID, err = strconv.ParseInt(h.Get(HeaderEndID), 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid header: "+HeaderEndID)
+	}
+	info.Duplicate = h.Get(HeaderDuplicate) == "true"
+	return info, nil
+}
+
+// ModifyRequest is the request structure required by the modify endpoints. Delete tombstones the messages of
+// each id range, they are kept in the topic with their ids but consumed as deleted messages without content
 type ModifyRequest struct {
 	Truncate int64     `json:"truncate,omitempty"`
 	Before   time.Time `json:"before,omitempty"`
+	Delete   []IDRange `json:"delete,omitempty"`
+}
+
+// IDRange is a range of message ids, from Start to End inclusive
+type IDRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// ValidateTopic returns ErrInvalidTopic if a name in the topic's path is empty or a relative path element, and
+// ErrReservedTopic if a name starts with a dot. Such names are reserved for the queue, such as the subject key
+// store of a file queue, and are not listed as topics
+func ValidateTopic(topic string) error {
+	for _, name := range strings.Split(topic, "/") {
+		switch {
+		case name == "", name == ".", name == "..":
+			return ErrInvalidTopic
+		case strings.HasPrefix(name, "."):
+			return ErrReservedTopic
+		}
+	}
+	return nil
+}
+
+// ValidateIDRanges returns ErrInvalidDeleteRange if a range has a negative start or ends before it starts
+func ValidateIDRanges(ranges []IDRange) error {
+	for _, r := range ranges {
+		if r.Start < 0 || r.End < r.Start {
+			return ErrInvalidDeleteRange
+		}
+	}
+	return nil
 }
 
 // TopicInfo is the response structure returned by the modify endpoints
@@ -151,3 +597,50 @@ type TopicInfo struct {
 	MinOffset int64 `json:"minOffset"`
 	MaxOffset int64 `json:"maxOffset"`
 }
+
+// SetTopicInfo sets the topic offsets in the header
+func SetTopicInfo(info *TopicInfo, h http.Header) http.Header {
+	h[HeaderMinOffset] = []string{strconv.FormatInt(info.MinOffset, 10)}
+	h[HeaderMaxOffset] = []string{strconv.FormatInt(info.MaxOffset, 10)}
+	return h
+}
+
+// ReadTopicInfo reads the topic offsets from the header
+func ReadTopicInfo(h http.Header) (*TopicInfo, error) {
+	var err error
+	info := &TopicInfo{}
+	info.MinOffset, err = strconv.ParseInt(h.Get(HeaderMinOffset), 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid header: "+HeaderMinOffset)
+	}
+	info.MaxOffset, err = strconv.ParseInt(h.Get(HeaderMaxOffset), 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid header: "+HeaderMaxOffset)
+	}
+	return info, nil
+}
+
+// Formats for messages sent over a watch websocket, set with the HeaderWatchFormat header
+const (
+	WatchFormatJSON = "json"
+	WatchFormatText = "text"
+)
+
+// EventType describes the kind of change made to a watched topic
+type EventType string
+
+// Event types sent to watchers of a topic
+const (
+	EventProduced  EventType = "produced"
+	EventCreated   EventType = "created"
+	EventDeleted   EventType = "deleted"
+	EventTruncated EventType = "truncated"
+	EventModified  EventType = "modified"
+)
+
+// WatchEvent is the structure sent to websocket clients watching topics
+type WatchEvent struct {
+	Type  EventType `json:"type"`
+	Topic string    `json:"topic"`
+	TopicInfo
+}
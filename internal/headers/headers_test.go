@@ -1,10 +1,13 @@
 package headers
 
 import (
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -19,11 +22,32 @@ func TestErrors(t *testing.T) {
 
 	// bad request
 	testError(t, ErrInvalidHeaderSizes, http.StatusBadRequest)
+	testError(t, ErrInvalidEventTimes, http.StatusBadRequest)
+	testError(t, ErrInvalidSubjects, http.StatusBadRequest)
+	testError(t, ErrInvalidRedacted, http.StatusBadRequest)
+	testError(t, ErrInvalidDeleted, http.StatusBadRequest)
+	testError(t, ErrInvalidDeleteRange, http.StatusBadRequest)
+	testError(t, ErrInvalidSubject, http.StatusBadRequest)
 	testError(t, ErrInvalidMessageID, http.StatusBadRequest)
 	testError(t, ErrInvalidMessageLimit, http.StatusBadRequest)
 	testError(t, ErrInvalidTopic, http.StatusBadRequest)
+	testError(t, ErrReservedTopic, http.StatusBadRequest)
 	testError(t, ErrInvalidBodyMissing, http.StatusBadRequest)
 	testError(t, ErrInvalidBodyJSON, http.StatusBadRequest)
+	testError(t, ErrInvalidProducer, http.StatusBadRequest)
+	testError(t, ErrInvalidGroup, http.StatusBadRequest)
+	testError(t, ErrInvalidWait, http.StatusBadRequest)
+
+	// unsupported media type
+	testError(t, ErrInvalidBodyEncoding, http.StatusUnsupportedMediaType)
+
+	// not implemented
+	testError(t, ErrUnsupportedSubjects, http.StatusNotImplemented)
+	testError(t, ErrInvalidDeliverAt, http.StatusBadRequest)
+	testError(t, ErrUnsupportedDelay, http.StatusNotImplemented)
+
+	// conflict
+	testError(t, ErrStaleProducerSeq, http.StatusConflict)
 
 	// no content
 	testError(t, ErrNoContent, http.StatusNoContent)
@@ -96,3 +120,274 @@ func testSize(t *testing.T, header http.Header, sizes []int64, err error) {
 		t.Fatal(header, sizes, s)
 	}
 }
+
+func TestEventTimes(t *testing.T) {
+	for _, values := range [][]string{{"blue"}, {"2020-01-02"}, {"1960-01-02T03:04:05Z"}} {
+		if _, err := ReadEventTimes(http.Header{HeaderEventTimes: values}); err != ErrInvalidEventTimes {
+			t.Error(values, err)
+		}
+	}
+	if eventTimes, err := ReadEventTimes(http.Header{}); err != nil || eventTimes != nil {
+		t.Error(eventTimes, err)
+	}
+
+	h := SetEventTimes([]uint64{0, 0}, http.Header{})
+	if _, ok := h[HeaderEventTimes]; ok {
+		t.Error(h)
+	}
+	SetEventTimes([]uint64{0, 1577934245000000006}, h)
+	if !reflect.DeepEqual(h[HeaderEventTimes], []string{"", "2020-01-02T03:04:05.000000006Z"}) {
+		t.Error(h)
+	}
+	if eventTimes, err := ReadEventTimes(h); err != nil || !reflect.DeepEqual(eventTimes, []uint64{0, 1577934245000000006}) {
+		t.Error(eventTimes, err)
+	}
+	if s := FormatTime(1577934245000000000); s != "2020-01-02T03:04:05Z" {
+		t.Error(s)
+	}
+}
+
+func TestDeliverAt(t *testing.T) {
+	for _, v := range []string{"blue", "2020-01-02", "1960-01-02T03:04:05Z"} {
+		if _, err := ReadDeliverAt(http.Header{HeaderDeliverAt: {v}}); err != ErrInvalidDeliverAt {
+			t.Error(v, err)
+		}
+	}
+	if deliverAt, err := ReadDeliverAt(http.Header{}); err != nil || !deliverAt.IsZero() {
+		t.Error(deliverAt, err)
+	}
+
+	h := SetDeliverAt(time.Time{}, http.Header{})
+	if _, ok := h[HeaderDeliverAt]; ok {
+		t.Error(h)
+	}
+	deliverAt := time.Date(2020, 1, 2, 3, 4, 5, 6, time.FixedZone("test", 3600))
+	SetDeliverAt(deliverAt, h)
+	if !reflect.DeepEqual(h[HeaderDeliverAt], []string{"2020-01-02T02:04:05.000000006Z"}) {
+		t.Error(h)
+	}
+	if v, err := ReadDeliverAt(h); err != nil || !v.Equal(deliverAt) {
+		t.Error(v, err)
+	}
+}
+
+func TestSubjects(t *testing.T) {
+	if subjects := ReadSubjects(http.Header{}); subjects != nil {
+		t.Error(subjects)
+	}
+	h := SetSubjects([]string{"", ""}, http.Header{})
+	if _, ok := h[HeaderSubjects]; ok {
+		t.Error(h)
+	}
+	SetSubjects([]string{"", "user-1"}, h)
+	if subjects := ReadSubjects(h); !reflect.DeepEqual(subjects, []string{"", "user-1"}) {
+		t.Error(subjects)
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	if _, err := ReadRedacted(http.Header{HeaderRedacted: {"", "maybe"}}); err != ErrInvalidRedacted {
+		t.Error(err)
+	}
+	if redacted, err := ReadRedacted(http.Header{}); err != nil || redacted != nil {
+		t.Error(redacted, err)
+	}
+	h := SetRedacted([]bool{false, false}, http.Header{})
+	if _, ok := h[HeaderRedacted]; ok {
+		t.Error(h)
+	}
+	SetRedacted([]bool{false, true}, h)
+	if !reflect.DeepEqual(h[HeaderRedacted], []string{"", "true"}) {
+		t.Error(h)
+	}
+	if redacted, err := ReadRedacted(h); err != nil || !reflect.DeepEqual(redacted, []bool{false, true}) {
+		t.Error(redacted, err)
+	}
+}
+
+func TestDeleted(t *testing.T) {
+	if _, err := ReadDeleted(http.Header{HeaderDeleted: {"maybe"}}); err != ErrInvalidDeleted {
+		t.Error(err)
+	}
+	h := SetDeleted([]bool{true, false}, http.Header{})
+	if !reflect.DeepEqual(h[HeaderDeleted], []string{"true", ""}) {
+		t.Error(h)
+	}
+	if deleted, err := ReadDeleted(h); err != nil || !reflect.DeepEqual(deleted, []bool{true, false}) {
+		t.Error(deleted, err)
+	}
+}
+
+func TestValidateProduce(t *testing.T) {
+	if err := ValidateProduce(2, nil, nil, time.Now().Add(time.Hour)); err != nil {
+		t.Error(err)
+	}
+	if err := ValidateProduce(2, []time.Time{{}}, nil, time.Time{}); err != ErrInvalidEventTimes {
+		t.Error(err)
+	}
+	if err := ValidateProduce(2, nil, []string{"user-1"}, time.Time{}); err != ErrInvalidSubjects {
+		t.Error(err)
+	}
+	if err := ValidateProduce(1, nil, []string{"user-1"}, time.Now().Add(time.Hour)); err != ErrInvalidDeliverAt {
+		t.Error(err)
+	}
+	if nanos := EventTimeNanos(nil); nanos != nil {
+		t.Error(nanos)
+	}
+	if nanos := EventTimeNanos([]time.Time{{}, time.Unix(0, 1577934245000000006)}); !reflect.DeepEqual(nanos, []uint64{0, 1577934245000000006}) {
+		t.Error(nanos)
+	}
+}
+
+func TestReadMessages(t *testing.T) {
+	h := SetSizes([]int64{1, 2}, http.Header{})
+	msgs, err := ReadMessages("topic", 5, h, strings.NewReader("abc"))
+	if err != nil || len(msgs) != 2 {
+		t.Fatal(msgs, err)
+	}
+	if !reflect.DeepEqual(*msgs[1], Message{Topic: "topic", ID: 6, Data: []byte("bc")}) {
+		t.Error(*msgs[1])
+	}
+	if _, err = ReadMessages("topic", 5, h, strings.NewReader("ab")); err != io.ErrUnexpectedEOF {
+		t.Error(err)
+	}
+
+	SetEventTimes([]uint64{0, 1577934245000000006}, h)
+	SetRedacted([]bool{true, false}, h)
+	SetDeleted([]bool{false, true}, h)
+	h[HeaderStartID] = []string{"10"}
+	msgs, err = ReadMessages("topic", 5, h, strings.NewReader("abc"))
+	if err != nil || len(msgs) != 2 {
+		t.Fatal(msgs, err)
+	}
+	if msgs[0].ID != 10 || !msgs[0].EventTime.IsZero() || !msgs[0].Redacted || msgs[0].Deleted {
+		t.Error(*msgs[0])
+	}
+	if msgs[1].ID != 11 || msgs[1].EventTime.UnixNano() != 1577934245000000006 || msgs[1].Redacted || !msgs[1].Deleted {
+		t.Error(*msgs[1])
+	}
+
+	h[HeaderStartID] = []string{"ten"}
+	if _, err = ReadMessages("topic", 5, h, strings.NewReader("abc")); err == nil {
+		t.Error("expected invalid start id")
+	}
+	for key, err := range map[string]error{HeaderEventTimes: ErrInvalidEventTimes, HeaderRedacted: ErrInvalidRedacted, HeaderDeleted: ErrInvalidDeleted} {
+		h := SetSizes([]int64{1, 2}, http.Header{})
+		h[key] = []string{""}
+		if _, got := ReadMessages("topic", 5, h, strings.NewReader("abc")); got != err {
+			t.Error(key, got)
+		}
+	}
+}
+
+func TestValidateTopic(t *testing.T) {
+	for _, topic := range []string{"topic", "nested/topic", "topic.name"} {
+		if err := ValidateTopic(topic); err != nil {
+			t.Error(topic, err)
+		}
+	}
+	for _, topic := range []string{"", ".", "..", "nested/", "nested//topic"} {
+		if err := ValidateTopic(topic); err != ErrInvalidTopic {
+			t.Error(topic, err)
+		}
+	}
+	for _, topic := range []string{".subjects", "nested/.topic"} {
+		if err := ValidateTopic(topic); err != ErrReservedTopic {
+			t.Error(topic, err)
+		}
+	}
+}
+
+func TestValidateIDRanges(t *testing.T) {
+	if err := ValidateIDRanges([]IDRange{{Start: 0, End: 0}, {Start: 2, End: 5}}); err != nil {
+		t.Error(err)
+	}
+	for _, r := range []IDRange{{Start: -1, End: 2}, {Start: 3, End: 2}} {
+		if err := ValidateIDRanges([]IDRange{r}); err != ErrInvalidDeleteRange {
+			t.Error(r, err)
+		}
+	}
+}
+
+func TestReadError(t *testing.T) {
+	if err := ReadError(""); err != nil {
+		t.Error(err)
+	}
+	if err := ReadError(errClosed); err != ErrClosed {
+		t.Error(err)
+	}
+	if err := ReadError("some other error"); err == nil || err.Error() != "some other error" {
+		t.Error(err)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	if !Retryable(ErrClosed) || !Retryable(errors.Wrap(ErrClosed, "wrapped")) {
+		t.Error("closed errors should be retryable")
+	}
+	for _, err := range []error{nil, ErrTopicDoesNotExist, ErrInvalidHeaderSizes, ErrNoContent, errors.New("other")} {
+		if Retryable(err) {
+			t.Error(err)
+		}
+	}
+}
+
+func TestProducerSequence(t *testing.T) {
+	p, err := ReadProducerSequence(http.Header{})
+	if p != nil || err != nil {
+		t.Error(p, err)
+	}
+	for _, h := range []http.Header{
+		{HeaderProducerID: {"abc"}},
+		{HeaderProducerID: {"abc"}, HeaderProducerSeq: {"0"}},
+		{HeaderProducerID: {"abc"}, HeaderProducerSeq: {"blue"}},
+		{HeaderProducerID: {string(make([]byte, MaxProducerIDLength+1))}, HeaderProducerSeq: {"1"}},
+	} {
+		if _, err = ReadProducerSequence(h); err != ErrInvalidProducer {
+			t.Error(h, err)
+		}
+	}
+
+	h := SetProducerSequence(&ProducerSequence{ID: "abc", Seq: 12}, http.Header{})
+	p, err = ReadProducerSequence(h)
+	if err != nil || !reflect.DeepEqual(p, &ProducerSequence{ID: "abc", Seq: 12}) {
+		t.Error(p, err)
+	}
+}
+
+func TestProduceInfo(t *testing.T) {
+	info, err := ReadProduceInfo(http.Header{})
+	if info != nil || err != nil {
+		t.Error(info, err)
+	}
+	if _, err = ReadProduceInfo(http.Header{HeaderStartID: {"blue"}}); err == nil {
+		t.Error("expected invalid start id")
+	}
+	if _, err = ReadProduceInfo(http.Header{HeaderStartID: {"1"}, HeaderEndID: {"blue"}}); err == nil {
+		t.Error("expected invalid end id")
+	}
+
+	for _, expected := range []*ProduceInfo{
+		{StartID: 10, EndID: 12},
+		{StartID: 0, EndID: 0, Duplicate: true},
+	} {
+		info, err = ReadProduceInfo(SetProduceInfo(expected, http.Header{}))
+		if err != nil || !reflect.DeepEqual(info, expected) {
+			t.Error(info, err)
+		}
+	}
+}
+
+func TestTopicInfo(t *testing.T) {
+	if _, err := ReadTopicInfo(http.Header{}); err == nil {
+		t.Error("expected invalid min offset")
+	}
+	if _, err := ReadTopicInfo(http.Header{HeaderMinOffset: {"1"}}); err == nil {
+		t.Error("expected invalid max offset")
+	}
+	expected := &TopicInfo{MinOffset: 3, MaxOffset: -1}
+	info, err := ReadTopicInfo(SetTopicInfo(expected, http.Header{}))
+	if err != nil || !reflect.DeepEqual(info, expected) {
+		t.Error(info, err)
+	}
+}
@@ -0,0 +1,554 @@
+package memqueue
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// maxGroupLength is the longest consumer group name which can be stored, matching the file queue
+const maxGroupLength = 255
+
+// MemoryQueue implements the haraqa queue by storing messages in memory. Messages are grouped into segments
+// of up to maxEntries messages, which are the unit of truncation, the same as the files of a FileQueue.
+// All messages are lost when the process exits
+type MemoryQueue struct {
+	max    int64
+	mux    sync.RWMutex
+	topics map[string]*topic
+
+	// delayed holds the timers of the delayed batches which have not been delivered, guarded by delayMux
+	delayMux  sync.Mutex
+	delayed   map[*time.Timer]struct{}
+	delivered func(topic string, n int)
+	closed    bool
+}
+
+// topic holds the segments and state of a single topic, guarded by its lock
+type topic struct {
+	mux             sync.RWMutex
+	segments        []*segment
+	nextID          int64
+	producers       map[string]producerState
+	consumerOffsets map[string]int64
+}
+
+// segment holds a range of consecutive messages, starting at base
+type segment struct {
+	base       int64
+	modTime    time.Time
+	timestamps []uint64
+	eventTimes []uint64
+	offsets    []int64
+	sizes      []int64
+	log        []byte
+	// deleted flags the deleted messages, it is nil until a message of the segment is deleted
+	deleted []bool
+}
+
+// producerState is the last batch produced by an idempotent producer
+type producerState struct {
+	seq     uint64
+	startID int64
+	endID   int64
+}
+
+// New creates a new MemoryQueue with at most maxEntries messages per segment
+func New(maxEntries int64) *MemoryQueue {
+	return &MemoryQueue{
+		max:     maxEntries,
+		topics:  make(map[string]*topic),
+		delayed: make(map[*time.Timer]struct{}),
+	}
+}
+
+// Close drops the delayed messages which have not been delivered, other messages are kept until the queue is
+// garbage collected
+func (q *MemoryQueue) Close() error {
+	q.delayMux.Lock()
+	defer q.delayMux.Unlock()
+	q.closed = true
+	for timer := range q.delayed {
+		timer.Stop()
+		delete(q.delayed, timer)
+	}
+	return nil
+}
+
+// RootDir returns an empty string, there are no raw files to serve
+func (q *MemoryQueue) RootDir() string {
+	return ""
+}
+
+// ListTopics returns all of the topic names in the queue, in lexical order
+func (q *MemoryQueue) ListTopics(prefix, suffix, regex string) ([]string, error) {
+	var rx *regexp.Regexp
+	if regex != "" && regex != ".*" {
+		var err error
+		rx, err = regexp.Compile(regex)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid regex")
+		}
+	}
+
+	q.mux.RLock()
+	defer q.mux.RUnlock()
+	var names []string
+	for name := range q.topics {
+		if prefix != "" && !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if suffix != "" && !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		if rx != nil && !rx.MatchString(name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// CreateTopic creates a new topic if it does not already exist. The parents of a nested topic are also
+// created, as they are by the directories of a FileQueue
+func (q *MemoryQueue) CreateTopic(name string) error {
+	name = strings.TrimSuffix(strings.TrimSpace(name), "/")
+	if err := headers.ValidateTopic(name); err != nil {
+		return err
+	}
+
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if _, ok := q.topics[name]; ok {
+		return headers.ErrTopicAlreadyExists
+	}
+	split := strings.Split(name, "/")
+	for i := 1; i < len(split); i++ {
+		parent := strings.Join(split[:i], "/")
+		if _, ok := q.topics[parent]; !ok {
+			q.topics[parent] = newTopic()
+		}
+	}
+	q.topics[name] = newTopic()
+	return nil
+}
+
+func newTopic() *topic {
+	return &topic{
+		producers:       make(map[string]producerState),
+		consumerOffsets: make(map[string]int64),
+	}
+}
+
+// DeleteTopic deletes the topic and any nested topic within
+func (q *MemoryQueue) DeleteTopic(name string) error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	for t := range q.topics {
+		if t == name || strings.HasPrefix(t, name+"/") {
+			delete(q.topics, t)
+		}
+	}
+	return nil
+}
+
+// getTopic returns the topic or ErrTopicDoesNotExist
+func (q *MemoryQueue) getTopic(name string) (*topic, error) {
+	q.mux.RLock()
+	defer q.mux.RUnlock()
+	t, ok := q.topics[name]
+	if !ok {
+		return nil, headers.ErrTopicDoesNotExist
+	}
+	return t, nil
+}
+
+// GetTopicInfo returns the min and max offsets of the messages currently stored in the topic.
+// An empty topic returns a max offset of one less than the min offset
+func (q *MemoryQueue) GetTopicInfo(name string) (*headers.TopicInfo, error) {
+	t, err := q.getTopic(name)
+	if err != nil {
+		return nil, err
+	}
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	return t.info(), nil
+}
+
+func (t *topic) info() *headers.TopicInfo {
+	if len(t.segments) == 0 {
+		return &headers.TopicInfo{MinOffset: t.nextID, MaxOffset: t.nextID - 1}
+	}
+	return &headers.TopicInfo{MinOffset: t.segments[0].base, MaxOffset: t.nextID - 1}
+}
+
+// evictProducer forgets the producer with the lowest end id, whose last batch is the oldest
+func (t *topic) evictProducer() {
+	var oldest string
+	minID := int64(-1)
+	for id, state := range t.producers {
+		if minID < 0 || state.endID < minID {
+			oldest, minID = id, state.endID
+		}
+	}
+	delete(t.producers, oldest)
+}
+
+// ModifyTopic updates the topic to truncate/remove messages and return the topic offset info.
+// Segments are removed if they are entirely before the truncate id, or were last written to before the
+// given time. A negative truncate id removes all but the latest segment. The messages of the delete ranges
+// are then removed from the remaining segments, keeping their ids
+func (q *MemoryQueue) ModifyTopic(name string, request headers.ModifyRequest) (*headers.TopicInfo, error) {
+	if name == "" {
+		return nil, nil
+	}
+	if err := headers.ValidateIDRanges(request.Delete); err != nil {
+		return nil, err
+	}
+	t, err := q.getTopic(name)
+	if err != nil {
+		return nil, err
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	segments := t.segments[:0]
+	for i, seg := range t.segments {
+		switch {
+		case request.Truncate < 0 && i != len(t.segments)-1:
+		case !request.Before.IsZero() && seg.modTime.Before(request.Before):
+		case request.Truncate > 0 && seg.base+int64(len(seg.sizes)) < request.Truncate:
+		default:
+			segments = append(segments, seg)
+		}
+	}
+	for i := len(segments); i < len(t.segments); i++ {
+		t.segments[i] = nil
+	}
+	t.segments = segments
+	for _, seg := range t.segments {
+		seg.delete(request.Delete)
+	}
+	return t.info(), nil
+}
+
+// delete removes the content of the messages of the id ranges held by the segment. The log and the slices of
+// the segment are replaced rather than modified, as consumers may still be reading them
+func (seg *segment) delete(ranges []headers.IDRange) {
+	last := seg.base + int64(len(seg.sizes)) - 1
+	var deleted []bool
+	for _, r := range ranges {
+		if r.End < seg.base || r.Start > last {
+			continue
+		}
+		if deleted == nil {
+			deleted = make([]bool, len(seg.sizes))
+			copy(deleted, seg.deleted)
+		}
+		start, end := r.Start, r.End
+		if start < seg.base {
+			start = seg.base
+		}
+		if end > last {
+			end = last
+		}
+		for id := start; id <= end; id++ {
+			deleted[id-seg.base] = true
+		}
+	}
+	if deleted == nil {
+		return
+	}
+
+	offsets := make([]int64, len(seg.offsets))
+	sizes := make([]int64, len(seg.sizes))
+	log := make([]byte, 0, len(seg.log))
+	for i := range seg.sizes {
+		offsets[i] = int64(len(log))
+		if !deleted[i] {
+			sizes[i] = seg.sizes[i]
+			log = append(log, seg.log[seg.offsets[i]:seg.offsets[i]+seg.sizes[i]]...)
+		}
+	}
+	seg.offsets, seg.sizes, seg.log, seg.deleted = offsets, sizes, log, deleted
+}
+
+// Produce copies messages from the reader into the queue and returns the ids assigned to them.
+// If a producer sequence is given and the batch has already been produced, the messages are not written
+// again and the ids assigned to the original batch are returned
+func (q *MemoryQueue) Produce(name string, msgSizes []int64, timestamp uint64, eventTimes []uint64, producer *headers.ProducerSequence, r io.Reader) (*headers.ProduceInfo, error) {
+	if len(msgSizes) == 0 {
+		return nil, nil
+	}
+	if eventTimes != nil && len(eventTimes) != len(msgSizes) {
+		return nil, headers.ErrInvalidEventTimes
+	}
+	if r == nil {
+		return nil, headers.ErrInvalidBodyMissing
+	}
+	t, err := q.getTopic(name)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	// check for duplicate batches
+	if producer != nil {
+		if state, ok := t.producers[producer.ID]; ok && producer.Seq <= state.seq {
+			if producer.Seq < state.seq {
+				return nil, headers.ErrStaleProducerSeq
+			}
+			return &headers.ProduceInfo{StartID: state.startID, EndID: state.endID, Duplicate: true}, nil
+		}
+	}
+
+	var total int64
+	for _, size := range msgSizes {
+		if size < 0 {
+			return nil, headers.ErrInvalidHeaderSizes
+		}
+		total += size
+	}
+	data := make([]byte, total)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return nil, errors.Wrap(err, "unable to read messages")
+	}
+
+	// start a new segment once the latest is full
+	var seg *segment
+	if n := len(t.segments); n > 0 && int64(len(t.segments[n-1].sizes)) < q.max {
+		seg = t.segments[n-1]
+	} else {
+		seg = &segment{base: t.nextID}
+		t.segments = append(t.segments, seg)
+	}
+
+	info := &headers.ProduceInfo{StartID: t.nextID, EndID: t.nextID + int64(len(msgSizes)) - 1}
+	offset := int64(len(seg.log))
+	for i, size := range msgSizes {
+		seg.timestamps = append(seg.timestamps, timestamp)
+		if eventTimes != nil {
+			seg.eventTimes = append(seg.eventTimes, eventTimes[i])
+		} else {
+			seg.eventTimes = append(seg.eventTimes, 0)
+		}
+		seg.offsets = append(seg.offsets, offset)
+		seg.sizes = append(seg.sizes, size)
+		if seg.deleted != nil {
+			seg.deleted = append(seg.deleted, false)
+		}
+		offset += size
+	}
+	seg.log = append(seg.log, data...)
+	seg.modTime = time.Now()
+	t.nextID = info.EndID + 1
+
+	if producer != nil {
+		t.producers[producer.ID] = producerState{seq: producer.Seq, startID: info.StartID, endID: info.EndID}
+		if len(t.producers) > headers.MaxTrackedProducers {
+			t.evictProducer()
+		}
+	}
+	return info, nil
+}
+
+// ProduceDelayed copies the messages from the reader, to be produced to the topic once deliverAt has passed
+func (q *MemoryQueue) ProduceDelayed(name string, msgSizes []int64, deliverAt time.Time, eventTimes []uint64, r io.Reader) error {
+	if len(msgSizes) == 0 {
+		return nil
+	}
+	if eventTimes != nil && len(eventTimes) != len(msgSizes) {
+		return headers.ErrInvalidEventTimes
+	}
+	if r == nil {
+		return headers.ErrInvalidBodyMissing
+	}
+	if _, err := q.getTopic(name); err != nil {
+		return err
+	}
+	var total int64
+	for _, size := range msgSizes {
+		if size < 0 {
+			return headers.ErrInvalidHeaderSizes
+		}
+		total += size
+	}
+	data := make([]byte, total)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return errors.Wrap(err, "unable to read messages")
+	}
+
+	q.delayMux.Lock()
+	defer q.delayMux.Unlock()
+	if q.closed {
+		return headers.ErrClosed
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Until(deliverAt), func() {
+		q.delayMux.Lock()
+		defer q.delayMux.Unlock()
+		if _, ok := q.delayed[timer]; !ok {
+			return
+		}
+		delete(q.delayed, timer)
+		// batches of a topic deleted before they are due are dropped
+		if _, err := q.Produce(name, msgSizes, uint64(time.Now().UnixNano()), eventTimes, nil, bytes.NewReader(data)); err != nil {
+			return
+		}
+		if q.delivered != nil {
+			q.delivered(name, len(msgSizes))
+		}
+	})
+	q.delayed[timer] = struct{}{}
+	return nil
+}
+
+// OnDelivered sets the function called after delayed messages are produced to a topic, with the number produced
+func (q *MemoryQueue) OnDelivered(fn func(topic string, n int)) {
+	q.delayMux.Lock()
+	defer q.delayMux.Unlock()
+	q.delivered = fn
+}
+
+// Consume copies messages from a segment to the writer
+func (q *MemoryQueue) Consume(group, name string, id int64, limit int64, w http.ResponseWriter) (int, error) {
+	t, err := q.getTopic(name)
+	if err != nil {
+		return 0, err
+	}
+
+	t.mux.RLock()
+	if group != "" && id <= 0 {
+		if offset, ok := t.consumerOffsets[group]; ok {
+			id = offset
+		}
+	}
+	if len(t.segments) == 0 {
+		t.mux.RUnlock()
+		return 0, nil
+	}
+
+	// find the segment holding the id, a negative id reads the latest message
+	seg := t.segments[len(t.segments)-1]
+	local := int64(len(seg.sizes)) - 1
+	if id >= 0 {
+		i := sort.Search(len(t.segments), func(i int) bool { return t.segments[i].base > id }) - 1
+		if i < 0 {
+			t.mux.RUnlock()
+			return 0, nil
+		}
+		seg = t.segments[i]
+		local = id - seg.base
+	}
+	count := int64(len(seg.sizes))
+	if local < 0 || local >= count || limit == 0 {
+		t.mux.RUnlock()
+		return 0, nil
+	}
+	if limit < 0 || local+limit > count {
+		limit = count - local
+	}
+
+	// the slices are only ever appended to or replaced, so the messages read here cannot change after unlocking
+	end := local + limit
+	sizes := seg.sizes[local:end:end]
+	timestamps := seg.timestamps[local:end:end]
+	eventTimes := seg.eventTimes[local:end:end]
+	var deleted []bool
+	if seg.deleted != nil {
+		deleted = seg.deleted[local:end:end]
+	}
+	startAt := seg.offsets[local]
+	log := seg.log[:len(seg.log):len(seg.log)]
+	t.mux.RUnlock()
+
+	endAt := startAt - 1
+	for _, size := range sizes {
+		endAt += size
+	}
+	endTime := time.Unix(0, int64(timestamps[len(timestamps)-1]))
+	filename := name + "/" + formatName(seg.base) + ".log"
+
+	wHeader := w.Header()
+	wHeader[headers.HeaderStartTime] = []string{headers.FormatTime(timestamps[0])}
+	wHeader[headers.HeaderEndTime] = []string{headers.FormatTime(timestamps[len(timestamps)-1])}
+	wHeader[headers.HeaderFileName] = []string{filename}
+	wHeader[headers.HeaderStartID] = []string{strconv.FormatInt(seg.base+local, 10)}
+	wHeader[headers.HeaderEndID] = []string{strconv.FormatInt(seg.base+end-1, 10)}
+	wHeader[headers.ContentType] = []string{"application/octet-stream"}
+	headers.SetSizes(sizes, wHeader)
+	headers.SetEventTimes(eventTimes, wHeader)
+	headers.SetDeleted(deleted, wHeader)
+
+	// there is no range to serve for batches without content, such as batches of deleted messages
+	if endAt < startAt {
+		wHeader["Content-Length"] = []string{"0"}
+		w.WriteHeader(http.StatusOK)
+		return len(sizes), nil
+	}
+	wHeader["Range"] = []string{"bytes=" + strconv.FormatInt(startAt, 10) + "-" + strconv.FormatInt(endAt, 10)}
+
+	req := &http.Request{Header: wHeader}
+	http.ServeContent(w, req, filename, endTime, bytes.NewReader(log))
+	return len(sizes), nil
+}
+
+// SetConsumerOffset sets the offset for a given consumer group + topic
+func (q *MemoryQueue) SetConsumerOffset(group, name string, id int64) error {
+	if group == "" || len(group) > maxGroupLength {
+		return headers.ErrInvalidGroup
+	}
+	if id < 0 {
+		return headers.ErrInvalidMessageID
+	}
+	t, err := q.getTopic(name)
+	if err != nil {
+		return err
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.consumerOffsets[group] = id
+	return nil
+}
+
+// GetConsumerOffset returns the offset committed by the consumer group for the topic, or -1 if no offset has been committed
+func (q *MemoryQueue) GetConsumerOffset(group, name string) (int64, error) {
+	if group == "" {
+		return -1, nil
+	}
+	t, err := q.getTopic(name)
+	if err != nil {
+		return -1, nil
+	}
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	offset, ok := t.consumerOffsets[group]
+	if !ok {
+		return -1, nil
+	}
+	return offset, nil
+}
+
+// formatName formats the base id of a segment as the file queue names its files
+func formatName(baseID int64) string {
+	const defaultName = "0000000000000000"
+
+	v := strconv.FormatInt(baseID, 10)
+	if len(v) < len(defaultName) {
+		v = defaultName[len(v):] + v
+	}
+	return v
+}
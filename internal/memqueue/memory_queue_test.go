@@ -0,0 +1,237 @@
+package memqueue
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestMemoryQueue_Topics(t *testing.T) {
+	q := New(10)
+	if q.RootDir() != "" {
+		t.Error(q.RootDir())
+	}
+	for _, topic := range []string{"a/b/c", "b", "a/d/"} {
+		if err := q.CreateTopic(topic); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := q.CreateTopic("a/b"); !errors.Is(err, headers.ErrTopicAlreadyExists) {
+		t.Error(err)
+	}
+
+	topics, err := q.ListTopics("", "", "")
+	if err != nil || !reflect.DeepEqual(topics, []string{"a", "a/b", "a/b/c", "a/d", "b"}) {
+		t.Error(topics, err)
+	}
+	topics, err = q.ListTopics("a/", "", "[cd]$")
+	if err != nil || !reflect.DeepEqual(topics, []string{"a/b/c", "a/d"}) {
+		t.Error(topics, err)
+	}
+	if _, err = q.ListTopics("", "", "["); err == nil {
+		t.Error("expected invalid regex")
+	}
+
+	if err = q.DeleteTopic("a/b"); err != nil {
+		t.Error(err)
+	}
+	topics, err = q.ListTopics("", "", "")
+	if err != nil || !reflect.DeepEqual(topics, []string{"a", "a/d", "b"}) {
+		t.Error(topics, err)
+	}
+	if _, err = q.GetTopicInfo("a/b/c"); !errors.Is(err, headers.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+	if err = q.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMemoryQueue_ProduceConsume(t *testing.T) {
+	q := New(3)
+	topic := "produce"
+	now := time.Now()
+
+	if _, err := q.Produce(topic, []int64{1}, 0, nil, nil, bytes.NewBufferString("a")); !errors.Is(err, headers.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+	if _, err := q.Consume("", topic, 0, -1, httptest.NewRecorder()); !errors.Is(err, headers.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+	if err := q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := q.Consume("", topic, 0, -1, httptest.NewRecorder()); err != nil || n != 0 {
+		t.Error(n, err)
+	}
+	if info, err := q.Produce(topic, nil, 0, nil, nil, nil); err != nil || info != nil {
+		t.Error(info, err)
+	}
+	if _, err := q.Produce(topic, []int64{1}, 0, nil, nil, nil); err != headers.ErrInvalidBodyMissing {
+		t.Error(err)
+	}
+	if _, err := q.Produce(topic, []int64{-1}, 0, nil, nil, bytes.NewBufferString("a")); err != headers.ErrInvalidHeaderSizes {
+		t.Error(err)
+	}
+	if _, err := q.Produce(topic, []int64{5}, 0, nil, nil, bytes.NewBufferString("a")); err == nil {
+		t.Error("expected short body error")
+	}
+
+	// batches fill segments of 3 messages, a batch is never split across segments
+	for i, batch := range []string{"ab", "cd", "e"} {
+		sizes := make([]int64, len(batch))
+		for j := range sizes {
+			sizes[j] = 1
+		}
+		info, err := q.Produce(topic, sizes, uint64(now.UnixNano())+uint64(i), nil, nil, bytes.NewBufferString(batch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.StartID != int64(2*i) || info.EndID != int64(2*i+len(batch)-1) {
+			t.Error(i, info)
+		}
+	}
+	if len(q.topics[topic].segments) != 2 || q.topics[topic].segments[1].base != 4 {
+		t.Error(q.topics[topic].segments)
+	}
+	if info, err := q.GetTopicInfo(topic); err != nil || info.MinOffset != 0 || info.MaxOffset != 4 {
+		t.Error(info, err)
+	}
+
+	consume := func(group string, id, limit int64, expected string, expectedStart int64) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		n, err := q.Consume(group, topic, id, limit, w)
+		if err != nil || n != len(expected) {
+			t.Error(n, err)
+			return
+		}
+		if n == 0 {
+			return
+		}
+		b, _ := ioutil.ReadAll(w.Body)
+		if string(b) != expected || w.Code != http.StatusPartialContent {
+			t.Error(string(b), w.Code)
+		}
+		sizes, err := headers.ReadSizes(w.Header())
+		if err != nil || len(sizes) != n {
+			t.Error(sizes, err)
+		}
+		if w.Header().Get(headers.HeaderStartID) != strconv.FormatInt(expectedStart, 10) {
+			t.Error(w.Header())
+		}
+	}
+	consume("", 0, -1, "abcd", 0)
+	consume("", 1, 2, "bc", 1)
+	consume("", 4, -1, "e", 4)
+	consume("", -1, -1, "e", 4)
+	consume("", 5, -1, "", 0)
+	consume("", 1, 0, "", 0)
+
+	// timestamps are reported in the headers
+	w := httptest.NewRecorder()
+	if _, err := q.Consume("", topic, 2, -1, w); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get(headers.HeaderStartTime) != time.Unix(0, now.UnixNano()+1).UTC().Format(time.RFC3339Nano) ||
+		w.Header().Get(headers.HeaderEndID) != "3" || w.Header().Get(headers.HeaderFileName) != "produce/0000000000000000.log" {
+		t.Error(w.Header())
+	}
+
+	// consumer groups read from their committed offset
+	if err := q.SetConsumerOffset("", topic, 1); err != headers.ErrInvalidGroup {
+		t.Error(err)
+	}
+	if err := q.SetConsumerOffset("group", topic, -1); err != headers.ErrInvalidMessageID {
+		t.Error(err)
+	}
+	if err := q.SetConsumerOffset("group", "missing", 1); !errors.Is(err, headers.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+	if offset, err := q.GetConsumerOffset("group", topic); err != nil || offset != -1 {
+		t.Error(offset, err)
+	}
+	if err := q.SetConsumerOffset("group", topic, 3); err != nil {
+		t.Fatal(err)
+	}
+	if offset, err := q.GetConsumerOffset("group", topic); err != nil || offset != 3 {
+		t.Error(offset, err)
+	}
+	consume("group", 0, -1, "d", 3)
+	consume("group", 1, 1, "b", 1)
+}
+
+func TestMemoryQueue_ProduceIdempotent(t *testing.T) {
+	q := New(10)
+	if err := q.CreateTopic("idempotent"); err != nil {
+		t.Fatal(err)
+	}
+	producer := &headers.ProducerSequence{ID: "producer", Seq: 2}
+	info, err := q.Produce("idempotent", []int64{1, 1}, 0, nil, producer, bytes.NewBufferString("ab"))
+	if err != nil || info.StartID != 0 || info.EndID != 1 || info.Duplicate {
+		t.Fatal(info, err)
+	}
+	info, err = q.Produce("idempotent", []int64{1, 1}, 0, nil, producer, bytes.NewBufferString("ab"))
+	if err != nil || info.StartID != 0 || info.EndID != 1 || !info.Duplicate {
+		t.Error(info, err)
+	}
+	if _, err = q.Produce("idempotent", []int64{1}, 0, nil, &headers.ProducerSequence{ID: "producer", Seq: 1}, bytes.NewBufferString("a")); err != headers.ErrStaleProducerSeq {
+		t.Error(err)
+	}
+	if topicInfo, err := q.GetTopicInfo("idempotent"); err != nil || topicInfo.MaxOffset != 1 {
+		t.Error(topicInfo, err)
+	}
+}
+
+func TestMemoryQueue_ModifyTopic(t *testing.T) {
+	q := New(2)
+	topic := "modify"
+	if info, err := q.ModifyTopic("", headers.ModifyRequest{}); err != nil || info != nil {
+		t.Error(info, err)
+	}
+	if _, err := q.ModifyTopic(topic, headers.ModifyRequest{Truncate: 1}); !errors.Is(err, headers.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+	if err := q.CreateTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		if _, err := q.Produce(topic, []int64{1}, 0, nil, nil, bytes.NewBufferString("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// segments entirely before the truncate id are removed
+	info, err := q.ModifyTopic(topic, headers.ModifyRequest{Truncate: 3})
+	if err != nil || info.MinOffset != 2 || info.MaxOffset != 6 {
+		t.Error(info, err)
+	}
+	if n, err := q.Consume("", topic, 1, -1, httptest.NewRecorder()); err != nil || n != 0 {
+		t.Error(n, err)
+	}
+
+	// a negative truncate id removes all but the latest segment
+	info, err = q.ModifyTopic(topic, headers.ModifyRequest{Truncate: -1})
+	if err != nil || info.MinOffset != 6 || info.MaxOffset != 6 {
+		t.Error(info, err)
+	}
+
+	// segments last written before the given time are removed, ids are never reused
+	info, err = q.ModifyTopic(topic, headers.ModifyRequest{Before: time.Now().Add(time.Second)})
+	if err != nil || info.MinOffset != 7 || info.MaxOffset != 6 {
+		t.Error(info, err)
+	}
+	produced, err := q.Produce(topic, []int64{1}, 0, nil, nil, bytes.NewBufferString("a"))
+	if err != nil || produced.StartID != 7 {
+		t.Error(produced, err)
+	}
+}
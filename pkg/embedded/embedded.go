@@ -0,0 +1,411 @@
+package embedded
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa"
+	"github.com/haraqa/haraqa/internal/headers"
+	"github.com/haraqa/haraqa/pkg/server"
+)
+
+// Option represents a optional function argument to NewClient
+type Option func(*Client) error
+
+// WithConsumerGroup sets the consumer group used by the client, as haraqa.WithConsumerGroup does for a
+// haraqa.Client
+func WithConsumerGroup(group string) Option {
+	return func(c *Client) error {
+		c.consumerGroup = group
+		return nil
+	}
+}
+
+// WithConsumeLimit sets the limit used when a consume call is given a limit less than 1,
+// as server.WithDefaultConsumeLimit does for a server. A limit less than 1 returns all available messages
+func WithConsumeLimit(limit int64) Option {
+	return func(c *Client) error {
+		c.defaultConsumeLimit = limit
+		return nil
+	}
+}
+
+// Client implements the operations of haraqa.Client by calling a queue directly, without a server or any
+// network connection. It is useful in tests and in applications which run the queue in the same binary.
+// The queue is not closed by the client, nor configured by it: a server.DelayQueue only delivers the messages
+// delayed before it was opened once its OnDelivered method is called. Use NewClient to create a new embedded client
+type Client struct {
+	q                   server.Queue
+	consumerGroup       string
+	defaultConsumeLimit int64
+}
+
+var _ haraqa.API = &Client{}
+
+// NewClient creates a new client which uses the given queue. Any options given override the local defaults
+func NewClient(q server.Queue, opts ...Option) (*Client, error) {
+	if q == nil {
+		return nil, errors.New("invalid queue: queue cannot be nil")
+	}
+	c := &Client{
+		q:                   q,
+		defaultConsumeLimit: -1,
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// CreateTopic Creates a new topic. It returns an error if the topic already exists
+func (c *Client) CreateTopic(topic string) error {
+	return c.CreateTopicContext(context.Background(), topic)
+}
+
+// CreateTopicContext Creates a new topic using the given context. It returns an error if the topic already exists
+func (c *Client) CreateTopicContext(ctx context.Context, topic string) error {
+	topic, err := cleanTopic(ctx, topic)
+	if err != nil {
+		return err
+	}
+	return c.q.CreateTopic(topic)
+}
+
+// DeleteTopic Delete a topic
+func (c *Client) DeleteTopic(topic string) error {
+	return c.DeleteTopicContext(context.Background(), topic)
+}
+
+// DeleteTopicContext Delete a topic using the given context
+func (c *Client) DeleteTopicContext(ctx context.Context, topic string) error {
+	topic, err := cleanTopic(ctx, topic)
+	if err != nil {
+		return err
+	}
+	return c.q.DeleteTopic(topic)
+}
+
+// ListTopics Lists all topics, filter by prefix, suffix, and/or a regex expression
+func (c *Client) ListTopics(prefix, suffix, regex string) ([]string, error) {
+	return c.ListTopicsContext(context.Background(), prefix, suffix, regex)
+}
+
+// ListTopicsContext Lists all topics using the given context, filter by prefix, suffix, and/or a regex expression
+func (c *Client) ListTopicsContext(ctx context.Context, prefix, suffix, regex string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	topics, err := c.q.ListTopics(prefix, suffix, regex)
+	if err != nil {
+		return nil, err
+	}
+	if topics == nil {
+		topics = []string{}
+	}
+	return topics, nil
+}
+
+// Produce sends messages from a reader to the designated topic
+func (c *Client) Produce(topic string, sizes []int64, r io.Reader) error {
+	return c.ProduceContext(context.Background(), topic, sizes, r)
+}
+
+// ProduceContext sends messages from a reader to the designated topic using the given context
+func (c *Client) ProduceContext(ctx context.Context, topic string, sizes []int64, r io.Reader) error {
+	return c.produce(ctx, topic, sizes, haraqa.ProduceOptions{}, r)
+}
+
+// ProduceWithOptions sends messages from a reader to the designated topic, with the attributes given by opts.
+// Subjects require the queue to implement server.SubjectQueue, and a DeliverAt time in the future requires the
+// queue to implement server.DelayQueue
+func (c *Client) ProduceWithOptions(topic string, sizes []int64, opts haraqa.ProduceOptions, r io.Reader) error {
+	return c.ProduceWithOptionsContext(context.Background(), topic, sizes, opts, r)
+}
+
+// ProduceWithOptionsContext sends messages from a reader to the designated topic with the attributes given by
+// opts, using the given context
+func (c *Client) ProduceWithOptionsContext(ctx context.Context, topic string, sizes []int64, opts haraqa.ProduceOptions, r io.Reader) error {
+	if err := headers.ValidateProduce(len(sizes), opts.EventTimes, opts.Subjects, opts.DeliverAt); err != nil {
+		return err
+	}
+	return c.produce(ctx, topic, sizes, opts, r)
+}
+
+func (c *Client) produce(ctx context.Context, topic string, sizes []int64, opts haraqa.ProduceOptions, r io.Reader) error {
+	topic, err := cleanTopic(ctx, topic)
+	if err != nil {
+		return err
+	}
+	if len(sizes) == 0 {
+		return headers.ErrInvalidHeaderSizes
+	}
+	if r == nil {
+		return headers.ErrInvalidBodyMissing
+	}
+	eventTimes := headers.EventTimeNanos(opts.EventTimes)
+
+	// messages with a deliver at time in the past are produced immediately
+	switch {
+	case opts.DeliverAt.After(time.Now()):
+		dq, ok := c.q.(server.DelayQueue)
+		if !ok {
+			return headers.ErrUnsupportedDelay
+		}
+		return dq.ProduceDelayed(topic, sizes, opts.DeliverAt, eventTimes, r)
+	case opts.Subjects != nil:
+		sq, ok := c.q.(server.SubjectQueue)
+		if !ok {
+			return headers.ErrUnsupportedSubjects
+		}
+		_, err = sq.ProduceWithSubjects(topic, sizes, uint64(time.Now().UnixNano()), eventTimes, opts.Subjects, nil, r)
+		return err
+	}
+	_, err = c.q.Produce(topic, sizes, uint64(time.Now().UnixNano()), eventTimes, nil, r)
+	return err
+}
+
+// ProduceMsgs sends the messages to the designated topic
+func (c *Client) ProduceMsgs(topic string, msgs ...[]byte) error {
+	return c.ProduceMsgsContext(context.Background(), topic, msgs...)
+}
+
+// ProduceMsgsContext sends the messages to the designated topic using the given context
+func (c *Client) ProduceMsgsContext(ctx context.Context, topic string, msgs ...[]byte) error {
+	sizes := make([]int64, 0, len(msgs))
+	for i := range msgs {
+		if len(msgs[i]) > 0 {
+			sizes = append(sizes, int64(len(msgs[i])))
+		}
+	}
+	if len(sizes) == 0 {
+		return nil
+	}
+	return c.ProduceContext(ctx, topic, sizes, bytes.NewReader(bytes.Join(msgs, nil)))
+}
+
+// Consume reads messages off of a topic starting from id, no more than the given limit is returned.
+// If limit is less than 1, the default consume limit is used. The caller is responsible for closing the returned reader.
+func (c *Client) Consume(topic string, id int64, limit int) (io.ReadCloser, []int64, error) {
+	return c.ConsumeContext(context.Background(), topic, id, limit)
+}
+
+// ConsumeContext reads messages off of a topic starting from id using the given context, no more than the given
+// limit is returned. If limit is less than 1, the default consume limit is used. The caller is responsible for
+// closing the returned reader.
+func (c *Client) ConsumeContext(ctx context.Context, topic string, id int64, limit int) (io.ReadCloser, []int64, error) {
+	w, err := c.consume(ctx, topic, id, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	sizes, err := headers.ReadSizes(w.header)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ioutil.NopCloser(&w.body), sizes, nil
+}
+
+// consume reads messages as in ConsumeContext, returning the response written by the queue
+func (c *Client) consume(ctx context.Context, topic string, id int64, limit int) (*consumeWriter, error) {
+	topic, err := cleanTopic(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+	n := int64(limit)
+	if n < 1 {
+		n = c.defaultConsumeLimit
+	}
+
+	w := &consumeWriter{header: make(http.Header)}
+	count, err := c.q.Consume(c.consumerGroup, topic, id, n, w)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, headers.ErrNoContent
+	}
+	if w.status != http.StatusOK && w.status != http.StatusPartialContent {
+		return nil, errors.Errorf("unexpected status %d reading from queue: %s", w.status, strings.TrimSpace(w.body.String()))
+	}
+	return w, nil
+}
+
+// ConsumeMsgs reads messages off of a topic starting from id, no more than the given limit is returned.
+// If limit is less than 1, the default consume limit is used.
+func (c *Client) ConsumeMsgs(topic string, id int64, limit int) ([][]byte, error) {
+	return c.ConsumeMsgsContext(context.Background(), topic, id, limit)
+}
+
+// ConsumeMsgsContext reads messages off of a topic starting from id using the given context, no more than the
+// given limit is returned. If limit is less than 1, the default consume limit is used.
+func (c *Client) ConsumeMsgsContext(ctx context.Context, topic string, id int64, limit int) ([][]byte, error) {
+	msgs, err := c.ConsumeMessagesContext(ctx, topic, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	data := make([][]byte, len(msgs))
+	for i := range msgs {
+		data[i] = msgs[i].Data
+	}
+	return data, nil
+}
+
+// ConsumeMessages reads messages off of a topic starting from id as in ConsumeMsgs, along with the id, event time
+// and whether each message is redacted or deleted
+func (c *Client) ConsumeMessages(topic string, id int64, limit int) ([]*haraqa.Message, error) {
+	return c.ConsumeMessagesContext(context.Background(), topic, id, limit)
+}
+
+// ConsumeMessagesContext reads messages and their attributes off of a topic starting from id using the given
+// context
+func (c *Client) ConsumeMessagesContext(ctx context.Context, topic string, id int64, limit int) ([]*haraqa.Message, error) {
+	w, err := c.consume(ctx, topic, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	return headers.ReadMessages(topic, id, w.header, &w.body)
+}
+
+// DestroySubject destroys the key of a subject, the messages produced with the subject are then consumed as
+// redacted. The queue must implement server.SubjectQueue
+func (c *Client) DestroySubject(subject string) error {
+	return c.DestroySubjectContext(context.Background(), subject)
+}
+
+// DestroySubjectContext destroys the key of a subject using the given context
+func (c *Client) DestroySubjectContext(ctx context.Context, subject string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if subject == "" {
+		return headers.ErrInvalidSubject
+	}
+	sq, ok := c.q.(server.SubjectQueue)
+	if !ok {
+		return headers.ErrUnsupportedSubjects
+	}
+	return sq.DestroySubject(subject)
+}
+
+// DeleteMsgs deletes the messages of a topic in the id ranges. Deleted messages keep their ids and are consumed
+// without their content. Ids past the end of the topic are ignored
+func (c *Client) DeleteMsgs(topic string, ranges ...haraqa.IDRange) (*haraqa.TopicInfo, error) {
+	return c.DeleteMsgsContext(context.Background(), topic, ranges...)
+}
+
+// DeleteMsgsContext deletes the messages of a topic in the id ranges using the given context
+func (c *Client) DeleteMsgsContext(ctx context.Context, topic string, ranges ...haraqa.IDRange) (*haraqa.TopicInfo, error) {
+	topic, err := cleanTopic(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+	if len(ranges) == 0 {
+		return nil, headers.ErrInvalidDeleteRange
+	}
+	return c.q.ModifyTopic(topic, headers.ModifyRequest{Delete: ranges})
+}
+
+// GetTopicInfo returns the range of message ids stored in a topic
+func (c *Client) GetTopicInfo(topic string) (*haraqa.TopicInfo, error) {
+	return c.GetTopicInfoContext(context.Background(), topic)
+}
+
+// GetTopicInfoContext returns the range of message ids stored in a topic using the given context
+func (c *Client) GetTopicInfoContext(ctx context.Context, topic string) (*haraqa.TopicInfo, error) {
+	topic, err := cleanTopic(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+	return c.q.GetTopicInfo(topic)
+}
+
+// GetConsumerOffset returns the offset committed by the client's consumer group for the topic, or -1 if
+// the group has not committed an offset
+func (c *Client) GetConsumerOffset(topic string) (int64, error) {
+	return c.GetConsumerOffsetContext(context.Background(), topic)
+}
+
+// GetConsumerOffsetContext returns the offset committed by the client's consumer group for the topic using
+// the given context, or -1 if the group has not committed an offset
+func (c *Client) GetConsumerOffsetContext(ctx context.Context, topic string) (int64, error) {
+	if c.consumerGroup == "" {
+		return -1, headers.ErrInvalidGroup
+	}
+	topic, err := cleanTopic(ctx, topic)
+	if err != nil {
+		return -1, err
+	}
+	if _, err = c.q.GetTopicInfo(topic); err != nil {
+		return -1, err
+	}
+	return c.q.GetConsumerOffset(c.consumerGroup, topic)
+}
+
+// SetConsumerOffset commits id as the next message to be consumed from the topic by the client's consumer group.
+// Consume requests from the group for an id of 0 or less start from the committed offset
+func (c *Client) SetConsumerOffset(topic string, id int64) error {
+	return c.SetConsumerOffsetContext(context.Background(), topic, id)
+}
+
+// SetConsumerOffsetContext commits id as the next message to be consumed from the topic by the client's
+// consumer group using the given context
+func (c *Client) SetConsumerOffsetContext(ctx context.Context, topic string, id int64) error {
+	if c.consumerGroup == "" {
+		return headers.ErrInvalidGroup
+	}
+	topic, err := cleanTopic(ctx, topic)
+	if err != nil {
+		return err
+	}
+	return c.q.SetConsumerOffset(c.consumerGroup, topic, id)
+}
+
+// Close is a no-op, the queue should be closed by its owner
+func (c *Client) Close() error {
+	return nil
+}
+
+// cleanTopic normalizes the topic name as the server does for topics in a url path
+func cleanTopic(ctx context.Context, topic string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	topic = strings.ToLower(filepath.Clean(strings.TrimPrefix(topic, "/")))
+	if err := headers.ValidateTopic(topic); err != nil {
+		return "", err
+	}
+	return topic, nil
+}
+
+// consumeWriter buffers the response written by a queue's Consume method
+type consumeWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *consumeWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *consumeWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *consumeWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
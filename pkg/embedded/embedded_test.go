@@ -0,0 +1,460 @@
+//+build linux
+
+package embedded
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa"
+	"github.com/haraqa/haraqa/internal/filequeue"
+	"github.com/haraqa/haraqa/internal/memqueue"
+	"github.com/haraqa/haraqa/pkg/server"
+)
+
+func newTestServer(t *testing.T, dir string) (*httptest.Server, func()) {
+	_ = os.RemoveAll(dir)
+	s, err := server.NewServer(server.WithFileQueue([]string{dir}, true, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	return ts, func() {
+		ts.Close()
+		_ = s.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	if _, err := NewClient(nil); err == nil {
+		t.Error("expected invalid queue")
+	}
+	errOpt := func(*Client) error { return errors.New("test error") }
+	if _, err := NewClient(&filequeue.FileQueue{}, errOpt); err == nil || err.Error() != "test error" {
+		t.Error(err)
+	}
+	c, err := NewClient(&filequeue.FileQueue{}, WithConsumerGroup("group"), WithConsumeLimit(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.consumerGroup != "group" || c.defaultConsumeLimit != 10 {
+		t.Error(c)
+	}
+	if err = c.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+// testAPI runs the same operations against any implementation of haraqa.API
+func testAPI(t *testing.T, c haraqa.API) {
+	ctx := context.Background()
+	if err := c.CreateTopic("API/Topic"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateTopicContext(ctx, "api/topic"); !errors.Is(err, haraqa.ErrTopicAlreadyExists) {
+		t.Error(err)
+	}
+	topics, err := c.ListTopics("api/", "", "")
+	if err != nil || len(topics) != 1 || topics[0] != "api/topic" {
+		t.Error(topics, err)
+	}
+
+	if err = c.ProduceMsgs("api/topic", []byte("hello"), []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Produce("api/topic", []int64{1, 2}, bytes.NewBufferString("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.ProduceMsgs("api/missing", []byte("hello")); !errors.Is(err, haraqa.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+
+	msgs, err := c.ConsumeMsgs("api/topic", 1, 2)
+	if err != nil || len(msgs) != 1 || string(msgs[0]) != "world" {
+		t.Error(msgs, err)
+	}
+	r, sizes, err := c.Consume("api/topic", 2, -1)
+	if err != nil || len(sizes) != 2 {
+		t.Fatal(sizes, err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil || string(b) != "abc" {
+		t.Error(string(b), err)
+	}
+	_ = r.Close()
+	if _, err = c.ConsumeMsgs("api/topic", 4, 1); !errors.Is(err, haraqa.ErrNoContent) {
+		t.Error(err)
+	}
+	if _, err = c.ConsumeMsgs("api/missing", 0, 1); !errors.Is(err, haraqa.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+
+	info, err := c.GetTopicInfo("api/topic")
+	if err != nil || info.MinOffset != 0 || info.MaxOffset != 3 {
+		t.Error(info, err)
+	}
+	if err = c.SetConsumerOffset("api/topic", 2); err != haraqa.ErrInvalidGroup {
+		t.Error(err)
+	}
+	if _, err = c.GetConsumerOffset("api/topic"); err != haraqa.ErrInvalidGroup {
+		t.Error(err)
+	}
+
+	// event times are returned with the messages, messages without one have a zero time
+	eventTime := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	if err = c.ProduceWithOptions("api/topic", []int64{1, 1}, haraqa.ProduceOptions{EventTimes: []time.Time{eventTime}}, bytes.NewBufferString("de")); !errors.Is(err, haraqa.ErrInvalidEventTimes) {
+		t.Error(err)
+	}
+	if err = c.ProduceWithOptionsContext(ctx, "api/topic", []int64{1, 1}, haraqa.ProduceOptions{EventTimes: []time.Time{{}, eventTime}}, bytes.NewBufferString("de")); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := c.ConsumeMessages("api/topic", 4, -1)
+	if err != nil || len(messages) != 2 || !messages[0].EventTime.IsZero() || !messages[1].EventTime.Equal(eventTime) {
+		t.Fatal(messages, err)
+	}
+	if messages[0].ID != 4 || string(messages[0].Data) != "d" || messages[1].ID != 5 || string(messages[1].Data) != "e" || messages[1].Topic != "api/topic" {
+		t.Error(messages[0], messages[1])
+	}
+	if messages, err = c.ConsumeMessagesContext(ctx, "api/topic", 2, -1); err != nil || len(messages) != 2 || !messages[0].EventTime.IsZero() || messages[0].ID != 2 {
+		t.Error(messages, err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err = c.ListTopicsContext(cancelled, "", "", ""); !errors.Is(err, context.Canceled) {
+		t.Error(err)
+	}
+
+	if err = c.DeleteTopic("api/topic"); err != nil {
+		t.Error(err)
+	}
+	if _, err = c.GetTopicInfo("api/topic"); !errors.Is(err, haraqa.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	t.Run("embedded", func(t *testing.T) {
+		dir := ".haraqa-embedded-api"
+		_ = os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+		q, err := filequeue.New(true, 2, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer q.Close()
+		c, err := NewClient(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testAPI(t, c)
+	})
+	t.Run("memory", func(t *testing.T) {
+		c, err := NewClient(memqueue.New(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testAPI(t, c)
+	})
+	t.Run("http", func(t *testing.T) {
+		ts, cleanup := newTestServer(t, ".haraqa-http-api")
+		defer cleanup()
+		c, err := haraqa.NewClient(haraqa.WithURL(ts.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testAPI(t, c)
+	})
+}
+
+func TestAPI_Subjects(t *testing.T) {
+	t.Run("embedded", func(t *testing.T) {
+		dir := ".haraqa-embedded-subjects"
+		_ = os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+		q, err := filequeue.New(true, 2, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer q.Close()
+		c, err := NewClient(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testAPISubjects(t, c)
+	})
+	t.Run("memory", func(t *testing.T) {
+		c, err := NewClient(memqueue.New(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = c.CreateTopic("subjects"); err != nil {
+			t.Fatal(err)
+		}
+		if err = c.ProduceWithOptions("subjects", []int64{1}, haraqa.ProduceOptions{Subjects: []string{"alice"}}, bytes.NewBufferString("a")); !errors.Is(err, haraqa.ErrUnsupportedSubjects) {
+			t.Error(err)
+		}
+		if err = c.DestroySubject("alice"); !errors.Is(err, haraqa.ErrUnsupportedSubjects) {
+			t.Error(err)
+		}
+	})
+	t.Run("http", func(t *testing.T) {
+		ts, cleanup := newTestServer(t, ".haraqa-http-subjects")
+		defer cleanup()
+		c, err := haraqa.NewClient(haraqa.WithURL(ts.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testAPISubjects(t, c)
+	})
+}
+
+func testAPISubjects(t *testing.T, c haraqa.API) {
+	ctx := context.Background()
+	if err := c.CreateTopic("subjects"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateTopic(".subjects"); !errors.Is(err, haraqa.ErrReservedTopic) {
+		t.Error(err)
+	}
+	if err := c.ProduceWithOptions("subjects", []int64{1, 2}, haraqa.ProduceOptions{Subjects: []string{"alice"}}, bytes.NewBufferString("abc")); !errors.Is(err, haraqa.ErrInvalidSubjects) {
+		t.Error(err)
+	}
+	if err := c.ProduceWithOptions("subjects", []int64{1}, haraqa.ProduceOptions{Subjects: []string{"alice"}, DeliverAt: time.Now().Add(time.Hour)}, bytes.NewBufferString("a")); !errors.Is(err, haraqa.ErrInvalidDeliverAt) {
+		t.Error(err)
+	}
+
+	// subjects can be combined with event times
+	eventTime := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	opts := haraqa.ProduceOptions{
+		Subjects:   []string{"alice", "", "bob/x"},
+		EventTimes: []time.Time{eventTime, {}, eventTime},
+	}
+	if err := c.ProduceWithOptionsContext(ctx, "subjects", []int64{5, 6, 3}, opts, bytes.NewBufferString("alicepublicbob")); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := c.ConsumeMessages("subjects", 0, -1)
+	if err != nil || len(msgs) != 3 || string(msgs[0].Data) != "alice" || string(msgs[2].Data) != "bob" || msgs[0].Redacted || msgs[2].Redacted {
+		t.Fatal(msgs, err)
+	}
+	if !msgs[0].EventTime.Equal(eventTime) || !msgs[1].EventTime.IsZero() || !msgs[2].EventTime.Equal(eventTime) {
+		t.Error(msgs[0].EventTime, msgs[1].EventTime, msgs[2].EventTime)
+	}
+
+	// destroying a subject redacts its messages
+	if err = c.DestroySubject(""); !errors.Is(err, haraqa.ErrInvalidSubject) {
+		t.Error(err)
+	}
+	if err = c.DestroySubjectContext(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.DestroySubject("bob/x"); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err = c.ConsumeMessagesContext(ctx, "subjects", 0, -1)
+	if err != nil || len(msgs) != 3 || len(msgs[0].Data) != 0 || string(msgs[1].Data) != "public" || len(msgs[2].Data) != 0 || !msgs[0].Redacted || msgs[1].Redacted || !msgs[2].Redacted {
+		t.Error(msgs, err)
+	}
+	if !msgs[0].EventTime.Equal(eventTime) {
+		t.Error(msgs[0].EventTime)
+	}
+}
+
+func TestAPI_Deletions(t *testing.T) {
+	t.Run("embedded", func(t *testing.T) {
+		dir := ".haraqa-embedded-deletions"
+		_ = os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+		q, err := filequeue.New(true, 2, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer q.Close()
+		c, err := NewClient(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testAPIDeletions(t, c)
+	})
+	t.Run("memory", func(t *testing.T) {
+		c, err := NewClient(memqueue.New(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testAPIDeletions(t, c)
+	})
+	t.Run("http", func(t *testing.T) {
+		ts, cleanup := newTestServer(t, ".haraqa-http-deletions")
+		defer cleanup()
+		c, err := haraqa.NewClient(haraqa.WithURL(ts.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testAPIDeletions(t, c)
+	})
+}
+
+func testAPIDeletions(t *testing.T, c haraqa.API) {
+	ctx := context.Background()
+	if err := c.CreateTopic("deletions"); err != nil {
+		t.Fatal(err)
+	}
+	eventTime := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	opts := haraqa.ProduceOptions{EventTimes: []time.Time{eventTime, eventTime, eventTime, eventTime}}
+	if err := c.ProduceWithOptions("deletions", []int64{1, 1, 1, 1}, opts, bytes.NewBufferString("abcd")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.DeleteMsgs("deletions"); !errors.Is(err, haraqa.ErrInvalidDeleteRange) {
+		t.Error(err)
+	}
+	if _, err := c.DeleteMsgs("deletions", haraqa.IDRange{Start: 2, End: 1}); !errors.Is(err, haraqa.ErrInvalidDeleteRange) {
+		t.Error(err)
+	}
+	if _, err := c.DeleteMsgs("missing", haraqa.IDRange{Start: 0, End: 0}); !errors.Is(err, haraqa.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+
+	// deleted messages keep their ids and are consumed without content
+	info, err := c.DeleteMsgsContext(ctx, "deletions", haraqa.IDRange{Start: 1, End: 2})
+	if err != nil || info.MinOffset != 0 || info.MaxOffset != 3 {
+		t.Fatal(info, err)
+	}
+	msgs, err := c.ConsumeMessages("deletions", 0, -1)
+	if err != nil || len(msgs) != 4 || string(msgs[0].Data) != "a" || len(msgs[1].Data) != 0 || len(msgs[2].Data) != 0 || string(msgs[3].Data) != "d" {
+		t.Fatal(msgs, err)
+	}
+	for i, msg := range msgs {
+		if msg.ID != int64(i) || msg.Deleted != (i == 1 || i == 2) || msg.Redacted {
+			t.Error(i, msg)
+		}
+	}
+
+	// deletion flags are returned along with the event times
+	msgs, err = c.ConsumeMessagesContext(ctx, "deletions", 3, -1)
+	if err != nil || len(msgs) != 1 || string(msgs[0].Data) != "d" || msgs[0].Deleted || !msgs[0].EventTime.Equal(eventTime) {
+		t.Error(msgs, err)
+	}
+}
+
+func TestAPI_Delayed(t *testing.T) {
+	t.Run("embedded", func(t *testing.T) {
+		dir := ".haraqa-embedded-delayed"
+		_ = os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+		q, err := filequeue.New(true, 2, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer q.Close()
+		c, err := NewClient(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testAPIDelayed(t, c)
+	})
+	t.Run("memory", func(t *testing.T) {
+		c, err := NewClient(memqueue.New(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testAPIDelayed(t, c)
+	})
+	t.Run("http", func(t *testing.T) {
+		ts, cleanup := newTestServer(t, ".haraqa-http-delayed")
+		defer cleanup()
+		c, err := haraqa.NewClient(haraqa.WithURL(ts.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testAPIDelayed(t, c)
+	})
+}
+
+func testAPIDelayed(t *testing.T, c haraqa.API) {
+	ctx := context.Background()
+	if err := c.CreateTopic("delayed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ProduceWithOptions("missing", []int64{1}, haraqa.ProduceOptions{DeliverAt: time.Now().Add(time.Hour)}, bytes.NewBufferString("a")); !errors.Is(err, haraqa.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+
+	// messages are only visible once delivered, messages with a past deliver at time are produced immediately
+	eventTime := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	opts := haraqa.ProduceOptions{DeliverAt: time.Now().Add(100 * time.Millisecond), EventTimes: []time.Time{eventTime}}
+	if err := c.ProduceWithOptionsContext(ctx, "delayed", []int64{5}, opts, bytes.NewBufferString("later")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ProduceWithOptions("delayed", []int64{3}, haraqa.ProduceOptions{DeliverAt: time.Now().Add(-time.Hour)}, bytes.NewBufferString("now")); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := c.ConsumeMsgs("delayed", 0, -1)
+	if err != nil || len(msgs) != 1 || string(msgs[0]) != "now" {
+		t.Fatal(msgs, err)
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		messages, err := c.ConsumeMessages("delayed", 1, -1)
+		if err == nil && len(messages) == 1 && string(messages[0].Data) == "later" && messages[0].EventTime.Equal(eventTime) {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("delayed message was not delivered", messages, err)
+		}
+	}
+}
+
+func TestClient_ConsumerGroup(t *testing.T) {
+	dir := ".haraqa-embedded-group"
+	_ = os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	q, err := filequeue.New(true, 2, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	c, err := NewClient(q, WithConsumerGroup("group"), WithConsumeLimit(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.CreateTopic("group"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.CreateTopic("/"); err != haraqa.ErrInvalidTopic {
+		t.Error(err)
+	}
+	if err = c.Produce("group", nil, bytes.NewBufferString("a")); err != haraqa.ErrInvalidHeaderSizes {
+		t.Error(err)
+	}
+	if err = c.Produce("group", []int64{1}, nil); err != haraqa.ErrInvalidBodyMissing {
+		t.Error(err)
+	}
+	if err = c.ProduceMsgs("group", []byte("a"), []byte("b"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if offset, err := c.GetConsumerOffset("group"); err != nil || offset != -1 {
+		t.Error(offset, err)
+	}
+	if _, err = c.GetConsumerOffset("missing"); !errors.Is(err, haraqa.ErrTopicDoesNotExist) {
+		t.Error(err)
+	}
+	if err = c.SetConsumerOffset("group", 2); err != nil {
+		t.Fatal(err)
+	}
+	if offset, err := c.GetConsumerOffset("group"); err != nil || offset != 2 {
+		t.Error(offset, err)
+	}
+
+	// the group resumes from its committed offset, and the default limit applies
+	msgs, err := c.ConsumeMsgs("group", 0, 0)
+	if err != nil || len(msgs) != 1 || string(msgs[0]) != "c" {
+		t.Error(msgs, err)
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// decodeBody returns the request body decoded according to its content encoding. The message sizes of a
+// produce request always describe the decoded messages
+func decodeBody(r *http.Request) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get(headers.ContentEncoding))) {
+	case "", "identity":
+		return r.Body, nil
+	case "gzip", "x-gzip":
+		body, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, headers.ErrInvalidBodyEncoding
+		}
+		return body, nil
+	}
+	return nil, headers.ErrInvalidBodyEncoding
+}
+
+// acceptsGzip returns true if the request accepts a gzip encoded response
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values(headers.AcceptEncoding) {
+		for _, coding := range strings.Split(v, ",") {
+			parts := strings.Split(coding, ";")
+			if name := strings.ToLower(strings.TrimSpace(parts[0])); name != "gzip" && name != "x-gzip" {
+				continue
+			}
+			q := 1.0
+			for _, param := range parts[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, _ = strconv.ParseFloat(param[2:], 64)
+				}
+			}
+			return q > 0
+		}
+	}
+	return false
+}
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// gzipResponseWriter gzip encodes the body of successful responses, other responses such as errors are sent
+// as they are
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+// WriteHeader sets the encoding headers of successful responses before writing the status
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if status == http.StatusOK || status == http.StatusPartialContent {
+			h := w.Header()
+			h.Del("Content-Length")
+			h.Set(headers.ContentEncoding, "gzip")
+			h.Add("Vary", headers.AcceptEncoding)
+			w.gz = gzipWriterPool.Get().(*gzip.Writer)
+			w.gz.Reset(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes the body, gzip encoding it if the response is successful
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Close flushes the encoded body
+func (w *gzipResponseWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	err := w.gz.Close()
+	gzipWriterPool.Put(w.gz)
+	w.gz = nil
+	return err
+}
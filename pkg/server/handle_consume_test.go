@@ -2,9 +2,12 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/haraqa/haraqa/internal/headers"
@@ -42,6 +45,12 @@ func TestServer_HandleConsume(t *testing.T) {
 		handleConsume(group, http.StatusNoContent, headers.ErrNoContent, "/topics/"+topic+"?id=123", func(q *MockQueue) {
 			q.EXPECT().Consume(group, topic, int64(123), int64(-1), gomock.Any()).Return(0, nil).Times(1)
 		}))
+	t.Run("invalid wait",
+		handleConsume(group, http.StatusBadRequest, headers.ErrInvalidWait, "/topics/"+topic+"?id=123&wait=invalid", nil))
+	t.Run("wait timeout",
+		handleConsume(group, http.StatusNoContent, headers.ErrNoContent, "/topics/"+topic+"?id=123&wait=10ms", func(q *MockQueue) {
+			q.EXPECT().Consume(group, topic, int64(123), int64(-1), gomock.Any()).Return(0, nil).Times(1)
+		}))
 	errUnknown := errors.New("some unexpected error")
 	t.Run("unknown error",
 		handleConsume(group, http.StatusInternalServerError, errUnknown, "/topics/"+topic+"?id=123", func(q *MockQueue) {
@@ -49,6 +58,101 @@ func TestServer_HandleConsume(t *testing.T) {
 		}))
 }
 
+func TestServer_HandleConsumeGzip(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	topic := "consumer_topic"
+	q := NewMockQueue(ctrl)
+	q.EXPECT().RootDir().Times(1).Return("")
+	q.EXPECT().Close().Times(1).Return(nil)
+	q.EXPECT().Consume("", topic, int64(5), int64(-1), gomock.Any()).
+		DoAndReturn(func(group, topic string, offset, limit int64, w http.ResponseWriter) (int, error) {
+			headers.SetSizes([]int64{5, 6}, w.Header())
+			w.Header().Set("Content-Length", "11")
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write([]byte("hello world"))
+			return 2, nil
+		}).Times(3)
+	q.EXPECT().Consume("", topic, int64(7), int64(-1), gomock.Any()).Return(0, headers.ErrTopicDoesNotExist).Times(1)
+	s, err := NewServer(WithQueue(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	consume := func(id, acceptEncoding string, status int, encoding string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/topics/"+topic+"?id="+id, nil)
+		r.Header.Set(headers.AcceptEncoding, acceptEncoding)
+		s.ServeHTTP(w, r)
+		if w.Code != status || w.Header().Get(headers.ContentEncoding) != encoding {
+			t.Error(acceptEncoding, w.Code, w.Header())
+		}
+		return w
+	}
+
+	// the messages are encoded, the sizes describe the decoded messages
+	w := consume("5", "deflate, gzip;q=0.5", http.StatusPartialContent, "gzip")
+	if w.Header().Get("Content-Length") != "" || len(w.Header()[headers.HeaderSizes]) != 2 {
+		t.Error(w.Header())
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(zr); err != nil || string(b) != "hello world" {
+		t.Error(string(b), err)
+	}
+
+	// gzip must be accepted, errors are not encoded
+	consume("5", "gzip;q=0", http.StatusPartialContent, "")
+	consume("5", "identity", http.StatusPartialContent, "")
+	consume("7", "gzip", http.StatusPreconditionFailed, "")
+}
+
+func TestServer_HandleConsumeWait(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	topic := "consumer_topic"
+	q := NewMockQueue(ctrl)
+	q.EXPECT().RootDir().Times(1).Return("")
+	q.EXPECT().Close().Times(1).Return(nil)
+	gomock.InOrder(
+		q.EXPECT().Consume("", topic, int64(5), int64(-1), gomock.Any()).Return(0, nil).Times(1),
+		q.EXPECT().Consume("", topic, int64(5), int64(-1), gomock.Any()).Return(2, nil).Times(1),
+	)
+	s, err := NewServer(WithQueue(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// publish an event once the request is waiting
+	go func() {
+		for !s.watchers.watching(topic) {
+			time.Sleep(time.Millisecond)
+		}
+		s.watchers.publish(headers.WatchEvent{Type: headers.EventProduced, Topic: topic})
+	}()
+
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest(http.MethodGet, "/topics/"+topic+"?id=5&wait=10s", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || time.Since(start) > 5*time.Second {
+		t.Error(w.Code, time.Since(start))
+	}
+	if s.watchers.active() {
+		t.Error("expected watcher to be removed")
+	}
+}
+
 func handleConsume(group string, status int, errExpected error, url string, expect func(q *MockQueue)) func(*testing.T) {
 	return func(t *testing.T) {
 		ctrl := gomock.NewController(t)
@@ -15,6 +15,8 @@ func TestServer_HandleCreateTopic(t *testing.T) {
 	topic := "created_topic"
 	t.Run("invalid topic",
 		handleCreateTopic(http.StatusBadRequest, headers.ErrInvalidTopic, "", nil))
+	t.Run("reserved topic",
+		handleCreateTopic(http.StatusBadRequest, headers.ErrReservedTopic, ".subjects", nil))
 	t.Run("happy path",
 		handleCreateTopic(http.StatusCreated, nil, topic, func(q *MockQueue) {
 			q.EXPECT().CreateTopic(topic).Return(nil).Times(1)
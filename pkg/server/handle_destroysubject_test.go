@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/haraqa/haraqa/internal/headers"
+	"github.com/pkg/errors"
+)
+
+// subjectQueue is a mock queue supporting subjects
+type subjectQueue struct {
+	*MockQueue
+	*MockSubjectQueue
+}
+
+func TestServer_HandleDestroySubject(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// queues without subjects
+	{
+		q := NewMockQueue(ctrl)
+		q.EXPECT().RootDir().Times(1).Return("")
+		q.EXPECT().Close().Return(nil).Times(1)
+		s, err := NewServer(WithQueue(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(http.MethodDelete, "/subjects/alice", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusNotImplemented || headers.ReadErrors(w.Header()) != headers.ErrUnsupportedSubjects {
+			t.Error(w.Code, headers.ReadErrors(w.Header()))
+		}
+		_ = s.Close()
+	}
+
+	q := &subjectQueue{MockQueue: NewMockQueue(ctrl), MockSubjectQueue: NewMockSubjectQueue(ctrl)}
+	q.MockQueue.EXPECT().RootDir().Times(1).Return("")
+	gomock.InOrder(
+		q.MockSubjectQueue.EXPECT().DestroySubject("alice").Return(nil).Times(1),
+		q.MockSubjectQueue.EXPECT().DestroySubject("bob").Return(errors.New("test destroy error")).Times(1),
+	)
+	q.MockSubjectQueue.EXPECT().ProduceWithSubjects("topic", []int64{5, 6}, gomock.Any(), nil, []string{"alice", ""}, nil, gomock.Any()).
+		Return(&headers.ProduceInfo{StartID: 0, EndID: 1}, nil).Times(1)
+	q.MockQueue.EXPECT().Close().Return(nil).Times(1)
+	s, err := NewServer(WithQueue(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		status int
+		err    error
+	}{
+		{http.MethodDelete, "/subjects/", http.StatusBadRequest, headers.ErrInvalidSubject},
+		{http.MethodGet, "/subjects/alice", http.StatusOK, nil},
+		{http.MethodDelete, "/subjects/alice", http.StatusNoContent, nil},
+		{http.MethodDelete, "/subjects/bob", http.StatusInternalServerError, errors.New("test destroy error")},
+	} {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(tc.method, tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Error(tc.method, tc.path, w.Code)
+		}
+		if err = headers.ReadErrors(w.Header()); (err == nil) != (tc.err == nil) || (err != nil && err.Error() != tc.err.Error()) {
+			t.Error(tc.method, tc.path, err)
+		}
+	}
+
+	// messages with subjects are produced to the subject queue
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest(http.MethodPost, "/topics/topic", bytes.NewBufferString("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers.SetSizes([]int64{5, 6}, r.Header)
+	headers.SetSubjects([]string{"alice", ""}, r.Header)
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Error(w.Code, headers.ReadErrors(w.Header()))
+	}
+}
+
+func TestServer_RawHidesDotFiles(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	dir := ".haraqa-raw-dotfiles"
+	_ = os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"topic/file", ".subjects/key"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q := NewMockQueue(ctrl)
+	q.EXPECT().RootDir().Times(1).Return(dir)
+	q.EXPECT().Close().Return(nil).Times(1)
+	s, err := NewServer(WithQueue(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for path, status := range map[string]int{
+		"/raw/topic/file":             http.StatusOK,
+		"/raw/.subjects/key":          http.StatusNotFound,
+		"/raw/.subjects/":             http.StatusNotFound,
+		"/raw/topic/../.subjects/key": http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.ServeHTTP(w, r)
+		if w.Code != status {
+			t.Error(path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestServer_HandleHealth(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	q := NewMockQueue(ctrl)
+	gomock.InOrder(
+		q.EXPECT().RootDir().Times(1).Return(""),
+		q.EXPECT().Close().Return(nil).Times(1),
+	)
+	s, err := NewServer(WithQueue(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := http.NewRequest(http.MethodGet, "/health", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Error(w.Code, w.Body.String())
+	}
+
+	// closed servers are unhealthy
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable || headers.ReadErrors(w.Header()) != headers.ErrClosed {
+		t.Error(w.Code, w.Header())
+	}
+}
@@ -29,6 +29,14 @@ func TestServer_HandleModifyTopic(t *testing.T) {
 		handleModifyTopic(http.StatusOK, nil, topic, info, bytes.NewBuffer([]byte(`{"truncate":123}`)), func(q *MockQueue) {
 			q.EXPECT().ModifyTopic(topic, gomock.Any()).Return(&headers.TopicInfo{MinOffset: 123, MaxOffset: 456}, nil).Times(1)
 		}))
+	t.Run("delete",
+		handleModifyTopic(http.StatusOK, nil, topic, info, bytes.NewBuffer([]byte(`{"delete":[{"start":1,"end":2}]}`)), func(q *MockQueue) {
+			q.EXPECT().ModifyTopic(topic, headers.ModifyRequest{Delete: []headers.IDRange{{Start: 1, End: 2}}}).Return(&headers.TopicInfo{MinOffset: 123, MaxOffset: 456}, nil).Times(1)
+		}))
+	t.Run("invalid delete range",
+		handleModifyTopic(http.StatusBadRequest, headers.ErrInvalidDeleteRange, topic, info, bytes.NewBuffer([]byte(`{"delete":[{"start":2,"end":1}]}`)), func(q *MockQueue) {
+			q.EXPECT().ModifyTopic(topic, gomock.Any()).Return(nil, headers.ErrInvalidDeleteRange).Times(1)
+		}))
 	t.Run("topic doesn't exist",
 		handleModifyTopic(http.StatusPreconditionFailed, headers.ErrTopicDoesNotExist, topic, info, bytes.NewBuffer([]byte(`{"truncate":123}`)), func(q *MockQueue) {
 			q.EXPECT().ModifyTopic(topic, gomock.Any()).Return(nil, headers.ErrTopicDoesNotExist).Times(1)
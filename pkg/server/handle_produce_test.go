@@ -2,36 +2,93 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/haraqa/haraqa/internal/headers"
+	"github.com/haraqa/haraqa/internal/memqueue"
 )
 
 func TestServer_HandleProduce(t *testing.T) {
 	topic := "produce_topic"
 	t.Run("nil body",
-		handleProduce(http.StatusBadRequest, headers.ErrInvalidBodyMissing, topic, nil, nil, nil))
+		handleProduce(http.StatusBadRequest, headers.ErrInvalidBodyMissing, topic, nil, nil, nil, nil))
 	t.Run("invalid topic",
-		handleProduce(http.StatusBadRequest, headers.ErrInvalidTopic, "", nil, bytes.NewBuffer([]byte("hello world")), nil))
+		handleProduce(http.StatusBadRequest, headers.ErrInvalidTopic, "", nil, nil, bytes.NewBuffer([]byte("hello world")), nil))
 	t.Run("missing sizes",
-		handleProduce(http.StatusBadRequest, headers.ErrInvalidHeaderSizes, topic, nil, bytes.NewBuffer([]byte("hello world")), nil))
+		handleProduce(http.StatusBadRequest, headers.ErrInvalidHeaderSizes, topic, nil, nil, bytes.NewBuffer([]byte("hello world")), nil))
 	t.Run("invalid sizes",
-		handleProduce(http.StatusBadRequest, headers.ErrInvalidHeaderSizes, topic, []string{"invalid"}, bytes.NewBuffer([]byte("hello world")), nil))
+		handleProduce(http.StatusBadRequest, headers.ErrInvalidHeaderSizes, topic, []string{"invalid"}, nil, bytes.NewBuffer([]byte("hello world")), nil))
 	t.Run("valid sizes",
-		handleProduce(http.StatusNoContent, nil, topic, []string{"5", "6"}, bytes.NewBuffer([]byte("hello world")), func(q *MockQueue) {
-			q.EXPECT().Produce(topic, []int64{5, 6}, gomock.Any(), gomock.Any()).Return(nil).Times(1)
+		handleProduce(http.StatusNoContent, nil, topic, []string{"5", "6"}, nil, bytes.NewBuffer([]byte("hello world")), func(q *MockQueue) {
+			q.EXPECT().Produce(topic, []int64{5, 6}, gomock.Any(), gomock.Any(), nil, gomock.Any()).Return(&headers.ProduceInfo{StartID: 4, EndID: 5}, nil).Times(1)
 		}))
 	t.Run("no such topic",
-		handleProduce(http.StatusPreconditionFailed, headers.ErrTopicDoesNotExist, topic, []string{"5", "6"}, bytes.NewBuffer([]byte("hello world")), func(q *MockQueue) {
-			q.EXPECT().Produce(topic, []int64{5, 6}, gomock.Any(), gomock.Any()).Return(headers.ErrTopicDoesNotExist).Times(1)
+		handleProduce(http.StatusPreconditionFailed, headers.ErrTopicDoesNotExist, topic, []string{"5", "6"}, nil, bytes.NewBuffer([]byte("hello world")), func(q *MockQueue) {
+			q.EXPECT().Produce(topic, []int64{5, 6}, gomock.Any(), gomock.Any(), nil, gomock.Any()).Return(nil, headers.ErrTopicDoesNotExist).Times(1)
 		}))
+	t.Run("invalid event times",
+		handleProduce(http.StatusBadRequest, headers.ErrInvalidEventTimes, topic, []string{"5", "6"}, http.Header{headers.HeaderEventTimes: {"invalid", ""}}, bytes.NewBuffer([]byte("hello world")), nil))
+	t.Run("mismatched event times",
+		handleProduce(http.StatusBadRequest, headers.ErrInvalidEventTimes, topic, []string{"5", "6"}, http.Header{headers.HeaderEventTimes: {"2020-01-02T03:04:05Z"}}, bytes.NewBuffer([]byte("hello world")), nil))
+	t.Run("event times",
+		handleProduce(http.StatusNoContent, nil, topic, []string{"5", "6"}, http.Header{headers.HeaderEventTimes: {"", "2020-01-02T03:04:05.000000006Z"}}, bytes.NewBuffer([]byte("hello world")), func(q *MockQueue) {
+			q.EXPECT().Produce(topic, []int64{5, 6}, gomock.Any(), []uint64{0, 1577934245000000006}, nil, gomock.Any()).Return(&headers.ProduceInfo{StartID: 4, EndID: 5}, nil).Times(1)
+		}))
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	_, _ = zw.Write([]byte("hello world"))
+	_ = zw.Close()
+	t.Run("gzip body",
+		handleProduce(http.StatusNoContent, nil, topic, []string{"5", "6"}, http.Header{headers.ContentEncoding: {"gzip"}}, &gzipped, func(q *MockQueue) {
+			q.EXPECT().Produce(topic, []int64{5, 6}, gomock.Any(), gomock.Any(), nil, gomock.Any()).
+				DoAndReturn(func(topic string, sizes []int64, timestamp uint64, eventTimes []uint64, producer *headers.ProducerSequence, r io.Reader) (*headers.ProduceInfo, error) {
+					if b, err := ioutil.ReadAll(r); err != nil || string(b) != "hello world" {
+						t.Error(string(b), err)
+					}
+					return &headers.ProduceInfo{StartID: 4, EndID: 5}, nil
+				}).Times(1)
+		}))
+	t.Run("invalid gzip body",
+		handleProduce(http.StatusUnsupportedMediaType, headers.ErrInvalidBodyEncoding, topic, []string{"5", "6"}, http.Header{headers.ContentEncoding: {"gzip"}}, bytes.NewBuffer([]byte("hello world")), nil))
+	t.Run("unsupported encoding",
+		handleProduce(http.StatusUnsupportedMediaType, headers.ErrInvalidBodyEncoding, topic, []string{"5", "6"}, http.Header{headers.ContentEncoding: {"br"}}, bytes.NewBuffer([]byte("hello world")), nil))
+	t.Run("mismatched subjects",
+		handleProduce(http.StatusBadRequest, headers.ErrInvalidSubjects, topic, []string{"5", "6"}, http.Header{headers.HeaderSubjects: {"alice"}}, bytes.NewBuffer([]byte("hello world")), nil))
+	t.Run("unsupported subjects",
+		handleProduce(http.StatusNotImplemented, headers.ErrUnsupportedSubjects, topic, []string{"5", "6"}, http.Header{headers.HeaderSubjects: {"alice", ""}}, bytes.NewBuffer([]byte("hello world")), nil))
+	t.Run("invalid deliver at",
+		handleProduce(http.StatusBadRequest, headers.ErrInvalidDeliverAt, topic, []string{"5", "6"}, http.Header{headers.HeaderDeliverAt: {"tomorrow"}}, bytes.NewBuffer([]byte("hello world")), nil))
+	t.Run("unsupported delay",
+		handleProduce(http.StatusNotImplemented, headers.ErrUnsupportedDelay, topic, []string{"5", "6"}, headers.SetDeliverAt(time.Now().Add(time.Hour), http.Header{}), bytes.NewBuffer([]byte("hello world")), nil))
+	t.Run("past deliver at",
+		handleProduce(http.StatusNoContent, nil, topic, []string{"5", "6"}, headers.SetDeliverAt(time.Now().Add(-time.Hour), http.Header{}), bytes.NewBuffer([]byte("hello world")), func(q *MockQueue) {
+			q.EXPECT().Produce(topic, []int64{5, 6}, gomock.Any(), gomock.Any(), nil, gomock.Any()).Return(&headers.ProduceInfo{StartID: 4, EndID: 5}, nil).Times(1)
+		}))
+
+	producer := &headers.ProducerSequence{ID: "producer", Seq: 3}
+	t.Run("invalid producer",
+		handleProduce(http.StatusBadRequest, headers.ErrInvalidProducer, topic, []string{"5", "6"}, http.Header{headers.HeaderProducerID: {"producer"}}, bytes.NewBuffer([]byte("hello world")), nil))
+	t.Run("duplicate batch",
+		handleProduce(http.StatusNoContent, nil, topic, []string{"5", "6"}, headers.SetProducerSequence(producer, http.Header{}), bytes.NewBuffer([]byte("hello world")), func(q *MockQueue) {
+			q.EXPECT().Produce(topic, []int64{5, 6}, gomock.Any(), gomock.Any(), producer, gomock.Any()).Return(&headers.ProduceInfo{StartID: 4, EndID: 5, Duplicate: true}, nil).Times(1)
+		}))
+	t.Run("stale batch",
+		handleProduce(http.StatusConflict, headers.ErrStaleProducerSeq, topic, []string{"5", "6"}, headers.SetProducerSequence(producer, http.Header{}), bytes.NewBuffer([]byte("hello world")), func(q *MockQueue) {
+			q.EXPECT().Produce(topic, []int64{5, 6}, gomock.Any(), gomock.Any(), producer, gomock.Any()).Return(nil, headers.ErrStaleProducerSeq).Times(1)
+		}))
+	t.Run("delayed batch with producer",
+		handleProduce(http.StatusBadRequest, headers.ErrInvalidDeliverAt, topic, []string{"5", "6"}, headers.SetDeliverAt(time.Now().Add(time.Hour), headers.SetProducerSequence(producer, http.Header{})), bytes.NewBuffer([]byte("hello world")), nil))
 }
 
-func handleProduce(status int, errExpected error, topic string, sizes []string, body io.Reader, expect func(q *MockQueue)) func(*testing.T) {
+func handleProduce(status int, errExpected error, topic string, sizes []string, h http.Header, body io.Reader, expect func(q *MockQueue)) func(*testing.T) {
 	return func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
@@ -61,6 +118,9 @@ func handleProduce(status int, errExpected error, topic string, sizes []string,
 		for _, size := range sizes {
 			r.Header.Add(headers.HeaderSizes, size)
 		}
+		for k, v := range h {
+			r.Header[k] = v
+		}
 
 		// if no topic, handle directly
 		_, err = getTopic(r)
@@ -80,5 +140,79 @@ func handleProduce(status int, errExpected error, topic string, sizes []string,
 		if err != errExpected && err.Error() != errExpected.Error() {
 			t.Error(err)
 		}
+		if status == http.StatusNoContent {
+			info, err := headers.ReadProduceInfo(resp.Header)
+			if err != nil || info == nil || info.StartID != 4 || info.EndID != 5 {
+				t.Error(info, err)
+			}
+		}
+	}
+}
+
+type produceMetrics struct {
+	noOpMetrics
+	mux      sync.Mutex
+	produced int
+}
+
+func (m *produceMetrics) ProduceMsgs(n int) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.produced += n
+}
+
+func TestServer_HandleProduceDelayed(t *testing.T) {
+	m := &produceMetrics{}
+	s, err := NewServer(WithQueue(memqueue.New(10)), WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err = s.q.CreateTopic("delayed"); err != nil {
+		t.Fatal(err)
+	}
+
+	produce := func(deliverAt time.Time, status int) {
+		t.Helper()
+		r, err := http.NewRequest(http.MethodPost, "/topics/delayed", bytes.NewBufferString("hello world"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers.SetSizes([]int64{5, 6}, r.Header)
+		headers.SetDeliverAt(deliverAt, r.Header)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != status || w.Header().Get(headers.HeaderStartID) != "" {
+			t.Fatal(w.Code, w.Header(), headers.ReadErrors(w.Header()))
+		}
+	}
+	consume := func(query string) *httptest.ResponseRecorder {
+		t.Helper()
+		r, err := http.NewRequest(http.MethodGet, "/topics/delayed?id=0"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	// delayed messages are accepted without ids, and are not visible until delivered
+	produce(time.Now().Add(time.Hour), http.StatusAccepted)
+	produce(time.Now().Add(100*time.Millisecond), http.StatusAccepted)
+	if w := consume(""); w.Code != http.StatusNoContent {
+		t.Fatal(w.Code)
+	}
+
+	// consumers waiting for messages are woken once the messages are delivered
+	start := time.Now()
+	w := consume("&wait=10s")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "hello world" || time.Since(start) > 5*time.Second {
+		t.Fatal(w.Code, w.Body.String(), time.Since(start))
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.produced != 2 {
+		t.Error(m.produced)
 	}
 }
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/haraqa/haraqa/internal/headers"
+	"github.com/pkg/errors"
+)
+
+func TestServer_HandleSetConsumerOffset(t *testing.T) {
+	topic := "offset_topic"
+	group := "group"
+	t.Run("invalid topic",
+		handleSetConsumerOffset(http.StatusBadRequest, headers.ErrInvalidTopic, "/offsets/", group, nil))
+	t.Run("missing group",
+		handleSetConsumerOffset(http.StatusBadRequest, headers.ErrInvalidGroup, "/offsets/topics/"+topic+"?id=1", "", nil))
+	t.Run("invalid id",
+		handleSetConsumerOffset(http.StatusBadRequest, headers.ErrInvalidMessageID, "/offsets/topics/"+topic+"?id=-1", group, nil))
+	t.Run("topic doesn't exist",
+		handleSetConsumerOffset(http.StatusPreconditionFailed, headers.ErrTopicDoesNotExist, "/offsets/topics/"+topic+"?id=1", group, func(q *MockQueue) {
+			q.EXPECT().SetConsumerOffset(group, topic, int64(1)).Return(headers.ErrTopicDoesNotExist).Times(1)
+		}))
+	t.Run("happy path",
+		handleSetConsumerOffset(http.StatusNoContent, nil, "/offsets/topics/"+topic+"?id=12", group, func(q *MockQueue) {
+			q.EXPECT().SetConsumerOffset(group, topic, int64(12)).Return(nil).Times(1)
+		}))
+	errUnknown := errors.New("some unexpected error")
+	t.Run("unknown error",
+		handleSetConsumerOffset(http.StatusInternalServerError, errUnknown, "/offsets/topics/"+topic+"?id=12", group, func(q *MockQueue) {
+			q.EXPECT().SetConsumerOffset(group, topic, int64(12)).Return(errUnknown).Times(1)
+		}))
+}
+
+func handleSetConsumerOffset(status int, errExpected error, url, group string, expect func(q *MockQueue)) func(t *testing.T) {
+	return func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		// setup mock queue
+		q := NewMockQueue(ctrl)
+		q.EXPECT().RootDir().Times(1).Return("")
+		q.EXPECT().Close().Return(nil).Times(1)
+		if expect != nil {
+			expect(q)
+		}
+
+		// setup server
+		s, err := NewServer(WithQueue(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		// create request
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(http.MethodPut, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if group != "" {
+			r.Header.Set(headers.HeaderConsumerGroup, group)
+		}
+
+		// handle
+		_, err = getTopic(r)
+		if err != nil {
+			s.HandleSetConsumerOffset(w, r)
+		} else {
+			s.ServeHTTP(w, r)
+		}
+
+		// check result
+		resp := w.Result()
+		defer resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Error(resp.Status)
+		}
+		err = headers.ReadErrors(resp.Header)
+		if err != errExpected && err.Error() != errExpected.Error() {
+			t.Error(err)
+		}
+	}
+}
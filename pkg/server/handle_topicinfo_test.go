@@ -0,0 +1,98 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/haraqa/haraqa/internal/headers"
+	"github.com/pkg/errors"
+)
+
+func TestServer_HandleTopicInfo(t *testing.T) {
+	topic := "info_topic"
+	group := "group"
+	t.Run("invalid topic",
+		handleTopicInfo(http.StatusBadRequest, headers.ErrInvalidTopic, "", "", nil))
+	t.Run("topic doesn't exist",
+		handleTopicInfo(http.StatusPreconditionFailed, headers.ErrTopicDoesNotExist, topic, "", func(q *MockQueue) {
+			q.EXPECT().GetTopicInfo(topic).Return(nil, headers.ErrTopicDoesNotExist).Times(1)
+		}))
+	t.Run("happy path",
+		handleTopicInfo(http.StatusOK, nil, topic, "", func(q *MockQueue) {
+			q.EXPECT().GetTopicInfo(topic).Return(&headers.TopicInfo{MinOffset: 3, MaxOffset: 9}, nil).Times(1)
+		}))
+	t.Run("happy path: with group",
+		handleTopicInfo(http.StatusOK, nil, topic, group, func(q *MockQueue) {
+			q.EXPECT().GetTopicInfo(topic).Return(&headers.TopicInfo{MinOffset: 3, MaxOffset: 9}, nil).Times(1)
+			q.EXPECT().GetConsumerOffset(group, topic).Return(int64(7), nil).Times(1)
+		}))
+	errUnknown := errors.New("some unexpected error")
+	t.Run("offset error",
+		handleTopicInfo(http.StatusInternalServerError, errUnknown, topic, group, func(q *MockQueue) {
+			q.EXPECT().GetTopicInfo(topic).Return(&headers.TopicInfo{MinOffset: 3, MaxOffset: 9}, nil).Times(1)
+			q.EXPECT().GetConsumerOffset(group, topic).Return(int64(-1), errUnknown).Times(1)
+		}))
+}
+
+func handleTopicInfo(status int, errExpected error, topic, group string, expect func(q *MockQueue)) func(t *testing.T) {
+	return func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		// setup mock queue
+		q := NewMockQueue(ctrl)
+		q.EXPECT().RootDir().Times(1).Return("")
+		q.EXPECT().Close().Return(nil).Times(1)
+		if expect != nil {
+			expect(q)
+		}
+
+		// setup server
+		s, err := NewServer(WithQueue(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		// create request
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(http.MethodHead, "/topics/"+topic, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if group != "" {
+			r.Header.Set(headers.HeaderConsumerGroup, group)
+		}
+
+		// handle
+		_, err = getTopic(r)
+		if err != nil {
+			s.HandleTopicInfo(w, r)
+		} else {
+			s.ServeHTTP(w, r)
+		}
+
+		// check result
+		resp := w.Result()
+		defer resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Error(resp.Status)
+		}
+		err = headers.ReadErrors(resp.Header)
+		if err != errExpected && err.Error() != errExpected.Error() {
+			t.Error(err)
+		}
+		if status != http.StatusOK {
+			return
+		}
+		info, err := headers.ReadTopicInfo(resp.Header)
+		if err != nil || info.MinOffset != 3 || info.MaxOffset != 9 {
+			t.Error(info, err)
+		}
+		if group != "" && resp.Header.Get(headers.HeaderGroupOffset) != "7" {
+			t.Error(resp.Header)
+		}
+	}
+}
@@ -4,8 +4,6 @@ import (
 	"bytes"
 	"net/http"
 	"net/http/httptest"
-	"os"
-	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -25,10 +23,14 @@ func TestServer_HandleWatchTopic(t *testing.T) {
 	mockQ := NewMockQueue(ctrl)
 	mockQ.EXPECT().RootDir().Return(dir).AnyTimes()
 	mockQ.EXPECT().Close().Return(nil)
-
-	os.RemoveAll(dir)
-	os.MkdirAll(filepath.Join(dir, topic), os.ModePerm)
-	defer os.RemoveAll(dir)
+	mockQ.EXPECT().GetTopicInfo("invalid_topic").Return(nil, headers.ErrTopicDoesNotExist).AnyTimes()
+	mockQ.EXPECT().GetTopicInfo(topic).Return(&headers.TopicInfo{MinOffset: 0, MaxOffset: 9}, nil).AnyTimes()
+	mockQ.EXPECT().GetTopicInfo(topic+"/nested").Return(&headers.TopicInfo{MinOffset: 0, MaxOffset: -1}, nil).AnyTimes()
+	mockQ.EXPECT().Produce(topic, []int64{5}, gomock.Any(), gomock.Any(), nil, gomock.Any()).Return(&headers.ProduceInfo{StartID: 9, EndID: 9}, nil).AnyTimes()
+	mockQ.EXPECT().DeleteTopic(topic).Return(nil).AnyTimes()
+	mockQ.EXPECT().ListTopics(topic+"/", "", "").Return([]string{topic + "/nested"}, nil).AnyTimes()
+	mockQ.EXPECT().CreateTopic("orders/new").Return(nil).AnyTimes()
+	mockQ.EXPECT().ModifyTopic(topic, gomock.Any()).Return(&headers.TopicInfo{MinOffset: 3, MaxOffset: 9}, nil).AnyTimes()
 
 	s, err := NewServer(WithQueue(mockQ))
 	if err != nil {
@@ -43,58 +45,178 @@ func TestServer_HandleWatchTopic(t *testing.T) {
 
 	t.Run("missing topics", handleWatchTopicErrors(http.StatusBadRequest, server.URL+"/ws/topics", headers.ErrInvalidTopic))
 	t.Run("invalid topic", handleWatchTopicErrors(http.StatusPreconditionFailed, server.URL+"/ws/topics/invalid_topic", headers.ErrTopicDoesNotExist))
+	t.Run("invalid pattern", handleWatchTopicErrors(http.StatusBadRequest, server.URL+"/ws/topics?regex=[", headers.ErrInvalidTopic))
 	t.Run("invalid websocket", handleWatchTopicErrors(http.StatusBadRequest, server.URL+"/ws/topics/"+topic, headers.ErrInvalidWebsocket))
 
-	// valid websocket
-	{
-		url := strings.Replace(server.URL, "http", "ws", 1) + "/ws/topics/" + topic
-		conn, resp, err := websocket.DefaultDialer.Dial(url, map[string][]string{
-			headers.HeaderWatchTopics: {topic, topic, topic},
-		})
+	produce := func() {
+		r, err := http.NewRequest(http.MethodPost, server.URL+"/topics/"+topic, bytes.NewBufferString("hello"))
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
-		err = headers.ReadErrors(resp.Header)
+		headers.SetSizes([]int64{5}, r.Header)
+		resp, err := http.DefaultClient.Do(r)
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
-		if conn == nil {
-			t.Error("invalid conn")
+		resp.Body.Close()
+	}
+
+	// valid websocket, json events
+	{
+		conn := dialWatchTopic(t, server.URL, topic, headers.WatchFormatJSON)
+		defer conn.Close()
+
+		produce()
+		var event headers.WatchEvent
+		if err = conn.ReadJSON(&event); err != nil {
+			t.Fatal(err)
 		}
-		if resp.Body != nil {
-			defer resp.Body.Close()
+		if event.Type != headers.EventProduced || event.Topic != topic || event.MinOffset != 0 || event.MaxOffset != 9 {
+			t.Error(event)
 		}
+	}
 
-		err = conn.WriteControl(websocket.PongMessage, nil, time.Now().Add(s.wsPingInterval))
+	// valid websocket, text events
+	for _, format := range []string{"", headers.WatchFormatText} {
+		conn := dialWatchTopic(t, server.URL, topic, format)
+		defer conn.Close()
+
+		produce()
+		msgType, data, err := conn.ReadMessage()
 		if err != nil {
-			t.Error(err)
-			return
+			t.Fatal(err)
+		}
+		if msgType != websocket.TextMessage {
+			t.Error(format, msgType)
 		}
+		if !bytes.Equal(data, []byte(topic)) {
+			t.Error(format, string(data))
+		}
+	}
 
-		f, err := os.Create(filepath.Join(dir, topic, "00000"))
+	// patterns receive events for new topics
+	{
+		url := strings.Replace(server.URL, "http", "ws", 1) + "/ws/topics?prefix=orders/"
+		conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{headers.HeaderWatchFormat: {headers.WatchFormatJSON}})
 		if err != nil {
-			t.Error(err)
-			return
+			t.Fatal(err)
 		}
-		defer f.Close()
-		f.Write([]byte("hello_there"))
-		time.Sleep(s.wsPingInterval * 2)
+		resp.Body.Close()
+		defer conn.Close()
 
-		msgType, data, err := conn.ReadMessage()
+		r, err := http.NewRequest(http.MethodPut, server.URL+"/topics/orders/new", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err = http.DefaultClient.Do(r)
 		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		var event headers.WatchEvent
+		if err = conn.ReadJSON(&event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != headers.EventCreated || event.Topic != "orders/new" || event.MaxOffset != -1 {
+			t.Error(event)
+		}
+	}
+
+	// modifies send an event, truncated or not
+	{
+		conn := dialWatchTopic(t, server.URL, topic, headers.WatchFormatJSON)
+		defer conn.Close()
+
+		for body, eventType := range map[string]headers.EventType{
+			`{"delete":[{"start":1,"end":2}]}`: headers.EventModified,
+			`{"truncate":3}`:                   headers.EventTruncated,
+		} {
+			r, err := http.NewRequest(http.MethodPatch, server.URL+"/topics/"+topic, bytes.NewBufferString(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			var event headers.WatchEvent
+			if err = conn.ReadJSON(&event); err != nil {
+				t.Fatal(err)
+			}
+			if event.Type != eventType || event.Topic != topic || event.MinOffset != 3 || event.MaxOffset != 9 {
+				t.Error(body, event)
+			}
+		}
+	}
+
+	// delete closes the websocket
+	{
+		conn := dialWatchTopic(t, server.URL, topic, headers.WatchFormatJSON)
+		defer conn.Close()
+		nestedConn := dialWatchTopic(t, server.URL, topic+"/nested", headers.WatchFormatJSON)
+		defer nestedConn.Close()
+
+		r, err := http.NewRequest(http.MethodDelete, server.URL+"/topics/"+topic, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		var event headers.WatchEvent
+		if err = conn.ReadJSON(&event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != headers.EventDeleted || event.Topic != topic {
+			t.Error(event)
+		}
+		_, _, err = conn.ReadMessage()
+		if ce, ok := err.(*websocket.CloseError); !ok || ce.Code != websocket.CloseGoingAway {
 			t.Error(err)
-			return
 		}
-		if msgType != websocket.TextMessage {
-			t.Error(msgType)
+
+		// nested topics are deleted too
+		if err = nestedConn.ReadJSON(&event); err != nil {
+			t.Fatal(err)
 		}
-		if !bytes.Equal(data, []byte(topic)) {
-			t.Error(string(data))
+		if event.Type != headers.EventDeleted || event.Topic != topic+"/nested" {
+			t.Error(event)
 		}
-		conn.Close()
 	}
 }
 
+func dialWatchTopic(t *testing.T, serverURL, topic, format string) *websocket.Conn {
+	url := strings.Replace(serverURL, "http", "ws", 1) + "/ws/topics/" + topic
+	h := http.Header{
+		headers.HeaderWatchTopics: {topic, topic, topic},
+	}
+	if format != "" {
+		h.Set(headers.HeaderWatchFormat, format)
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial(url, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	err = headers.ReadErrors(resp.Header)
+	if err != nil {
+		t.Error(err)
+	}
+	err = conn.WriteControl(websocket.PongMessage, nil, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
 func handleWatchTopicErrors(status int, url string, expectedError error) func(*testing.T) {
 	return func(t *testing.T) {
 		resp, err := http.Post(url, "application/json", nil)
@@ -3,14 +3,12 @@ package server
 import (
 	"encoding/json"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 
@@ -39,6 +37,17 @@ func (s *Server) HandleOptions(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// HandleHealth handles requests to the /health endpoint. It responds with a 200 status while the server
+// is accepting requests, once the server is closed it responds with a 503 status
+func (s *Server) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		_ = r.Body.Close()
+	}
+	w.Header()[headers.ContentType] = []string{"text/plain"}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
 // HandleGetAllTopics handles requests to the /topics endpoints with method == GET.
 // It returns all topics currently defined in the queue as either a json or csv depending on the
 // request content-type header
@@ -94,13 +103,14 @@ func (s *Server) HandleCreateTopic(w http.ResponseWriter, r *http.Request) {
 		headers.SetError(w, err)
 		return
 	}
+	s.notify(r, headers.EventCreated, topic, &headers.TopicInfo{MinOffset: 0, MaxOffset: -1})
 	w.Header()[headers.ContentType] = []string{"text/plain"}
 	w.WriteHeader(http.StatusCreated)
 }
 
 // HandleModifyTopic handles requests to the /topics/... endpoints with method == PATCH.
 // It will modify the topic if the topic exists. This is used to truncate topics by message
-// offset or mod time.
+// offset or mod time, and to delete messages by id.
 func (s *Server) HandleModifyTopic(w http.ResponseWriter, r *http.Request) {
 	if r.Body == nil {
 		s.logger.Warnf("%s:%s:body required: %s", r.Method, r.URL.Path, headers.ErrInvalidBodyMissing.Error())
@@ -125,7 +135,7 @@ func (s *Server) HandleModifyTopic(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if request.Truncate == 0 {
+	if request.Truncate == 0 && len(request.Delete) == 0 {
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
@@ -136,6 +146,11 @@ func (s *Server) HandleModifyTopic(w http.ResponseWriter, r *http.Request) {
 		headers.SetError(w, err)
 		return
 	}
+	eventType := headers.EventModified
+	if request.Truncate != 0 {
+		eventType = headers.EventTruncated
+	}
+	s.notify(r, eventType, topic, info)
 	w.Header()[headers.ContentType] = []string{"application/json"}
 	w.WriteHeader(http.StatusOK)
 	err = json.NewEncoder(w).Encode(&info)
@@ -157,18 +172,33 @@ func (s *Server) HandleDeleteTopic(w http.ResponseWriter, r *http.Request) {
 		headers.SetError(w, err)
 		return
 	}
+
+	// nested topics are deleted along with the topic, find them first so watchers can be notified
+	var nested []string
+	if s.watchers.active() {
+		nested, err = s.q.ListTopics(topic+"/", "", "")
+		if err != nil {
+			s.logger.Warnf("%s:%s:list nested topics: %s", r.Method, r.URL.Path, err.Error())
+		}
+	}
+
 	err = s.q.DeleteTopic(topic)
 	if err != nil {
 		s.logger.Warnf("%s:%s:delete topic: %s", r.Method, r.URL.Path, err.Error())
 		headers.SetError(w, err)
 		return
 	}
+	for _, t := range append(nested, topic) {
+		s.notify(r, headers.EventDeleted, t, &headers.TopicInfo{MinOffset: 0, MaxOffset: -1})
+	}
 	w.Header()[headers.ContentType] = []string{"text/plain"}
 	w.WriteHeader(http.StatusNoContent)
 }
 
 // HandleProduce handles requests to the /topics/... endpoints with method == POST.
-// It will add the given messages to the queue topic
+// It will add the given messages to the queue topic. Batches repeated by an idempotent producer
+// are acknowledged with the ids of the original batch without being added again. Gzip encoded bodies are decoded.
+// Messages tagged with a subject are encrypted under the key of the subject, if the queue supports subjects
 func (s *Server) HandleProduce(w http.ResponseWriter, r *http.Request) {
 	if r.Body == nil {
 		s.logger.Warnf("%s:%s:body required: %s", r.Method, r.URL.Path, headers.ErrInvalidBodyMissing.Error())
@@ -193,19 +223,107 @@ func (s *Server) HandleProduce(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = s.q.Produce(topic, sizes, uint64(time.Now().Unix()), r.Body)
+	eventTimes, err := headers.ReadEventTimes(r.Header)
+	if err == nil && eventTimes != nil && len(eventTimes) != len(sizes) {
+		err = headers.ErrInvalidEventTimes
+	}
+	if err != nil {
+		s.logger.Warnf("%s:%s:read event times: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, err)
+		return
+	}
+
+	subjects := headers.ReadSubjects(r.Header)
+	var sq SubjectQueue
+	switch {
+	case subjects == nil:
+	case len(subjects) != len(sizes):
+		err = headers.ErrInvalidSubjects
+	default:
+		var ok bool
+		if sq, ok = s.q.(SubjectQueue); !ok {
+			err = headers.ErrUnsupportedSubjects
+		}
+	}
+	if err != nil {
+		s.logger.Warnf("%s:%s:read subjects: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, err)
+		return
+	}
+
+	producer, err := headers.ReadProducerSequence(r.Header)
+	if err != nil {
+		s.logger.Warnf("%s:%s:read producer: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, err)
+		return
+	}
+
+	// messages with a deliver at time in the past are produced immediately
+	deliverAt, err := headers.ReadDeliverAt(r.Header)
+	var dq DelayQueue
+	if err == nil && deliverAt.After(time.Now()) {
+		var ok bool
+		switch {
+		case subjects != nil, producer != nil:
+			// delayed messages cannot be tagged with a subject or deduplicated by producer sequence
+			err = headers.ErrInvalidDeliverAt
+		default:
+			if dq, ok = s.q.(DelayQueue); !ok {
+				err = headers.ErrUnsupportedDelay
+			}
+		}
+	}
+	if err != nil {
+		s.logger.Warnf("%s:%s:read deliver at: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, err)
+		return
+	}
+
+	body, err := decodeBody(r)
+	if err != nil {
+		s.logger.Warnf("%s:%s:decode body: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, err)
+		return
+	}
+
+	// delayed messages are accepted without ids, which are assigned once they are delivered
+	if dq != nil {
+		if err = dq.ProduceDelayed(topic, sizes, deliverAt, eventTimes, body); err != nil {
+			s.logger.Warnf("%s:%s:produce delayed: %s", r.Method, r.URL.Path, err.Error())
+			headers.SetError(w, err)
+			return
+		}
+		w.Header()[headers.ContentType] = []string{"text/plain"}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	var info *headers.ProduceInfo
+	if sq != nil {
+		info, err = sq.ProduceWithSubjects(topic, sizes, uint64(time.Now().UnixNano()), eventTimes, subjects, producer, body)
+	} else {
+		info, err = s.q.Produce(topic, sizes, uint64(time.Now().UnixNano()), eventTimes, producer, body)
+	}
 	if err != nil {
 		s.logger.Warnf("%s:%s:produce: %s", r.Method, r.URL.Path, err.Error())
 		headers.SetError(w, err)
 		return
 	}
-	s.metrics.ProduceMsgs(len(sizes))
+	if info != nil {
+		headers.SetProduceInfo(info, w.Header())
+	}
+	if info == nil || !info.Duplicate {
+		s.metrics.ProduceMsgs(len(sizes))
+		s.notify(r, headers.EventProduced, topic, nil)
+	}
 	w.Header()[headers.ContentType] = []string{"text/plain"}
 	w.WriteHeader(http.StatusNoContent)
 }
 
 // HandleConsume handles requests to the /topics/... endpoints with method == GET.
-// It will retrieve messages from the queue topic
+// It will retrieve messages from the queue topic. If the wait query parameter is set and there
+// are no messages, the request is held until messages are produced or the wait duration passes.
+// The messages are gzip encoded if the request accepts it
 func (s *Server) HandleConsume(w http.ResponseWriter, r *http.Request) {
 	if r.Body != nil {
 		_ = r.Body.Close()
@@ -248,7 +366,35 @@ func (s *Server) HandleConsume(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	wait, err := getConsumeWait(r)
+	if err != nil {
+		s.logger.Warnf("%s:%s:parse wait: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, err)
+		return
+	}
+
+	// the messages are gzip encoded if accepted, the sizes describe the messages before encoding
+	if acceptsGzip(r) {
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		w = gw
+	}
+
+	// subscribe before consuming so that messages produced in between are not missed
+	var watcher *topicWatcher
+	if wait > 0 {
+		watcher = s.watchers.subscribe(&watchFilter{topics: map[string]bool{topic: true}})
+		defer s.watchers.unsubscribe(watcher)
+	}
+
 	count, err := s.q.Consume(group, topic, id, limit, w)
+	if err == nil && count == 0 && watcher != nil {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		for err == nil && count == 0 && s.waitForEvent(r, watcher, timer) {
+			count, err = s.q.Consume(group, topic, id, limit, w)
+		}
+	}
 	if err != nil {
 		s.logger.Warnf("%s:%s:consume: %s", r.Method, r.URL.Path, err.Error())
 		headers.SetError(w, err)
@@ -261,41 +407,140 @@ func (s *Server) HandleConsume(w http.ResponseWriter, r *http.Request) {
 	s.metrics.ConsumeMsgs(count)
 }
 
-// HandleWatchTopics accepts websocket connections and watches the topic files for writes
-func (s *Server) HandleWatchTopics(w http.ResponseWriter, r *http.Request) {
+// HandleTopicInfo handles requests to the /topics/... endpoints with method == HEAD.
+// It returns the min and max offsets of the topic, and the committed offset of the consumer group if given
+func (s *Server) HandleTopicInfo(w http.ResponseWriter, r *http.Request) {
 	if r.Body != nil {
 		_ = r.Body.Close()
 	}
 
-	// get topic from url & header
-	topics, err := getWatchTopics(r)
+	topic, err := getTopic(r)
 	if err != nil {
 		s.logger.Warnf("%s:%s:topic error: %s", r.Method, r.URL.Path, err.Error())
 		headers.SetError(w, err)
 		return
 	}
 
-	// setup watcher
-	watcher, err := fsnotify.NewWatcher()
+	info, err := s.q.GetTopicInfo(topic)
 	if err != nil {
-		s.logger.Warnf("%s:%s:new watcher: %s", r.Method, r.URL.Path, err.Error())
+		s.logger.Warnf("%s:%s:topic info: %s", r.Method, r.URL.Path, err.Error())
 		headers.SetError(w, err)
 		return
 	}
-	defer watcher.Close()
-	rootDir := s.q.RootDir()
-	for topic := range topics {
-		err = watcher.Add(filepath.Join(rootDir, topic))
+	headers.SetTopicInfo(info, w.Header())
+
+	if group := r.Header.Get(headers.HeaderConsumerGroup); group != "" {
+		offset, err := s.q.GetConsumerOffset(group, topic)
 		if err != nil {
-			s.logger.Warnf("%s:%s:watcher add: %s", r.Method, r.URL.Path, err.Error())
-			if os.IsNotExist(err) {
-				err = headers.ErrTopicDoesNotExist
-			}
+			s.logger.Warnf("%s:%s:consumer offset: %s", r.Method, r.URL.Path, err.Error())
+			headers.SetError(w, err)
+			return
+		}
+		w.Header()[headers.HeaderGroupOffset] = []string{strconv.FormatInt(offset, 10)}
+	}
+	w.Header()[headers.ContentType] = []string{"text/plain"}
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleSetConsumerOffset handles requests to the /offsets/topics/... endpoints with method == PUT.
+// It commits the id as the next message to be consumed by the consumer group
+func (s *Server) HandleSetConsumerOffset(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		_ = r.Body.Close()
+	}
+
+	topic, err := getTopic(r)
+	if err != nil {
+		s.logger.Warnf("%s:%s:topic error: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, err)
+		return
+	}
+
+	group := r.Header.Get(headers.HeaderConsumerGroup)
+	if group == "" {
+		s.logger.Warnf("%s:%s:group required: %s", r.Method, r.URL.Path, headers.ErrInvalidGroup.Error())
+		headers.SetError(w, headers.ErrInvalidGroup)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil || id < 0 {
+		s.logger.Warnf("%s:%s:parse id: %s", r.Method, r.URL.Path, headers.ErrInvalidMessageID.Error())
+		headers.SetError(w, headers.ErrInvalidMessageID)
+		return
+	}
+
+	err = s.q.SetConsumerOffset(group, topic, id)
+	if err != nil {
+		s.logger.Warnf("%s:%s:set consumer offset: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, err)
+		return
+	}
+	w.Header()[headers.ContentType] = []string{"text/plain"}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleDestroySubject handles requests to the /subjects/... endpoints with method == DELETE.
+// It destroys the key of the subject, so that the messages tagged with it are consumed as redacted
+func (s *Server) HandleDestroySubject(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		_ = r.Body.Close()
+	}
+
+	sq, ok := s.q.(SubjectQueue)
+	if !ok {
+		s.logger.Warnf("%s:%s:destroy subject: %s", r.Method, r.URL.Path, headers.ErrUnsupportedSubjects.Error())
+		headers.SetError(w, headers.ErrUnsupportedSubjects)
+		return
+	}
+
+	subject := strings.TrimPrefix(r.URL.Path, "/subjects/")
+	if subject == "" {
+		s.logger.Warnf("%s:%s:subject required: %s", r.Method, r.URL.Path, headers.ErrInvalidSubject.Error())
+		headers.SetError(w, headers.ErrInvalidSubject)
+		return
+	}
+
+	if err := sq.DestroySubject(subject); err != nil {
+		s.logger.Warnf("%s:%s:destroy subject: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, err)
+		return
+	}
+	w.Header()[headers.ContentType] = []string{"text/plain"}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleWatchTopics accepts websocket connections and sends an event whenever a watched topic changes.
+// Topics can be given exactly, as glob patterns such as "orders/*", or filtered with the prefix, suffix and
+// regex query parameters. Patterns and filters also match topics created after the connection is opened.
+// By default only the names of topics with newly produced messages are sent. Requests setting the
+// X-Watch-Format header to "json" receive every event as json
+func (s *Server) HandleWatchTopics(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		_ = r.Body.Close()
+	}
 
+	// get topics & patterns from url, header & query
+	filter, err := getWatchFilter(r)
+	if err != nil {
+		s.logger.Warnf("%s:%s:topic error: %s", r.Method, r.URL.Path, err.Error())
+		headers.SetError(w, err)
+		return
+	}
+	topics := make(map[string]bool, len(filter.topics))
+	for topic := range filter.topics {
+		if _, err = s.q.GetTopicInfo(topic); err != nil {
+			s.logger.Warnf("%s:%s:topic info: %s", r.Method, r.URL.Path, err.Error())
 			headers.SetError(w, err)
 			return
 		}
+		topics[topic] = true
 	}
+	format := r.Header.Get(headers.HeaderWatchFormat)
+
+	// setup watcher
+	watcher := s.watchers.subscribe(filter)
+	defer s.watchers.unsubscribe(watcher)
 
 	// upgrade request to websocket connection
 	conn, err := s.wsUpgrader.Upgrade(w, r, nil)
@@ -333,20 +578,14 @@ func (s *Server) HandleWatchTopics(w http.ResponseWriter, r *http.Request) {
 	// loop waiting for an event or timeout
 	for {
 		select {
-		case event := <-watcher.Events:
-			if event.Op == fsnotify.Write && !strings.HasSuffix(event.Name, ".log") {
-				topic := strings.TrimPrefix(filepath.Dir(event.Name), rootDir+string(filepath.Separator))
-				err = conn.WriteMessage(websocket.TextMessage, []byte(topic))
-				err = errors.Wrap(err, "cannot write topic")
-			} else if event.Op == fsnotify.Remove {
-				topic := strings.TrimPrefix(filepath.Dir(event.Name), rootDir+string(filepath.Separator))
-				err = watcher.Remove(filepath.Dir(event.Name))
-				err = errors.Wrap(err, "cannot remove watcher item")
-				delete(topics, topic)
+		case event := <-watcher.events:
+			err = writeWatchEvent(conn, format, event)
+			if event.Type == headers.EventDeleted && !filter.dynamic() {
+				delete(topics, event.Topic)
 				if len(topics) == 0 {
 					s.logger.Warnf("%s:%s:deleted all topics: %s", r.Method, r.URL.Path, "all topics removed, closing ws connection")
 					msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, headers.ErrTopicDoesNotExist.Error())
-					_ = conn.WriteControl(websocket.CloseGoingAway, msg, time.Now().Add(s.wsPingInterval))
+					_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(s.wsPingInterval))
 					return
 				}
 			}
@@ -361,7 +600,7 @@ func (s *Server) HandleWatchTopics(w http.ResponseWriter, r *http.Request) {
 		case <-s.closed:
 			s.logger.Warnf("%s:%s:closing server: %s", r.Method, r.URL.Path, "server closing, closing ws connection")
 			msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, headers.ErrClosed.Error())
-			_ = conn.WriteControl(websocket.CloseGoingAway, msg, time.Now().Add(s.wsPingInterval))
+			_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(s.wsPingInterval))
 			return
 		}
 		if err != nil {
@@ -371,33 +610,99 @@ func (s *Server) HandleWatchTopics(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// notify sends an event to any websockets watching the topic. If info is nil the current
+// topic info is read from the queue
+func (s *Server) notify(r *http.Request, eventType headers.EventType, topic string, info *headers.TopicInfo) {
+	if err := s.publish(eventType, topic, info); err != nil {
+		s.logger.Warnf("%s:%s:%s", r.Method, r.URL.Path, err.Error())
+	}
+}
+
+// publish sends an event to the watchers of the topic, getting the topic info if it is not given
+func (s *Server) publish(eventType headers.EventType, topic string, info *headers.TopicInfo) error {
+	if !s.watchers.watching(topic) {
+		return nil
+	}
+	if info == nil {
+		var err error
+		info, err = s.q.GetTopicInfo(topic)
+		if err != nil {
+			return errors.Wrap(err, "watch topic info")
+		}
+	}
+	dropped := s.watchers.publish(headers.WatchEvent{
+		Type:      eventType,
+		Topic:     topic,
+		TopicInfo: *info,
+	})
+	if dropped > 0 {
+		return errors.Errorf("watch events dropped: %d", dropped)
+	}
+	return nil
+}
+
+// delivered counts and notifies the delayed messages produced to a topic by a DelayQueue
+func (s *Server) delivered(topic string, n int) {
+	s.metrics.ProduceMsgs(n)
+	if err := s.publish(headers.EventProduced, topic, nil); err != nil {
+		s.logger.Warnf("delayed:%s:%s", topic, err.Error())
+	}
+}
+
+func writeWatchEvent(conn *websocket.Conn, format string, event headers.WatchEvent) error {
+	if format == headers.WatchFormatJSON {
+		return errors.Wrap(conn.WriteJSON(&event), "cannot write event")
+	}
+	if event.Type != headers.EventProduced {
+		return nil
+	}
+	return errors.Wrap(conn.WriteMessage(websocket.TextMessage, []byte(event.Topic)), "cannot write topic")
+}
+
+// maxConsumeWait is the longest a consume request is held waiting for new messages
+const maxConsumeWait = time.Minute
+
+// getConsumeWait reads the wait query parameter, a duration such as "30s"
+func getConsumeWait(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("wait")
+	if v == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(v)
+	if err != nil || wait < 0 {
+		return 0, headers.ErrInvalidWait
+	}
+	if wait > maxConsumeWait {
+		wait = maxConsumeWait
+	}
+	return wait, nil
+}
+
+// waitForEvent waits for a change to a watched topic. It returns false if the timer expires,
+// the request is cancelled or the server is closed
+func (s *Server) waitForEvent(r *http.Request, watcher *topicWatcher, timer *time.Timer) bool {
+	select {
+	case <-watcher.events:
+		return true
+	case <-timer.C:
+	case <-r.Context().Done():
+	case <-s.closed:
+	}
+	return false
+}
+
 func getTopic(r *http.Request) (string, error) {
 	split := strings.SplitN(strings.ToLower(r.URL.Path), "/topics/", 2)
 	if len(split) < 2 {
 		return "", headers.ErrInvalidTopic
 	}
 	topic := strings.ToLower(filepath.Clean(split[1]))
-	if topic == "" || topic == "." {
-		return "", headers.ErrInvalidTopic
+	if err := headers.ValidateTopic(topic); err != nil {
+		return "", err
 	}
 	return topic, nil
 }
 
-func getWatchTopics(r *http.Request) (map[string]bool, error) {
-	topics := make(map[string]bool)
-	for _, topic := range r.Header.Values(headers.HeaderWatchTopics) {
-		topics[strings.ToLower(filepath.Clean(topic))] = true
-	}
-	topic, err := getTopic(r)
-	if err == nil {
-		topics[topic] = true
-	}
-	if len(topics) == 0 {
-		return nil, headers.ErrInvalidTopic
-	}
-	return topics, nil
-}
-
 func readNoopWebsocket(conn *websocket.Conn, ch chan error) {
 	for {
 		// continuously read until an error occurs
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/filequeue"
+)
+
+// KeyProvider provides the keys of the topics a file queue encrypts at rest with AES-GCM. New segments of a
+// topic are encrypted with its current key, identified by an id stored with the segment. Keys are rotated by
+// changing the current key of a topic, the keys of older segments must still be provided to consume them.
+// An empty id is returned for topics which are not encrypted
+type KeyProvider interface {
+	CurrentKey(topic string) (id string, key []byte, err error)
+	Key(topic, id string) ([]byte, error)
+}
+
+// KeyFile is a KeyProvider loading its keys from a json file, mapping key ids to base64 encoded keys and
+// topics to the id of their current key:
+//
+//	{"keys": {"<id>": "<base64 key>"}, "topics": {"<topic>": "<id>"}}
+//
+// Keys are rotated by updating the file and calling Reload
+type KeyFile = filequeue.KeyFile
+
+// NewKeyFile loads the keys of the json file at path
+func NewKeyFile(path string) (*KeyFile, error) {
+	return filequeue.NewKeyFile(path)
+}
+
+// WithKeyProvider encrypts the messages of a file queue's topics at rest, with the keys of the provider.
+// Consumers are sent the decrypted messages, while the raw file endpoint only serves the encrypted files
+func WithKeyProvider(keys KeyProvider) Option {
+	return func(s *Server) error {
+		if keys == nil {
+			return errors.New("key provider cannot be nil")
+		}
+		s.fileQueueOptions = append(s.fileQueueOptions, filequeue.WithKeyProvider(keys))
+		return nil
+	}
+}
@@ -6,6 +6,20 @@ type Metrics interface {
 	ConsumeMsgs(int)
 }
 
+// CacheMetrics can optionally be implemented by a Metrics, to count the hits, misses and evictions of the
+// file queue's cache of open files
+type CacheMetrics interface {
+	CacheHit()
+	CacheMiss()
+	CacheEviction()
+}
+
+// CompressionMetrics can optionally be implemented by a Metrics, to record the uncompressed and compressed
+// sizes of the segment logs compressed by the file queue
+type CompressionMetrics interface {
+	SegmentCompressed(rawSize, compressedSize int64)
+}
+
 var _ Metrics = noOpMetrics{}
 
 type noOpMetrics struct{}
@@ -3,16 +3,24 @@ package server
 import (
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/haraqa/haraqa/internal/headers"
 
 	"github.com/haraqa/haraqa/internal/filequeue"
+	"github.com/haraqa/haraqa/internal/memqueue"
 )
 
 //go:generate mockgen -source queue.go -package server -destination queue_mock_test.go
 //go:generate goimports -w queue_mock_test.go
 
-var _ Queue = &filequeue.FileQueue{}
+var (
+	_ Queue        = &filequeue.FileQueue{}
+	_ Queue        = &memqueue.MemoryQueue{}
+	_ SubjectQueue = &filequeue.FileQueue{}
+	_ DelayQueue   = &filequeue.FileQueue{}
+	_ DelayQueue   = &memqueue.MemoryQueue{}
+)
 
 // Queue is the interface used by the server to produce and consume messages from different distinct categories called topics
 type Queue interface {
@@ -23,8 +31,32 @@ type Queue interface {
 	CreateTopic(topic string) error
 	DeleteTopic(topic string) error
 	ModifyTopic(topic string, request headers.ModifyRequest) (*headers.TopicInfo, error)
+	GetTopicInfo(topic string) (*headers.TopicInfo, error)
 
-	Produce(topic string, msgSizes []int64, timestamp uint64, r io.Reader) error
+	// Produce stores the messages with the broker timestamp, in unix nanoseconds. The event times are nil, or hold the
+	// unix nanoseconds of each message given by the producer, 0 for messages without an event time
+	Produce(topic string, msgSizes []int64, timestamp uint64, eventTimes []uint64, producer *headers.ProducerSequence, r io.Reader) (*headers.ProduceInfo, error)
 	Consume(group, topic string, id int64, limit int64, w http.ResponseWriter) (int, error)
 	SetConsumerOffset(group, topic string, id int64) error
+	GetConsumerOffset(group, topic string) (int64, error)
+}
+
+// SubjectQueue can optionally be implemented by a Queue, to encrypt messages tagged with a subject under a key of
+// the subject. Once the key of a subject is destroyed, its messages are consumed as redacted
+type SubjectQueue interface {
+	// ProduceWithSubjects stores the messages as Produce does. The subjects are nil, or hold the subject of each
+	// message, empty for messages without a subject
+	ProduceWithSubjects(topic string, msgSizes []int64, timestamp uint64, eventTimes []uint64, subjects []string, producer *headers.ProducerSequence, r io.Reader) (*headers.ProduceInfo, error)
+	DestroySubject(subject string) error
+}
+
+// DelayQueue can optionally be implemented by a Queue, to hold messages until a deliver at time before producing
+// them to their topic. Delayed messages are produced with the time they are delivered at as their timestamp
+type DelayQueue interface {
+	// ProduceDelayed stores the messages, to be produced to the topic as Produce does once deliverAt has passed
+	ProduceDelayed(topic string, msgSizes []int64, deliverAt time.Time, eventTimes []uint64, r io.Reader) error
+	// OnDelivered sets the function called after delayed messages are produced to a topic, with the number produced.
+	// The server calls it once the queue is configured, a queue which stores delayed messages across restarts starts
+	// delivering them then
+	OnDelivered(fn func(topic string, n int))
 }
@@ -8,6 +8,7 @@ import (
 	io "io"
 	http "net/http"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 	headers "github.com/haraqa/haraqa/internal/headers"
@@ -122,18 +123,34 @@ func (mr *MockQueueMockRecorder) ModifyTopic(topic, request interface{}) *gomock
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ModifyTopic", reflect.TypeOf((*MockQueue)(nil).ModifyTopic), topic, request)
 }
 
+// GetTopicInfo mocks base method
+func (m *MockQueue) GetTopicInfo(topic string) (*headers.TopicInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetTopicInfo", topic)
+	ret0, _ := ret[0].(*headers.TopicInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetTopicInfo indicates an expected call of GetTopicInfo
+func (mr *MockQueueMockRecorder) GetTopicInfo(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTopicInfo", reflect.TypeOf((*MockQueue)(nil).GetTopicInfo), topic)
+}
+
 // Produce mocks base method
-func (m *MockQueue) Produce(topic string, msgSizes []int64, timestamp uint64, r io.Reader) error {
+func (m *MockQueue) Produce(topic string, msgSizes []int64, timestamp uint64, eventTimes []uint64, producer *headers.ProducerSequence, r io.Reader) (*headers.ProduceInfo, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Produce", topic, msgSizes, timestamp, r)
-	ret0, _ := ret[0].(error)
-	return ret0
+	ret := m.ctrl.Call(m, "Produce", topic, msgSizes, timestamp, eventTimes, producer, r)
+	ret0, _ := ret[0].(*headers.ProduceInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 // Produce indicates an expected call of Produce
-func (mr *MockQueueMockRecorder) Produce(topic, msgSizes, timestamp, r interface{}) *gomock.Call {
+func (mr *MockQueueMockRecorder) Produce(topic, msgSizes, timestamp, eventTimes, producer, r interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Produce", reflect.TypeOf((*MockQueue)(nil).Produce), topic, msgSizes, timestamp, r)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Produce", reflect.TypeOf((*MockQueue)(nil).Produce), topic, msgSizes, timestamp, eventTimes, producer, r)
 }
 
 // Consume mocks base method
@@ -164,3 +181,119 @@ func (mr *MockQueueMockRecorder) SetConsumerOffset(group, topic, id interface{})
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetConsumerOffset", reflect.TypeOf((*MockQueue)(nil).SetConsumerOffset), group, topic, id)
 }
+
+// GetConsumerOffset mocks base method
+func (m *MockQueue) GetConsumerOffset(group, topic string) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetConsumerOffset", group, topic)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetConsumerOffset indicates an expected call of GetConsumerOffset
+func (mr *MockQueueMockRecorder) GetConsumerOffset(group, topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetConsumerOffset", reflect.TypeOf((*MockQueue)(nil).GetConsumerOffset), group, topic)
+}
+
+// MockSubjectQueue is a mock of SubjectQueue interface
+type MockSubjectQueue struct {
+	ctrl     *gomock.Controller
+	recorder *MockSubjectQueueMockRecorder
+}
+
+// MockSubjectQueueMockRecorder is the mock recorder for MockSubjectQueue
+type MockSubjectQueueMockRecorder struct {
+	mock *MockSubjectQueue
+}
+
+// NewMockSubjectQueue creates a new mock instance
+func NewMockSubjectQueue(ctrl *gomock.Controller) *MockSubjectQueue {
+	mock := &MockSubjectQueue{ctrl: ctrl}
+	mock.recorder = &MockSubjectQueueMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockSubjectQueue) EXPECT() *MockSubjectQueueMockRecorder {
+	return m.recorder
+}
+
+// ProduceWithSubjects mocks base method
+func (m *MockSubjectQueue) ProduceWithSubjects(topic string, msgSizes []int64, timestamp uint64, eventTimes []uint64, subjects []string, producer *headers.ProducerSequence, r io.Reader) (*headers.ProduceInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ProduceWithSubjects", topic, msgSizes, timestamp, eventTimes, subjects, producer, r)
+	ret0, _ := ret[0].(*headers.ProduceInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ProduceWithSubjects indicates an expected call of ProduceWithSubjects
+func (mr *MockSubjectQueueMockRecorder) ProduceWithSubjects(topic, msgSizes, timestamp, eventTimes, subjects, producer, r interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ProduceWithSubjects", reflect.TypeOf((*MockSubjectQueue)(nil).ProduceWithSubjects), topic, msgSizes, timestamp, eventTimes, subjects, producer, r)
+}
+
+// DestroySubject mocks base method
+func (m *MockSubjectQueue) DestroySubject(subject string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DestroySubject", subject)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DestroySubject indicates an expected call of DestroySubject
+func (mr *MockSubjectQueueMockRecorder) DestroySubject(subject interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DestroySubject", reflect.TypeOf((*MockSubjectQueue)(nil).DestroySubject), subject)
+}
+
+// MockDelayQueue is a mock of DelayQueue interface
+type MockDelayQueue struct {
+	ctrl     *gomock.Controller
+	recorder *MockDelayQueueMockRecorder
+}
+
+// MockDelayQueueMockRecorder is the mock recorder for MockDelayQueue
+type MockDelayQueueMockRecorder struct {
+	mock *MockDelayQueue
+}
+
+// NewMockDelayQueue creates a new mock instance
+func NewMockDelayQueue(ctrl *gomock.Controller) *MockDelayQueue {
+	mock := &MockDelayQueue{ctrl: ctrl}
+	mock.recorder = &MockDelayQueueMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockDelayQueue) EXPECT() *MockDelayQueueMockRecorder {
+	return m.recorder
+}
+
+// ProduceDelayed mocks base method
+func (m *MockDelayQueue) ProduceDelayed(topic string, msgSizes []int64, deliverAt time.Time, eventTimes []uint64, r io.Reader) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ProduceDelayed", topic, msgSizes, deliverAt, eventTimes, r)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ProduceDelayed indicates an expected call of ProduceDelayed
+func (mr *MockDelayQueueMockRecorder) ProduceDelayed(topic, msgSizes, deliverAt, eventTimes, r interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ProduceDelayed", reflect.TypeOf((*MockDelayQueue)(nil).ProduceDelayed), topic, msgSizes, deliverAt, eventTimes, r)
+}
+
+// OnDelivered mocks base method
+func (m *MockDelayQueue) OnDelivered(fn func(string, int)) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "OnDelivered", fn)
+}
+
+// OnDelivered indicates an expected call of OnDelivered
+func (mr *MockDelayQueueMockRecorder) OnDelivered(fn interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "OnDelivered", reflect.TypeOf((*MockDelayQueue)(nil).OnDelivered), fn)
+}
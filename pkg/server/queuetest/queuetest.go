@@ -0,0 +1,773 @@
+// Package queuetest implements a conformance suite for implementations of server.Queue.
+// It pins down the behavior the server relies on, so that custom queues given to server.WithQueue
+// can be checked against the same expectations as the built in queues
+package queuetest
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+	"github.com/haraqa/haraqa/pkg/server"
+)
+
+// Factory creates a new, empty queue for a single test. maxEntries is the number of messages the queue
+// should store in each segment (or file) before starting a new one, queues without segments may ignore it.
+// The queue is closed by the test, any other cleanup should be registered with t.Cleanup
+type Factory func(t *testing.T, maxEntries int64) server.Queue
+
+// Run runs the conformance suite as subtests of t, each using a new queue from the factory
+func Run(t *testing.T, newQueue Factory) {
+	tests := []struct {
+		name       string
+		maxEntries int64
+		fn         func(t *testing.T, q server.Queue)
+	}{
+		{"Topics", 10, testTopics},
+		{"NestedTopics", 2, testNestedTopics},
+		{"ProduceConsume", 100, testProduceConsume},
+		{"SegmentRollover", 3, testSegmentRollover},
+		{"Truncate", 2, testTruncate},
+		{"ConsumerGroups", 10, testConsumerGroups},
+		{"IdempotentProducers", 10, testIdempotentProducers},
+		{"ConcurrentProducers", 7, testConcurrentProducers},
+		{"EventTimes", 3, testEventTimes},
+		{"DeleteMessages", 3, testDeleteMessages},
+		{"ProduceDelayed", 10, testProduceDelayed},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			q := newQueue(t, tt.maxEntries)
+			if q == nil {
+				t.Fatal("factory returned a nil queue")
+			}
+			defer func() {
+				if err := q.Close(); err != nil {
+					t.Error("close:", err)
+				}
+			}()
+			tt.fn(t, q)
+		})
+	}
+}
+
+// consumed is the result of a single call to Consume
+type consumed struct {
+	msgs    [][]byte
+	deleted []bool
+	startID int64
+	endID   int64
+}
+
+// consume calls Consume and checks that the response is well formed
+func consume(t *testing.T, q server.Queue, group, topic string, id, limit int64) *consumed {
+	t.Helper()
+	w := httptest.NewRecorder()
+	n, err := q.Consume(group, topic, id, limit, w)
+	if err != nil {
+		t.Fatalf("consume %q from %d: %v", topic, id, err)
+	}
+	if n == 0 {
+		return &consumed{}
+	}
+	if w.Code != http.StatusOK && w.Code != http.StatusPartialContent {
+		t.Fatalf("consume %q from %d: unexpected status %d", topic, id, w.Code)
+	}
+	if limit > 0 && int64(n) > limit {
+		t.Fatalf("consume %q from %d: returned %d messages, more than the limit %d", topic, id, n, limit)
+	}
+	sizes, err := headers.ReadSizes(w.Header())
+	if err != nil || len(sizes) != n {
+		t.Fatalf("consume %q from %d: returned %d messages with sizes %v: %v", topic, id, n, sizes, err)
+	}
+	c := &consumed{msgs: make([][]byte, n)}
+	if c.startID, err = strconv.ParseInt(w.Header().Get(headers.HeaderStartID), 10, 64); err != nil {
+		t.Fatalf("consume %q from %d: invalid %s header: %v", topic, id, headers.HeaderStartID, err)
+	}
+	if c.endID, err = strconv.ParseInt(w.Header().Get(headers.HeaderEndID), 10, 64); err != nil {
+		t.Fatalf("consume %q from %d: invalid %s header: %v", topic, id, headers.HeaderEndID, err)
+	}
+	if c.endID-c.startID+1 != int64(n) {
+		t.Fatalf("consume %q from %d: ids %d to %d do not match %d messages", topic, id, c.startID, c.endID, n)
+	}
+	if c.deleted, err = headers.ReadDeleted(w.Header()); err != nil || (c.deleted != nil && len(c.deleted) != n) {
+		t.Fatalf("consume %q from %d: returned %d messages with deleted flags %v: %v", topic, id, n, c.deleted, err)
+	}
+	for i := range c.deleted {
+		if c.deleted[i] && sizes[i] != 0 {
+			t.Fatalf("consume %q from %d: deleted message %d has size %d", topic, id, c.startID+int64(i), sizes[i])
+		}
+	}
+	body := w.Body.Bytes()
+	for i, size := range sizes {
+		if int64(len(body)) < size {
+			t.Fatalf("consume %q from %d: body is shorter than the message sizes %v", topic, id, sizes)
+		}
+		c.msgs[i], body = body[:size], body[size:]
+	}
+	if len(body) != 0 {
+		t.Fatalf("consume %q from %d: body is longer than the message sizes %v", topic, id, sizes)
+	}
+	return c
+}
+
+// consumeAll reads every message from id onwards, calling Consume until no messages are returned
+func consumeAll(t *testing.T, q server.Queue, topic string, id int64) []string {
+	t.Helper()
+	var msgs []string
+	for {
+		c := consume(t, q, "", topic, id, -1)
+		if len(c.msgs) == 0 {
+			return msgs
+		}
+		if c.startID != id {
+			t.Fatalf("consume %q from %d: started at id %d", topic, id, c.startID)
+		}
+		for _, msg := range c.msgs {
+			msgs = append(msgs, string(msg))
+		}
+		id = c.endID + 1
+	}
+}
+
+// produce produces the messages as a single batch and returns the id of the first message
+func produce(t *testing.T, q server.Queue, topic string, msgs ...string) int64 {
+	t.Helper()
+	sizes := make([]int64, len(msgs))
+	var body bytes.Buffer
+	for i, msg := range msgs {
+		sizes[i] = int64(len(msg))
+		body.WriteString(msg)
+	}
+	info, err := q.Produce(topic, sizes, uint64(time.Now().UnixNano()), nil, nil, &body)
+	if err != nil {
+		t.Fatalf("produce %q: %v", topic, err)
+	}
+	if info == nil {
+		t.Fatalf("produce %q: no produce info returned", topic)
+	}
+	if info.EndID-info.StartID+1 != int64(len(msgs)) || info.Duplicate {
+		t.Fatalf("produce %q: unexpected produce info %+v for %d messages", topic, info, len(msgs))
+	}
+	return info.StartID
+}
+
+func checkInfo(t *testing.T, q server.Queue, topic string, min, max int64) {
+	t.Helper()
+	info, err := q.GetTopicInfo(topic)
+	if err != nil {
+		t.Fatalf("topic info %q: %v", topic, err)
+	}
+	if info.MinOffset != min || info.MaxOffset != max {
+		t.Fatalf("topic info %q: expected offsets %d to %d, got %d to %d", topic, min, max, info.MinOffset, info.MaxOffset)
+	}
+}
+
+func checkMsgs(t *testing.T, name string, got []string, expected ...string) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("%s: expected messages %q, got %q", name, expected, got)
+	}
+}
+
+func testTopics(t *testing.T, q server.Queue) {
+	for _, topic := range []string{"topic-a", "topic-b", "other"} {
+		if err := q.CreateTopic(topic); err != nil {
+			t.Fatalf("create %q: %v", topic, err)
+		}
+	}
+	if err := q.CreateTopic("topic-a"); !errors.Is(err, headers.ErrTopicAlreadyExists) {
+		t.Fatalf("create existing topic: expected %v, got %v", headers.ErrTopicAlreadyExists, err)
+	}
+	for _, topic := range []string{".reserved", "topic-a/.reserved"} {
+		if err := q.CreateTopic(topic); !errors.Is(err, headers.ErrReservedTopic) {
+			t.Fatalf("create %q: expected %v, got %v", topic, headers.ErrReservedTopic, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		prefix, suffix, regex string
+		expected              []string
+	}{
+		{"", "", "", []string{"other", "topic-a", "topic-b"}},
+		{"topic-", "", "", []string{"topic-a", "topic-b"}},
+		{"", "-b", "", []string{"topic-b"}},
+		{"", "", "^o", []string{"other"}},
+		{"topic-", "", "a$", []string{"topic-a"}},
+		{"missing", "", "", nil},
+	} {
+		topics, err := q.ListTopics(tt.prefix, tt.suffix, tt.regex)
+		if err != nil {
+			t.Fatalf("list topics: %v", err)
+		}
+		got := make(map[string]bool)
+		for _, topic := range topics {
+			got[topic] = true
+		}
+		if len(got) != len(tt.expected) || len(topics) != len(tt.expected) {
+			t.Fatalf("list topics %q %q %q: expected %q, got %q", tt.prefix, tt.suffix, tt.regex, tt.expected, topics)
+		}
+		for _, topic := range tt.expected {
+			if !got[topic] {
+				t.Fatalf("list topics %q %q %q: expected %q, got %q", tt.prefix, tt.suffix, tt.regex, tt.expected, topics)
+			}
+		}
+	}
+	if _, err := q.ListTopics("", "", "["); err == nil {
+		t.Fatal("list topics: expected an error for an invalid regex")
+	}
+
+	// new topics are empty
+	checkInfo(t, q, "topic-a", 0, -1)
+	if c := consume(t, q, "", "topic-a", 0, -1); len(c.msgs) != 0 {
+		t.Fatalf("consume empty topic: got %d messages", len(c.msgs))
+	}
+
+	// missing topics return ErrTopicDoesNotExist
+	if err := q.DeleteTopic("topic-a"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := q.GetTopicInfo("topic-a"); !errors.Is(err, headers.ErrTopicDoesNotExist) {
+		t.Fatalf("topic info of deleted topic: expected %v, got %v", headers.ErrTopicDoesNotExist, err)
+	}
+	if _, err := q.Produce("topic-a", []int64{1}, 0, nil, nil, bytes.NewBufferString("a")); !errors.Is(err, headers.ErrTopicDoesNotExist) {
+		t.Fatalf("produce to deleted topic: expected %v, got %v", headers.ErrTopicDoesNotExist, err)
+	}
+	if _, err := q.Consume("", "topic-a", 0, -1, httptest.NewRecorder()); !errors.Is(err, headers.ErrTopicDoesNotExist) {
+		t.Fatalf("consume from deleted topic: expected %v, got %v", headers.ErrTopicDoesNotExist, err)
+	}
+	topics, err := q.ListTopics("", "", "")
+	if err != nil || len(topics) != 2 {
+		t.Fatalf("list topics after delete: %q %v", topics, err)
+	}
+
+	// deleted topics can be created again, starting from empty
+	if err = q.CreateTopic("topic-b/"); !errors.Is(err, headers.ErrTopicAlreadyExists) {
+		t.Fatalf("create existing topic with a trailing slash: expected %v, got %v", headers.ErrTopicAlreadyExists, err)
+	}
+	produce(t, q, "topic-b", "a")
+	if err = q.DeleteTopic("topic-b"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err = q.CreateTopic("topic-b"); err != nil {
+		t.Fatalf("create deleted topic: %v", err)
+	}
+	checkInfo(t, q, "topic-b", 0, -1)
+}
+
+func testNestedTopics(t *testing.T, q server.Queue) {
+	if err := q.CreateTopic("parent"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	for _, topic := range []string{"parent/child", "parent/child/grandchild", "created/with/parents"} {
+		if err := q.CreateTopic(topic); err != nil {
+			t.Fatalf("create %q: %v", topic, err)
+		}
+	}
+	topics, err := q.ListTopics("parent/", "", "")
+	if err != nil || fmt.Sprint(topics) != "[parent/child parent/child/grandchild]" {
+		t.Fatalf("list nested topics: %q %v", topics, err)
+	}
+
+	// nested topics are independent of their parents
+	for i := 0; i < 3; i++ {
+		produce(t, q, "parent", "p"+strconv.Itoa(i))
+		produce(t, q, "parent/child", "c"+strconv.Itoa(i), "c"+strconv.Itoa(i))
+	}
+	produce(t, q, "created/with/parents", "x")
+	checkInfo(t, q, "parent", 0, 2)
+	checkInfo(t, q, "parent/child", 0, 5)
+	checkInfo(t, q, "parent/child/grandchild", 0, -1)
+	checkMsgs(t, "consume parent", consumeAll(t, q, "parent", 0), "p0", "p1", "p2")
+	checkMsgs(t, "consume child", consumeAll(t, q, "parent/child", 4), "c2", "c2")
+
+	// truncating a parent does not truncate its nested topics
+	if _, err = q.ModifyTopic("parent", headers.ModifyRequest{Truncate: -1}); err != nil {
+		t.Fatalf("truncate parent: %v", err)
+	}
+	checkInfo(t, q, "parent/child", 0, 5)
+
+	// deleting a parent deletes its nested topics
+	if err = q.DeleteTopic("parent"); err != nil {
+		t.Fatalf("delete parent: %v", err)
+	}
+	for _, topic := range []string{"parent", "parent/child", "parent/child/grandchild"} {
+		if _, err = q.GetTopicInfo(topic); !errors.Is(err, headers.ErrTopicDoesNotExist) {
+			t.Fatalf("topic info %q after deleting parent: expected %v, got %v", topic, headers.ErrTopicDoesNotExist, err)
+		}
+	}
+	checkInfo(t, q, "created/with/parents", 0, 0)
+}
+
+func testProduceConsume(t *testing.T, q server.Queue) {
+	if err := q.CreateTopic("topic"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if info, err := q.Produce("topic", nil, 0, nil, nil, bytes.NewBuffer(nil)); err != nil || info != nil {
+		t.Fatalf("produce no messages: expected no info and no error, got %+v %v", info, err)
+	}
+	if _, err := q.Produce("topic", []int64{1}, 0, nil, nil, nil); !errors.Is(err, headers.ErrInvalidBodyMissing) {
+		t.Fatalf("produce without a body: expected %v, got %v", headers.ErrInvalidBodyMissing, err)
+	}
+
+	// ids are assigned in order, starting from 0
+	if id := produce(t, q, "topic", "zero"); id != 0 {
+		t.Fatalf("first id: expected 0, got %d", id)
+	}
+	if id := produce(t, q, "topic", "one", "two", "three"); id != 1 {
+		t.Fatalf("second batch id: expected 1, got %d", id)
+	}
+	if id := produce(t, q, "topic", "four", string([]byte{0, 1, 2, 254, 255})); id != 4 {
+		t.Fatalf("third batch id: expected 4, got %d", id)
+	}
+	checkInfo(t, q, "topic", 0, 5)
+	checkMsgs(t, "consume all", consumeAll(t, q, "topic", 0), "zero", "one", "two", "three", "four", string([]byte{0, 1, 2, 254, 255}))
+
+	// limits and offsets
+	c := consume(t, q, "", "topic", 2, 2)
+	if c.startID != 2 || c.endID != 3 {
+		t.Fatalf("consume 2 from 2: got ids %d to %d", c.startID, c.endID)
+	}
+	checkMsgs(t, "consume 2 from 2", []string{string(c.msgs[0]), string(c.msgs[1])}, "two", "three")
+
+	// a negative id consumes the latest message
+	c = consume(t, q, "", "topic", -1, -1)
+	if len(c.msgs) != 1 || c.startID != 5 {
+		t.Fatalf("consume latest: got %d messages from %d", len(c.msgs), c.startID)
+	}
+
+	// consuming past the end returns no messages
+	if c = consume(t, q, "", "topic", 6, -1); len(c.msgs) != 0 {
+		t.Fatalf("consume past the end: got %d messages", len(c.msgs))
+	}
+	if c = consume(t, q, "", "topic", 100, 10); len(c.msgs) != 0 {
+		t.Fatalf("consume past the end: got %d messages", len(c.msgs))
+	}
+
+	// the response reports when messages were produced
+	w := httptest.NewRecorder()
+	if _, err := q.Consume("", "topic", 0, 1, w); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	produced, err := time.Parse(time.RFC3339Nano, w.Header().Get(headers.HeaderStartTime))
+	if err != nil || time.Since(produced) > time.Hour || time.Since(produced) < -time.Hour {
+		t.Fatalf("consume: invalid %s header %q: %v", headers.HeaderStartTime, w.Header().Get(headers.HeaderStartTime), err)
+	}
+}
+
+func testSegmentRollover(t *testing.T, q server.Queue) {
+	if err := q.CreateTopic("topic"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	var expected []string
+	produceSingle := func(n int, prefix string) {
+		for i := 0; i < n; i++ {
+			msg := prefix + strconv.Itoa(i)
+			if id := produce(t, q, "topic", msg); id != int64(len(expected)) {
+				t.Fatalf("produce %q: expected id %d, got %d", msg, len(expected), id)
+			}
+			expected = append(expected, msg)
+		}
+	}
+	produceSingle(3, "msg-")
+
+	// batches larger than a segment are not split
+	batch := []string{"batch-0", "batch-1", "batch-2", "batch-3", "batch-4", "batch-5", "batch-6"}
+	if id := produce(t, q, "topic", batch...); id != 3 {
+		t.Fatalf("produce batch: got id %d", id)
+	}
+	expected = append(expected, batch...)
+	produceSingle(7, "after-")
+	checkInfo(t, q, "topic", 0, int64(len(expected)-1))
+
+	// every id can be consumed on its own and from any starting point
+	for id := range expected {
+		c := consume(t, q, "", "topic", int64(id), 1)
+		if len(c.msgs) != 1 || c.startID != int64(id) || string(c.msgs[0]) != expected[id] {
+			t.Fatalf("consume id %d: expected %q, got %q starting at %d", id, expected[id], c.msgs, c.startID)
+		}
+		checkMsgs(t, "consume from "+strconv.Itoa(id), consumeAll(t, q, "topic", int64(id)), expected[id:]...)
+	}
+}
+
+func testTruncate(t *testing.T, q server.Queue) {
+	if err := q.CreateTopic("topic"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := q.ModifyTopic("missing", headers.ModifyRequest{Truncate: 1}); err == nil {
+		t.Fatal("truncate missing topic: expected an error")
+	}
+	for i := 0; i < 10; i++ {
+		produce(t, q, "topic", "msg-"+strconv.Itoa(i))
+	}
+
+	// truncating removes messages before the id, some earlier messages may be kept
+	info, err := q.ModifyTopic("topic", headers.ModifyRequest{Truncate: 5})
+	if err != nil || info == nil || info.MaxOffset != 9 {
+		t.Fatalf("truncate to 5: %+v %v", info, err)
+	}
+	info, err = q.GetTopicInfo("topic")
+	if err != nil || info.MinOffset > 5 || info.MaxOffset != 9 {
+		t.Fatalf("topic info after truncate to 5: %+v %v", info, err)
+	}
+	min := info.MinOffset
+	checkMsgs(t, "consume after truncate", consumeAll(t, q, "topic", 5), "msg-5", "msg-6", "msg-7", "msg-8", "msg-9")
+	if min > 0 {
+		if c := consume(t, q, "", "topic", min-1, -1); len(c.msgs) != 0 {
+			t.Fatalf("consume truncated id %d: got %d messages", min-1, len(c.msgs))
+		}
+	}
+
+	// times in the past do not remove anything
+	if _, err = q.ModifyTopic("topic", headers.ModifyRequest{Before: time.Now().Add(-time.Hour)}); err != nil {
+		t.Fatalf("truncate before an hour ago: %v", err)
+	}
+	checkInfo(t, q, "topic", min, 9)
+
+	// a negative id keeps only the latest messages
+	if _, err = q.ModifyTopic("topic", headers.ModifyRequest{Truncate: -1}); err != nil {
+		t.Fatalf("truncate to latest: %v", err)
+	}
+	info, err = q.GetTopicInfo("topic")
+	if err != nil || info.MinOffset < min || info.MaxOffset != 9 {
+		t.Fatalf("topic info after truncate to latest: %+v %v", info, err)
+	}
+	checkMsgs(t, "consume latest", consumeAll(t, q, "topic", 9), "msg-9")
+
+	// producing continues from the last id
+	if id := produce(t, q, "topic", "msg-10"); id != 10 {
+		t.Fatalf("produce after truncate: got id %d", id)
+	}
+	checkMsgs(t, "consume after truncate", consumeAll(t, q, "topic", 9), "msg-9", "msg-10")
+}
+
+func testConsumerGroups(t *testing.T, q server.Queue) {
+	if err := q.CreateTopic("topic"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		produce(t, q, "topic", "msg-"+strconv.Itoa(i))
+	}
+
+	if err := q.SetConsumerOffset("", "topic", 1); !errors.Is(err, headers.ErrInvalidGroup) {
+		t.Fatalf("set offset without a group: expected %v, got %v", headers.ErrInvalidGroup, err)
+	}
+	if err := q.SetConsumerOffset("group", "topic", -1); !errors.Is(err, headers.ErrInvalidMessageID) {
+		t.Fatalf("set negative offset: expected %v, got %v", headers.ErrInvalidMessageID, err)
+	}
+	if err := q.SetConsumerOffset("group", "missing", 1); !errors.Is(err, headers.ErrTopicDoesNotExist) {
+		t.Fatalf("set offset of missing topic: expected %v, got %v", headers.ErrTopicDoesNotExist, err)
+	}
+	offset, err := q.GetConsumerOffset("group", "topic")
+	if err != nil || offset != -1 {
+		t.Fatalf("get uncommitted offset: expected -1, got %d %v", offset, err)
+	}
+	if offset, err = q.GetConsumerOffset("", "topic"); err != nil || offset != -1 {
+		t.Fatalf("get offset without a group: expected -1, got %d %v", offset, err)
+	}
+
+	// without a committed offset, groups consume from the given id
+	if c := consume(t, q, "group", "topic", 0, 1); c.startID != 0 {
+		t.Fatalf("consume without committed offset: started at %d", c.startID)
+	}
+
+	if err = q.SetConsumerOffset("group", "topic", 3); err != nil {
+		t.Fatalf("set offset: %v", err)
+	}
+	if err = q.SetConsumerOffset("other", "topic", 1); err != nil {
+		t.Fatalf("set offset: %v", err)
+	}
+	if offset, err = q.GetConsumerOffset("group", "topic"); err != nil || offset != 3 {
+		t.Fatalf("get offset: expected 3, got %d %v", offset, err)
+	}
+
+	// an id of 0 consumes from the committed offset, other ids are used as given
+	if c := consume(t, q, "group", "topic", 0, 1); c.startID != 3 || string(c.msgs[0]) != "msg-3" {
+		t.Fatalf("consume from committed offset: started at %d", c.startID)
+	}
+	if c := consume(t, q, "other", "topic", 0, 1); c.startID != 1 {
+		t.Fatalf("consume from other group offset: started at %d", c.startID)
+	}
+	if c := consume(t, q, "group", "topic", 2, 1); c.startID != 2 {
+		t.Fatalf("consume from given id: started at %d", c.startID)
+	}
+	if c := consume(t, q, "", "topic", 0, 1); c.startID != 0 {
+		t.Fatalf("consume without a group: started at %d", c.startID)
+	}
+
+	// committed offsets can move backwards
+	if err = q.SetConsumerOffset("group", "topic", 1); err != nil {
+		t.Fatalf("set offset: %v", err)
+	}
+	if offset, err = q.GetConsumerOffset("group", "topic"); err != nil || offset != 1 {
+		t.Fatalf("get offset: expected 1, got %d %v", offset, err)
+	}
+}
+
+func testIdempotentProducers(t *testing.T, q server.Queue) {
+	if err := q.CreateTopic("topic"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	produceSeq := func(id string, seq uint64, msgs ...string) (*headers.ProduceInfo, error) {
+		sizes := make([]int64, len(msgs))
+		var body bytes.Buffer
+		for i, msg := range msgs {
+			sizes[i] = int64(len(msg))
+			body.WriteString(msg)
+		}
+		return q.Produce("topic", sizes, uint64(time.Now().UnixNano()), nil, &headers.ProducerSequence{ID: id, Seq: seq}, &body)
+	}
+
+	info, err := produceSeq("producer", 1, "a", "b")
+	if err != nil || info.StartID != 0 || info.EndID != 1 || info.Duplicate {
+		t.Fatalf("produce: %+v %v", info, err)
+	}
+	if info, err = produceSeq("other", 1, "c"); err != nil || info.StartID != 2 || info.Duplicate {
+		t.Fatalf("produce from another producer: %+v %v", info, err)
+	}
+
+	// the same sequence is not produced again and returns the original ids
+	if info, err = produceSeq("producer", 1, "a", "b"); err != nil || info.StartID != 0 || info.EndID != 1 || !info.Duplicate {
+		t.Fatalf("produce duplicate: %+v %v", info, err)
+	}
+	checkInfo(t, q, "topic", 0, 2)
+
+	// sequences may skip ahead, but not go back
+	if info, err = produceSeq("producer", 5, "d"); err != nil || info.StartID != 3 || info.Duplicate {
+		t.Fatalf("produce later sequence: %+v %v", info, err)
+	}
+	if _, err = produceSeq("producer", 2, "e"); !errors.Is(err, headers.ErrStaleProducerSeq) {
+		t.Fatalf("produce stale sequence: expected %v, got %v", headers.ErrStaleProducerSeq, err)
+	}
+	checkMsgs(t, "consume", consumeAll(t, q, "topic", 0), "a", "b", "c", "d")
+
+	// producers with the oldest batches are forgotten once too many are tracked
+	for i := 0; i < headers.MaxTrackedProducers; i++ {
+		if _, err = produceSeq(fmt.Sprintf("producer-%d", i), 1, "f"); err != nil {
+			t.Fatalf("produce from producer %d: %v", i, err)
+		}
+	}
+	if info, err = produceSeq("producer", 2, "e"); err != nil || info.Duplicate {
+		t.Fatalf("produce from forgotten producer: %+v %v", info, err)
+	}
+	if info, err = produceSeq("producer-1", 1, "f"); err != nil || info.StartID != 5 || !info.Duplicate {
+		t.Fatalf("produce duplicate from tracked producer: %+v %v", info, err)
+	}
+}
+
+func testConcurrentProducers(t *testing.T, q server.Queue) {
+	if err := q.CreateTopic("topic"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	const producers, batches, batchSize = 8, 25, 3
+
+	var wg sync.WaitGroup
+	errs := make(chan error, producers)
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for b := 0; b < batches; b++ {
+				var body bytes.Buffer
+				sizes := make([]int64, batchSize)
+				for m := range sizes {
+					msg := fmt.Sprintf("%d-%d-%d", p, b, m)
+					sizes[m] = int64(len(msg))
+					body.WriteString(msg)
+				}
+				info, err := q.Produce("topic", sizes, uint64(time.Now().UnixNano()), nil, nil, &body)
+				if err == nil && (info == nil || info.EndID-info.StartID+1 != batchSize) {
+					err = errors.Errorf("unexpected produce info %+v", info)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent produce: %v", err)
+	}
+
+	// every message is stored once, batches are not interleaved, and each producer's batches are in order
+	msgs := consumeAll(t, q, "topic", 0)
+	if len(msgs) != producers*batches*batchSize {
+		t.Fatalf("concurrent produce: expected %d messages, got %d", producers*batches*batchSize, len(msgs))
+	}
+	next := make([]int, producers)
+	for i := 0; i < len(msgs); i += batchSize {
+		var p, b int
+		if _, err := fmt.Sscanf(msgs[i], "%d-%d-0", &p, &b); err != nil || p < 0 || p >= producers {
+			t.Fatalf("concurrent produce: unexpected message %q at %d", msgs[i], i)
+		}
+		if b != next[p] {
+			t.Fatalf("concurrent produce: producer %d batch %d stored out of order at %d", p, b, i)
+		}
+		next[p]++
+		for m := 1; m < batchSize; m++ {
+			if expected := fmt.Sprintf("%d-%d-%d", p, b, m); msgs[i+m] != expected {
+				t.Fatalf("concurrent produce: expected %q at %d, got %q", expected, i+m, msgs[i+m])
+			}
+		}
+	}
+	checkInfo(t, q, "topic", 0, producers*batches*batchSize-1)
+}
+
+func testEventTimes(t *testing.T, q server.Queue) {
+	if err := q.CreateTopic("topic"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := q.Produce("topic", []int64{1, 1}, 1, []uint64{1}, nil, bytes.NewBufferString("ab")); !errors.Is(err, headers.ErrInvalidEventTimes) {
+		t.Fatalf("produce mismatched event times: expected %v, got %v", headers.ErrInvalidEventTimes, err)
+	}
+
+	// broker timestamps keep nanoseconds, event times are stored per message and only where given
+	produceAt := func(timestamp uint64, eventTimes []uint64, msgs string) {
+		t.Helper()
+		sizes := make([]int64, len(msgs))
+		for i := range sizes {
+			sizes[i] = 1
+		}
+		if _, err := q.Produce("topic", sizes, timestamp, eventTimes, nil, bytes.NewBufferString(msgs)); err != nil {
+			t.Fatalf("produce: %v", err)
+		}
+	}
+	base := uint64(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC).UnixNano())
+	produceAt(base+1, nil, "a")
+	produceAt(base+2, []uint64{0, base - 10}, "bc")
+	produceAt(base+3, []uint64{base - 20}, "d")
+	produceAt(base+4, nil, "e")
+
+	check := func(id, limit int64, start, end string, eventTimes ...string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		if _, err := q.Consume("", "topic", id, limit, w); err != nil {
+			t.Fatalf("consume: %v", err)
+		}
+		h := w.Header()
+		if h.Get(headers.HeaderStartTime) != start || h.Get(headers.HeaderEndTime) != end {
+			t.Fatalf("consume from %d: unexpected times %q to %q", id, h.Get(headers.HeaderStartTime), h.Get(headers.HeaderEndTime))
+		}
+		if got := h[headers.HeaderEventTimes]; len(got) != len(eventTimes) || strings.Join(got, " ") != strings.Join(eventTimes, " ") {
+			t.Fatalf("consume from %d: expected event times %q, got %q", id, eventTimes, got)
+		}
+	}
+	check(0, 2, "2020-01-02T03:04:05.000000001Z", "2020-01-02T03:04:05.000000002Z")
+	check(0, -1, "2020-01-02T03:04:05.000000001Z", "2020-01-02T03:04:05.000000002Z", "", "", "2020-01-02T03:04:04.99999999Z")
+	check(3, -1, "2020-01-02T03:04:05.000000003Z", "2020-01-02T03:04:05.000000004Z", "2020-01-02T03:04:04.99999998Z", "")
+	check(4, -1, "2020-01-02T03:04:05.000000004Z", "2020-01-02T03:04:05.000000004Z")
+}
+
+func testDeleteMessages(t *testing.T, q server.Queue) {
+	if err := q.CreateTopic("topic"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	del := func(ranges ...headers.IDRange) (*headers.TopicInfo, error) {
+		return q.ModifyTopic("topic", headers.ModifyRequest{Delete: ranges})
+	}
+	if _, err := q.ModifyTopic("missing", headers.ModifyRequest{Delete: []headers.IDRange{{Start: 0, End: 0}}}); err == nil {
+		t.Fatal("delete from missing topic: expected an error")
+	}
+	if _, err := del(headers.IDRange{Start: 2, End: 1}); !errors.Is(err, headers.ErrInvalidDeleteRange) {
+		t.Fatalf("delete invalid range: expected %v, got %v", headers.ErrInvalidDeleteRange, err)
+	}
+	for i := 0; i < 6; i++ {
+		produce(t, q, "topic", "msg-"+strconv.Itoa(i))
+	}
+
+	// deleted messages keep their ids and are consumed without content, ranges past the topic are ignored
+	info, err := del(headers.IDRange{Start: 1, End: 1}, headers.IDRange{Start: 3, End: 4}, headers.IDRange{Start: 100, End: 200})
+	if err != nil || info == nil || info.MinOffset != 0 || info.MaxOffset != 5 {
+		t.Fatalf("delete: %+v %v", info, err)
+	}
+	checkInfo(t, q, "topic", 0, 5)
+	checkMsgs(t, "consume after delete", consumeAll(t, q, "topic", 0), "msg-0", "", "msg-2", "", "", "msg-5")
+	check := func(id int64, expected ...bool) {
+		t.Helper()
+		c := consume(t, q, "", "topic", id, int64(len(expected)))
+		if len(c.msgs) != len(expected) || c.startID != id {
+			t.Fatalf("consume id %d: got %d messages starting at %d", id, len(c.msgs), c.startID)
+		}
+		for i := range expected {
+			if (c.deleted != nil && c.deleted[i]) != expected[i] {
+				t.Fatalf("consume id %d: expected deleted flags %v, got %v", id, expected, c.deleted)
+			}
+		}
+	}
+	check(0, false, true, false)
+	check(1, true)
+	check(3, true, true)
+	check(5, false)
+
+	// messages can be deleted again, and producing continues from the last id
+	if _, err = del(headers.IDRange{Start: 0, End: 1}); err != nil {
+		t.Fatalf("delete again: %v", err)
+	}
+	if id := produce(t, q, "topic", "msg-6"); id != 6 {
+		t.Fatalf("produce after delete: got id %d", id)
+	}
+	checkMsgs(t, "consume after delete again", consumeAll(t, q, "topic", 0), "", "", "msg-2", "", "", "msg-5", "msg-6")
+	check(6, false)
+}
+
+// testProduceDelayed checks queues implementing server.DelayQueue, other queues skip it
+func testProduceDelayed(t *testing.T, q server.Queue) {
+	dq, ok := q.(server.DelayQueue)
+	if !ok {
+		t.Skip("queue does not implement server.DelayQueue")
+	}
+	delivered := make(chan int, 10)
+	dq.OnDelivered(func(topic string, n int) {
+		if topic == "delayed" {
+			delivered <- n
+		}
+	})
+	if err := q.CreateTopic("delayed"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := dq.ProduceDelayed("missing", []int64{1}, time.Now(), nil, bytes.NewBufferString("a")); !errors.Is(err, headers.ErrTopicDoesNotExist) {
+		t.Fatalf("produce delayed to missing topic: expected %v, got %v", headers.ErrTopicDoesNotExist, err)
+	}
+
+	// delayed messages are not visible until they are due, messages produced meanwhile come first
+	if err := dq.ProduceDelayed("delayed", []int64{5}, time.Now().Add(time.Hour), nil, bytes.NewBufferString("never")); err != nil {
+		t.Fatalf("produce delayed: %v", err)
+	}
+	eventTime := uint64(time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC).UnixNano())
+	if err := dq.ProduceDelayed("delayed", []int64{5, 6}, time.Now().Add(100*time.Millisecond), []uint64{eventTime, 0}, bytes.NewBufferString("helloworld!")); err != nil {
+		t.Fatalf("produce delayed: %v", err)
+	}
+	checkInfo(t, q, "delayed", 0, -1)
+	produce(t, q, "delayed", "now")
+
+	select {
+	case n := <-delivered:
+		if n != 2 {
+			t.Fatalf("delivered: expected 2 messages, got %d", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("delayed messages were not delivered")
+	}
+	checkInfo(t, q, "delayed", 0, 2)
+	checkMsgs(t, "consume delivered", consumeAll(t, q, "delayed", 0), "now", "hello", "world!")
+	w := httptest.NewRecorder()
+	if _, err := q.Consume("", "delayed", 1, 1, w); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	if eventTimes, err := headers.ReadEventTimes(w.Header()); err != nil || len(eventTimes) != 1 || eventTimes[0] != eventTime {
+		t.Fatalf("consume delivered: expected event time %d, got %v: %v", eventTime, eventTimes, err)
+	}
+}
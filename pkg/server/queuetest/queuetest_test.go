@@ -0,0 +1,76 @@
+package queuetest
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/haraqa/haraqa/internal/filequeue"
+	"github.com/haraqa/haraqa/internal/memqueue"
+	"github.com/haraqa/haraqa/pkg/server"
+)
+
+func TestFileQueue(t *testing.T) {
+	var n int
+	for _, cache := range []bool{true, false} {
+		cache := cache
+		t.Run("cache="+strconv.FormatBool(cache), func(t *testing.T) {
+			Run(t, func(t *testing.T, maxEntries int64) server.Queue {
+				n++
+				dirs := []string{".haraqa-queuetest-" + strconv.Itoa(n) + "-a", ".haraqa-queuetest-" + strconv.Itoa(n) + "-b"}
+				for _, dir := range dirs {
+					_ = os.RemoveAll(dir)
+				}
+				t.Cleanup(func() {
+					for _, dir := range dirs {
+						_ = os.RemoveAll(dir)
+					}
+				})
+				q, err := filequeue.New(cache, maxEntries, dirs...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return q
+			})
+		})
+	}
+}
+
+func TestFileQueue_MemFS(t *testing.T) {
+	Run(t, func(t *testing.T, maxEntries int64) server.Queue {
+		q, err := filequeue.NewWithOptions(true, maxEntries, []string{"a", "b"}, filequeue.WithFS(filequeue.NewMemFS()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q
+	})
+}
+
+func TestFileQueue_TailCache(t *testing.T) {
+	Run(t, func(t *testing.T, maxEntries int64) server.Queue {
+		q, err := filequeue.NewWithOptions(true, maxEntries, []string{"a"}, filequeue.WithFS(filequeue.NewMemFS()), filequeue.WithTailCache(16))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q
+	})
+}
+
+func TestFileQueue_Compression(t *testing.T) {
+	Run(t, func(t *testing.T, maxEntries int64) server.Queue {
+		compression := filequeue.Compression{Format: filequeue.CompressionFlate, BlockSize: 8, Interval: time.Millisecond}
+		q, err := filequeue.NewWithOptions(true, maxEntries, []string{"a", "b"}, filequeue.WithFS(filequeue.NewMemFS()), filequeue.WithCompression(compression))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = q.Close() })
+		return q
+	})
+}
+
+func TestMemoryQueue(t *testing.T) {
+	Run(t, func(t *testing.T, maxEntries int64) server.Queue {
+		return memqueue.New(maxEntries)
+	})
+}
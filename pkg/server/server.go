@@ -11,6 +11,7 @@ import (
 
 	"github.com/haraqa/haraqa/internal/filequeue"
 	"github.com/haraqa/haraqa/internal/headers"
+	"github.com/haraqa/haraqa/internal/memqueue"
 )
 
 // Option represents a optional function argument to NewServer
@@ -39,13 +40,127 @@ func WithFileQueue(dirs []string, cache bool, entries int64) Option {
 		if entries < 0 {
 			return errors.New("invalid entries, value must not be negative")
 		}
-		var err error
-		s.q, err = filequeue.New(cache, entries, dirs...)
-		return err
+		q, err := filequeue.New(cache, entries, dirs...)
+		if err != nil {
+			return err
+		}
+		s.q = q
+		return nil
+	}
+}
+
+// WithMemoryQueue sets the queue to an in-memory queue, with up to entries messages per segment.
+// Messages are lost when the server exits
+func WithMemoryQueue(entries int64) Option {
+	return func(s *Server) error {
+		if s.q != nil {
+			return nil
+		}
+		if entries < 0 {
+			return errors.New("invalid entries, value must not be negative")
+		}
+		s.q = memqueue.New(entries)
+		return nil
+	}
+}
+
+// WithMaxOpenFiles limits the number of files kept open by the cache of a file queue, closing the files of
+// the least recently produced to topics once the limit is reached. A limit of 0 keeps all files open. Setting a
+// limit on a file queue created without caching returns an error
+func WithMaxOpenFiles(n int) Option {
+	return func(s *Server) error {
+		if n < 0 {
+			return errors.New("invalid max open files, value must not be negative")
+		}
+		s.fileQueueOptions = append(s.fileQueueOptions, filequeue.WithMaxOpenFiles(n))
+		return nil
+	}
+}
+
+// WithPersistedIndex stores the segment index of each topic of a file queue in the topic directory, so that
+// the directories do not need to be read when topics are first used after a restart
+func WithPersistedIndex(persist bool) Option {
+	return func(s *Server) error {
+		s.fileQueueOptions = append(s.fileQueueOptions, filequeue.WithPersistedIndex(persist))
+		return nil
+	}
+}
+
+// WithTailCache keeps up to size bytes of the most recently produced messages of each topic of a file queue
+// in memory, consumers reading the latest messages are served from memory instead of the files
+func WithTailCache(size int64) Option {
+	return func(s *Server) error {
+		if size < 0 {
+			return errors.New("invalid tail cache size, value must not be negative")
+		}
+		s.fileQueueOptions = append(s.fileQueueOptions, filequeue.WithTailCache(size))
+		return nil
+	}
+}
+
+// WithPreallocation preallocates logSize bytes for the log of the latest segment of each topic of a file
+// queue, and space for the max entries in its dat file. The space is released once the segment is sealed.
+// Only supported on linux, a size of 0 disables preallocation
+func WithPreallocation(logSize int64) Option {
+	return func(s *Server) error {
+		if logSize < 0 {
+			return errors.New("invalid preallocation size, value must not be negative")
+		}
+		s.fileQueueOptions = append(s.fileQueueOptions, filequeue.WithPreallocation(logSize))
+		return nil
+	}
+}
+
+// WithIOHints advises the kernel of the sequential reads of sealed segments by consumers of a file queue.
+// Only supported on linux
+func WithIOHints(enable bool) Option {
+	return func(s *Server) error {
+		s.fileQueueOptions = append(s.fileQueueOptions, filequeue.WithIOHints(enable))
+		return nil
+	}
+}
+
+// WithCompression compresses the logs of sealed segments of a file queue in the background, checking for
+// segments to compress on each interval. The format is either "flate" or "gzip", an empty format disables
+// compression. Compressed logs are served as .zlog files by the raw file endpoint
+func WithCompression(format string, interval time.Duration) Option {
+	return func(s *Server) error {
+		compression := filequeue.Compression{Interval: interval}
+		switch format {
+		case "":
+			return nil
+		case "flate":
+			compression.Format = filequeue.CompressionFlate
+		case "gzip":
+			compression.Format = filequeue.CompressionGzip
+		default:
+			return errors.Errorf("invalid compression format %q", format)
+		}
+		s.fileQueueOptions = append(s.fileQueueOptions, filequeue.WithCompression(compression))
+		return nil
+	}
+}
+
+// WithSegmentLimits starts a new segment in the topics of a file queue once the log of the latest segment
+// reaches maxBytes, or once its first message is older than maxAge. A zero value disables a limit
+func WithSegmentLimits(maxBytes int64, maxAge time.Duration) Option {
+	return func(s *Server) error {
+		s.fileQueueOptions = append(s.fileQueueOptions, filequeue.WithSegmentLimits(filequeue.SegmentLimits{MaxBytes: maxBytes, MaxAge: maxAge}))
+		return nil
+	}
+}
+
+// WithTopicSegmentLimits sets the segment limits of a topic of a file queue, replacing the limits set by
+// WithSegmentLimits
+func WithTopicSegmentLimits(topic string, maxBytes int64, maxAge time.Duration) Option {
+	return func(s *Server) error {
+		s.fileQueueOptions = append(s.fileQueueOptions, filequeue.WithTopicSegmentLimits(topic, filequeue.SegmentLimits{MaxBytes: maxBytes, MaxAge: maxAge}))
+		return nil
 	}
 }
 
-// WithMetrics sets the handler for produce and consume metrics
+// WithMetrics sets the handler for produce and consume metrics. If the handler implements CacheMetrics,
+// it also receives the cache metrics of a file queue
 func WithMetrics(metrics Metrics) Option {
 	return func(s *Server) error {
 		if metrics == nil {
@@ -100,10 +215,12 @@ type Server struct {
 	defaultConsumeLimit int64
 	consumerGroupLock   *sync.Map
 	q                   Queue
+	fileQueueOptions    []filequeue.Option
 	closed              chan struct{}
 	waitGroup           *sync.WaitGroup
 	wsPingInterval      time.Duration
 	wsUpgrader          websocket.Upgrader
+	watchers            *watchHub
 }
 
 // NewServer creates a new server with the given options
@@ -116,6 +233,7 @@ func NewServer(options ...Option) (*Server, error) {
 		closed:              make(chan struct{}),
 		waitGroup:           &sync.WaitGroup{},
 		wsPingInterval:      time.Second * 60,
+		watchers:            newWatchHub(),
 		wsUpgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
@@ -131,11 +249,44 @@ func NewServer(options ...Option) (*Server, error) {
 
 	for _, option := range options {
 		if err := option(s); err != nil {
+			// close the queue if an earlier option opened it
+			if s.q != nil {
+				_ = s.q.Close()
+			}
 			return nil, errors.Wrap(err, "invalid option")
 		}
 	}
 
-	rawHandler := http.StripPrefix("/raw/", http.FileServer(http.Dir(s.q.RootDir())))
+	// file queue settings apply regardless of the order of the queue option
+	if q, ok := s.q.(*filequeue.FileQueue); ok {
+		if m, ok := s.metrics.(CacheMetrics); ok {
+			s.fileQueueOptions = append(s.fileQueueOptions, filequeue.WithCacheMetrics(m))
+		}
+		if m, ok := s.metrics.(CompressionMetrics); ok {
+			// the metrics are set before compression starts
+			s.fileQueueOptions = append([]filequeue.Option{filequeue.WithCompressionMetrics(m)}, s.fileQueueOptions...)
+		}
+		for _, option := range s.fileQueueOptions {
+			if err := option(q); err != nil {
+				_ = q.Close()
+				return nil, errors.Wrap(err, "invalid option")
+			}
+		}
+		q.OnDeliveryFailed(func(err error) {
+			s.logger.Errorf("delayed delivery error: %s", err.Error())
+		})
+	}
+
+	// delayed messages are counted and notified to watchers once they are delivered
+	if dq, ok := s.q.(DelayQueue); ok {
+		dq.OnDelivered(s.delivered)
+	}
+
+	// queues without a root directory have no raw files to serve
+	rawHandler := http.NotFoundHandler()
+	if root := s.q.RootDir(); root != "" {
+		rawHandler = http.StripPrefix("/raw/", hideDotFiles(http.FileServer(http.Dir(root))))
+	}
 	s.handler = s.route(rawHandler)
 
 	// iterate over middlewares in reverse order
@@ -146,6 +297,20 @@ func NewServer(options ...Option) (*Server, error) {
 	return s, nil
 }
 
+// hideDotFiles hides the raw files and directories with names starting with a dot, such as the subject key store
+// of a file queue
+func hideDotFiles(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range strings.Split(r.URL.Path, "/") {
+			if strings.HasPrefix(name, ".") {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.handler.ServeHTTP(w, r)
 }
@@ -175,6 +340,22 @@ func (s *Server) route(raw http.Handler) http.HandlerFunc {
 				s.HandleDeleteTopic(w, r)
 			case http.MethodPatch:
 				s.HandleModifyTopic(w, r)
+			case http.MethodHead:
+				s.HandleTopicInfo(w, r)
+			default:
+				s.logger.Warnf("%s:%s:%s", r.Method, r.URL.Path, "invalid method")
+			}
+		case strings.HasPrefix(r.URL.Path, "/offsets/topics/"):
+			switch r.Method {
+			case http.MethodPut:
+				s.HandleSetConsumerOffset(w, r)
+			default:
+				s.logger.Warnf("%s:%s:%s", r.Method, r.URL.Path, "invalid method")
+			}
+		case strings.HasPrefix(r.URL.Path, "/subjects/"):
+			switch r.Method {
+			case http.MethodDelete:
+				s.HandleDestroySubject(w, r)
 			default:
 				s.logger.Warnf("%s:%s:%s", r.Method, r.URL.Path, "invalid method")
 			}
@@ -182,6 +363,8 @@ func (s *Server) route(raw http.Handler) http.HandlerFunc {
 			raw.ServeHTTP(w, r)
 		case strings.HasPrefix(r.URL.Path, "/ws/topics"):
 			s.HandleWatchTopics(w, r)
+		case r.URL.Path == "/health":
+			s.HandleHealth(w, r)
 		default:
 			s.logger.Warnf("%s:%s:%s", r.Method, r.URL.Path, "invalid url")
 			w.WriteHeader(http.StatusNotFound)
@@ -1,10 +1,18 @@
 package server
 
 import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/haraqa/haraqa/internal/memqueue"
 )
 
 func TestWithQueue(t *testing.T) {
@@ -118,3 +126,234 @@ func TestWithWebsocketInterval(t *testing.T) {
 		t.Error(s.wsPingInterval)
 	}
 }
+
+func TestWithMemoryQueue(t *testing.T) {
+	s := &Server{}
+	err := WithMemoryQueue(-1)(s)
+	if err == nil || err.Error() != "invalid entries, value must not be negative" {
+		t.Error(err)
+	}
+	if err = WithMemoryQueue(10)(s); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.q.(*memqueue.MemoryQueue); !ok {
+		t.Errorf("%T", s.q)
+	}
+
+	// the first queue option wins
+	if err = WithFileQueue([]string{".haraqa_options"}, true, 10)(s); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.q.(*memqueue.MemoryQueue); !ok {
+		t.Errorf("%T", s.q)
+	}
+
+	// raw files are not served from memory
+	s, err = NewServer(WithMemoryQueue(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest(http.MethodGet, "/raw/server.go", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Error(w.Code)
+	}
+}
+
+type cacheMetrics struct {
+	noOpMetrics
+	hits, misses, evictions int
+}
+
+func (m *cacheMetrics) CacheHit()      { m.hits++ }
+func (m *cacheMetrics) CacheMiss()     { m.misses++ }
+func (m *cacheMetrics) CacheEviction() { m.evictions++ }
+
+func TestWithMaxOpenFiles(t *testing.T) {
+	s := &Server{}
+	if err := WithMaxOpenFiles(-1)(s); err == nil || err.Error() != "invalid max open files, value must not be negative" {
+		t.Error(err)
+	}
+	if err := WithMaxOpenFiles(2)(s); err != nil || len(s.fileQueueOptions) != 1 {
+		t.Error(s.fileQueueOptions, err)
+	}
+
+	// the limit and metrics apply to the file queue, even when given after the queue option
+	dir := ".haraqa-max-open-files"
+	_ = os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	m := &cacheMetrics{}
+	s, err := NewServer(WithFileQueue([]string{dir}, true, 10), WithMaxOpenFiles(2), WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, topic := range []string{"a", "b", "a"} {
+		_ = s.q.CreateTopic(topic)
+		if _, err = s.q.Produce(topic, []int64{1}, 0, nil, nil, bytes.NewBufferString("m")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m.hits != 0 || m.misses != 3 || m.evictions != 2 {
+		t.Error(m.hits, m.misses, m.evictions)
+	}
+}
+
+func TestWithPersistedIndex(t *testing.T) {
+	s := &Server{}
+	if err := WithPersistedIndex(true)(s); err != nil || len(s.fileQueueOptions) != 1 {
+		t.Error(s.fileQueueOptions, err)
+	}
+}
+
+func TestWithTailCache(t *testing.T) {
+	s := &Server{}
+	if err := WithTailCache(-1)(s); err == nil {
+		t.Error("expected invalid tail cache size")
+	}
+	if err := WithTailCache(1 << 20)(s); err != nil || len(s.fileQueueOptions) != 1 {
+		t.Error(s.fileQueueOptions, err)
+	}
+}
+
+func TestWithPreallocation(t *testing.T) {
+	s := &Server{}
+	if err := WithPreallocation(-1)(s); err == nil {
+		t.Error("expected invalid preallocation size")
+	}
+	if err := WithPreallocation(1 << 20)(s); err != nil || len(s.fileQueueOptions) != 1 {
+		t.Error(s.fileQueueOptions, err)
+	}
+	if err := WithIOHints(true)(s); err != nil || len(s.fileQueueOptions) != 2 {
+		t.Error(s.fileQueueOptions, err)
+	}
+}
+
+type compressionMetrics struct {
+	noOpMetrics
+	rawSize int64
+}
+
+func (m *compressionMetrics) SegmentCompressed(rawSize, compressedSize int64) {
+	atomic.AddInt64(&m.rawSize, rawSize)
+}
+
+func TestWithCompression(t *testing.T) {
+	s := &Server{}
+	if err := WithCompression("zip", time.Minute)(s); err == nil {
+		t.Error("expected invalid compression format")
+	}
+	if err := WithCompression("", time.Minute)(s); err != nil || len(s.fileQueueOptions) != 0 {
+		t.Error(s.fileQueueOptions, err)
+	}
+	if err := WithCompression("gzip", time.Minute)(s); err != nil || len(s.fileQueueOptions) != 1 {
+		t.Error(s.fileQueueOptions, err)
+	}
+
+	dir := ".haraqa-compression"
+	_ = os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	if _, err := NewServer(WithFileQueue([]string{dir}, true, 1), WithCompression("flate", -time.Second)); err == nil {
+		t.Error("expected invalid compression interval")
+	}
+
+	// the metrics record the segments compressed in the background
+	m := &compressionMetrics{}
+	s, err := NewServer(WithFileQueue([]string{dir}, true, 1), WithCompression("flate", time.Millisecond), WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_ = s.q.CreateTopic("topic")
+	for i := 0; i < 2; i++ {
+		if _, err = s.q.Produce("topic", []int64{1}, 0, nil, nil, bytes.NewBufferString("m")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for start := time.Now(); atomic.LoadInt64(&m.rawSize) != 1; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("segment was not compressed")
+		}
+	}
+}
+
+func TestWithKeyProvider(t *testing.T) {
+	if err := WithKeyProvider(nil)(&Server{}); err == nil {
+		t.Error("expected invalid key provider")
+	}
+
+	dir := ".haraqa-encryption"
+	_ = os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(dir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewKeyFile(dir + "/keys.json"); err == nil {
+		t.Error("expected missing key file")
+	}
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	if err := ioutil.WriteFile(dir+"/keys.json", []byte(`{"keys": {"k1": "`+key+`"}, "topics": {"topic": "k1"}}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeyFile(dir + "/keys.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(WithFileQueue([]string{dir + "/queue"}, true, 10), WithKeyProvider(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_ = s.q.CreateTopic("topic")
+	if _, err = s.q.Produce("topic", []int64{6}, 0, nil, nil, bytes.NewBufferString("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	// consumers are sent the decrypted messages, the raw files hold the encrypted messages
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/topics/topic?id=0", nil))
+	if body, _ := ioutil.ReadAll(w.Body); w.Code != http.StatusPartialContent || string(body) != "secret" {
+		t.Error(w.Code, string(body))
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/raw/topic/0000000000000000.log", nil))
+	if body, _ := ioutil.ReadAll(w.Body); w.Code != http.StatusOK || len(body) == 0 || bytes.Contains(body, []byte("secret")) {
+		t.Error(w.Code, string(body))
+	}
+}
+
+func TestWithSegmentLimits(t *testing.T) {
+	dir := ".haraqa-segment-limits"
+	_ = os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	if _, err := NewServer(WithFileQueue([]string{dir}, true, 10), WithSegmentLimits(-1, 0)); err == nil {
+		t.Error("expected invalid segment limits")
+	}
+	if _, err := NewServer(WithFileQueue([]string{dir}, true, 10), WithTopicSegmentLimits("topic", 0, -time.Second)); err == nil {
+		t.Error("expected invalid topic segment limits")
+	}
+	s, err := NewServer(WithFileQueue([]string{dir}, true, 10), WithSegmentLimits(1, 0), WithTopicSegmentLimits("topic", 0, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, topic := range []string{"topic", "other"} {
+		_ = s.q.CreateTopic(topic)
+		for i := 0; i < 2; i++ {
+			if _, err = s.q.Produce(topic, []int64{1}, 0, nil, nil, bytes.NewBufferString("m")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for topic, expected := range map[string]int{"topic": 1, "other": 2} {
+		infos, err := ioutil.ReadDir(dir + "/" + topic)
+		if err != nil || len(infos) != 2*expected {
+			t.Error(topic, len(infos), err)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/haraqa/haraqa/internal/headers"
@@ -41,6 +42,28 @@ func TestNewServer(t *testing.T) {
 		s.Close()
 	}
 
+	// option w/error after the queue is set closes the queue
+	{
+		q := NewMockQueue(ctrl)
+		q.EXPECT().Close().Times(1)
+		_, err := NewServer(WithQueue(q), func(server *Server) error {
+			return errors.New("test error")
+		})
+		if err.Error() != "invalid option: test error" {
+			t.Fatal(err)
+		}
+	}
+
+	// file queue option w/error closes the queue
+	{
+		dir := ".haraqa-invalid-file-option"
+		defer os.RemoveAll(dir)
+		_, err := NewServer(WithFileQueue([]string{dir}, false, 5000), WithMaxOpenFiles(10))
+		if err == nil || !strings.Contains(err.Error(), "does not cache files") {
+			t.Fatal(err)
+		}
+	}
+
 	// with invalid dir
 	{
 		_, err := NewServer(WithFileQueue([]string{"invalid/folder/doesnt/exist/..."}, true, 5000))
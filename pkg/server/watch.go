@@ -0,0 +1,184 @@
+package server
+
+import (
+	"net/http"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// watchHub distributes topic events to the websocket connections watching those topics
+type watchHub struct {
+	mux      sync.RWMutex
+	watchers map[*topicWatcher]struct{}
+}
+
+type topicWatcher struct {
+	filter *watchFilter
+	events chan headers.WatchEvent
+}
+
+// watchFilter selects the topics a watcher receives events for. A topic matches if it is one of the
+// exact topics, matches one of the glob patterns, or passes the prefix, suffix and regex filters
+type watchFilter struct {
+	topics   map[string]bool
+	patterns []string
+	prefix   string
+	suffix   string
+	regex    *regexp.Regexp
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{
+		watchers: make(map[*topicWatcher]struct{}),
+	}
+}
+
+// subscribe registers a new watcher for the topics selected by the filter
+func (h *watchHub) subscribe(filter *watchFilter) *topicWatcher {
+	w := &topicWatcher{
+		filter: filter,
+		events: make(chan headers.WatchEvent, 64),
+	}
+	h.mux.Lock()
+	h.watchers[w] = struct{}{}
+	h.mux.Unlock()
+	return w
+}
+
+// unsubscribe removes the watcher, no more events are sent to it after it returns
+func (h *watchHub) unsubscribe(w *topicWatcher) {
+	h.mux.Lock()
+	delete(h.watchers, w)
+	h.mux.Unlock()
+}
+
+// active returns true if there are any watchers
+func (h *watchHub) active() bool {
+	if h == nil {
+		return false
+	}
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	return len(h.watchers) > 0
+}
+
+// watching returns true if any watcher is interested in the topic
+func (h *watchHub) watching(topic string) bool {
+	if h == nil {
+		return false
+	}
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	for w := range h.watchers {
+		if w.filter.match(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// publish sends the event to all interested watchers without blocking. It returns the number
+// of events dropped because a watcher was not keeping up
+func (h *watchHub) publish(event headers.WatchEvent) int {
+	if h == nil {
+		return 0
+	}
+	var dropped int
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	for w := range h.watchers {
+		if !w.filter.match(event.Topic) {
+			continue
+		}
+		select {
+		case w.events <- event:
+		default:
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// match returns true if the topic is selected by the filter
+func (f *watchFilter) match(topic string) bool {
+	if f.topics[topic] {
+		return true
+	}
+	for _, pattern := range f.patterns {
+		if ok, _ := path.Match(pattern, topic); ok {
+			return true
+		}
+	}
+	if f.prefix == "" && f.suffix == "" && f.regex == nil {
+		return false
+	}
+	if f.prefix != "" && !strings.HasPrefix(topic, f.prefix) {
+		return false
+	}
+	if f.suffix != "" && !strings.HasSuffix(topic, f.suffix) {
+		return false
+	}
+	if f.regex != nil && !f.regex.MatchString(topic) {
+		return false
+	}
+	return true
+}
+
+// dynamic returns true if the filter can match topics other than its exact topics
+func (f *watchFilter) dynamic() bool {
+	return len(f.patterns) > 0 || f.prefix != "" || f.suffix != "" || f.regex != nil
+}
+
+// getWatchFilter reads the topics to watch from the url path, the X-Topics header and the
+// prefix, suffix and regex query parameters. Topics containing glob characters are treated as patterns
+func getWatchFilter(r *http.Request) (*watchFilter, error) {
+	f := &watchFilter{
+		topics: make(map[string]bool),
+	}
+	add := func(topic string) error {
+		topic = strings.ToLower(filepath.ToSlash(filepath.Clean(topic)))
+		if !strings.ContainsAny(topic, "*?[") {
+			f.topics[topic] = true
+			return nil
+		}
+		if _, err := path.Match(topic, ""); err != nil {
+			return errors.Wrapf(headers.ErrInvalidTopic, "invalid pattern %q", topic)
+		}
+		f.patterns = append(f.patterns, topic)
+		return nil
+	}
+
+	for _, topic := range r.Header.Values(headers.HeaderWatchTopics) {
+		if err := add(topic); err != nil {
+			return nil, err
+		}
+	}
+	if topic, err := getTopic(r); err == nil {
+		if err = add(topic); err != nil {
+			return nil, err
+		}
+	}
+
+	query := r.URL.Query()
+	f.prefix = strings.ToLower(query.Get("prefix"))
+	f.suffix = strings.ToLower(query.Get("suffix"))
+	if regex := query.Get("regex"); regex != "" {
+		rx, err := regexp.Compile(regex)
+		if err != nil {
+			return nil, errors.Wrapf(headers.ErrInvalidTopic, "invalid regex: %s", err.Error())
+		}
+		f.regex = rx
+	}
+
+	if len(f.topics) == 0 && !f.dynamic() {
+		return nil, headers.ErrInvalidTopic
+	}
+	return f, nil
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestWatchHub(t *testing.T) {
+	var nilHub *watchHub
+	if nilHub.active() || nilHub.watching("topic") || nilHub.publish(headers.WatchEvent{}) != 0 {
+		t.Error("nil hub should be a no-op")
+	}
+
+	h := newWatchHub()
+	if h.active() {
+		t.Error("new hub should not be active")
+	}
+	w := h.subscribe(&watchFilter{topics: map[string]bool{"parent": true}, patterns: []string{"parent/*"}})
+	defer h.unsubscribe(w)
+
+	if !h.active() || !h.watching("parent") || !h.watching("parent/child") || h.watching("other") {
+		t.Error("unexpected watching result")
+	}
+	if h.publish(headers.WatchEvent{Type: headers.EventCreated, Topic: "parent/new"}) != 0 {
+		t.Error("unexpected dropped events")
+	}
+	if h.publish(headers.WatchEvent{Type: headers.EventCreated, Topic: "parent/new/nested"}) != 0 {
+		t.Error("unexpected dropped events")
+	}
+	if len(w.events) != 1 {
+		t.Fatal(len(w.events))
+	}
+	if event := <-w.events; event.Type != headers.EventCreated || event.Topic != "parent/new" {
+		t.Error(event)
+	}
+
+	// slow watchers drop events instead of blocking
+	for i := 0; i < cap(w.events); i++ {
+		h.publish(headers.WatchEvent{Type: headers.EventProduced, Topic: "parent"})
+	}
+	if h.publish(headers.WatchEvent{Type: headers.EventProduced, Topic: "parent"}) != 1 {
+		t.Error("expected a dropped event")
+	}
+
+	h.unsubscribe(w)
+	if h.active() || h.watching("parent") {
+		t.Error("unsubscribed watcher still matched")
+	}
+}
+
+func TestGetWatchFilter(t *testing.T) {
+	filter := func(url string, topics ...string) (*watchFilter, error) {
+		r, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header[headers.HeaderWatchTopics] = topics
+		return getWatchFilter(r)
+	}
+
+	// invalid requests
+	for _, url := range []string{"/ws/topics", "/ws/topics?prefix=&suffix=", "/ws/topics/[", "/ws/topics?regex=["} {
+		if _, err := filter(url); !errors.Is(err, headers.ErrInvalidTopic) {
+			t.Error(url, err)
+		}
+	}
+
+	// exact topics & patterns
+	f, err := filter("/ws/topics/Orders/*", "exact", "other/exact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.dynamic() || len(f.topics) != 2 || len(f.patterns) != 1 {
+		t.Error(f)
+	}
+	for topic, expected := range map[string]bool{
+		"exact":         true,
+		"other/exact":   true,
+		"orders/a":      true,
+		"orders/a/b":    false,
+		"orders":        false,
+		"exact/nested":  false,
+		"unknown-topic": false,
+	} {
+		if f.match(topic) != expected {
+			t.Error(topic, expected)
+		}
+	}
+
+	// prefix, suffix & regex
+	f, err = filter("/ws/topics?prefix=orders/&suffix=_eu&regex=[0-9]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for topic, expected := range map[string]bool{
+		"orders/1_eu":     true,
+		"orders/a/b/2_eu": true,
+		"orders/a_eu":     false,
+		"orders/1_us":     false,
+		"users/1_eu":      false,
+	} {
+		if f.match(topic) != expected {
+			t.Error(topic, expected)
+		}
+	}
+
+	// exact topics only
+	f, err = filter("/ws/topics/exact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.dynamic() || f.match("exact/nested") {
+		t.Error(f)
+	}
+}
@@ -0,0 +1,327 @@
+package haraqa
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrProducerClosed is returned when sending a message to a closed Producer
+var ErrProducerClosed = errors.New("producer closed")
+
+// ProducerOption represents a optional function argument to NewProducer
+type ProducerOption func(*Producer) error
+
+// WithBatchSize sets the number of messages which triggers a send of a topic batch
+func WithBatchSize(size int) ProducerOption {
+	return func(p *Producer) error {
+		if size < 1 {
+			return errors.New("invalid batch size")
+		}
+		p.batchSize = size
+		return nil
+	}
+}
+
+// WithBatchBytes sets the total message size which triggers a send of a topic batch
+func WithBatchBytes(n int64) ProducerOption {
+	return func(p *Producer) error {
+		if n < 1 {
+			return errors.New("invalid batch bytes")
+		}
+		p.batchBytes = n
+		return nil
+	}
+}
+
+// WithLinger sets how long a message waits for more messages to batch with before it is sent
+func WithLinger(linger time.Duration) ProducerOption {
+	return func(p *Producer) error {
+		if linger < 0 {
+			return errors.New("invalid linger")
+		}
+		p.linger = linger
+		return nil
+	}
+}
+
+// WithMaxBufferedBytes limits the total size of the messages waiting to be delivered.
+// Send blocks while the limit is reached
+func WithMaxBufferedBytes(n int64) ProducerOption {
+	return func(p *Producer) error {
+		if n < 1 {
+			return errors.New("invalid max buffered bytes")
+		}
+		p.maxBuffered = n
+		return nil
+	}
+}
+
+// Producer batches messages sent to a topic and produces them in the background. A batch is sent
+// once it holds the maximum number of messages or bytes, or once its first message has waited the linger time.
+// Batches for a topic are produced in the order they were filled. Use NewProducer to create a new producer
+type Producer struct {
+	c           *Client
+	batchSize   int
+	batchBytes  int64
+	linger      time.Duration
+	maxBuffered int64
+
+	mux      sync.Mutex
+	topics   map[string]*producerTopic
+	buffered int64
+	space    chan struct{}
+	closed   bool
+	closer   chan struct{}
+	wg       sync.WaitGroup
+}
+
+type producerTopic struct {
+	batch   *producerBatch
+	pending []*producerBatch
+	sending bool
+	last    *Delivery
+}
+
+type producerBatch struct {
+	msgs       [][]byte
+	sizes      []int64
+	bytes      int64
+	deliveries []*Delivery
+	timer      *time.Timer
+}
+
+// Delivery is the result of producing a message with a Producer
+type Delivery struct {
+	done     chan struct{}
+	callback func(id int64, err error)
+	id       int64
+	err      error
+}
+
+// Done returns a channel which is closed once the message has been delivered or has failed
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+// Result waits for the message to be delivered and returns its id. The id is -1 if the server did not report it
+func (d *Delivery) Result() (int64, error) {
+	<-d.done
+	return d.id, d.err
+}
+
+// Wait waits for the message to be delivered or the context to end, and returns the id of the message
+func (d *Delivery) Wait(ctx context.Context) (int64, error) {
+	select {
+	case <-d.done:
+		return d.id, d.err
+	case <-ctx.Done():
+		return -1, ctx.Err()
+	}
+}
+
+func (d *Delivery) resolve(id int64, err error) {
+	d.id, d.err = id, err
+	close(d.done)
+	if d.callback != nil {
+		d.callback(id, err)
+	}
+}
+
+// NewProducer creates a new producer which sends messages using the client
+func NewProducer(c *Client, opts ...ProducerOption) (*Producer, error) {
+	if c == nil {
+		return nil, errors.New("invalid client")
+	}
+	p := &Producer{
+		c:           c,
+		batchSize:   1000,
+		batchBytes:  1024 * 1024,
+		linger:      5 * time.Millisecond,
+		maxBuffered: 32 * 1024 * 1024,
+		topics:      make(map[string]*producerTopic),
+		space:       make(chan struct{}),
+		closer:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if err := opt(p); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Send adds the message to the batch for the topic and returns its Delivery. The message must not be
+// modified until it is delivered. If the producer is holding the maximum buffered bytes,
+// Send blocks until there is space or the context ends
+func (p *Producer) Send(ctx context.Context, topic string, msg []byte) (*Delivery, error) {
+	return p.send(ctx, topic, msg, nil)
+}
+
+// SendFunc adds the message to the batch for the topic as in Send. The callback is called with the id of the
+// message once it is delivered, or with an error if it fails. Callbacks should not block, as they
+// delay the delivery of later batches
+func (p *Producer) SendFunc(ctx context.Context, topic string, msg []byte, callback func(id int64, err error)) error {
+	_, err := p.send(ctx, topic, msg, callback)
+	return err
+}
+
+func (p *Producer) send(ctx context.Context, topic string, msg []byte, callback func(int64, error)) (*Delivery, error) {
+	if topic == "" {
+		return nil, ErrInvalidTopic
+	}
+	if len(msg) == 0 {
+		return nil, errors.New("invalid message: message cannot be empty")
+	}
+	size := int64(len(msg))
+
+	p.mux.Lock()
+	for {
+		if p.closed {
+			p.mux.Unlock()
+			return nil, ErrProducerClosed
+		}
+		// a message larger than the limit is allowed once nothing else is buffered
+		if p.buffered == 0 || p.buffered+size <= p.maxBuffered {
+			break
+		}
+		space := p.space
+		p.mux.Unlock()
+		select {
+		case <-space:
+		case <-p.closer:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		p.mux.Lock()
+	}
+	defer p.mux.Unlock()
+
+	t, ok := p.topics[topic]
+	if !ok {
+		t = &producerTopic{}
+		p.topics[topic] = t
+	}
+	b := t.batch
+	if b == nil {
+		b = &producerBatch{}
+		t.batch = b
+		if p.linger > 0 {
+			b.timer = time.AfterFunc(p.linger, func() {
+				p.mux.Lock()
+				defer p.mux.Unlock()
+				if t.batch == b {
+					p.dispatch(topic, t)
+				}
+			})
+		}
+	}
+
+	d := &Delivery{
+		done:     make(chan struct{}),
+		callback: callback,
+		id:       -1,
+	}
+	b.msgs = append(b.msgs, msg)
+	b.sizes = append(b.sizes, size)
+	b.bytes += size
+	b.deliveries = append(b.deliveries, d)
+	t.last = d
+	p.buffered += size
+
+	if p.linger == 0 || len(b.msgs) >= p.batchSize || b.bytes >= p.batchBytes {
+		p.dispatch(topic, t)
+	}
+	return d, nil
+}
+
+// dispatch queues the current batch of the topic to be sent. The producer lock must be held
+func (p *Producer) dispatch(topic string, t *producerTopic) {
+	b := t.batch
+	if b == nil {
+		return
+	}
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	t.batch = nil
+	t.pending = append(t.pending, b)
+	if t.sending {
+		return
+	}
+	t.sending = true
+	p.wg.Add(1)
+	go p.sendBatches(topic, t)
+}
+
+// sendBatches produces the pending batches of a topic in order, until none are left
+func (p *Producer) sendBatches(topic string, t *producerTopic) {
+	defer p.wg.Done()
+	for {
+		p.mux.Lock()
+		if len(t.pending) == 0 {
+			t.sending = false
+			p.mux.Unlock()
+			return
+		}
+		b := t.pending[0]
+		t.pending = t.pending[1:]
+		p.mux.Unlock()
+
+		info, err := p.c.produce(context.Background(), topic, b.sizes, nil, nil, time.Time{}, bytes.NewBuffer(bytes.Join(b.msgs, nil)))
+		for i, d := range b.deliveries {
+			id := int64(-1)
+			if err == nil && info != nil && info.EndID-info.StartID+1 == int64(len(b.deliveries)) {
+				id = info.StartID + int64(i)
+			}
+			d.resolve(id, err)
+		}
+
+		// release the buffered space and wake any blocked senders
+		p.mux.Lock()
+		p.buffered -= b.bytes
+		close(p.space)
+		p.space = make(chan struct{})
+		p.mux.Unlock()
+	}
+}
+
+// Flush sends all buffered messages and waits until they are delivered or the context ends
+func (p *Producer) Flush(ctx context.Context) error {
+	p.mux.Lock()
+	waits := make([]*Delivery, 0, len(p.topics))
+	for topic, t := range p.topics {
+		p.dispatch(topic, t)
+		if t.last != nil {
+			waits = append(waits, t.last)
+		}
+	}
+	p.mux.Unlock()
+
+	for _, d := range waits {
+		select {
+		case <-d.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Close stops accepting new messages, then sends all buffered messages and waits for them to be delivered.
+// It is safe to call Close multiple times
+func (p *Producer) Close() error {
+	p.mux.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.closer)
+	}
+	p.mux.Unlock()
+
+	err := p.Flush(context.Background())
+	p.wg.Wait()
+	return err
+}
@@ -0,0 +1,252 @@
+//+build linux
+
+package haraqa
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestProducerOptions(t *testing.T) {
+	for _, opt := range []ProducerOption{
+		WithBatchSize(0),
+		WithBatchBytes(0),
+		WithLinger(-1),
+		WithMaxBufferedBytes(0),
+	} {
+		if err := opt(&Producer{}); err == nil {
+			t.Error("expected invalid option")
+		}
+	}
+	if _, err := NewProducer(nil); err == nil {
+		t.Error("expected invalid client")
+	}
+
+	p, err := NewProducer(&Client{}, WithBatchSize(10), WithBatchBytes(20), WithLinger(time.Second), WithMaxBufferedBytes(30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.batchSize != 10 || p.batchBytes != 20 || p.linger != time.Second || p.maxBuffered != 30 {
+		t.Error(p)
+	}
+}
+
+// producerServer records the batches produced to it and assigns sequential ids
+type producerServer struct {
+	*httptest.Server
+	mux     sync.Mutex
+	nextID  int64
+	batches []string
+	block   chan struct{}
+}
+
+func newProducerServer(t *testing.T) *producerServer {
+	s := &producerServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.block != nil {
+			<-s.block
+		}
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			headers.SetError(w, headers.ErrTopicDoesNotExist)
+			return
+		}
+		sizes, err := headers.ReadSizes(r.Header)
+		if err != nil {
+			t.Error(err)
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		s.batches = append(s.batches, string(b))
+		headers.SetProduceInfo(&headers.ProduceInfo{StartID: s.nextID, EndID: s.nextID + int64(len(sizes)) - 1}, w.Header())
+		s.nextID += int64(len(sizes))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return s
+}
+
+func (s *producerServer) getBatches() []string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]string{}, s.batches...)
+}
+
+func TestProducer_Batching(t *testing.T) {
+	s := newProducerServer(t)
+	defer s.Close()
+	c, err := NewClient(WithURL(s.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// batches are sent when full
+	p, err := NewProducer(c, WithBatchSize(2), WithBatchBytes(100), WithLinger(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deliveries []*Delivery
+	for _, msg := range []string{"a", "b", "c", "d", "e"} {
+		d, err := p.Send(ctx, "topic", []byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	for i, d := range deliveries[:4] {
+		id, err := d.Result()
+		if err != nil || id != int64(i) {
+			t.Error(i, id, err)
+		}
+	}
+	select {
+	case <-deliveries[4].Done():
+		t.Error("partial batch should wait for linger")
+	default:
+	}
+	if err = p.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := deliveries[4].Wait(ctx); err != nil || id != 4 {
+		t.Error(id, err)
+	}
+	if batches := s.getBatches(); strings.Join(batches, ",") != "ab,cd,e" {
+		t.Error(batches)
+	}
+	if err = p.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err = p.Send(ctx, "topic", []byte("f")); err != ErrProducerClosed {
+		t.Error(err)
+	}
+	if err = p.Close(); err != nil {
+		t.Error(err)
+	}
+
+	// batches are sent when the byte limit is reached or after lingering
+	p, err = NewProducer(c, WithBatchSize(100), WithBatchBytes(6), WithLinger(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var wg sync.WaitGroup
+	var ids []int64
+	var mux sync.Mutex
+	for _, msg := range []string{"hello", "world", "!"} {
+		wg.Add(1)
+		err = p.SendFunc(ctx, "topic", []byte(msg), func(id int64, err error) {
+			defer wg.Done()
+			if err != nil {
+				t.Error(err)
+			}
+			mux.Lock()
+			ids = append(ids, id)
+			mux.Unlock()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	if len(ids) != 3 || ids[0] != 5 || ids[1] != 6 || ids[2] != 7 {
+		t.Error(ids)
+	}
+	if batches := s.getBatches(); strings.Join(batches[3:], ",") != "helloworld,!" {
+		t.Error(batches)
+	}
+
+	// invalid messages
+	if _, err = p.Send(ctx, "", []byte("hello")); err != ErrInvalidTopic {
+		t.Error(err)
+	}
+	if _, err = p.Send(ctx, "topic", nil); err == nil {
+		t.Error("expected error for empty message")
+	}
+}
+
+func TestProducer_Errors(t *testing.T) {
+	s := newProducerServer(t)
+	defer s.Close()
+	c, err := NewClient(WithURL(s.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewProducer(c, WithLinger(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	d, err := p.Send(context.Background(), "missing", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := d.Result(); !errors.Is(err, ErrTopicDoesNotExist) || id != -1 {
+		t.Error(id, err)
+	}
+}
+
+func TestProducer_Backpressure(t *testing.T) {
+	s := newProducerServer(t)
+	s.block = make(chan struct{})
+	defer s.Close()
+	c, err := NewClient(WithURL(s.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewProducer(c, WithLinger(0), WithMaxBufferedBytes(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// messages larger than the limit are accepted when nothing else is buffered
+	first, err := p.Send(context.Background(), "topic", []byte("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sends block until there is space
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = p.Send(ctx, "topic", []byte("hello")); err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+
+	sent := make(chan *Delivery)
+	go func() {
+		d, err := p.Send(context.Background(), "topic", []byte("hello"))
+		if err != nil {
+			t.Error(err)
+		}
+		sent <- d
+	}()
+	select {
+	case <-sent:
+		t.Fatal("send should block while the producer is full")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(s.block)
+	if _, err = first.Result(); err != nil {
+		t.Error(err)
+	}
+	if id, err := (<-sent).Result(); err != nil || id != 1 {
+		t.Error(id, err)
+	}
+	if err = p.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,138 @@
+package haraqa
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+// RetryPolicy configures how client requests are retried after a transient failure
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts made for a request, including the first
+	MaxAttempts int
+	// MinBackoff is the wait before the first retry, it doubles after each failed attempt
+	MinBackoff time.Duration
+	// MaxBackoff is the longest wait between attempts
+	MaxBackoff time.Duration
+	// Jitter is the fraction (0 to 1) of each wait which is randomized, to spread out retries from many clients
+	Jitter float64
+}
+
+// DefaultRetryPolicy is a reasonable retry policy for use with WithRetryPolicy
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	MinBackoff:  100 * time.Millisecond,
+	MaxBackoff:  5 * time.Second,
+	Jitter:      0.5,
+}
+
+// WithRetryPolicy retries requests which fail with a retryable error, see IsRetryable.
+// Produce requests are sent with a producer id and sequence number so that the server can drop
+// duplicate batches, making retries safe. Batches produced to the same topic by the client are sent
+// one at a time to keep their sequence numbers in order. Delayed produce requests cannot be sequenced,
+// so they are never retried.
+// A retried CreateTopic or DeleteTopic may report ErrTopicAlreadyExists or ErrTopicDoesNotExist
+// if an earlier attempt succeeded without the response reaching the client
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *Client) error {
+		if policy.MaxAttempts < 1 {
+			return errors.New("invalid retry policy: max attempts must be at least 1")
+		}
+		if policy.MinBackoff < 0 || policy.MaxBackoff < policy.MinBackoff {
+			return errors.New("invalid retry policy: invalid backoff")
+		}
+		if policy.Jitter < 0 || policy.Jitter > 1 {
+			return errors.New("invalid retry policy: jitter must be between 0 and 1")
+		}
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return errors.Wrap(err, "unable to create producer id")
+		}
+		c.retryPolicy = &policy
+		c.producerID = hex.EncodeToString(id)
+		return nil
+	}
+}
+
+// IsRetryable returns true if the error is temporary, such as a lost connection or the server restarting
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if headers.Retryable(err) {
+		return true
+	}
+	var respErr *ResponseError
+	if errors.As(err, &respErr) {
+		switch respErr.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retry calls fn until it succeeds, fails with an error which is not retryable, or the retry policy is exhausted
+func (c *Client) retry(ctx context.Context, fn func() error) error {
+	if c.retryPolicy == nil {
+		return fn()
+	}
+	backoff := c.retryPolicy.MinBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= c.retryPolicy.MaxAttempts || !IsRetryable(err) {
+			return err
+		}
+
+		wait := backoff
+		if c.retryPolicy.Jitter > 0 && wait > 0 {
+			wait -= time.Duration(c.retryPolicy.Jitter * mathrand.Float64() * float64(wait))
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+
+		backoff *= 2
+		if backoff > c.retryPolicy.MaxBackoff {
+			backoff = c.retryPolicy.MaxBackoff
+		}
+	}
+}
+
+// produceSequence tracks the sequence number of the last batch produced to a topic
+type produceSequence struct {
+	mux sync.Mutex
+	seq uint64
+}
+
+// nextProduceSequence locks the topic sequence and returns the next sequence number. The returned
+// function must be called once the batch has been sent
+func (c *Client) nextProduceSequence(topic string) (uint64, func()) {
+	v, ok := c.produceSeqs.Load(topic)
+	if !ok {
+		v, _ = c.produceSeqs.LoadOrStore(topic, &produceSequence{})
+	}
+	ps := v.(*produceSequence)
+	ps.mux.Lock()
+	ps.seq++
+	return ps.seq, ps.mux.Unlock
+}
@@ -0,0 +1,161 @@
+//+build linux
+
+package haraqa
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/haraqa/haraqa/internal/headers"
+)
+
+func TestWithRetryPolicy(t *testing.T) {
+	for _, policy := range []RetryPolicy{
+		{MaxAttempts: 0},
+		{MaxAttempts: 1, MinBackoff: -1},
+		{MaxAttempts: 1, MinBackoff: time.Second, MaxBackoff: time.Millisecond},
+		{MaxAttempts: 1, Jitter: 2},
+	} {
+		if err := WithRetryPolicy(policy)(&Client{}); err == nil {
+			t.Error("expected error for policy", policy)
+		}
+	}
+
+	c := &Client{}
+	if err := WithRetryPolicy(DefaultRetryPolicy)(c); err != nil {
+		t.Fatal(err)
+	}
+	if *c.retryPolicy != DefaultRetryPolicy || len(c.producerID) != 32 {
+		t.Error(c.retryPolicy, c.producerID)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, err := range []error{
+		headers.ErrClosed,
+		&ResponseError{StatusCode: http.StatusBadGateway, Err: errors.New("bad gateway")},
+		io.ErrUnexpectedEOF,
+		errors.Wrap(syscall.ECONNRESET, "read"),
+		&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED},
+	} {
+		if !IsRetryable(err) {
+			t.Error(err)
+		}
+	}
+	for _, err := range []error{
+		nil,
+		context.Canceled,
+		headers.ErrTopicDoesNotExist,
+		&ResponseError{StatusCode: http.StatusPreconditionFailed, Err: headers.ErrTopicAlreadyExists},
+		errors.New("some error"),
+	} {
+		if IsRetryable(err) {
+			t.Error(err)
+		}
+	}
+}
+
+func TestClient_Retry(t *testing.T) {
+	var mux sync.Mutex
+	var attempts int
+	var producerID string
+	var seqs []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		attempts++
+		switch r.Method {
+		case http.MethodPost:
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil || string(b) != "hello world" {
+				t.Error(string(b), err)
+			}
+			if producerID == "" {
+				producerID = r.Header.Get(headers.HeaderProducerID)
+			}
+			if r.Header.Get(headers.HeaderProducerID) != producerID {
+				t.Error(r.Header)
+			}
+			seqs = append(seqs, r.Header.Get(headers.HeaderProducerSeq))
+			if attempts%3 != 0 {
+				headers.SetError(w, headers.ErrClosed)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodPut:
+			headers.SetError(w, headers.ErrTopicAlreadyExists)
+		default:
+			headers.SetError(w, headers.ErrClosed)
+		}
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(WithURL(ts.URL), WithRetryPolicy(RetryPolicy{
+		MaxAttempts: 3,
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  time.Millisecond * 2,
+		Jitter:      0.5,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resetAttempts := func() {
+		mux.Lock()
+		attempts = 0
+		mux.Unlock()
+	}
+	getAttempts := func() int {
+		mux.Lock()
+		defer mux.Unlock()
+		return attempts
+	}
+
+	// retried until success, retries reuse the same sequence
+	err = c.ProduceMsgs("topic", []byte("hello "), []byte("world"))
+	if err != nil {
+		t.Error(err)
+	}
+	err = c.Produce("topic", []int64{5, 6}, io.MultiReader(strings.NewReader("hello"), strings.NewReader(" world")))
+	if err != nil {
+		t.Error(err)
+	}
+	mux.Lock()
+	if strings.Join(seqs, ",") != "1,1,1,2,2,2" || producerID == "" {
+		t.Error(seqs, producerID)
+	}
+	mux.Unlock()
+
+	// errors which aren't retryable return immediately
+	resetAttempts()
+	err = c.CreateTopic("topic")
+	if !errors.Is(err, ErrTopicAlreadyExists) || getAttempts() != 1 {
+		t.Error(err, getAttempts())
+	}
+
+	// retries are exhausted
+	resetAttempts()
+	_, err = c.ListTopics("", "", "")
+	if !errors.Is(err, ErrClosed) || getAttempts() != 3 {
+		t.Error(err, getAttempts())
+	}
+
+	// context cancellation stops retries
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	resetAttempts()
+	_, _, err = c.ConsumeContext(ctx, "topic", 0, 1)
+	if err == nil || getAttempts() > 1 {
+		t.Error(err, getAttempts())
+	}
+}